@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+)
+
+// DebugServer represents the HTTP server exposing pprof and expvar endpoints
+type DebugServer struct {
+	server *http.Server
+}
+
+// NewDebugServer creates a new debug server listening on addr
+func NewDebugServer(addr string) *DebugServer {
+	// Use a dedicated mux so debug handlers never leak onto other servers
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	return &DebugServer{
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Start starts listening in the background
+func (s *DebugServer) Start() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.server.Addr, err)
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("debug server stopped: %v", err)
+		}
+	}()
+
+	logger.Info("debug server listening on %s", listener.Addr())
+	return nil
+}
+
+// Stop gracefully shuts down the server
+func (s *DebugServer) Stop(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/metrics"
+)
+
+// MetricsServer represents the HTTP server exposing the Prometheus metrics, apart from the
+// debug server so scraping never requires exposing pprof
+type MetricsServer struct {
+	server *http.Server
+}
+
+// NewMetricsServer creates a new metrics server listening on addr
+func NewMetricsServer(addr string) *MetricsServer {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	return &MetricsServer{
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// handleMetrics writes the service counters in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.PrometheusContentType)
+	if err := metrics.WritePrometheus(w); err != nil {
+		logger.Warn("failed to write metrics: %v", err)
+	}
+}
+
+// Start starts listening in the background
+func (s *MetricsServer) Start() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.server.Addr, err)
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server stopped: %v", err)
+		}
+	}()
+
+	logger.Info("metrics server listening on %s", listener.Addr())
+	return nil
+}
+
+// Stop gracefully shuts down the server
+func (s *MetricsServer) Stop(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/storage"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+const (
+	// defaultLimit is the page size used when the request does not specify one
+	defaultLimit = 100
+	// maxLimit is the largest page size a request may ask for
+	maxLimit = 1000
+)
+
+// Server represents the HTTP API server exposing stored device data
+type Server struct {
+	server             *http.Server
+	storageManager     *storage.Manager
+	transformerManager *transformer.Manager
+	ingestion          Ingestion
+	// adminToken is the bearer token of the admin endpoints, empty to only accept loopback clients
+	adminToken string
+}
+
+// Ingestion is the message ingestion paused, resumed and reconnected by the admin endpoints
+type Ingestion interface {
+	Pause() bool
+	Resume() bool
+	Paused() bool
+	Reconnect() error
+}
+
+// ingestionResponse is the response body of the admin endpoints
+type ingestionResponse struct {
+	Paused bool `json:"paused"`
+}
+
+// listResponse is the response body of list endpoints
+type listResponse struct {
+	Data   []transformer.DeviceData `json:"data"`
+	Limit  int                      `json:"limit"`
+	Offset int                      `json:"offset"`
+}
+
+// errorResponse is the response body of failed requests
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewServer creates a new HTTP API server listening on addr. The admin endpoints require adminToken
+// as bearer token, or a client connecting from a loopback address when it is empty
+func NewServer(addr string, adminToken string, storageManager *storage.Manager, transformerManager *transformer.Manager, ingestion Ingestion) *Server {
+	s := &Server{
+		storageManager:     storageManager,
+		transformerManager: transformerManager,
+		ingestion:          ingestion,
+		adminToken:         adminToken,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /devices/{type}/{name}/latest", s.handleLatest)
+	mux.HandleFunc("GET /devices/{type}", s.handleList)
+	mux.HandleFunc("GET /admin/ingestion", s.admin(s.handleIngestion))
+	mux.HandleFunc("POST /admin/pause", s.admin(s.handlePause))
+	mux.HandleFunc("POST /admin/resume", s.admin(s.handleResume))
+	mux.HandleFunc("POST /admin/reconnect", s.admin(s.handleReconnect))
+
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Start starts listening in the background
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.server.Addr, err)
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP API server stopped: %v", err)
+		}
+	}()
+
+	logger.Info("HTTP API server listening on %s", listener.Addr())
+	return nil
+}
+
+// Stop gracefully shuts down the server
+func (s *Server) Stop(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// handleLatest returns the most recent record of a device
+func (s *Server) handleLatest(w http.ResponseWriter, r *http.Request) {
+	deviceType := r.PathValue("type")
+	if !s.transformerManager.HasTransformer(deviceType) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown device type: %s", deviceType))
+		return
+	}
+
+	results, err := s.storageManager.Query(storage.QueryFilter{
+		DeviceType: deviceType,
+		DeviceName: r.PathValue("name"),
+		Descending: true,
+		Limit:      1,
+	})
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	if len(results) == 0 {
+		writeError(w, http.StatusNotFound, "no data found for device")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results[0])
+}
+
+// handleList returns the records of a device type within an optional time range
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	deviceType := r.PathValue("type")
+	if !s.transformerManager.HasTransformer(deviceType) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown device type: %s", deviceType))
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := parseInt(query.Get("from"), 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from parameter")
+		return
+	}
+	to, err := parseInt(query.Get("to"), 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid to parameter")
+		return
+	}
+	limit, err := parseInt(query.Get("limit"), defaultLimit)
+	if err != nil || limit <= 0 || limit > maxLimit {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLimit))
+		return
+	}
+	offset, err := parseInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "invalid offset parameter")
+		return
+	}
+
+	results, err := s.storageManager.Query(storage.QueryFilter{
+		DeviceType: deviceType,
+		From:       from,
+		To:         to,
+		Limit:      int(limit),
+		Offset:     int(offset),
+	})
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	if results == nil {
+		results = []transformer.DeviceData{}
+	}
+
+	writeJSON(w, http.StatusOK, listResponse{
+		Data:   results,
+		Limit:  int(limit),
+		Offset: int(offset),
+	})
+}
+
+// admin wraps the handler of an admin endpoint, it rejects requests without the admin token,
+// or from other than loopback addresses when no token is configured
+func (s *Server) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+				logger.Warn("rejected unauthorized admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "invalid or missing admin token")
+				return
+			}
+		} else if !isLoopback(r.RemoteAddr) {
+			logger.Warn("rejected admin request %s %s from non-loopback address %s", r.Method, r.URL.Path, r.RemoteAddr)
+			writeError(w, http.StatusForbidden, "admin endpoints only accept loopback clients unless api.admin_token is set")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// isLoopback reports whether the remote address of a request is a loopback address
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// handleIngestion returns whether ingestion is paused
+func (s *Server) handleIngestion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ingestionResponse{Paused: s.ingestion.Paused()})
+}
+
+// handlePause pauses ingestion, pausing while already paused has no effect
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request) {
+	if s.ingestion.Pause() {
+		logger.Warn("ingestion paused from %s, received messages are held until resumed", r.RemoteAddr)
+	}
+	writeJSON(w, http.StatusOK, ingestionResponse{Paused: true})
+}
+
+// handleResume resumes ingestion, resuming while not paused has no effect
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	if s.ingestion.Resume() {
+		logger.Info("ingestion resumed from %s", r.RemoteAddr)
+	}
+	writeJSON(w, http.StatusOK, ingestionResponse{Paused: false})
+}
+
+// handleReconnect connects to the broker again with the configuration of the last reload, which also resumes ingestion
+func (s *Server) handleReconnect(w http.ResponseWriter, r *http.Request) {
+	logger.Info("reconnect to the MQTT broker requested from %s", r.RemoteAddr)
+	if err := s.ingestion.Reconnect(); err != nil {
+		logger.Error("reconnect requested from %s failed: %v", r.RemoteAddr, err)
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("reconnect failed: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, ingestionResponse{Paused: s.ingestion.Paused()})
+}
+
+// parseInt parses an optional integer query parameter
+func parseInt(value string, defaultValue int64) (int64, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// writeQueryError maps a storage query error to a response
+func writeQueryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrNoQueryableBackend) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	logger.Error("failed to query storage: %v", err)
+	writeError(w, http.StatusInternalServerError, "failed to query storage")
+}
+
+// writeError writes an error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: message})
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("failed to write HTTP response: %v", err)
+	}
+}
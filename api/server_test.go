@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeIngestion records whether ingestion is paused
+type fakeIngestion struct {
+	paused bool
+}
+
+func (f *fakeIngestion) Pause() bool {
+	was := f.paused
+	f.paused = true
+	return !was
+}
+
+func (f *fakeIngestion) Resume() bool {
+	was := f.paused
+	f.paused = false
+	return was
+}
+
+func (f *fakeIngestion) Paused() bool {
+	return f.paused
+}
+
+func (f *fakeIngestion) Reconnect() error {
+	f.paused = false
+	return nil
+}
+
+func TestAdminEndpointsAuthorization(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		remoteAddr string
+		header     string
+		wantStatus int
+	}{
+		{name: "no token from loopback", remoteAddr: "127.0.0.1:50000", wantStatus: http.StatusOK},
+		{name: "no token from IPv6 loopback", remoteAddr: "[::1]:50000", wantStatus: http.StatusOK},
+		{name: "no token from remote", remoteAddr: "192.0.2.10:50000", wantStatus: http.StatusForbidden},
+		{name: "token from remote", token: "secret", remoteAddr: "192.0.2.10:50000", header: "Bearer secret", wantStatus: http.StatusOK},
+		{name: "missing token", token: "secret", remoteAddr: "127.0.0.1:50000", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", remoteAddr: "127.0.0.1:50000", header: "Bearer other", wantStatus: http.StatusUnauthorized},
+		{name: "token without bearer scheme", token: "secret", remoteAddr: "127.0.0.1:50000", header: "secret", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingestion := &fakeIngestion{}
+			s := NewServer("", tt.token, nil, nil, ingestion)
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/pause", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			s.server.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if paused := tt.wantStatus == http.StatusOK; ingestion.paused != paused {
+				t.Errorf("paused = %v, want %v", ingestion.paused, paused)
+			}
+		})
+	}
+}
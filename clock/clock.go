@@ -0,0 +1,151 @@
+// Package clock provides the current time and timers through an interface,
+// so components deriving file names or rotation from the time can run on a controlled clock
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock returns the current time and creates timers running on that time
+type Clock interface {
+	Now() time.Time
+	// NewTimer creates a timer that fires once the clock has advanced by d
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single-shot timer created by a Clock
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, it returns false when it already fired or was stopped
+	Stop() bool
+}
+
+// Real is the system clock
+type Real struct{}
+
+// Now returns the current system time
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer creates a system timer
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// realTimer adapts time.Timer to Timer
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// Or returns c, or the system clock when c is nil
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real{}
+	}
+	return c
+}
+
+// Fake is a clock that only moves when it is set or advanced, it is safe for concurrent use.
+// Its timers fire when the clock is moved to or past their deadline
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake creates a fake clock showing now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the time the clock shows
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTimer creates a timer firing once the clock reaches Now() + d, right away when d is not positive
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTimer{clock: f, deadline: f.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- f.now
+		return t
+	}
+	f.timers = append(f.timers, t)
+	return t
+}
+
+// Timers returns the number of timers waiting to fire, so tests can wait for a goroutine to arm its timer
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// Set sets the time the clock shows and fires the timers it reaches
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+	f.fire()
+}
+
+// Advance moves the clock forward by d and fires the timers it reaches
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	f.fire()
+}
+
+// fire sends the time on the timers whose deadline has passed and removes them, the caller must hold mu
+func (f *Fake) fire() {
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.deadline.After(f.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- f.now
+	}
+	f.timers = pending
+}
+
+// fakeTimer is a timer of a Fake clock
+type fakeTimer struct {
+	clock    *Fake
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
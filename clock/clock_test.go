@@ -0,0 +1,88 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeSetAndAdvance(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+	if now := c.Now(); !now.Equal(start) {
+		t.Fatalf("Now() = %v, want %v", now, start)
+	}
+
+	c.Advance(90 * time.Second)
+	if now, want := c.Now(), start.Add(90*time.Second); !now.Equal(want) {
+		t.Errorf("Now() after Advance = %v, want %v", now, want)
+	}
+
+	later := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	c.Set(later)
+	if now := c.Now(); !now.Equal(later) {
+		t.Errorf("Now() after Set = %v, want %v", now, later)
+	}
+}
+
+func TestOr(t *testing.T) {
+	if _, ok := Or(nil).(Real); !ok {
+		t.Errorf("Or(nil) = %T, want Real", Or(nil))
+	}
+	c := NewFake(time.Now())
+	if got := Or(c); got != c {
+		t.Errorf("Or(c) = %v, want c", got)
+	}
+}
+
+func TestFakeTimerFiresWhenAdvanced(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+	timer := c.NewTimer(time.Minute)
+
+	c.Advance(59 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired before its deadline")
+	default:
+	}
+
+	c.Advance(time.Second)
+	select {
+	case now := <-timer.C():
+		if want := start.Add(time.Minute); !now.Equal(want) {
+			t.Errorf("fired at %v, want %v", now, want)
+		}
+	default:
+		t.Fatal("timer did not fire at its deadline")
+	}
+	if timer.Stop() {
+		t.Error("Stop of a fired timer returned true")
+	}
+}
+
+func TestFakeTimerStop(t *testing.T) {
+	c := NewFake(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC))
+	timer := c.NewTimer(time.Minute)
+	if !timer.Stop() {
+		t.Fatal("Stop of a pending timer returned false")
+	}
+	if n := c.Timers(); n != 0 {
+		t.Fatalf("%d timers pending after Stop, want 0", n)
+	}
+
+	c.Advance(time.Hour)
+	select {
+	case <-timer.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+}
+
+func TestFakeTimerNonPositiveDuration(t *testing.T) {
+	c := NewFake(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC))
+	select {
+	case <-c.NewTimer(0).C():
+	default:
+		t.Fatal("timer of zero duration did not fire right away")
+	}
+}
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/eddielth/data-trans/logger"
@@ -13,8 +17,57 @@ import (
 type Config struct {
 	MQTT         MQTTConfig             `mapstructure:"mqtt"`
 	Transformers map[string]Transformer `mapstructure:"transformers"`
-	Storage      StorageConfig          `mapstructure:"storage"`
-	Logger       LoggerConfig           `mapstructure:"logger"`
+	// TransformersDir is scanned for *.js scripts, each file name is a device type
+	TransformersDir string `mapstructure:"transformers_dir"`
+	// Lookups are named tables shared by all scripts through lookup(table, key)
+	Lookups    map[string]map[string]string `mapstructure:"lookups"`
+	Storage    StorageConfig                `mapstructure:"storage"`
+	Logger     LoggerConfig                 `mapstructure:"logger"`
+	API        APIConfig                    `mapstructure:"api"`
+	Debug      DebugConfig                  `mapstructure:"debug"`
+	Metrics    MetricsConfig                `mapstructure:"metrics"`
+	Dedup      DedupConfig                  `mapstructure:"dedup"`
+	RateLimit  RateLimitConfig              `mapstructure:"rate_limit"`
+	DeadLetter DeadLetterConfig             `mapstructure:"dead_letter"`
+	// MinQuality drops attributes with a lower quality before they are stored, 0 disables the filter
+	MinQuality int `mapstructure:"min_quality"`
+	// UnitNormalization converts attributes to a target unit by attribute name, names are case-insensitive
+	UnitNormalization map[string]UnitRule `mapstructure:"unit_normalization"`
+	// Registry merges static metadata of devices into their records by device name
+	Registry RegistryConfig `mapstructure:"registry"`
+	// TimingLogInterval logs a summary of the transform durations per device type periodically, 0 disables it
+	TimingLogInterval time.Duration `mapstructure:"timing_log_interval"`
+	// Rules are evaluated on every transformed record, matching records are published or stored additionally
+	Rules []Rule `mapstructure:"rules"`
+}
+
+// Rule represents a routing rule for transformed records
+type Rule struct {
+	Name string `mapstructure:"name"`
+	// Condition is a CEL expression over record and attributes, the rule matches when it is true
+	Condition string `mapstructure:"condition"`
+	// PublishTopic receives matching records as JSON, {device_type}, {device_name} and {rule} are replaced
+	PublishTopic string `mapstructure:"publish_topic"`
+	QoS          byte   `mapstructure:"qos"`
+	Retained     bool   `mapstructure:"retained"`
+	// StoreAs stores a copy of matching records under this device type
+	StoreAs string `mapstructure:"store_as"`
+	// Backends limits the copy to these storage backend types, all backends store it when empty
+	Backends []string `mapstructure:"backends"`
+}
+
+// RegistryConfig represents the configuration of the static device registry
+type RegistryConfig struct {
+	// Path is a .csv, .yaml or .yml file, empty disables the registry
+	Path string `mapstructure:"path"`
+}
+
+// UnitRule represents the target unit of an attribute
+type UnitRule struct {
+	// Unit is the target unit, e.g. C, Pa or m
+	Unit string `mapstructure:"unit"`
+	// Kind is the conversion used: temperature, pressure or length
+	Kind string `mapstructure:"kind"`
 }
 
 // MQTTConfig represents the configuration for MQTT connection
@@ -24,12 +77,145 @@ type MQTTConfig struct {
 	Username string   `mapstructure:"username"`
 	Password string   `mapstructure:"password"`
 	Topics   []string `mapstructure:"topics"`
+	// UsernameFile and PasswordFile read the credentials from files instead, e.g. mounted secrets
+	UsernameFile string `mapstructure:"username_file"`
+	PasswordFile string `mapstructure:"password_file"`
+	// RefreshPasswordFile reads PasswordFile again on every (re)connect, for short-lived tokens rotated on disk
+	RefreshPasswordFile bool `mapstructure:"refresh_password_file"`
+	// TokenCommand is run with sh -c on every (re)connect, its output is sent as the password, e.g. a fresh JWT
+	TokenCommand string `mapstructure:"token_command"`
+	// TokenTimeout limits how long TokenCommand may run
+	TokenTimeout time.Duration `mapstructure:"token_timeout"`
+	// ProtocolVersion is 4 for MQTT 3.1.1 (default) or 5 for MQTT 5, which passes message user properties to the transform
+	ProtocolVersion int `mapstructure:"protocol_version"`
+	// QoS is the quality of service level the topics are subscribed with
+	QoS byte `mapstructure:"qos"`
+	// ReceiveMaximum limits unacknowledged QoS 1 and 2 messages the broker sends at once, MQTT 5 only
+	ReceiveMaximum int `mapstructure:"receive_maximum"`
+	// MaxResumePubInFlight limits publishes resumed from the store at once after reconnecting, MQTT 3.1.1 only
+	MaxResumePubInFlight int `mapstructure:"max_resume_pub_in_flight"`
+	// OrderMatters delivers messages to the handler one at a time in order (default true), MQTT 3.1.1 only
+	OrderMatters *bool `mapstructure:"order_matters"`
+	// SessionExpiry keeps the broker session after a disconnect so unacknowledged messages are delivered again,
+	// zero uses a clean session. MQTT 3.1.1 has no expiry, any positive value keeps the session until the broker drops it
+	SessionExpiry time.Duration `mapstructure:"session_expiry"`
+	// TopicRegex is matched against the topic a message was delivered on to find its device type
+	TopicRegex string `mapstructure:"topic_regex"`
+	// DeviceTypeGroup is the capture group of TopicRegex holding the device type
+	DeviceTypeGroup int `mapstructure:"device_type_group"`
+	// DeviceNameGroup is the capture group of TopicRegex holding the device name, used when the transformer sets none
+	DeviceNameGroup int `mapstructure:"device_name_group"`
+	// TopicPattern replaces TopicRegex with a pattern such as sites/{site}/{device_type}/{device_name},
+	// captures other than device_type and device_name are merged into the record metadata
+	TopicPattern string `mapstructure:"topic_pattern"`
+	// DrainTimeout is how long shutdown waits for in-flight messages
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+	// Workers is the number of goroutines processing messages
+	Workers int `mapstructure:"workers"`
+	// QueueSize is the capacity of the queue between subscription callbacks and workers
+	QueueSize int `mapstructure:"queue_size"`
+	// QueueFullPolicy is block (default) or drop
+	QueueFullPolicy string `mapstructure:"queue_full_policy"`
+	// MaxPayloadSize is the largest payload in bytes that is processed, larger payloads are dropped
+	MaxPayloadSize int `mapstructure:"max_payload_size"`
+	// AllowTopics and DenyTopics are patterns of delivered topics that are processed or dropped, deny wins
+	AllowTopics []string `mapstructure:"allow_topics"`
+	DenyTopics  []string `mapstructure:"deny_topics"`
+	// Last will, published by the broker when the connection is lost unexpectedly
+	WillTopic    string `mapstructure:"will_topic"`
+	WillPayload  string `mapstructure:"will_payload"`
+	WillQoS      byte   `mapstructure:"will_qos"`
+	WillRetained bool   `mapstructure:"will_retained"`
+	// PublishWillOnStop publishes the will payload to the will topic on clean shutdown too
+	PublishWillOnStop bool `mapstructure:"publish_will_on_stop"`
+	// Heartbeat publishes a periodic status message
+	Heartbeat HeartbeatConfig `mapstructure:"heartbeat"`
+	// TLS configures the certificates of ssl://, tls:// and mqtts:// broker connections
+	TLS MQTTTLSConfig `mapstructure:"tls"`
+}
+
+// MQTTTLSConfig represents the TLS configuration of the broker connection
+type MQTTTLSConfig struct {
+	// CAFile is a PEM file of the CA the broker certificate is verified against, the system roots are used when empty
+	CAFile string `mapstructure:"ca_file"`
+	// CertFile and KeyFile are PEM files of the client certificate
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ServerName overrides the host name the broker certificate is verified against
+	ServerName string `mapstructure:"server_name"`
+}
+
+// HeartbeatConfig represents the configuration for the periodic status message
+type HeartbeatConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Topic    string        `mapstructure:"topic"`
+	Interval time.Duration `mapstructure:"interval"`
+	// QoS is the QoS heartbeats are published with
+	QoS byte `mapstructure:"qos"`
 }
 
 // Transformer represents the configuration for data transformers
 type Transformer struct {
+	// Engine is js (default), cel, template or passthrough
+	Engine     string `mapstructure:"engine"`
 	ScriptPath string `mapstructure:"script_path"`
 	ScriptCode string `mapstructure:"script_code"`
+	// Helpers limits the helper functions injected into the js engine, all helpers are injected when empty
+	Helpers []string `mapstructure:"helpers"`
+	// Expression is the CEL expression used by the cel engine
+	Expression string `mapstructure:"expression"`
+	// Template is the Go text/template producing device data JSON, used by the template engine
+	Template string `mapstructure:"template"`
+	// InputSchema is the path of a JSON Schema inbound payloads must match
+	InputSchema string `mapstructure:"input_schema"`
+	// PayloadEncoding unwraps the payload (utf8, hex or base64) before the codec and the transformer see it
+	PayloadEncoding string `mapstructure:"payload_encoding"`
+	// Codec decodes the payload (json, msgpack or protobuf) before it is passed to the transformer
+	Codec string `mapstructure:"codec"`
+	// ProtoDescriptor is a FileDescriptorSet file and ProtoMessage the full message name, used by the protobuf codec
+	ProtoDescriptor string `mapstructure:"proto_descriptor"`
+	ProtoMessage    string `mapstructure:"proto_message"`
+	// TimestampUnit is the unit of timestamps returned by the transformer (s, ms or us), detected from the magnitude when empty
+	TimestampUnit string `mapstructure:"timestamp_unit"`
+	// TimestampSource is message (default) to keep the transformer's timestamp or received to use the receive time
+	TimestampSource string `mapstructure:"timestamp_source"`
+	// TimestampPath is the dotted path of a timestamp in the JSON payload, e.g. ts or metadata.time,
+	// used when the transformer returns no timestamp. TimestampFormat is the Go time layout of string values
+	TimestampPath   string `mapstructure:"timestamp_path"`
+	TimestampFormat string `mapstructure:"timestamp_format"`
+	// MinQuality overrides the global min_quality for this device type
+	MinQuality *int `mapstructure:"min_quality"`
+	// StoreRaw adds the raw payload and topic to the metadata of the device data
+	StoreRaw bool `mapstructure:"store_raw"`
+	// StoreMode overrides storage.mode for this device type
+	StoreMode string `mapstructure:"store_mode"`
+	// InsertMode is insert (default) to append records to SQL databases or upsert to keep the latest record per device
+	InsertMode string `mapstructure:"insert_mode"`
+	// TableLayout is normalized (default) to store attributes as rows of device_attributes or wide to store the records
+	// in a table of the device type with a column per attribute (MySQL and PostgreSQL)
+	TableLayout string `mapstructure:"table_layout"`
+	// Attributes declares the type of attributes, their values are coerced to it after the transform
+	Attributes []AttributeSchema `mapstructure:"attributes"`
+	Timeout    time.Duration     `mapstructure:"timeout"`
+	// Republish publishes the transformed records as JSON to another topic
+	Republish RepublishConfig `mapstructure:"republish"`
+}
+
+// RepublishConfig represents the topic transformed records of a device type are published to
+type RepublishConfig struct {
+	// Topic is a template such as processed/{device_type}/{device_name}, other placeholders are
+	// replaced with the captures of mqtt.topic_pattern or the record metadata. Empty disables republishing
+	Topic    string `mapstructure:"topic"`
+	QoS      byte   `mapstructure:"qos"`
+	Retained bool   `mapstructure:"retained"`
+}
+
+// AttributeSchema represents the declared type of an attribute
+type AttributeSchema struct {
+	// Name is the attribute name, matched case-insensitively
+	Name string `mapstructure:"name"`
+	// Type is number, bool or string
+	Type string `mapstructure:"type"`
 }
 
 // LoggerConfig represents the configuration for logging
@@ -39,89 +225,384 @@ type LoggerConfig struct {
 	MaxSize    int    `mapstructure:"max_size"`
 	MaxBackups int    `mapstructure:"max_backups"`
 	Console    bool   `mapstructure:"console"`
+	// RotateInterval rotates the log file periodically in addition to size-based rotation, 0 disables it
+	RotateInterval time.Duration `mapstructure:"rotate_interval"`
+	// Async writes entries from a background goroutine, BufferSize entries are queued
+	Async      bool `mapstructure:"async"`
+	BufferSize int  `mapstructure:"buffer_size"`
+	// ErrorFilePath is an optional secondary log file receiving only entries at or above ErrorLevel
+	ErrorFilePath string `mapstructure:"error_file_path"`
+	ErrorLevel    string `mapstructure:"error_level"`
+	// Format is text (default) or json, which writes one JSON object per line with structured fields as keys
+	Format string `mapstructure:"format"`
+}
+
+// APIConfig represents the configuration for the HTTP read API
+type APIConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Listen  string `mapstructure:"listen"`
+	// AdminToken is the bearer token the admin endpoints require, without one they only accept loopback clients
+	AdminToken     string `mapstructure:"admin_token"`
+	AdminTokenFile string `mapstructure:"admin_token_file"`
+}
+
+// DebugConfig represents the configuration for the pprof/expvar debug server
+type DebugConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Listen  string `mapstructure:"listen"`
+}
+
+// MetricsConfig represents the configuration for the Prometheus metrics server
+type MetricsConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Listen  string `mapstructure:"listen"`
+	// MaxTopics is the number of topics counted separately in messages_total, further topics are counted together
+	MaxTopics int `mapstructure:"max_topics"`
+}
+
+// DedupConfig represents the configuration for message deduplication
+type DedupConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// KeyFields are payload fields identifying a message, a payload hash is used when empty
+	KeyFields []string      `mapstructure:"key_fields"`
+	CacheSize int           `mapstructure:"cache_size"`
+	TTL       time.Duration `mapstructure:"ttl"`
+}
+
+// RateLimitConfig represents the configuration for per-device rate limiting
+type RateLimitConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Key is topic (default) or device_name
+	Key string `mapstructure:"key"`
+	// Rate is the sustained number of messages per second allowed per key
+	Rate float64 `mapstructure:"rate"`
+	// Burst is the number of messages allowed at once
+	Burst int `mapstructure:"burst"`
+}
+
+// DeadLetterConfig represents the configuration for recording messages that failed processing
+type DeadLetterConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Path    string `mapstructure:"path"`
 }
 
 // ConfigChangeCallback is the callback function type for configuration file changes
 type ConfigChangeCallback func(cfg *Config) error
 
-// LoadConfig loads the configuration file from the specified path
-func LoadConfig(configPath string) (*Config, error) {
-	viper.SetConfigFile(configPath)
-	viper.SetConfigType("yaml")
-
-	err := viper.ReadInConfig()
+// LoadConfig loads and merges the configuration files at configPaths, later files override earlier ones.
+// A directory stands for its .yaml and .yml files in name order
+func LoadConfig(configPaths ...string) (*Config, error) {
+	files, err := configFiles(configPaths)
 	if err != nil {
 		return nil, err
 	}
 
+	v := viper.New()
+	v.SetConfigType("yaml")
+	for _, file := range files {
+		// Maps are merged key by key, any other value including lists replaces the earlier one
+		v.SetConfigFile(file)
+		if err := v.MergeInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read configuration file %s: %v", file, err)
+		}
+	}
+
 	var config Config
-	err = viper.Unmarshal(&config)
+	err = v.Unmarshal(&config)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := config.resolveSecrets(); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
-// WatchConfig monitors configuration file changes and calls the callback function
-func WatchConfig(configPath string, callback ConfigChangeCallback) error {
-	// Get the absolute path of the configuration file
-	absPath, err := filepath.Abs(configPath)
+// configFiles expands the directories among paths into their configuration files
+func configFiles(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no configuration file given")
+	}
+
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		// Entries are sorted by name, so e.g. 10-local.yaml overrides 00-base.yaml
+		for _, entry := range entries {
+			if !entry.IsDir() && isConfigFile(entry.Name()) {
+				files = append(files, filepath.Join(path, entry.Name()))
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("configuration directory %s contains no .yaml or .yml file", path)
+		}
+	}
+	return files, nil
+}
+
+// isConfigFile reports whether name is a configuration file in a configuration directory, hidden files are skipped
+func isConfigFile(name string) bool {
+	ext := filepath.Ext(name)
+	return (ext == ".yaml" || ext == ".yml") && !strings.HasPrefix(name, ".")
+}
+
+// configDebounceInterval is the quiet period WatchConfig waits for before reloading
+var configDebounceInterval = 2 * time.Second
+
+// WatchConfig monitors the configuration files at configPaths and calls the callback function
+// with the merged configuration. Files added to or removed from a configuration directory are picked up
+func WatchConfig(configPaths []string, callback ConfigChangeCallback) error {
+	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
 
-	// Set Viper to watch configuration file changes
-	viper.SetConfigFile(absPath)
-	viper.WatchConfig()
-
-	// Debounce handling to avoid multiple triggers in a short time
-	var lastChangeTime time.Time
-	var debounceInterval = 2 * time.Second
-
-	viper.OnConfigChange(func(e fsnotify.Event) {
-		// Check if it's a write operation
-		if e.Op&fsnotify.Write == fsnotify.Write {
-			// Debounce handling
-			now := time.Now()
-			if now.Sub(lastChangeTime) < debounceInterval {
-				return
-			}
-			lastChangeTime = now
+	// Watch the directories holding the files: editors often replace a file (write to a temporary
+	// file, then rename), which a watch on the file itself would lose
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	watched := make(map[string]bool)
+	for _, path := range configPaths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		dir := filepath.Dir(absPath)
+		if info, err := os.Stat(absPath); err == nil && info.IsDir() {
+			dirs[absPath] = true
+			dir = absPath
+		} else {
+			files[absPath] = true
+		}
+		if watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+		watched[dir] = true
+	}
+	relevant := func(name string) bool {
+		return files[name] || (dirs[filepath.Dir(name)] && isConfigFile(filepath.Base(name)))
+	}
+
+	// A swapped symlink changes a file without an event naming it, e.g. Kubernetes mounts a ConfigMap as
+	// config.yaml -> ..data/config.yaml and updates it by replacing the ..data link. The targets of the files
+	// watched in a directory are therefore resolved again on every event in it and compared
+	targets := make(map[string]string)
+	for dir := range watched {
+		targets[dir] = resolveWatched(dir, files, dirs[dir])
+	}
+
+	// Debounce handling: editors often write a file in several steps, and several files may change
+	// together, so reload once the events have settled
+	reload := newDebouncer(configDebounceInterval, func() {
+		logger.Info("Configuration change detected, reloading %s", strings.Join(configPaths, ", "))
+
+		// Reload configuration, secret files are read again so rotated credentials take effect
+		newConfig, err := LoadConfig(configPaths...)
+		if err != nil {
+			logger.Error("Failed to read updated configuration: %v", err)
+			return
+		}
+
+		// Reject invalid configuration and keep running with the current one
+		if err := newConfig.Validate(); err != nil {
+			logger.Error("Updated configuration is invalid, keeping current configuration: %v", err)
+			return
+		}
 
-			logger.Info("Configuration file change detected: %s", e.Name)
+		// Call callback function to handle new configuration
+		if err := callback(newConfig); err != nil {
+			logger.Error("Failed to apply new configuration: %v", err)
+			return
+		}
 
-			// Reload configuration
-			var newConfig Config
-			err := viper.Unmarshal(&newConfig)
-			if err != nil {
-				logger.Error("Failed to parse updated configuration: %v", err)
-				return
+		logger.Info("Configuration has been successfully updated and applied")
+	})
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Clean(event.Name)
+				dir := filepath.Dir(name)
+				swapped := false
+				if _, ok := targets[dir]; ok {
+					target := resolveWatched(dir, files, dirs[dir])
+					swapped = target != targets[dir]
+					targets[dir] = target
+				}
+				// Writes, files created or renamed over a configuration file, and files removed from a directory
+				if !swapped && (!relevant(name) || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0) {
+					continue
+				}
+				logger.Debug("Configuration file change detected: %s", event)
+				reload.trigger()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("Failed to watch configuration files: %v", err)
 			}
+		}
+	}()
 
-			// Call callback function to handle new configuration
-			if err := callback(&newConfig); err != nil {
-				logger.Error("Failed to apply new configuration: %v", err)
-				return
+	return nil
+}
+
+// resolveWatched returns the files watched in dir with their symlinks resolved, one per line. Those are the
+// given files within dir, and all configuration files in it when the directory itself is watched
+func resolveWatched(dir string, files map[string]bool, watchDir bool) string {
+	var paths []string
+	for file := range files {
+		if filepath.Dir(file) == dir {
+			paths = append(paths, file)
+		}
+	}
+	if watchDir {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if isConfigFile(entry.Name()) {
+				paths = append(paths, filepath.Join(dir, entry.Name()))
 			}
+		}
+	}
+	sort.Strings(paths)
+
+	var resolved strings.Builder
+	for _, path := range paths {
+		// A missing file resolves to nothing, its removal is a change too
+		target, _ := filepath.EvalSymlinks(path)
+		resolved.WriteString(path + " -> " + target + "\n")
+	}
+	return resolved.String()
+}
 
-			logger.Info("Configuration has been successfully updated and applied")
+// WatchDir monitors a directory and calls the callback once changes have settled,
+// only files with the given extension are considered
+func WatchDir(dir string, ext string, callback func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	// Debounce handling, editors usually write a file in several steps
+	var debounceInterval = 500 * time.Millisecond
+	rescan := newDebouncer(debounceInterval, callback)
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Ext(event.Name) != ext || event.Op == fsnotify.Chmod {
+					continue
+				}
+				logger.Debug("Directory change detected: %s", event)
+				rescan.trigger()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("Failed to watch directory %s: %v", dir, err)
+			}
 		}
-	})
+	}()
 
 	return nil
 }
 
 // StorageConfig represents storage configuration
 type StorageConfig struct {
-	File     FileStorageConfig     `mapstructure:"file"`
-	Database DatabaseStorageConfig `mapstructure:"database"`
+	// Mode is best_effort (default) or all_or_nothing, transformers can override it with store_mode
+	Mode string `mapstructure:"mode"`
+	// Concurrent stores to all backends at once, Timeout limits how long a store waits for them
+	Concurrent    bool                       `mapstructure:"concurrent"`
+	Timeout       time.Duration              `mapstructure:"timeout"`
+	File          FileStorageConfig          `mapstructure:"file"`
+	Database      DatabaseStorageConfig      `mapstructure:"database"`
+	Elasticsearch ElasticsearchStorageConfig `mapstructure:"elasticsearch"`
+	// CircuitBreaker skips failing backends for a while
+	CircuitBreaker CircuitBreakerConfig `mapstructure:"circuit_breaker"`
+	// WAL records data on disk before it is stored and replays it after a crash
+	WAL WALConfig `mapstructure:"wal"`
+}
+
+// WALConfig represents the configuration of the storage write-ahead log
+type WALConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Path is the directory of the WAL segments
+	Path string `mapstructure:"path"`
+	// CheckpointInterval is how often buffered backends are flushed and confirmed segments removed
+	CheckpointInterval time.Duration `mapstructure:"checkpoint_interval"`
+	// Sync calls fsync after every entry so the WAL also survives power loss
+	Sync bool `mapstructure:"sync"`
+	// MaxSize is the size in MB the segments kept for failed backends are limited to, 0 selects 1024
+	MaxSize int `mapstructure:"max_size"`
+}
+
+// CircuitBreakerConfig represents the configuration of the per-backend circuit breaker
+type CircuitBreakerConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// FailureThreshold is the number of consecutive failures that opens the circuit
+	FailureThreshold int `mapstructure:"failure_threshold"`
+	// Cooldown is how long an open circuit skips the backend before testing it again
+	Cooldown time.Duration `mapstructure:"cooldown"`
 }
 
 // FileStorageConfig represents file storage configuration
 type FileStorageConfig struct {
-	Enabled bool   `mapstructure:"enabled"`
-	Path    string `mapstructure:"path"`
+	Enabled   bool   `mapstructure:"enabled"`
+	Path      string `mapstructure:"path"`
+	Format    string `mapstructure:"format"`    // json (default), csv or jsonl
+	Partition string `mapstructure:"partition"` // none (default), day or hour
+	Compress  string `mapstructure:"compress"`  // none (default) or gzip, json format only
+	// Serializer encodes the files of the json format: json (default), ndjson or avro
+	Serializer string `mapstructure:"serializer"`
+	// Fsync syncs the files of the json format to disk: none (default), file or full (the file and its directory)
+	Fsync string `mapstructure:"fsync"`
+	// MaxSize is the size in MB a jsonl file is rotated at and MaxBackups the number of rotated files kept, 0 keeps all
+	MaxSize    int `mapstructure:"max_size"`
+	MaxBackups int `mapstructure:"max_backups"`
+	// Compaction rolls the json files of completed days into daily gzipped NDJSON archives
+	Compaction FileCompactionConfig `mapstructure:"compaction"`
+}
+
+// FileCompactionConfig represents the configuration of file storage compaction
+type FileCompactionConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Interval is how often completed days are compacted
+	Interval time.Duration `mapstructure:"interval"`
+	// KeepOriginals keeps the compacted files instead of removing them
+	KeepOriginals bool `mapstructure:"keep_originals"`
 }
 
 // DatabaseStorageConfig represents database storage configuration
@@ -129,4 +610,48 @@ type DatabaseStorageConfig struct {
 	Enabled bool   `mapstructure:"enabled"`
 	Type    string `mapstructure:"type"`
 	DSN     string `mapstructure:"dsn"`
-}
\ No newline at end of file
+	// DSNFile reads the DSN from a file instead, e.g. a mounted secret
+	DSNFile string `mapstructure:"dsn_file"`
+	// Structured connection settings the DSN is built from when DSN is empty
+	Host         string `mapstructure:"host"`
+	Port         int    `mapstructure:"port"`
+	User         string `mapstructure:"user"`
+	Password     string `mapstructure:"password"`
+	PasswordFile string `mapstructure:"password_file"`
+	DBName       string `mapstructure:"dbname"`
+	SSLMode      string `mapstructure:"sslmode"`
+	// CAFile, CertFile and KeyFile are PEM files for TLS connections (mysql and postgresql)
+	CAFile   string `mapstructure:"ca_file"`
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// Params are additional driver parameters in URL query form, e.g. parseTime=true&loc=Local
+	Params          string        `mapstructure:"params"`
+	MaxOpenConns    int           `mapstructure:"max_open_conns"`
+	MaxIdleConns    int           `mapstructure:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `mapstructure:"conn_max_lifetime"`
+	// BatchSize and FlushInterval control batched inserts (clickhouse only)
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// TablePrefix is prepended to the table names so several instances can share one database
+	TablePrefix string `mapstructure:"table_prefix"`
+	// RetentionDays deletes records older than this many days every RetentionInterval, 0 keeps all (mysql and postgresql)
+	RetentionDays     int           `mapstructure:"retention_days"`
+	RetentionInterval time.Duration `mapstructure:"retention_interval"`
+	// ErrorLog records processing errors into the processing_errors table (mysql and postgresql)
+	ErrorLog bool `mapstructure:"error_log"`
+}
+
+// ElasticsearchStorageConfig represents Elasticsearch storage configuration
+type ElasticsearchStorageConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	URL     string `mapstructure:"url"`
+	// Username and Password enable basic authentication, APIKey takes precedence
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	APIKey   string `mapstructure:"api_key"`
+	// Index is the index name template, {device_type}, {date} and {month} are replaced
+	Index string `mapstructure:"index"`
+	// BatchSize and FlushInterval control bulk requests
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
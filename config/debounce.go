@@ -0,0 +1,43 @@
+package config
+
+import (
+	"sync"
+	"time"
+)
+
+// debouncer coalesces bursts of triggers into a single call of fn,
+// made once no trigger has arrived for the interval. Calls of fn never overlap
+type debouncer struct {
+	interval time.Duration
+	fn       func()
+
+	mutex sync.Mutex
+	timer *time.Timer
+	// running serializes calls of fn when a burst ends while the previous call is still running
+	running sync.Mutex
+}
+
+// newDebouncer creates a debouncer calling fn after interval of quiet
+func newDebouncer(interval time.Duration, fn func()) *debouncer {
+	return &debouncer{interval: interval, fn: fn}
+}
+
+// trigger (re)starts the quiet period, it is safe for concurrent use
+func (d *debouncer) trigger() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer == nil {
+		d.timer = time.AfterFunc(d.interval, d.run)
+		return
+	}
+	d.timer.Reset(d.interval)
+}
+
+// run calls fn, waiting for a previous call to finish first
+func (d *debouncer) run() {
+	d.running.Lock()
+	defer d.running.Unlock()
+
+	d.fn()
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDebouncerCoalescesBurst(t *testing.T) {
+	var calls atomic.Int32
+	var last atomic.Int64
+	d := newDebouncer(50*time.Millisecond, func() {
+		calls.Add(1)
+		last.Store(time.Now().UnixNano())
+	})
+
+	// A burst of events like an editor writing a file in several steps, shorter apart than the interval
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		d.trigger()
+		time.Sleep(5 * time.Millisecond)
+	}
+	lastTrigger := time.Now()
+
+	time.Sleep(200 * time.Millisecond)
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("fn called %d times after a burst of %v, want 1", got, lastTrigger.Sub(start))
+	}
+	if called := time.Unix(0, last.Load()); called.Before(lastTrigger) {
+		t.Errorf("fn called %v before the last trigger, want after the quiet period", lastTrigger.Sub(called))
+	}
+}
+
+func TestDebouncerConcurrentTriggers(t *testing.T) {
+	var calls atomic.Int32
+	d := newDebouncer(50*time.Millisecond, func() { calls.Add(1) })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				d.trigger()
+			}
+		}()
+	}
+	wg.Wait()
+
+	time.Sleep(200 * time.Millisecond)
+	if got := calls.Load(); got != 1 {
+		t.Errorf("fn called %d times, want 1", got)
+	}
+}
+
+func TestDebouncerSeparateBursts(t *testing.T) {
+	var calls atomic.Int32
+	d := newDebouncer(30*time.Millisecond, func() { calls.Add(1) })
+
+	d.trigger()
+	d.trigger()
+	time.Sleep(150 * time.Millisecond)
+	d.trigger()
+	time.Sleep(150 * time.Millisecond)
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("fn called %d times for two bursts, want 2", got)
+	}
+}
+
+func TestDebouncerCallsDoNotOverlap(t *testing.T) {
+	var running, overlaps, calls atomic.Int32
+	d := newDebouncer(10*time.Millisecond, func() {
+		if running.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		time.Sleep(50 * time.Millisecond)
+		running.Add(-1)
+		calls.Add(1)
+	})
+
+	// The second burst ends while the first call is still running
+	d.trigger()
+	time.Sleep(30 * time.Millisecond)
+	d.trigger()
+	time.Sleep(200 * time.Millisecond)
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("fn called %d times, want 2", got)
+	}
+	if got := overlaps.Load(); got != 0 {
+		t.Errorf("%d calls of fn overlapped", got)
+	}
+}
+
+// testConfig is a configuration file passing Validate
+const testConfig = `
+mqtt:
+  broker: "tcp://localhost:1883"
+  topics: ["devices/#"]
+transformers:
+  temperature:
+    script_code: "function transform(payload) { return {}; }"
+`
+
+// watchTestConfig starts WatchConfig on paths with a short debounce interval and returns
+// a channel receiving each reloaded configuration
+func watchTestConfig(t *testing.T, paths ...string) <-chan *Config {
+	t.Helper()
+
+	interval := configDebounceInterval
+	configDebounceInterval = 100 * time.Millisecond
+	t.Cleanup(func() { configDebounceInterval = interval })
+
+	reloaded := make(chan *Config, 10)
+	err := WatchConfig(paths, func(c *Config) error {
+		reloaded <- c
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reloaded
+}
+
+func TestWatchConfigReloadsOnceForRapidWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := watchTestConfig(t, path)
+
+	// Rapid writes, each one raises fsnotify events
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(path, []byte(testConfig), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("configuration was not reloaded")
+	}
+	select {
+	case <-reloaded:
+		t.Error("configuration reloaded more than once for one burst of writes")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// resolveSecrets reads credentials configured as *_file options, as mounted by Docker and Kubernetes secrets
+func (c *Config) resolveSecrets() error {
+	secrets := []struct {
+		name  string
+		value *string
+		path  string
+	}{
+		{"mqtt.username", &c.MQTT.Username, c.MQTT.UsernameFile},
+		{"mqtt.password", &c.MQTT.Password, c.MQTT.PasswordFile},
+		{"storage.database.dsn", &c.Storage.Database.DSN, c.Storage.Database.DSNFile},
+		{"storage.database.password", &c.Storage.Database.Password, c.Storage.Database.PasswordFile},
+		{"api.admin_token", &c.API.AdminToken, c.API.AdminTokenFile},
+	}
+
+	for _, secret := range secrets {
+		if secret.path == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return fmt.Errorf("set either %s or %s_file, not both", secret.name, secret.name)
+		}
+
+		value, err := ReadSecretFile(secret.path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_file: %v", secret.name, err)
+		}
+		*secret.value = value
+	}
+
+	return nil
+}
+
+// ReadSecretFile returns the content of a secret file without trailing newlines
+func ReadSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
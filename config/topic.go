@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultTopicRegex matches topics of the form devices/{device_type}/{device_name}/...
+	DefaultTopicRegex = `^devices/([^/]+)(?:/([^/]+))?`
+	// DefaultDeviceTypeGroup is the capture group of DefaultTopicRegex holding the device type
+	DefaultDeviceTypeGroup = 1
+	// DefaultDeviceNameGroup is the capture group of DefaultTopicRegex holding the device name
+	DefaultDeviceNameGroup = 2
+)
+
+// CompileTopicRegex compiles a topic regex and resolves its capture groups: empty pattern and zero type group
+// select the defaults, a zero name group selects the default only with the default pattern, otherwise no name
+// is extracted. The type group must be a capture group of the regex, the name group zero or one
+func CompileTopicRegex(pattern string, typeGroup int, nameGroup int) (*regexp.Regexp, int, int, error) {
+	if pattern == "" {
+		pattern = DefaultTopicRegex
+		if nameGroup == 0 {
+			nameGroup = DefaultDeviceNameGroup
+		}
+	}
+	if typeGroup == 0 {
+		typeGroup = DefaultDeviceTypeGroup
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid topic regex %q: %v", pattern, err)
+	}
+	if typeGroup < 1 || typeGroup > re.NumSubexp() {
+		return nil, 0, 0, fmt.Errorf("device type group %d is not a capture group of topic regex %q, which has %d", typeGroup, pattern, re.NumSubexp())
+	}
+	if nameGroup < 0 || nameGroup > re.NumSubexp() {
+		return nil, 0, 0, fmt.Errorf("device name group %d is not a capture group of topic regex %q, which has %d", nameGroup, pattern, re.NumSubexp())
+	}
+	return re, typeGroup, nameGroup, nil
+}
+
+// Captures of a topic pattern with a special meaning, the others are merged into the record metadata
+const (
+	// TopicCaptureDeviceType is the capture holding the device type, every topic pattern needs it
+	TopicCaptureDeviceType = "device_type"
+	// TopicCaptureDeviceName is the capture holding the device name, used when the transformer sets none
+	TopicCaptureDeviceName = "device_name"
+)
+
+// captureNamePattern is the set of capture names accepted in topic patterns, as allowed for regexp group names
+var captureNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// CompileTopicPattern compiles a topic pattern into an anchored regular expression. {name} captures a part of
+// a level and can be combined with literal text, e.g. sensor-{id}. + matches one level and # the remaining
+// levels, both only as a whole level, # only as the last one. Everything else is matched literally
+func CompileTopicPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("topic pattern cannot be empty")
+	}
+
+	levels := strings.Split(pattern, "/")
+	seen := make(map[string]bool)
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			if i != len(levels)-1 {
+				return nil, fmt.Errorf("topic pattern %q: # must be the last level", pattern)
+			}
+			// # also matches the parent level, sites/{site}/# matches sites/a
+			if i == 0 {
+				expr.WriteString(".*")
+			} else {
+				expr.WriteString("(?:/.*)?")
+			}
+			continue
+		case i > 0:
+			expr.WriteString("/")
+		}
+		if level == "+" {
+			expr.WriteString("[^/]+")
+			continue
+		}
+		if strings.ContainsAny(level, "+#") {
+			return nil, fmt.Errorf("topic pattern %q: + and # must be a whole level", pattern)
+		}
+
+		rest := level
+		for rest != "" {
+			start := strings.IndexByte(rest, '{')
+			if start < 0 {
+				break
+			}
+			end := strings.IndexByte(rest[start:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("topic pattern %q: unclosed { in level %q", pattern, level)
+			}
+			end += start
+			if strings.Contains(rest[:start], "}") {
+				return nil, fmt.Errorf("topic pattern %q: } without { in level %q", pattern, level)
+			}
+
+			name := rest[start+1 : end]
+			if !captureNamePattern.MatchString(name) {
+				return nil, fmt.Errorf("topic pattern %q: invalid capture name %q", pattern, name)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("topic pattern %q: capture {%s} is used twice", pattern, name)
+			}
+			seen[name] = true
+
+			expr.WriteString(regexp.QuoteMeta(rest[:start]))
+			expr.WriteString("(?P<" + name + ">[^/]+?)")
+			rest = rest[end+1:]
+		}
+		if strings.Contains(rest, "}") {
+			return nil, fmt.Errorf("topic pattern %q: } without { in level %q", pattern, level)
+		}
+		expr.WriteString(regexp.QuoteMeta(rest))
+	}
+	expr.WriteString("$")
+
+	return regexp.Compile(expr.String())
+}
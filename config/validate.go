@@ -0,0 +1,614 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+)
+
+// tablePrefixPattern matches table prefixes accepted by the database backends
+var tablePrefixPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// wideDeviceTypePattern matches the device types that can name a wide table
+var wideDeviceTypePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// topicPlaceholderPattern matches the {name} placeholders of a republish topic template
+var topicPlaceholderPattern = regexp.MustCompile(`\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+// builtinDatabaseTypes are the database types accepted when DatabaseTypes is not set
+var builtinDatabaseTypes = []string{"clickhouse", "mysql", "postgresql"}
+
+// DatabaseTypes returns the database types storage.database.type may name. The config package cannot
+// import storage, so the program sets it to storage.DatabaseTypes to accept registered drivers too
+var DatabaseTypes func() []string
+
+// HelperNames returns the names of the helpers transformers may list in helpers. The program sets it to
+// transformer.DefaultHelpers.Names, the names are not checked while it is nil
+var HelperNames func() []string
+
+// ValidationError lists all problems found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+// Error implements error
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks the configuration and returns a *ValidationError listing every problem found
+func (c *Config) Validate() error {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// MQTT
+	if c.MQTT.Broker == "" {
+		addProblem("mqtt.broker is required")
+	}
+	if len(c.MQTT.Topics) == 0 {
+		addProblem("mqtt.topics must contain at least one topic")
+	}
+	for i, topic := range c.MQTT.Topics {
+		if strings.TrimSpace(topic) == "" {
+			addProblem("mqtt.topics[%d] is empty", i)
+		}
+	}
+
+	if c.MQTT.DeviceTypeGroup < 0 {
+		addProblem("mqtt.device_type_group cannot be negative")
+	}
+	if c.MQTT.DeviceNameGroup < 0 {
+		addProblem("mqtt.device_name_group cannot be negative")
+	}
+	if c.MQTT.TopicPattern != "" {
+		if c.MQTT.TopicRegex != "" {
+			addProblem("set either mqtt.topic_pattern or mqtt.topic_regex, not both")
+		}
+		if re, err := CompileTopicPattern(c.MQTT.TopicPattern); err != nil {
+			addProblem("mqtt.topic_pattern is invalid: %v", err)
+		} else if !containsString(re.SubexpNames(), TopicCaptureDeviceType) {
+			addProblem("mqtt.topic_pattern must contain a {%s} capture", TopicCaptureDeviceType)
+		}
+	} else if c.MQTT.DeviceTypeGroup >= 0 && c.MQTT.DeviceNameGroup >= 0 {
+		// the same check the MQTT client runs, including the defaults of an empty topic_regex
+		if _, _, _, err := CompileTopicRegex(c.MQTT.TopicRegex, c.MQTT.DeviceTypeGroup, c.MQTT.DeviceNameGroup); err != nil {
+			addProblem("mqtt.topic_regex: %v", err)
+		}
+	}
+
+	if c.MQTT.RefreshPasswordFile && c.MQTT.PasswordFile == "" {
+		addProblem("mqtt.refresh_password_file requires mqtt.password_file")
+	}
+	if c.MQTT.TokenCommand != "" && c.MQTT.PasswordFile != "" {
+		addProblem("set either mqtt.token_command or mqtt.password_file, not both")
+	}
+	if c.MQTT.TokenTimeout < 0 {
+		addProblem("mqtt.token_timeout cannot be negative")
+	}
+
+	if tlsCfg := c.MQTT.TLS; tlsCfg != (MQTTTLSConfig{}) {
+		if (tlsCfg.CertFile == "") != (tlsCfg.KeyFile == "") {
+			addProblem("mqtt.tls.cert_file and mqtt.tls.key_file must be set together")
+		}
+		if brokerURL, err := url.Parse(c.MQTT.Broker); err == nil {
+			switch brokerURL.Scheme {
+			case "ssl", "tls", "tcps", "mqtts", "mqtt+ssl", "wss":
+			default:
+				addProblem("mqtt.tls only applies to TLS brokers, mqtt.broker %q should use ssl://, tls://, mqtts:// or wss://", c.MQTT.Broker)
+			}
+		}
+	}
+
+	if c.MQTT.Workers < 0 || c.MQTT.QueueSize < 0 {
+		addProblem("mqtt.workers and mqtt.queue_size cannot be negative")
+	}
+	switch c.MQTT.ProtocolVersion {
+	case 0, 4, 5:
+	default:
+		addProblem("mqtt.protocol_version %d is invalid, expected 4 (MQTT 3.1.1) or 5", c.MQTT.ProtocolVersion)
+	}
+	if c.MQTT.QoS > 2 {
+		addProblem("mqtt.qos %d is invalid, expected 0, 1 or 2", c.MQTT.QoS)
+	}
+	if c.MQTT.ReceiveMaximum < 0 || c.MQTT.ReceiveMaximum > 65535 {
+		addProblem("mqtt.receive_maximum must be between 0 and 65535")
+	}
+	if c.MQTT.MaxResumePubInFlight < 0 {
+		addProblem("mqtt.max_resume_pub_in_flight cannot be negative")
+	}
+	if c.MQTT.SessionExpiry < 0 {
+		addProblem("mqtt.session_expiry cannot be negative")
+	} else if c.MQTT.SessionExpiry > 0 && c.MQTT.ClientID == "" {
+		// The generated client ID changes on every start, so the session would never be resumed
+		addProblem("mqtt.session_expiry requires a fixed mqtt.client_id")
+	} else if c.MQTT.SessionExpiry/time.Second > math.MaxUint32 {
+		addProblem("mqtt.session_expiry must be at most %d seconds", uint32(math.MaxUint32))
+	}
+	switch c.MQTT.QueueFullPolicy {
+	case "", "block", "drop":
+	default:
+		addProblem("mqtt.queue_full_policy %q is invalid, expected block or drop", c.MQTT.QueueFullPolicy)
+	}
+	if c.MQTT.MaxPayloadSize < 0 {
+		addProblem("mqtt.max_payload_size cannot be negative")
+	}
+	for _, pattern := range append(append([]string(nil), c.MQTT.AllowTopics...), c.MQTT.DenyTopics...) {
+		if pattern == "" {
+			addProblem("mqtt.allow_topics and mqtt.deny_topics cannot contain empty patterns")
+			continue
+		}
+		levels := strings.Split(pattern, "/")
+		for i, level := range levels {
+			if level == "#" && i != len(levels)-1 {
+				addProblem("mqtt topic pattern %q is invalid: # must be the last level", pattern)
+				break
+			}
+			if _, err := path.Match(level, ""); err != nil {
+				addProblem("mqtt topic pattern %q is invalid: %v", pattern, err)
+				break
+			}
+		}
+	}
+
+	if c.Metrics.MaxTopics < 0 {
+		addProblem("metrics.max_topics cannot be negative")
+	}
+
+	if c.Dedup.CacheSize < 0 || c.Dedup.TTL < 0 {
+		addProblem("dedup.cache_size and dedup.ttl cannot be negative")
+	}
+
+	if c.RateLimit.Enabled {
+		if c.RateLimit.Rate <= 0 {
+			addProblem("rate_limit.rate must be positive when rate limiting is enabled")
+		}
+		if c.RateLimit.Burst < 0 {
+			addProblem("rate_limit.burst cannot be negative")
+		}
+		switch c.RateLimit.Key {
+		case "", "topic", "device_name":
+		default:
+			addProblem("rate_limit.key %q is invalid, expected topic or device_name", c.RateLimit.Key)
+		}
+	}
+
+	if c.DeadLetter.Enabled && c.DeadLetter.Path == "" {
+		addProblem("dead_letter.path is required when dead-lettering is enabled")
+	}
+
+	if c.MQTT.WillQoS > 2 {
+		addProblem("mqtt.will_qos must be 0, 1 or 2")
+	}
+	if c.MQTT.PublishWillOnStop && c.MQTT.WillTopic == "" {
+		addProblem("mqtt.publish_will_on_stop requires mqtt.will_topic")
+	}
+
+	if c.MQTT.Heartbeat.Enabled && c.MQTT.Heartbeat.Topic == "" {
+		addProblem("mqtt.heartbeat.topic is required when heartbeat is enabled")
+	}
+	if c.MQTT.Heartbeat.Interval < 0 {
+		addProblem("mqtt.heartbeat.interval cannot be negative")
+	}
+	if c.MQTT.Heartbeat.QoS > 2 {
+		addProblem("mqtt.heartbeat.qos must be 0, 1 or 2")
+	}
+
+	if c.TimingLogInterval < 0 {
+		addProblem("timing_log_interval cannot be negative")
+	}
+
+	ruleNames := make(map[string]bool, len(c.Rules))
+	for i, rule := range c.Rules {
+		if rule.Name == "" {
+			addProblem("rules[%d].name is required", i)
+		} else if ruleNames[rule.Name] {
+			addProblem("rules[%d].name %q is used more than once", i, rule.Name)
+		}
+		ruleNames[rule.Name] = true
+		if rule.Condition == "" {
+			addProblem("rules[%d].condition is required", i)
+		}
+		if rule.PublishTopic == "" && rule.StoreAs == "" {
+			addProblem("rules[%d] must set publish_topic or store_as", i)
+		}
+		if rule.QoS > 2 {
+			addProblem("rules[%d].qos must be 0, 1 or 2", i)
+		}
+		if len(rule.Backends) > 0 && rule.StoreAs == "" {
+			addProblem("rules[%d].backends only applies with store_as", i)
+		}
+		for _, backend := range rule.Backends {
+			if backends := ruleBackendTypes(); !containsString(backends, backend) {
+				addProblem("rules[%d].backends contains unknown backend %q, expected one of %s", i, backend, strings.Join(backends, ", "))
+			}
+		}
+	}
+
+	if c.Registry.Path != "" {
+		switch strings.ToLower(filepath.Ext(c.Registry.Path)) {
+		case ".csv", ".yaml", ".yml":
+		default:
+			addProblem("registry.path %q must be a .csv, .yaml or .yml file", c.Registry.Path)
+		}
+	}
+
+	if c.MinQuality < 0 || c.MinQuality > 100 {
+		addProblem("min_quality must be between 0 and 100")
+	}
+	for name, rule := range c.UnitNormalization {
+		switch rule.Kind {
+		case "temperature", "pressure", "length":
+		default:
+			addProblem("unit_normalization.%s.kind %q is invalid, expected temperature, pressure or length", name, rule.Kind)
+		}
+		if rule.Unit == "" {
+			addProblem("unit_normalization.%s.unit is required", name)
+		}
+	}
+
+	// Logger
+	if c.Logger.Level != "" {
+		if _, err := logger.ParseLogLevel(c.Logger.Level); err != nil {
+			addProblem("logger.level %q is invalid, expected one of DEBUG, INFO, WARN, ERROR", c.Logger.Level)
+		}
+	}
+
+	if c.Logger.ErrorLevel != "" {
+		if _, err := logger.ParseLogLevel(c.Logger.ErrorLevel); err != nil {
+			addProblem("logger.error_level %q is invalid, expected one of DEBUG, INFO, WARN, ERROR", c.Logger.ErrorLevel)
+		}
+	}
+	if c.Logger.RotateInterval < 0 {
+		addProblem("logger.rotate_interval cannot be negative")
+	}
+	if c.Logger.BufferSize < 0 {
+		addProblem("logger.buffer_size cannot be negative")
+	}
+	switch c.Logger.Format {
+	case "", logger.FormatText, logger.FormatJSON:
+	default:
+		addProblem("logger.format %q is invalid, expected text or json", c.Logger.Format)
+	}
+
+	// Storage
+	if !validStoreMode(c.Storage.Mode) {
+		addProblem("storage.mode %q is invalid, expected best_effort or all_or_nothing", c.Storage.Mode)
+	}
+	if c.Storage.Timeout < 0 {
+		addProblem("storage.timeout cannot be negative")
+	}
+	if c.Storage.CircuitBreaker.FailureThreshold < 0 || c.Storage.CircuitBreaker.Cooldown < 0 {
+		addProblem("storage.circuit_breaker.failure_threshold and cooldown cannot be negative")
+	}
+	if c.Storage.WAL.Enabled && c.Storage.WAL.Path == "" {
+		addProblem("storage.wal.path is required when the WAL is enabled")
+	}
+	if c.Storage.WAL.CheckpointInterval < 0 {
+		addProblem("storage.wal.checkpoint_interval cannot be negative")
+	}
+	if c.Storage.WAL.MaxSize < 0 {
+		addProblem("storage.wal.max_size cannot be negative")
+	}
+	if c.Storage.File.Enabled {
+		if c.Storage.File.Path == "" {
+			addProblem("storage.file.path is required when file storage is enabled")
+		}
+		switch c.Storage.File.Format {
+		case "", "json", "csv", "jsonl":
+		default:
+			addProblem("storage.file.format %q is invalid, expected json, csv or jsonl", c.Storage.File.Format)
+		}
+		switch c.Storage.File.Partition {
+		case "", "none", "day", "hour":
+		default:
+			addProblem("storage.file.partition %q is invalid, expected none, day or hour", c.Storage.File.Partition)
+		}
+		switch c.Storage.File.Compress {
+		case "", "none":
+		case "gzip":
+			if c.Storage.File.Format != "" && c.Storage.File.Format != "json" {
+				addProblem("storage.file.compress is only supported for the json format")
+			}
+		default:
+			addProblem("storage.file.compress %q is invalid, expected none or gzip", c.Storage.File.Compress)
+		}
+		switch c.Storage.File.Serializer {
+		case "", "json":
+		case "ndjson", "avro":
+			if c.Storage.File.Format != "" && c.Storage.File.Format != "json" {
+				addProblem("storage.file.serializer is only supported for the json format")
+			}
+			if c.Storage.File.Compress == "gzip" {
+				addProblem("storage.file.compress gzip requires the json serializer")
+			}
+			if c.Storage.File.Serializer == "avro" && c.Storage.File.Compaction.Enabled {
+				addProblem("storage.file.compaction is not supported for the avro serializer")
+			}
+		default:
+			addProblem("storage.file.serializer %q is invalid, expected json, ndjson or avro", c.Storage.File.Serializer)
+		}
+		switch c.Storage.File.Fsync {
+		case "", "none":
+		case "file", "full":
+			if c.Storage.File.Format != "" && c.Storage.File.Format != "json" {
+				addProblem("storage.file.fsync is only supported for the json format")
+			}
+		default:
+			addProblem("storage.file.fsync %q is invalid, expected none, file or full", c.Storage.File.Fsync)
+		}
+		if c.Storage.File.MaxSize < 0 || c.Storage.File.MaxBackups < 0 {
+			addProblem("storage.file.max_size and storage.file.max_backups cannot be negative")
+		}
+		if c.Storage.File.Compaction.Enabled && c.Storage.File.Format != "" && c.Storage.File.Format != "json" {
+			addProblem("storage.file.compaction is only supported for the json format")
+		}
+		if c.Storage.File.Compaction.Interval < 0 {
+			addProblem("storage.file.compaction.interval cannot be negative")
+		}
+	}
+	if c.Storage.Database.Enabled {
+		// Other types can be registered with storage.RegisterDatabaseDriver, DatabaseTypes includes them
+		if dbType := c.Storage.Database.Type; dbType == "" {
+			addProblem("storage.database.type is required when database storage is enabled")
+		} else if types := knownDatabaseTypes(); !containsString(types, dbType) {
+			addProblem("storage.database.type %q is unknown, expected %s", dbType, strings.Join(types, ", "))
+		}
+		if c.Storage.Database.DSN == "" {
+			if c.Storage.Database.Host == "" {
+				addProblem("storage.database.dsn or storage.database.host is required when database storage is enabled")
+			} else if c.Storage.Database.DBName == "" {
+				addProblem("storage.database.dbname is required when the DSN is built from storage.database.host")
+			}
+		}
+		switch c.Storage.Database.SSLMode {
+		case "", "disable", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			addProblem("storage.database.sslmode %q is invalid, expected disable, prefer, require, verify-ca or verify-full", c.Storage.Database.SSLMode)
+		}
+		if c.Storage.Database.SSLMode == "prefer" && (c.Storage.Database.Type == "postgresql" || c.Storage.Database.Type == "clickhouse") {
+			addProblem("storage.database.sslmode prefer is only supported for mysql, the %s driver cannot fall back to an unencrypted connection", c.Storage.Database.Type)
+		}
+		if c.Storage.Database.CAFile != "" || c.Storage.Database.CertFile != "" || c.Storage.Database.KeyFile != "" {
+			if c.Storage.Database.DSN != "" {
+				addProblem("storage.database.ca_file, cert_file and key_file only apply when the DSN is built from storage.database.host")
+			}
+			if c.Storage.Database.Type == "clickhouse" {
+				addProblem("storage.database.ca_file, cert_file and key_file are not supported for clickhouse")
+			}
+			if c.Storage.Database.SSLMode == "disable" || c.Storage.Database.SSLMode == "prefer" {
+				addProblem("storage.database TLS files cannot be used with sslmode %s", c.Storage.Database.SSLMode)
+			}
+			if (c.Storage.Database.CertFile == "") != (c.Storage.Database.KeyFile == "") {
+				addProblem("storage.database.cert_file and storage.database.key_file must be set together")
+			}
+		}
+		if c.Storage.Database.Port < 0 || c.Storage.Database.Port > 65535 {
+			addProblem("storage.database.port must be between 0 and 65535")
+		}
+		if _, err := url.ParseQuery(c.Storage.Database.Params); err != nil {
+			addProblem("storage.database.params is invalid: %v", err)
+		}
+		if c.Storage.Database.MaxOpenConns < 0 || c.Storage.Database.MaxIdleConns < 0 || c.Storage.Database.ConnMaxLifetime < 0 {
+			addProblem("storage.database connection pool settings cannot be negative")
+		}
+		if c.Storage.Database.BatchSize < 0 || c.Storage.Database.FlushInterval < 0 {
+			addProblem("storage.database.batch_size and storage.database.flush_interval cannot be negative")
+		}
+		if prefix := c.Storage.Database.TablePrefix; prefix != "" && (len(prefix) > 32 || !tablePrefixPattern.MatchString(prefix)) {
+			addProblem("storage.database.table_prefix %q is invalid, expected at most 32 letters, digits or '_' not starting with a digit", prefix)
+		}
+		if c.Storage.Database.RetentionDays < 0 || c.Storage.Database.RetentionInterval < 0 {
+			addProblem("storage.database.retention_days and storage.database.retention_interval cannot be negative")
+		}
+		if c.Storage.Database.RetentionDays > 0 && c.Storage.Database.Type == "clickhouse" {
+			addProblem("storage.database.retention_days is not supported for clickhouse, use a table TTL instead")
+		}
+		if c.Storage.Database.ErrorLog && c.Storage.Database.Type == "clickhouse" {
+			addProblem("storage.database.error_log is not supported for clickhouse")
+		}
+	}
+
+	if c.Storage.Elasticsearch.Enabled {
+		if c.Storage.Elasticsearch.URL == "" {
+			addProblem("storage.elasticsearch.url is required when Elasticsearch storage is enabled")
+		}
+		if c.Storage.Elasticsearch.BatchSize < 0 || c.Storage.Elasticsearch.FlushInterval < 0 {
+			addProblem("storage.elasticsearch.batch_size and storage.elasticsearch.flush_interval cannot be negative")
+		}
+	}
+
+	// Transformers, sorted so the report is stable
+	deviceTypes := make([]string, 0, len(c.Transformers))
+	for deviceType := range c.Transformers {
+		deviceTypes = append(deviceTypes, deviceType)
+	}
+	sort.Strings(deviceTypes)
+	for _, deviceType := range deviceTypes {
+		transformer := c.Transformers[deviceType]
+		switch transformer.Engine {
+		case "", "js":
+			if transformer.ScriptCode == "" && transformer.ScriptPath == "" {
+				addProblem("transformers.%s must set script_code or script_path", deviceType)
+			}
+		case "cel":
+			if transformer.Expression == "" {
+				addProblem("transformers.%s must set expression when engine is cel", deviceType)
+			}
+		case "template":
+			if transformer.Template == "" {
+				addProblem("transformers.%s must set template when engine is template", deviceType)
+			}
+		case "passthrough":
+		default:
+			addProblem("transformers.%s.engine %q is invalid, expected js, cel, template or passthrough", deviceType, transformer.Engine)
+		}
+		if len(transformer.Helpers) > 0 && HelperNames != nil {
+			known := HelperNames()
+			for _, name := range transformer.Helpers {
+				if !containsString(known, name) {
+					addProblem("transformers.%s.helpers contains unknown helper %q, expected one of %s", deviceType, name, strings.Join(known, ", "))
+				}
+			}
+		}
+		switch transformer.PayloadEncoding {
+		case "", "utf8", "hex", "base64":
+		default:
+			addProblem("transformers.%s.payload_encoding %q is invalid, expected utf8, hex or base64", deviceType, transformer.PayloadEncoding)
+		}
+		switch transformer.Codec {
+		case "", "json", "msgpack":
+		case "protobuf":
+			if transformer.ProtoDescriptor == "" || transformer.ProtoMessage == "" {
+				addProblem("transformers.%s must set proto_descriptor and proto_message when codec is protobuf", deviceType)
+			}
+		default:
+			addProblem("transformers.%s.codec %q is invalid, expected json, msgpack or protobuf", deviceType, transformer.Codec)
+		}
+		// The schema is checked against the payload before the codec decodes it, binary payloads never match
+		if transformer.InputSchema != "" && (transformer.Codec == "msgpack" || transformer.Codec == "protobuf") {
+			addProblem("transformers.%s.input_schema cannot be combined with codec %s, the schema applies to JSON payloads", deviceType, transformer.Codec)
+		}
+		switch transformer.TimestampUnit {
+		case "", "s", "ms", "us":
+		default:
+			addProblem("transformers.%s.timestamp_unit %q is invalid, expected s, ms or us", deviceType, transformer.TimestampUnit)
+		}
+		switch transformer.TimestampSource {
+		case "", "message", "received":
+		default:
+			addProblem("transformers.%s.timestamp_source %q is invalid, expected message or received", deviceType, transformer.TimestampSource)
+		}
+		if transformer.TimestampPath != "" {
+			if transformer.Codec != "" && transformer.Codec != "json" {
+				addProblem("transformers.%s.timestamp_path requires the json codec", deviceType)
+			}
+			for _, key := range strings.Split(strings.TrimPrefix(transformer.TimestampPath, "."), ".") {
+				if key == "" {
+					addProblem("transformers.%s.timestamp_path %q contains an empty field name", deviceType, transformer.TimestampPath)
+					break
+				}
+			}
+		} else if transformer.TimestampFormat != "" {
+			addProblem("transformers.%s.timestamp_format requires timestamp_path", deviceType)
+		}
+		if transformer.MinQuality != nil && (*transformer.MinQuality < 0 || *transformer.MinQuality > 100) {
+			addProblem("transformers.%s.min_quality must be between 0 and 100", deviceType)
+		}
+		if !validStoreMode(transformer.StoreMode) {
+			addProblem("transformers.%s.store_mode %q is invalid, expected best_effort or all_or_nothing", deviceType, transformer.StoreMode)
+		}
+		switch transformer.InsertMode {
+		case "", "insert":
+		case "upsert":
+			if c.Storage.Database.Enabled && c.Storage.Database.Type == "clickhouse" {
+				addProblem("transformers.%s.insert_mode upsert is not supported for clickhouse", deviceType)
+			}
+		default:
+			addProblem("transformers.%s.insert_mode %q is invalid, expected insert or upsert", deviceType, transformer.InsertMode)
+		}
+		switch transformer.TableLayout {
+		case "", "normalized":
+		case "wide":
+			if c.Storage.Database.Enabled && c.Storage.Database.Type == "clickhouse" {
+				addProblem("transformers.%s.table_layout wide is not supported for clickhouse", deviceType)
+			}
+			if transformer.InsertMode == "upsert" {
+				addProblem("transformers.%s.table_layout wide cannot be combined with insert_mode upsert", deviceType)
+			}
+			if deviceType == "default" {
+				addProblem("transformers.default.table_layout wide is not supported, the default transformer handles several device types")
+			} else if !wideDeviceTypePattern.MatchString(deviceType) {
+				addProblem("transformers.%s.table_layout wide requires a device type of lowercase letters, digits or '_'", deviceType)
+			} else if len(c.Storage.Database.TablePrefix)+len("device_data_")+len(deviceType) > 51 {
+				addProblem("transformers.%s.table_layout wide table name %sdevice_data_%s exceeds 51 characters", deviceType, c.Storage.Database.TablePrefix, deviceType)
+			}
+		default:
+			addProblem("transformers.%s.table_layout %q is invalid, expected normalized or wide", deviceType, transformer.TableLayout)
+		}
+		declared := make(map[string]bool, len(transformer.Attributes))
+		for i, attr := range transformer.Attributes {
+			if attr.Name == "" {
+				addProblem("transformers.%s.attributes[%d].name is required", deviceType, i)
+			} else if declared[strings.ToLower(attr.Name)] {
+				addProblem("transformers.%s.attributes declares %q more than once", deviceType, attr.Name)
+			}
+			declared[strings.ToLower(attr.Name)] = true
+			switch attr.Type {
+			case "number", "bool", "string":
+			default:
+				addProblem("transformers.%s.attributes[%d].type %q is invalid, expected number, bool or string", deviceType, i, attr.Type)
+			}
+		}
+		if transformer.Timeout < 0 {
+			addProblem("transformers.%s.timeout cannot be negative", deviceType)
+		}
+		if republish := transformer.Republish; republish.Topic != "" {
+			// What remains without the placeholders must be a plain topic
+			if rest := topicPlaceholderPattern.ReplaceAllString(republish.Topic, ""); strings.ContainsAny(rest, "{}+#") {
+				addProblem("transformers.%s.republish.topic %q is invalid, expected a topic without wildcards and {name} placeholders of letters, digits and underscores", deviceType, republish.Topic)
+			}
+			if republish.QoS > 2 {
+				addProblem("transformers.%s.republish.qos must be 0, 1 or 2", deviceType)
+			}
+		} else if republish.QoS != 0 || republish.Retained {
+			addProblem("transformers.%s.republish.qos and retained require republish.topic", deviceType)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// knownDatabaseTypes returns the built-in database types and those returned by DatabaseTypes, sorted
+func knownDatabaseTypes() []string {
+	types := append([]string(nil), builtinDatabaseTypes...)
+	if DatabaseTypes != nil {
+		for _, dbType := range DatabaseTypes() {
+			if !containsString(types, dbType) {
+				types = append(types, dbType)
+			}
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ruleBackendTypes returns the backend names rules[].backends may list, the file backends,
+// elasticsearch and every known database type
+func ruleBackendTypes() []string {
+	types := append([]string{"csv", "elasticsearch", "file", "jsonl"}, knownDatabaseTypes()...)
+	sort.Strings(types)
+	return types
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validStoreMode reports whether mode is empty or a known store mode
+func validStoreMode(mode string) bool {
+	switch mode {
+	case "", "best_effort", "all_or_nothing":
+		return true
+	default:
+		return false
+	}
+}
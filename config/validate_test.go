@@ -0,0 +1,148 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns a minimal configuration that passes Validate
+func validConfig() *Config {
+	return &Config{
+		MQTT: MQTTConfig{
+			Broker: "tcp://localhost:1883",
+			Topics: []string{"devices/#"},
+		},
+		Transformers: map[string]Transformer{
+			"temperature": {ScriptCode: "function transform(payload) { return {}; }"},
+		},
+		Storage: StorageConfig{
+			File: FileStorageConfig{Enabled: true, Path: "data"},
+		},
+	}
+}
+
+func TestValidateAcceptsValidConfig(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate() = %v, want nil", err)
+	}
+}
+
+func TestValidateFailureModes(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		// problem is a part of the expected problem
+		problem string
+	}{
+		{"missing broker", func(c *Config) { c.MQTT.Broker = "" }, "mqtt.broker is required"},
+		{"no topics", func(c *Config) { c.MQTT.Topics = nil }, "mqtt.topics must contain at least one topic"},
+		{"empty topic", func(c *Config) { c.MQTT.Topics = []string{"devices/#", " "} }, "mqtt.topics[1] is empty"},
+		{"invalid topic regex", func(c *Config) { c.MQTT.TopicRegex = "^devices/(" }, "mqtt.topic_regex"},
+		{"type group beyond the regex", func(c *Config) {
+			c.MQTT.TopicRegex = "^devices/([^/]+)"
+			c.MQTT.DeviceTypeGroup = 2
+		}, "device type group 2"},
+		{"default type group without capture groups", func(c *Config) { c.MQTT.TopicRegex = "^devices/.*" }, "device type group 1"},
+		{"name group beyond the default regex", func(c *Config) { c.MQTT.DeviceNameGroup = 3 }, "device name group 3"},
+		{"negative type group", func(c *Config) { c.MQTT.DeviceTypeGroup = -1 }, "mqtt.device_type_group cannot be negative"},
+		{"topic pattern and regex", func(c *Config) {
+			c.MQTT.TopicPattern = "devices/{device_type}"
+			c.MQTT.TopicRegex = "^devices/([^/]+)"
+		}, "not both"},
+		{"invalid topic pattern", func(c *Config) { c.MQTT.TopicPattern = "devices/{device_type" }, "mqtt.topic_pattern is invalid"},
+		{"topic pattern without device type", func(c *Config) { c.MQTT.TopicPattern = "devices/{device_name}" }, "must contain a {device_type} capture"},
+		{"invalid protocol version", func(c *Config) { c.MQTT.ProtocolVersion = 3 }, "mqtt.protocol_version 3 is invalid"},
+		{"invalid qos", func(c *Config) { c.MQTT.QoS = 3 }, "mqtt.qos 3 is invalid"},
+		{"session expiry without client id", func(c *Config) { c.MQTT.SessionExpiry = time.Hour }, "requires a fixed mqtt.client_id"},
+		{"invalid queue full policy", func(c *Config) { c.MQTT.QueueFullPolicy = "wait" }, "mqtt.queue_full_policy"},
+		{"invalid log level", func(c *Config) { c.Logger.Level = "TRACE" }, "logger.level \"TRACE\" is invalid"},
+		{"file storage without path", func(c *Config) { c.Storage.File.Path = "" }, "storage.file.path is required"},
+		{"invalid file format", func(c *Config) { c.Storage.File.Format = "xml" }, "storage.file.format \"xml\" is invalid"},
+		{"invalid file partition", func(c *Config) { c.Storage.File.Partition = "week" }, "storage.file.partition \"week\" is invalid"},
+		{"database without type", func(c *Config) {
+			c.Storage.Database = DatabaseStorageConfig{Enabled: true, DSN: "dsn"}
+		}, "storage.database.type is required"},
+		{"unknown database type", func(c *Config) {
+			c.Storage.Database = DatabaseStorageConfig{Enabled: true, Type: "oracle", DSN: "dsn"}
+		}, "storage.database.type \"oracle\" is unknown"},
+		{"database without dsn or host", func(c *Config) {
+			c.Storage.Database = DatabaseStorageConfig{Enabled: true, Type: "mysql"}
+		}, "storage.database.dsn or storage.database.host is required"},
+		{"negative pool settings", func(c *Config) {
+			c.Storage.Database = DatabaseStorageConfig{Enabled: true, Type: "mysql", DSN: "dsn", MaxOpenConns: -1}
+		}, "connection pool settings cannot be negative"},
+		{"transformer without script", func(c *Config) {
+			c.Transformers["humidity"] = Transformer{}
+		}, "transformers.humidity must set script_code or script_path"},
+		{"negative transformer timeout", func(c *Config) {
+			c.Transformers["humidity"] = Transformer{ScriptCode: "x", Timeout: -time.Second}
+		}, "transformers.humidity.timeout cannot be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.modify(c)
+
+			err := c.Validate()
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Validate() = %v, want a *ValidationError", err)
+			}
+			if len(validationErr.Problems) != 1 || !strings.Contains(validationErr.Problems[0], tt.problem) {
+				t.Errorf("problems = %q, want exactly one containing %q", validationErr.Problems, tt.problem)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	c := validConfig()
+	c.MQTT.Broker = ""
+	c.Logger.Level = "TRACE"
+	c.Transformers["humidity"] = Transformer{}
+
+	var validationErr *ValidationError
+	if !errors.As(c.Validate(), &validationErr) {
+		t.Fatal("expected a *ValidationError")
+	}
+	if len(validationErr.Problems) != 3 {
+		t.Fatalf("problems = %q, want 3", validationErr.Problems)
+	}
+	for _, problem := range validationErr.Problems {
+		if !strings.Contains(validationErr.Error(), problem) {
+			t.Errorf("Error() %q does not list %q", validationErr.Error(), problem)
+		}
+	}
+}
+
+func TestValidateRuleBackends(t *testing.T) {
+	defer func(types func() []string) { DatabaseTypes = types }(DatabaseTypes)
+	DatabaseTypes = func() []string { return []string{"timescale"} }
+
+	tests := []struct {
+		backend string
+		valid   bool
+	}{
+		{"jsonl", true},
+		{"postgresql", true},
+		{"timescale", true},
+		{"oracle", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			c := validConfig()
+			c.Rules = []Rule{{Name: "copy", Condition: "true", StoreAs: "copy", Backends: []string{tt.backend}}}
+
+			err := c.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("Validate() = %v, want nil", err)
+			}
+			if !tt.valid && (err == nil || !strings.Contains(err.Error(), "timescale")) {
+				t.Errorf("Validate() = %v, want an error listing the registered type timescale", err)
+			}
+		})
+	}
+}
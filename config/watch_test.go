@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// configMapVolume lays out dir like a Kubernetes ConfigMap volume: config.yaml -> ..data/config.yaml
+// and ..data -> a timestamped directory holding the files
+type configMapVolume struct {
+	t   *testing.T
+	dir string
+	rev int
+}
+
+// newConfigMapVolume creates the volume with its first revision of config.yaml
+func newConfigMapVolume(t *testing.T, content string) *configMapVolume {
+	v := &configMapVolume{t: t, dir: t.TempDir()}
+	v.update(content)
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), filepath.Join(v.dir, "config.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// update writes a new revision and swaps ..data to it the way the kubelet does, no event names config.yaml
+func (v *configMapVolume) update(content string) {
+	v.t.Helper()
+
+	v.rev++
+	revision := filepath.Join(v.dir, fmt.Sprintf("..rev%d", v.rev))
+	if err := os.Mkdir(revision, 0755); err != nil {
+		v.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(revision, "config.yaml"), []byte(content), 0644); err != nil {
+		v.t.Fatal(err)
+	}
+	tmp := filepath.Join(v.dir, "..data_tmp")
+	if err := os.Symlink(filepath.Base(revision), tmp); err != nil {
+		v.t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(v.dir, "..data")); err != nil {
+		v.t.Fatal(err)
+	}
+	if v.rev > 1 {
+		if err := os.RemoveAll(filepath.Join(v.dir, fmt.Sprintf("..rev%d", v.rev-1))); err != nil {
+			v.t.Fatal(err)
+		}
+	}
+}
+
+func TestWatchConfigFollowsConfigMapSwap(t *testing.T) {
+	for _, watchDir := range []bool{false, true} {
+		name := "file"
+		if watchDir {
+			name = "directory"
+		}
+		t.Run(name, func(t *testing.T) {
+			v := newConfigMapVolume(t, testConfig)
+			path := filepath.Join(v.dir, "config.yaml")
+			if watchDir {
+				path = v.dir
+			}
+			reloaded := watchTestConfig(t, path)
+
+			v.update(testConfig + "timing_log_interval: 1m\n")
+
+			select {
+			case c := <-reloaded:
+				if c.TimingLogInterval != time.Minute {
+					t.Errorf("reloaded timing_log_interval = %v, want the updated 1m", c.TimingLogInterval)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("configuration was not reloaded after the ..data symlink was swapped")
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package deadletter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+)
+
+// Reasons a message is dead-lettered
+const (
+	// ReasonSchema means the payload did not match the input schema of its device type
+	ReasonSchema = "schema"
+	// ReasonInvalidPayload means the payload did not match its payload_encoding, or was not complete JSON for a json codec device type
+	ReasonInvalidPayload = "invalid_payload"
+	// ReasonTransform means the transformer failed
+	ReasonTransform = "transform"
+	// ReasonStore means storing failed in all-or-nothing store mode
+	ReasonStore = "store"
+)
+
+// Record represents a message that could not be processed
+type Record struct {
+	Timestamp  int64  `json:"timestamp"` // Time the message failed, in milliseconds
+	Topic      string `json:"topic"`
+	DeviceType string `json:"device_type"`
+	Reason     string `json:"reason"`
+	Error      string `json:"error"`
+	// PayloadHash is the hex encoded SHA-256 of the payload, the payload_hash of the processing_errors table
+	PayloadHash string `json:"payload_hash,omitempty"`
+	Payload     []byte `json:"payload"` // Raw payload, base64 encoded in JSON
+}
+
+// Writer appends dead-letter records to daily JSON Lines files: {path}/YYYY-MM-DD.jsonl
+type Writer struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// NewWriter creates a dead-letter writer storing records under path
+func NewWriter(path string) (*Writer, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter directory: %v", err)
+	}
+	return &Writer{path: path}, nil
+}
+
+// Write appends a record, a zero timestamp is set to the current time and an empty payload hash is computed
+func (w *Writer) Write(record Record) error {
+	now := time.Now()
+	if record.Timestamp == 0 {
+		record.Timestamp = now.UnixMilli()
+	}
+	if record.PayloadHash == "" {
+		hash := sha256.Sum256(record.Payload)
+		record.PayloadHash = hex.EncodeToString(hash[:])
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to serialize dead-letter record: %v", err)
+	}
+	line = append(line, '\n')
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	filename := filepath.Join(w.path, now.Format("2006-01-02")+".jsonl")
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to write dead-letter record: %v", err)
+	}
+
+	logger.Debug("Dead-lettered message from topic %s: %s", record.Topic, record.Reason)
+	return nil
+}
@@ -0,0 +1,98 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Output formats of log entries
+const (
+	// FormatText writes colored human-readable lines, fields are appended as key=value
+	FormatText = "text"
+	// FormatJSON writes one JSON object per line, fields are top-level keys
+	FormatJSON = "json"
+)
+
+// Fields are the structured key-value pairs of a log entry, e.g. the device type or topic of a message
+type Fields map[string]interface{}
+
+// Keys of the JSON format set by the logger, fields with the same name are prefixed with "field."
+const (
+	jsonTimeKey   = "time"
+	jsonLevelKey  = "level"
+	jsonCallerKey = "caller"
+	jsonMsgKey    = "msg"
+)
+
+// sortedKeys returns the keys of fields in sorted order, so entries are written consistently
+func (fields Fields) sortedKeys() []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// text returns the fields as " key=value" pairs, values with spaces, quotes or '=' are quoted
+func (fields Fields) text() string {
+	if len(fields) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, key := range fields.sortedKeys() {
+		value := fmt.Sprint(fieldValue(fields[key]))
+		if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+			value = strconv.Quote(value)
+		}
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
+// jsonEntry returns a log entry in the JSON format, terminated by a newline
+func jsonEntry(timestamp, level, caller, msg string, fields Fields) string {
+	entry := make(map[string]interface{}, len(fields)+4)
+	for key, value := range fields {
+		switch key {
+		case jsonTimeKey, jsonLevelKey, jsonCallerKey, jsonMsgKey:
+			key = "field." + key
+		}
+		entry[key] = fieldValue(value)
+	}
+	entry[jsonTimeKey] = timestamp
+	entry[jsonLevelKey] = level
+	entry[jsonCallerKey] = caller
+	entry[jsonMsgKey] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		// Values that cannot be encoded are written as strings
+		for key, value := range entry {
+			entry[key] = fmt.Sprint(value)
+		}
+		line, _ = json.Marshal(entry)
+	}
+	return string(line) + "\n"
+}
+
+// fieldValue returns the value written for a field, errors are written as their message
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case []byte:
+		return string(v)
+	default:
+		return value
+	}
+}
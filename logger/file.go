@@ -0,0 +1,182 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/eddielth/data-trans/clock"
+)
+
+// rotatedTimestampPattern matches the timestamp rotate puts between the name and the extension of a rotated file
+var rotatedTimestampPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}$`)
+
+// logFile represents a log file with rotation, it is not safe for concurrent use
+type logFile struct {
+	path        string
+	file        *os.File
+	maxSize     int64 // Unit: bytes
+	maxBackups  int
+	currentSize int64
+	// clock provides the time in the names of rotated files
+	clock clock.Clock
+}
+
+// openLogFile opens or creates the log file at path, maxSize is in MB
+func openLogFile(path string, maxSize int, maxBackups int, c clock.Clock) (*logFile, error) {
+	// Ensure log directory exists
+	logDir := filepath.Dir(path)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+
+	// Open log file
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+
+	// Get current file size
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to get log file info: %v", err)
+	}
+
+	return &logFile{
+		path:        path,
+		file:        file,
+		maxSize:     int64(maxSize) * 1024 * 1024, // Convert to bytes
+		maxBackups:  maxBackups,
+		currentSize: info.Size(),
+		clock:       c,
+	}, nil
+}
+
+// write writes an entry and rotates the file when it exceeds the maximum size
+func (f *logFile) write(logEntry string) {
+	if f.file == nil {
+		// Reopening failed on the last rotation, keep the entry on stderr
+		io.WriteString(os.Stderr, logEntry)
+		return
+	}
+
+	n, err := io.WriteString(f.file, logEntry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write log: %v\n", err)
+		return
+	}
+
+	// Update current file size
+	f.currentSize += int64(n)
+
+	// Check if log rotation is needed
+	if f.currentSize >= f.maxSize {
+		f.rotate()
+	}
+}
+
+// rotate rotates the log file
+func (f *logFile) rotate() {
+	// Close current log file
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+
+	// Generate new log filename (with timestamp)
+	timestamp := f.clock.Now().Format("20060102-150405")
+	dir := filepath.Dir(f.path)
+	base := filepath.Base(f.path)
+	ext := filepath.Ext(base)
+	name := base[:len(base)-len(ext)]
+	backupPath := filepath.Join(dir, fmt.Sprintf("%s.%s%s", name, timestamp, ext))
+
+	// Rename current log file
+	os.Rename(f.path, backupPath)
+
+	// Clean up old log files
+	f.cleanOldLogs()
+
+	// Create new log file
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create new log file: %v\n", err)
+		return
+	}
+
+	f.file = file
+	f.currentSize = 0
+}
+
+// cleanOldLogs cleans up old log files
+func (f *logFile) cleanOldLogs() {
+	dir := filepath.Dir(f.path)
+	base := filepath.Base(f.path)
+	ext := filepath.Ext(base)
+	name := base[:len(base)-len(ext)]
+
+	// Find the files rotated from this log file, name.YYYYMMDD-HHMMSS.ext. A glob on name.*ext would
+	// also match sibling logs such as the error file name.error.ext and their rotated files
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to find old log files: %v\n", err)
+		return
+	}
+	var matches []string
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() || len(entryName) <= len(name)+1+len(ext) || !strings.HasPrefix(entryName, name+".") || !strings.HasSuffix(entryName, ext) {
+			continue
+		}
+		if rotatedTimestampPattern.MatchString(entryName[len(name)+1 : len(entryName)-len(ext)]) {
+			matches = append(matches, filepath.Join(dir, entryName))
+		}
+	}
+
+	// If the number of log files exceeds the maximum backup count, delete the oldest files
+	if len(matches) > f.maxBackups {
+		// Sort by modification time
+		type fileInfo struct {
+			path string
+			time time.Time
+		}
+		files := make([]fileInfo, 0, len(matches))
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				continue
+			}
+			files = append(files, fileInfo{match, info.ModTime()})
+		}
+
+		// Sort by time (oldest first)
+		for i := 0; i < len(files); i++ {
+			for j := i + 1; j < len(files); j++ {
+				if files[i].time.After(files[j].time) {
+					files[i], files[j] = files[j], files[i]
+				}
+			}
+		}
+
+		// Delete excess old files
+		for i := 0; i < len(files)-f.maxBackups; i++ {
+			os.Remove(files[i].path)
+		}
+	}
+}
+
+// close closes the log file
+func (f *logFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
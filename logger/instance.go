@@ -9,6 +9,9 @@ import (
 // Global logger instance
 var defaultLogger *Logger
 
+// defaultLoggerConfig is the configuration defaultLogger was created with
+var defaultLoggerConfig LoggerConfig
+
 // Initialize default logger instance
 func init() {
 	// Initialize with default configuration
@@ -20,38 +23,63 @@ func init() {
 	}
 
 	defaultLogger = logger
+	defaultLoggerConfig = DefaultConfig()
 }
 
-// InitFromConfig initializes the logger from configuration
-func InitFromConfig(level, filePath string, maxSize, maxBackups int, console bool) error {
-	if defaultLogger != nil {
-		// Close existing logger
-		defaultLogger.Close()
-	}
-
+// InitFromConfig initializes the logger from configuration,
+// level is parsed and overrides loggerConfig.Level.
+// When only the level differs from the current logger it is updated in place,
+// otherwise a new logger is created and replaces the current one.
+func InitFromConfig(level string, loggerConfig LoggerConfig) error {
 	// Parse log level
 	logLevel, err := ParseLogLevel(level)
 	if err != nil {
 		return err
 	}
+	loggerConfig.Level = logLevel
 
-	// Create new logger
-	logger, err := New(LoggerConfig{
-		Level:      logLevel,
-		FilePath:   filePath,
-		MaxSize:    maxSize,
-		MaxBackups: maxBackups,
-		Console:    console,
-	})
+	// Level-only change, keep the open file and queued entries
+	if defaultLogger != nil {
+		current := defaultLoggerConfig
+		current.Level = logLevel
+		if current == loggerConfig {
+			defaultLogger.SetLevel(logLevel)
+			defaultLoggerConfig = loggerConfig
+			return nil
+		}
+	}
 
+	// Create new logger before closing the existing one so no entries are dropped if it fails
+	logger, err := New(loggerConfig)
 	if err != nil {
 		return err
 	}
 
+	previous := defaultLogger
 	defaultLogger = logger
+	defaultLoggerConfig = loggerConfig
+	if previous != nil {
+		previous.Close()
+	}
 	return nil
 }
 
+// SetLevel changes the level of the default logger at runtime, e.g. from a signal handler.
+// The configured level is kept, ResetLevel and configuration reloads return to it
+func SetLevel(level LogLevel) {
+	if defaultLogger != nil {
+		defaultLogger.SetLevel(level)
+	}
+}
+
+// ResetLevel restores the configured level of the default logger and returns it
+func ResetLevel() LogLevel {
+	if defaultLogger != nil {
+		defaultLogger.SetLevel(defaultLoggerConfig.Level)
+	}
+	return defaultLoggerConfig.Level
+}
+
 // ParseLogLevel parses log level string
 func ParseLogLevel(level string) (LogLevel, error) {
 	switch strings.ToUpper(level) {
@@ -104,6 +132,42 @@ func Error(format string, args ...interface{}) {
 	}
 }
 
+// DebugKV logs a debug level message with structured fields
+func DebugKV(msg string, fields Fields) {
+	if defaultLogger != nil {
+		defaultLogger.DebugKV(msg, fields)
+	} else {
+		log.Printf("[DEBUG] %s%s", msg, fields.text())
+	}
+}
+
+// InfoKV logs an info level message with structured fields
+func InfoKV(msg string, fields Fields) {
+	if defaultLogger != nil {
+		defaultLogger.InfoKV(msg, fields)
+	} else {
+		log.Printf("[INFO] %s%s", msg, fields.text())
+	}
+}
+
+// WarnKV logs a warning level message with structured fields
+func WarnKV(msg string, fields Fields) {
+	if defaultLogger != nil {
+		defaultLogger.WarnKV(msg, fields)
+	} else {
+		log.Printf("[WARN] %s%s", msg, fields.text())
+	}
+}
+
+// ErrorKV logs an error level message with structured fields
+func ErrorKV(msg string, fields Fields) {
+	if defaultLogger != nil {
+		defaultLogger.ErrorKV(msg, fields)
+	} else {
+		log.Printf("[ERROR] %s%s", msg, fields.text())
+	}
+}
+
 // Close closes the logger
 func Close() error {
 	if defaultLogger != nil {
@@ -7,7 +7,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/eddielth/data-trans/clock"
 )
 
 // LogLevel represents the log level
@@ -32,15 +35,41 @@ var levelNames = map[LogLevel]string{
 	ERROR: "ERROR",
 }
 
+// String returns the name of the level
+func (level LogLevel) String() string {
+	if name, ok := levelNames[level]; ok {
+		return name
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(level))
+}
+
 // Logger represents the logger
 type Logger struct {
-	level       LogLevel
-	output      io.Writer
-	filePath    string
-	maxSize     int64 // Unit: bytes
-	maxBackups  int
-	currentSize int64
-	mu          sync.Mutex
+	level   atomic.Int32 // LogLevel, read without holding mu
+	console bool
+	file    *logFile
+	// errorFile receives entries at or above errorLevel, nil when not configured
+	errorFile  *logFile
+	errorLevel LogLevel
+	mu         sync.Mutex
+	// stopRotate stops the time-based rotation goroutine, nil when it is disabled
+	stopRotate chan struct{}
+	closeOnce  sync.Once
+	// entries queues log entries in async mode, nil in sync mode
+	entries     chan logEntry
+	writerDone  chan struct{}
+	asyncMu     sync.RWMutex
+	asyncClosed bool
+	// clock provides the entry timestamps and rotation times
+	clock clock.Clock
+	// json writes entries in FormatJSON
+	json bool
+}
+
+// logEntry represents a formatted log entry
+type logEntry struct {
+	level LogLevel
+	text  string
 }
 
 // LoggerConfig represents the configuration for the logger
@@ -55,8 +84,25 @@ type LoggerConfig struct {
 	MaxBackups int
 	// Whether to log to console
 	Console bool
+	// Interval of time-based rotation, 0 disables it
+	RotateInterval time.Duration
+	// Whether entries are written by a background goroutine
+	Async bool
+	// Number of entries buffered in async mode
+	BufferSize int
+	// Path of the secondary file receiving only entries at or above ErrorLevel, empty disables it
+	ErrorFilePath string
+	// Minimum level written to the secondary file
+	ErrorLevel LogLevel
+	// Clock provides the entry timestamps and rotation times, nil uses the system clock
+	Clock clock.Clock
+	// Format of the entries, FormatText (default) or FormatJSON
+	Format string
 }
 
+// DefaultBufferSize is the number of entries buffered in async mode when not configured
+const DefaultBufferSize = 1024
+
 // DefaultConfig returns default logger configuration
 func DefaultConfig() LoggerConfig {
 	return LoggerConfig{
@@ -65,65 +111,100 @@ func DefaultConfig() LoggerConfig {
 		MaxSize:    10, // 10MB
 		MaxBackups: 5,
 		Console:    true,
+		ErrorLevel: WARN,
 	}
 }
 
 // New creates a new logger
 func New(config LoggerConfig) (*Logger, error) {
-	// Ensure log directory exists
-	logDir := filepath.Dir(config.FilePath)
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	c := clock.Or(config.Clock)
+	file, err := openLogFile(config.FilePath, config.MaxSize, config.MaxBackups, c)
+	if err != nil {
+		return nil, err
 	}
 
-	// Open log file
-	file, err := os.OpenFile(config.FilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open log file: %v", err)
+	l := &Logger{
+		console:    config.Console,
+		file:       file,
+		errorLevel: config.ErrorLevel,
+		mu:         sync.Mutex{},
+		clock:      c,
+		json:       config.Format == FormatJSON,
+	}
+	l.level.Store(int32(config.Level))
+
+	// The error file shares the rotation settings of the main file
+	if config.ErrorFilePath != "" {
+		errorFile, err := openLogFile(config.ErrorFilePath, config.MaxSize, config.MaxBackups, c)
+		if err != nil {
+			file.close()
+			return nil, err
+		}
+		l.errorFile = errorFile
 	}
 
-	// Get current file size
-	info, err := file.Stat()
-	if err != nil {
-		file.Close()
-		return nil, fmt.Errorf("failed to get log file info: %v", err)
+	if config.Async {
+		bufferSize := config.BufferSize
+		if bufferSize <= 0 {
+			bufferSize = DefaultBufferSize
+		}
+		l.entries = make(chan logEntry, bufferSize)
+		l.writerDone = make(chan struct{})
+		go l.writeEntries()
+	}
+
+	if config.RotateInterval > 0 {
+		l.stopRotate = make(chan struct{})
+		go l.rotateEvery(config.RotateInterval)
 	}
 
-	// Create output writer
-	var output io.Writer = file
-	if config.Console {
-		// Output to both console and file
-		output = io.MultiWriter(os.Stdout, file)
+	return l, nil
+}
+
+// rotateEvery rotates the log files at every multiple of interval until the logger is closed
+func (l *Logger) rotateEvery(interval time.Duration) {
+	for {
+		timer := l.clock.NewTimer(untilRotation(l.clock.Now(), interval))
+
+		select {
+		case <-timer.C():
+			l.mu.Lock()
+			// Skip empty files to avoid piling up empty backups
+			for _, file := range []*logFile{l.file, l.errorFile} {
+				if file != nil && file.currentSize > 0 {
+					file.rotate()
+				}
+			}
+			l.mu.Unlock()
+		case <-l.stopRotate:
+			timer.Stop()
+			return
+		}
 	}
+}
 
-	return &Logger{
-		level:       config.Level,
-		output:      output,
-		filePath:    config.FilePath,
-		maxSize:     int64(config.MaxSize) * 1024 * 1024, // Convert to bytes
-		maxBackups:  config.MaxBackups,
-		currentSize: info.Size(),
-		mu:          sync.Mutex{},
-	}, nil
+// untilRotation returns how long it is from now to the next multiple of interval
+func untilRotation(now time.Time, interval time.Duration) time.Duration {
+	return now.Truncate(interval).Add(interval).Sub(now)
 }
 
 // SetLevel sets the log level
 func (l *Logger) SetLevel(level LogLevel) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	l.level = level
+	l.level.Store(int32(level))
+}
+
+// Level returns the current log level
+func (l *Logger) Level() LogLevel {
+	return LogLevel(l.level.Load())
 }
 
-// log is the internal method for logging
-func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
+// log is the internal method for logging, fields may be nil
+func (l *Logger) log(level LogLevel, fields Fields, format string, args ...interface{}) {
 	// Check log level
-	if level < l.level {
+	if level < l.Level() {
 		return
 	}
 
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
 	// Get caller information
 	_, file, line, ok := runtime.Caller(3)
 	if !ok {
@@ -135,10 +216,19 @@ func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
 	file = filepath.Base(file)
 
 	// Format log message
-	timestamp := time.Now().Format("2006-01-02 15:04:05.000")
+	now := l.clock.Now()
 	levelStr := levelNames[level]
 	msg := fmt.Sprintf(format, args...)
 
+	if l.json {
+		l.enqueue(logEntry{
+			level: level,
+			text:  jsonEntry(now.Format("2006-01-02T15:04:05.000Z07:00"), levelStr, fmt.Sprintf("%s:%d", file, line), msg, fields),
+		})
+		return
+	}
+	timestamp := now.Format("2006-01-02 15:04:05.000")
+
 	colorCode := ""
 	resetColor := "\033[0m"
 
@@ -153,149 +243,118 @@ func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
 		colorCode = "\033[31m" // Red
 	}
 
-	logEntry := fmt.Sprintf("%s [%s%s%s] %s:%d: %s\n", timestamp, colorCode, levelStr, resetColor, file, line, msg)
-
-	// Write log
-	n, err := io.WriteString(l.output, logEntry)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to write log: %v\n", err)
-		return
-	}
-
-	// Update current file size
-	l.currentSize += int64(n)
-
-	// Check if log rotation is needed
-	if l.currentSize >= l.maxSize {
-		l.rotate()
-	}
+	l.enqueue(logEntry{
+		level: level,
+		text:  fmt.Sprintf("%s [%s%s%s] %s:%d: %s%s\n", timestamp, colorCode, levelStr, resetColor, file, line, msg, fields.text()),
+	})
 }
 
-// rotate rotates the log file
-func (l *Logger) rotate() {
-	// Close current log file
-	if closer, ok := l.output.(io.Closer); ok {
-		closer.Close()
+// enqueue writes an entry, in async mode it is queued for the writer goroutine
+func (l *Logger) enqueue(entry logEntry) {
+	if l.entries != nil {
+		l.asyncMu.RLock()
+		defer l.asyncMu.RUnlock()
+		if !l.asyncClosed {
+			// Blocks when the buffer is full so no entry is lost
+			l.entries <- entry
+			return
+		}
 	}
 
-	// Generate new log filename (with timestamp)
-	timestamp := time.Now().Format("20060102-150405")
-	dir := filepath.Dir(l.filePath)
-	base := filepath.Base(l.filePath)
-	ext := filepath.Ext(base)
-	name := base[:len(base)-len(ext)]
-	backupPath := filepath.Join(dir, fmt.Sprintf("%s.%s%s", name, timestamp, ext))
-
-	// Rename current log file
-	os.Rename(l.filePath, backupPath)
-
-	// Clean up old log files
-	l.cleanOldLogs()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.write(entry)
+}
 
-	// Create new log file
-	file, err := os.OpenFile(l.filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to create new log file: %v\n", err)
-		return
+// write writes an entry to the console and the log files, the caller must hold mu
+func (l *Logger) write(entry logEntry) {
+	if l.console {
+		io.WriteString(os.Stdout, entry.text)
 	}
 
-	// Update output
-	// Check if console output was previously configured
-	var consoleConfigured bool
-	// Try to determine if console output was configured from field names or struct characteristics
-	_, consoleConfigured = l.output.(*os.File)
-	if !consoleConfigured && l.output != nil {
-		// If it's not a file type but output is not nil, assume multi-output was previously configured
-		consoleConfigured = true
-	}
+	l.file.write(entry.text)
 
-	// Decide new output method based on previous configuration
-	if consoleConfigured {
-		// If console output was previously configured, continue using multi-output
-		l.output = io.MultiWriter(os.Stdout, file)
-	} else {
-		// Otherwise, output to file only
-		l.output = file
+	if l.errorFile != nil && entry.level >= l.errorLevel {
+		l.errorFile.write(entry.text)
 	}
-
-	l.currentSize = 0
 }
 
-// cleanOldLogs cleans up old log files
-func (l *Logger) cleanOldLogs() {
-	dir := filepath.Dir(l.filePath)
-	base := filepath.Base(l.filePath)
-	ext := filepath.Ext(base)
-	name := base[:len(base)-len(ext)]
-	pattern := filepath.Join(dir, name+".*"+ext)
+// writeEntries writes queued entries in async mode until the queue is closed
+func (l *Logger) writeEntries() {
+	defer close(l.writerDone)
 
-	// Find all matching log files
-	matches, err := filepath.Glob(pattern)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to find old log files: %v\n", err)
-		return
-	}
-
-	// If the number of log files exceeds the maximum backup count, delete the oldest files
-	if len(matches) > l.maxBackups {
-		// Sort by modification time
-		type fileInfo struct {
-			path string
-			time time.Time
-		}
-		files := make([]fileInfo, 0, len(matches))
-
-		for _, match := range matches {
-			info, err := os.Stat(match)
-			if err != nil {
-				continue
-			}
-			files = append(files, fileInfo{match, info.ModTime()})
-		}
-
-		// Sort by time (oldest first)
-		for i := 0; i < len(files); i++ {
-			for j := i + 1; j < len(files); j++ {
-				if files[i].time.After(files[j].time) {
-					files[i], files[j] = files[j], files[i]
-				}
-			}
-		}
-
-		// Delete excess old files
-		for i := 0; i < len(files)-l.maxBackups; i++ {
-			os.Remove(files[i].path)
-		}
+	for entry := range l.entries {
+		l.mu.Lock()
+		l.write(entry)
+		l.mu.Unlock()
 	}
 }
 
 // Debug logs debug level messages
 func (l *Logger) Debug(format string, args ...interface{}) {
-	l.log(DEBUG, format, args...)
+	l.log(DEBUG, nil, format, args...)
 }
 
 // Info logs info level messages
 func (l *Logger) Info(format string, args ...interface{}) {
-	l.log(INFO, format, args...)
+	l.log(INFO, nil, format, args...)
 }
 
 // Warn logs warning level messages
 func (l *Logger) Warn(format string, args ...interface{}) {
-	l.log(WARN, format, args...)
+	l.log(WARN, nil, format, args...)
 }
 
 // Error logs error level messages
 func (l *Logger) Error(format string, args ...interface{}) {
-	l.log(ERROR, format, args...)
+	l.log(ERROR, nil, format, args...)
+}
+
+// DebugKV logs a debug level message with structured fields
+func (l *Logger) DebugKV(msg string, fields Fields) {
+	l.log(DEBUG, fields, "%s", msg)
+}
+
+// InfoKV logs an info level message with structured fields
+func (l *Logger) InfoKV(msg string, fields Fields) {
+	l.log(INFO, fields, "%s", msg)
+}
+
+// WarnKV logs a warning level message with structured fields
+func (l *Logger) WarnKV(msg string, fields Fields) {
+	l.log(WARN, fields, "%s", msg)
+}
+
+// ErrorKV logs an error level message with structured fields
+func (l *Logger) ErrorKV(msg string, fields Fields) {
+	l.log(ERROR, fields, "%s", msg)
 }
 
 // Close closes the logger
 func (l *Logger) Close() error {
+	l.closeOnce.Do(func() {
+		if l.stopRotate != nil {
+			close(l.stopRotate)
+		}
+
+		// Flush queued entries before closing the file
+		if l.entries != nil {
+			l.asyncMu.Lock()
+			l.asyncClosed = true
+			close(l.entries)
+			l.asyncMu.Unlock()
+			<-l.writerDone
+		}
+	})
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if closer, ok := l.output.(io.Closer); ok {
-		return closer.Close()
+	err := l.file.close()
+	if l.errorFile != nil {
+		if errorFileErr := l.errorFile.close(); err == nil {
+			err = errorFileErr
+		}
 	}
-	return nil
+	return err
 }
\ No newline at end of file
@@ -0,0 +1,267 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eddielth/data-trans/clock"
+)
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRotatedFileNamedByClock(t *testing.T) {
+	dir := t.TempDir()
+	c := clock.NewFake(time.Date(2024, 3, 1, 12, 30, 45, 0, time.Local))
+	// A maximum size of 0 rotates after every entry
+	file, err := openLogFile(filepath.Join(dir, "app.log"), 0, 5, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+
+	file.write("first\n")
+
+	content, err := os.ReadFile(filepath.Join(dir, "app.20240301-123045.log"))
+	if err != nil {
+		t.Fatalf("rotated file not named after the clock: %v", err)
+	}
+	if string(content) != "first\n" {
+		t.Errorf("rotated file contains %q, want %q", content, "first\n")
+	}
+}
+
+func TestRotateEveryFollowsClock(t *testing.T) {
+	dir := t.TempDir()
+	c := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 30, 0, time.Local))
+	l, err := New(LoggerConfig{
+		Level:          INFO,
+		FilePath:       filepath.Join(dir, "app.log"),
+		MaxSize:        10,
+		MaxBackups:     5,
+		RotateInterval: time.Minute,
+		Clock:          c,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l.Info("before rotation")
+	waitFor(t, "the rotation timer", func() bool { return c.Timers() == 1 })
+
+	// Nothing is rotated before the next multiple of the interval
+	c.Advance(29 * time.Second)
+	time.Sleep(20 * time.Millisecond)
+	if matches, _ := filepath.Glob(filepath.Join(dir, "app.*.log")); len(matches) != 0 {
+		t.Fatalf("rotated before the interval elapsed: %v", matches)
+	}
+
+	c.Advance(time.Second)
+	rotated := filepath.Join(dir, "app.20240301-120100.log")
+	waitFor(t, "the rotated file", func() bool {
+		_, err := os.Stat(rotated)
+		return err == nil
+	})
+	content, err := os.ReadFile(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "before rotation") {
+		t.Errorf("rotated file misses the entry written before rotation: %q", content)
+	}
+
+	// The next rotation is armed for the following minute
+	waitFor(t, "the next rotation timer", func() bool { return c.Timers() == 1 })
+}
+
+func TestUntilRotation(t *testing.T) {
+	tests := []struct {
+		now      time.Time
+		interval time.Duration
+		want     time.Duration
+	}{
+		{time.Date(2024, 3, 1, 12, 0, 30, 0, time.UTC), time.Minute, 30 * time.Second},
+		{time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), time.Minute, time.Minute},
+		{time.Date(2024, 3, 1, 12, 59, 0, 0, time.UTC), time.Hour, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := untilRotation(tt.now, tt.interval); got != tt.want {
+			t.Errorf("untilRotation(%v, %v) = %v, want %v", tt.now, tt.interval, got, tt.want)
+		}
+	}
+}
+
+// captureStdout redirects os.Stdout while fn runs and returns what was written to it
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		var b strings.Builder
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			b.Write(buf[:n])
+			if err != nil {
+				output <- b.String()
+				return
+			}
+		}
+	}()
+
+	fn()
+	w.Close()
+	return <-output
+}
+
+func TestRotateTwiceWritesEachLineOnce(t *testing.T) {
+	dir := t.TempDir()
+	c := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local))
+	path := filepath.Join(dir, "app.log")
+
+	var l *Logger
+	stdout := captureStdout(t, func() {
+		var err error
+		l, err = New(LoggerConfig{Level: INFO, FilePath: path, MaxSize: 10, MaxBackups: 5, Console: true, Clock: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, line := range []string{"line-1", "line-2", "line-3"} {
+			if i > 0 {
+				// Rotated files are named by the second, so each rotation needs its own
+				c.Advance(time.Second)
+				l.mu.Lock()
+				l.file.rotate()
+				l.mu.Unlock()
+			}
+			l.Info("%s", line)
+		}
+		l.Close()
+	})
+
+	var files strings.Builder
+	for _, name := range []string{"app.20240301-120001.log", "app.20240301-120002.log", "app.log"} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files.Write(content)
+	}
+
+	for _, line := range []string{"line-1", "line-2", "line-3"} {
+		if n := strings.Count(stdout, line); n != 1 {
+			t.Errorf("stdout received %s %d times, want once", line, n)
+		}
+		if n := strings.Count(files.String(), line); n != 1 {
+			t.Errorf("log files received %s %d times, want once", line, n)
+		}
+	}
+
+	// After two rotations the current file holds only the last line
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(current), "line-3") || strings.Contains(string(current), "line-2") {
+		t.Errorf("current log file holds %q, want only line-3", current)
+	}
+}
+
+func TestRotateWithoutConsoleKeepsStdoutQuiet(t *testing.T) {
+	dir := t.TempDir()
+
+	stdout := captureStdout(t, func() {
+		l, err := New(LoggerConfig{Level: INFO, FilePath: filepath.Join(dir, "app.log"), MaxSize: 10, MaxBackups: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, line := range []string{"line-1", "line-2", "line-3"} {
+			if i > 0 {
+				l.mu.Lock()
+				l.file.rotate()
+				l.mu.Unlock()
+			}
+			l.Info("%s", line)
+		}
+		l.Close()
+	})
+
+	if stdout != "" {
+		t.Errorf("stdout received %q without console output", stdout)
+	}
+}
+
+func TestCleanOldLogsKeepsSiblingLogs(t *testing.T) {
+	dir := t.TempDir()
+	for i, name := range []string{
+		"app.20240301-120000.log",
+		"app.20240301-120001.log",
+		"app.20240301-120002.log",
+		// Sibling logs sharing the name prefix must not count as backups of app.log
+		"app.error.log",
+		"app.error.20240301-115900.log",
+		"app.notes.log",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// The oldest backups are removed by modification time
+		mtime := time.Date(2024, 3, 1, 12, 0, i, 0, time.Local)
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local))
+	file, err := openLogFile(filepath.Join(dir, "app.log"), 10, 1, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+
+	file.cleanOldLogs()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := make(map[string]bool)
+	for _, entry := range entries {
+		remaining[entry.Name()] = true
+	}
+	for _, name := range []string{"app.error.log", "app.error.20240301-115900.log", "app.notes.log", "app.log"} {
+		if !remaining[name] {
+			t.Errorf("%s was removed", name)
+		}
+	}
+	var backups int
+	for name := range remaining {
+		if rotatedTimestampPattern.MatchString(strings.TrimSuffix(strings.TrimPrefix(name, "app."), ".log")) {
+			backups++
+		}
+	}
+	if backups != 1 || !remaining["app.20240301-120002.log"] {
+		t.Errorf("%d backups of app.log remain, want only the newest: %v", backups, remaining)
+	}
+}
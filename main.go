@@ -1,37 +1,53 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/eddielth/data-trans/api"
 	"github.com/eddielth/data-trans/config"
 	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/metrics"
 	"github.com/eddielth/data-trans/mqtt"
 	"github.com/eddielth/data-trans/storage"
 	"github.com/eddielth/data-trans/transformer"
 )
 
+// 配置校验接受已注册的数据库驱动类型和辅助函数
+func init() {
+	config.DatabaseTypes = storage.DatabaseTypes
+	config.HelperNames = transformer.DefaultHelpers.Names
+}
+
 // 初始化配置
-func initConfig(configPath string) (*config.Config, error) {
-	// 加载配置
-	cfg, err := config.LoadConfig(configPath)
+func initConfig(configPaths []string) (*config.Config, error) {
+	// 加载并合并配置文件
+	cfg, err := config.LoadConfig(configPaths...)
 	if err != nil {
 		logger.Error("加载配置失败: %v", err)
 		return nil, err
 	}
+
+	// 校验配置，一次性列出所有问题
+	if err := cfg.Validate(); err != nil {
+		logger.Error("配置校验失败: %v", err)
+		return nil, err
+	}
 	return cfg, nil
 }
 
 // 初始化日志系统
 func initLogger(cfg *config.Config) error {
-	err := logger.InitFromConfig(
-		cfg.Logger.Level,
-		cfg.Logger.FilePath,
-		cfg.Logger.MaxSize,
-		cfg.Logger.MaxBackups,
-		cfg.Logger.Console,
-	)
+	err := logger.InitFromConfig(cfg.Logger.Level, loggerConfig(cfg.Logger))
 	if err != nil {
 		logger.Error("初始化日志系统失败: %v", err)
 		// 继续使用默认日志配置
@@ -39,13 +55,51 @@ func initLogger(cfg *config.Config) error {
 	return nil
 }
 
+// 根据日志配置构建日志选项，日志级别由 InitFromConfig 单独解析
+func loggerConfig(cfg config.LoggerConfig) logger.LoggerConfig {
+	// 错误日志文件默认记录WARN及以上级别，配置已在启动时校验
+	errorLevel := logger.WARN
+	if cfg.ErrorLevel != "" {
+		errorLevel, _ = logger.ParseLogLevel(cfg.ErrorLevel)
+	}
+
+	return logger.LoggerConfig{
+		FilePath:       cfg.FilePath,
+		MaxSize:        cfg.MaxSize,
+		MaxBackups:     cfg.MaxBackups,
+		Console:        cfg.Console,
+		RotateInterval: cfg.RotateInterval,
+		Async:          cfg.Async,
+		BufferSize:     cfg.BufferSize,
+		ErrorFilePath:  cfg.ErrorFilePath,
+		ErrorLevel:     errorLevel,
+		Format:         cfg.Format,
+	}
+}
+
 // 初始化存储系统
 func initStorage(cfg *config.Config) (*storage.Manager, error) {
 	var storageBackends []storage.StorageBackend
 
 	// 添加文件存储后端
 	if cfg.Storage.File.Enabled {
-		fileStorage, err := storage.NewFileStorage(cfg.Storage.File.Path)
+		var fileStorage storage.StorageBackend
+		var err error
+		// 根据格式选择文件存储实现
+		switch cfg.Storage.File.Format {
+		case "", "json":
+			fileStorage, err = storage.NewFileStorage(cfg.Storage.File.Path, cfg.Storage.File.Partition, cfg.Storage.File.Compress, cfg.Storage.File.Serializer, cfg.Storage.File.Fsync, storage.CompactionOptions{
+				Enabled:       cfg.Storage.File.Compaction.Enabled,
+				Interval:      cfg.Storage.File.Compaction.Interval,
+				KeepOriginals: cfg.Storage.File.Compaction.KeepOriginals,
+			})
+		case "csv":
+			fileStorage, err = storage.NewCSVStorage(cfg.Storage.File.Path)
+		case "jsonl":
+			fileStorage, err = storage.NewJSONLStorage(cfg.Storage.File.Path, cfg.Storage.File.MaxSize, cfg.Storage.File.MaxBackups)
+		default:
+			err = fmt.Errorf("不支持的文件格式: %s", cfg.Storage.File.Format)
+		}
 		if err != nil {
 			logger.Warn("初始化文件存储失败: %v", err)
 		} else {
@@ -57,7 +111,7 @@ func initStorage(cfg *config.Config) (*storage.Manager, error) {
 	// 添加数据库存储后端
 	if cfg.Storage.Database.Enabled {
 		// 初始化数据库存储
-		dbStorage, err := storage.NewDatabaseStorage(cfg.Storage.Database.Type, cfg.Storage.Database.DSN)
+		dbStorage, err := newDatabaseStorage(cfg.Storage.Database, cfg.Transformers)
 		if err != nil {
 			logger.Warn("初始化数据库存储失败: %v", err)
 		} else {
@@ -66,25 +120,266 @@ func initStorage(cfg *config.Config) (*storage.Manager, error) {
 		}
 	}
 
-	return storage.NewManager(storageBackends), nil
+	// 添加Elasticsearch存储后端
+	if cfg.Storage.Elasticsearch.Enabled {
+		esCfg := cfg.Storage.Elasticsearch
+		esStorage, err := storage.NewElasticStorage(storage.ElasticOptions{
+			URL:           esCfg.URL,
+			Username:      esCfg.Username,
+			Password:      esCfg.Password,
+			APIKey:        esCfg.APIKey,
+			Index:         esCfg.Index,
+			BatchSize:     esCfg.BatchSize,
+			FlushInterval: esCfg.FlushInterval,
+		})
+		if err != nil {
+			logger.Warn("初始化Elasticsearch存储失败: %v", err)
+		} else {
+			storageBackends = append(storageBackends, esStorage)
+			logger.Info("已启用Elasticsearch存储")
+		}
+	}
+
+	storageManager := storage.NewManager(storageBackends)
+	applyStoreOptions(storageManager, cfg)
+	return storageManager, nil
+}
+
+// 打开预写日志并重放上次运行遗留的数据，重放失败的数据只为失败的后端保留，在之后的检查点重试
+func initWAL(storageManager *storage.Manager, cfg config.WALConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	wal, err := storage.OpenWAL(cfg.Path, cfg.Sync, cfg.MaxSize)
+	if err != nil {
+		return err
+	}
+	storageManager.SetWAL(wal, cfg.CheckpointInterval)
+	if err := storageManager.ReplayWAL(); err != nil {
+		logger.Error("重放存储预写日志失败: %v", err)
+	}
+	return nil
+}
+
+// 设置默认存储模式、各设备类型的存储模式、并发存储和熔断
+func applyStoreOptions(storageManager *storage.Manager, cfg *config.Config) {
+	deviceModes := make(map[string]storage.StoreMode)
+	for deviceType, transformerCfg := range cfg.Transformers {
+		if transformerCfg.StoreMode != "" {
+			deviceModes[deviceType] = storage.StoreMode(transformerCfg.StoreMode)
+		}
+	}
+	storageManager.SetStoreModes(storage.StoreMode(cfg.Storage.Mode), deviceModes)
+	storageManager.SetConcurrentStore(cfg.Storage.Concurrent, cfg.Storage.Timeout)
+
+	threshold := 0
+	if breaker := cfg.Storage.CircuitBreaker; breaker.Enabled {
+		threshold = breaker.FailureThreshold
+		if threshold <= 0 {
+			threshold = storage.DefaultCircuitFailureThreshold
+		}
+	}
+	storageManager.SetCircuitBreaker(threshold, cfg.Storage.CircuitBreaker.Cooldown)
+}
+
+// 启动HTTP数据查询接口
+func startAPIServer(cfg *config.Config, storageManager *storage.Manager, transformerManager *transformer.Manager, mqttManager *mqtt.Manager) (*api.Server, error) {
+	if !cfg.API.Enabled {
+		return nil, nil
+	}
+
+	listen := cfg.API.Listen
+	if listen == "" {
+		listen = ":8080"
+	}
+
+	server := api.NewServer(listen, cfg.API.AdminToken, storageManager, transformerManager, mqttManager)
+	if err := server.Start(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// 启动调试服务（pprof/expvar），默认关闭
+func startDebugServer(cfg *config.Config) (*api.DebugServer, error) {
+	if !cfg.Debug.Enabled {
+		return nil, nil
+	}
+
+	listen := cfg.Debug.Listen
+	if listen == "" {
+		listen = "localhost:6060"
+	}
+
+	server := api.NewDebugServer(listen)
+	if err := server.Start(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// 启动Prometheus指标服务，默认关闭
+func startMetricsServer(cfg *config.Config) (*api.MetricsServer, error) {
+	if !cfg.Metrics.Enabled {
+		return nil, nil
+	}
+
+	listen := cfg.Metrics.Listen
+	if listen == "" {
+		listen = ":2112"
+	}
+
+	server := api.NewMetricsServer(listen)
+	if err := server.Start(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// 定期输出各设备类型的转换耗时统计，interval 为0时不输出，修改间隔需要重启。返回的函数停止输出
+func logTimingSummary(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			stats := metrics.Timings(metrics.TransformDuration)
+			deviceTypes := make([]string, 0, len(stats))
+			for deviceType := range stats {
+				deviceTypes = append(deviceTypes, deviceType)
+			}
+			sort.Strings(deviceTypes)
+
+			for _, deviceType := range deviceTypes {
+				s := stats[deviceType]
+				logger.Info("设备类型 %s 的转换耗时: 次数 %d, 最小 %v, 平均 %v, 最大 %v, P95 %v", deviceType, s.Count, s.Min, s.Avg, s.Max, s.P95)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// 把SQL数据库后端的连接池统计作为指标发布，每次读取指标时采样，重新加载后的数据库后端也会被统计
+func registerDatabaseGauges(storageManager *storage.Manager) {
+	metrics.RegisterGauges("database", func() []metrics.Gauge {
+		var gauges []metrics.Gauge
+		for backend, stats := range storageManager.DatabaseStats() {
+			labels := map[string]string{"backend": backend}
+			gauges = append(gauges,
+				metrics.Gauge{Name: "db_max_open_connections", Labels: labels, Value: float64(stats.MaxOpenConnections)},
+				metrics.Gauge{Name: "db_open_connections", Labels: labels, Value: float64(stats.OpenConnections)},
+				metrics.Gauge{Name: "db_in_use_connections", Labels: labels, Value: float64(stats.InUse)},
+				metrics.Gauge{Name: "db_idle_connections", Labels: labels, Value: float64(stats.Idle)},
+				metrics.Gauge{Name: "db_wait_count", Labels: labels, Value: float64(stats.WaitCount)},
+				metrics.Gauge{Name: "db_wait_duration_seconds", Labels: labels, Value: stats.WaitDuration.Seconds()},
+				metrics.Gauge{Name: "db_max_idle_closed", Labels: labels, Value: float64(stats.MaxIdleClosed)},
+				metrics.Gauge{Name: "db_max_lifetime_closed", Labels: labels, Value: float64(stats.MaxLifetimeClosed)},
+			)
+		}
+		return gauges
+	})
+}
+
+// 根据数据库配置创建数据库存储，未配置dsn时根据结构化的连接配置生成
+// transformers 决定各设备类型的写入方式
+func newDatabaseStorage(cfg config.DatabaseStorageConfig, transformers map[string]config.Transformer) (storage.DatabaseStorage, error) {
+	dsn := cfg.DSN
+	if dsn == "" {
+		params, err := url.ParseQuery(cfg.Params)
+		if err != nil {
+			return nil, fmt.Errorf("解析数据库参数失败: %v", err)
+		}
+		dsn, err = storage.BuildDSN(cfg.Type, storage.DSNOptions{
+			Host:     cfg.Host,
+			Port:     cfg.Port,
+			User:     cfg.User,
+			Password: cfg.Password,
+			DBName:   cfg.DBName,
+			SSLMode:  cfg.SSLMode,
+			CAFile:   cfg.CAFile,
+			CertFile: cfg.CertFile,
+			KeyFile:  cfg.KeyFile,
+			Params:   params,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return storage.NewDatabaseStorage(cfg.Type, dsn, databaseOptions(cfg, transformers))
+}
+
+// 根据数据库配置和各设备类型的写入方式构建存储选项
+func databaseOptions(cfg config.DatabaseStorageConfig, transformers map[string]config.Transformer) storage.DatabaseOptions {
+	var upserts map[string]bool
+	for deviceType, transformerCfg := range transformers {
+		if transformerCfg.InsertMode == storage.InsertModeUpsert {
+			if upserts == nil {
+				upserts = make(map[string]bool)
+			}
+			upserts[deviceType] = true
+		}
+	}
+
+	// 宽表按声明的属性预先建列，列名为小写的属性名
+	var wide map[string]map[string]string
+	for deviceType, transformerCfg := range transformers {
+		if transformerCfg.TableLayout != storage.TableLayoutWide {
+			continue
+		}
+		if wide == nil {
+			wide = make(map[string]map[string]string)
+		}
+		declared := make(map[string]string, len(transformerCfg.Attributes))
+		for _, attr := range transformerCfg.Attributes {
+			declared[strings.ToLower(attr.Name)] = attr.Type
+		}
+		wide[deviceType] = declared
+	}
+
+	return storage.DatabaseOptions{
+		MaxOpenConns:      cfg.MaxOpenConns,
+		MaxIdleConns:      cfg.MaxIdleConns,
+		ConnMaxLifetime:   cfg.ConnMaxLifetime,
+		BatchSize:         cfg.BatchSize,
+		FlushInterval:     cfg.FlushInterval,
+		TablePrefix:       cfg.TablePrefix,
+		UpsertDeviceTypes: upserts,
+		WideDeviceTypes:   wide,
+		RetentionDays:     cfg.RetentionDays,
+		RetentionInterval: cfg.RetentionInterval,
+		ErrorLog:          cfg.ErrorLog,
+	}
 }
 
 // 监听配置文件变化
-func watchConfigChanges(configPath string, transformerManager *transformer.Manager, storageManager *storage.Manager) error {
-	err := config.WatchConfig(configPath, func(newCfg *config.Config) error {
+func watchConfigChanges(configPaths []string, transformerManager *transformer.Manager, storageManager *storage.Manager, mqttManager *mqtt.Manager) error {
+	err := config.WatchConfig(configPaths, func(newCfg *config.Config) error {
 		logger.Info("正在应用新的配置...")
 
 		// 检查并更新日志配置
-		if err := logger.InitFromConfig(
-			newCfg.Logger.Level,
-			newCfg.Logger.FilePath,
-			newCfg.Logger.MaxSize,
-			newCfg.Logger.MaxBackups,
-			newCfg.Logger.Console,
-		); err != nil {
+		if err := logger.InitFromConfig(newCfg.Logger.Level, loggerConfig(newCfg.Logger)); err != nil {
 			logger.Warn("重新加载日志配置失败: %v", err)
 		} else {
-			logger.Info("已重新加载日志配置")
+			logger.Info("已应用日志配置，日志级别: %s", newCfg.Logger.Level)
+		}
+
+		// 更新脚本共享的查找表
+		transformerManager.SetLookups(newCfg.Lookups)
+		transformerManager.SetMinQuality(newCfg.MinQuality)
+		if err := transformerManager.SetUnitNormalization(newCfg.UnitNormalization); err != nil {
+			logger.Warn("重新加载单位换算规则失败，继续使用原有规则: %v", err)
 		}
 
 		// 检查并更新转换器
@@ -95,26 +390,24 @@ func watchConfigChanges(configPath string, transformerManager *transformer.Manag
 			}
 		}
 
+		// 更新存储模式
+		applyStoreOptions(storageManager, newCfg)
+
 		// 检查并更新数据库存储配置
 		if newCfg.Storage.Database.Enabled {
-			// 先移除同类型的旧数据库后端
-			storageManager.RemoveBackendByType(newCfg.Storage.Database.Type)
-
-			// 初始化新的数据库连接
-			dbStorage, err := storage.NewDatabaseStorage(newCfg.Storage.Database.Type, newCfg.Storage.Database.DSN)
+			// 先建立新的数据库连接，成功后再替换旧的数据库后端，失败时保留原有后端
+			dbStorage, err := newDatabaseStorage(newCfg.Storage.Database, newCfg.Transformers)
 			if err != nil {
-				logger.Warn("重新加载数据库存储失败: %v", err)
+				logger.Error("重新加载%s数据库存储失败，继续使用原有的数据库存储: %v", newCfg.Storage.Database.Type, err)
 			} else {
-				// 添加新的数据库后端
-				storageManager.AddBackend(dbStorage)
+				storageManager.ReplaceDatabaseBackend(dbStorage)
 				logger.Info("已重新加载%s数据库存储", newCfg.Storage.Database.Type)
 			}
 		}
 
-		// 如果MQTT配置发生变化，可以在这里处理
-		// 例如重新连接MQTT服务器或重新订阅主题
-		// 这里简化处理，仅打印日志
-		logger.Info("MQTT配置更新将在服务重启后生效")
+		// MQTT连接配置在下次重新连接时生效，例如轮换凭据后调用 POST /admin/reconnect
+		mqttManager.SetConfig(newCfg.MQTT)
+		logger.Info("MQTT连接配置将在重新连接后生效，其他MQTT配置更新将在服务重启后生效")
 
 		return nil
 	})
@@ -129,6 +422,59 @@ func watchConfigChanges(configPath string, transformerManager *transformer.Manag
 	return nil
 }
 
+// 监听脚本目录，新增、修改和删除脚本后重新扫描
+func watchTransformersDir(dir string, transformerManager *transformer.Manager) {
+	if dir == "" {
+		return
+	}
+
+	err := config.WatchDir(dir, ".js", func() {
+		if err := transformerManager.Rescan(); err != nil {
+			logger.Warn("重新扫描脚本目录失败: %v", err)
+		}
+	})
+	if err != nil {
+		logger.Warn("监听脚本目录 %s 失败: %v", dir, err)
+		// 不致命，继续运行
+	} else {
+		logger.Info("已启动脚本目录监听: %s", dir)
+	}
+}
+
+// 加载设备注册表，path 为空时不补充元数据
+func loadRegistry(path string, transformerManager *transformer.Manager) error {
+	if path == "" {
+		return nil
+	}
+
+	entries, err := transformer.LoadRegistry(path)
+	if err != nil {
+		return err
+	}
+	transformerManager.SetRegistry(entries)
+	logger.Info("已加载设备注册表 %s，共 %d 个设备", path, len(entries))
+	return nil
+}
+
+// 监听设备注册表所在目录，文件变化后重新加载，加载失败时保留原有注册表
+func watchRegistry(path string, transformerManager *transformer.Manager) {
+	if path == "" {
+		return
+	}
+
+	err := config.WatchDir(filepath.Dir(path), filepath.Ext(path), func() {
+		if err := loadRegistry(path, transformerManager); err != nil {
+			logger.Warn("重新加载设备注册表失败，继续使用原有的注册表: %v", err)
+		}
+	})
+	if err != nil {
+		logger.Warn("监听设备注册表 %s 失败: %v", path, err)
+		// 不致命，继续运行
+	} else {
+		logger.Info("已启动设备注册表监听: %s", path)
+	}
+}
+
 // 等待退出信号
 func waitForExitSignal() os.Signal {
 	sigChan := make(chan os.Signal, 1)
@@ -136,27 +482,139 @@ func waitForExitSignal() os.Signal {
 	return <-sigChan
 }
 
+// 校验模式相关的命令行参数
+var (
+	validateMode = flag.Bool("validate", false, "只校验配置并用示例数据试运行转换脚本，不连接MQTT和数据库")
+	samplesDir   = flag.String("samples", "samples", "校验模式使用的示例数据目录，文件名为 {device_type}.json")
+)
+
+// 重放模式相关的命令行参数
+var (
+	replayDir  = flag.String("replay", "", "重放目录中的死信文件和保存了原始数据的存储记录，用当前转换器重新转换并存储后退出")
+	replayType = flag.String("replay-type", "", "只重放指定设备类型的消息")
+	replayFrom = flag.String("replay-from", "", "只重放该时间之后接收的消息，RFC3339或YYYY-MM-DD格式")
+	replayTo   = flag.String("replay-to", "", "只重放该时间之前接收的消息，RFC3339或YYYY-MM-DD格式")
+)
+
+// 自检相关的命令行参数
+var (
+	selfTestMode    = flag.Bool("selftest", false, "启动后发布一条自检消息，确认其经过转换和存储，失败时退出")
+	selfTestTopic   = flag.String("selftest-topic", "devices/selftest/data-trans", "自检消息的主题，需被订阅的主题覆盖并解析为设备类型 selftest")
+	selfTestTimeout = flag.Duration("selftest-timeout", 10*time.Second, "等待自检消息处理完成的最长时间")
+)
+
+// 为自检设备类型加载恒等转换器，配置中已有该设备类型的转换器时使用配置的转换器
+func prepareSelfTest(transformerManager *transformer.Manager) error {
+	if transformerManager.HasTransformer(mqtt.SelfTestDeviceType) {
+		return nil
+	}
+	return transformerManager.ReloadTransformer(mqtt.SelfTestDeviceType, config.Transformer{Engine: transformer.EnginePassthrough})
+}
+
+// 发布自检消息并等待其经过转换和存储，用于部署后立即发现代理权限、订阅、脚本或存储的配置错误。
+// 任一存储后端写入失败时自检失败，与存储模式无关
+func runSelfTest(mqttManager *mqtt.Manager, storageManager *storage.Manager, topic string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := mqttManager.SelfTest(ctx, topic); err != nil {
+		return err
+	}
+	logger.Info("自检通过: 主题 %s 的消息已完成转换并存储到 %s，耗时 %v", topic, strings.Join(storageManager.BackendTypes(), ", "), time.Since(start))
+	return nil
+}
+
+// 解析配置文件路径，优先级：命令行参数 > 环境变量 > 默认值。
+// 多个路径用逗号分隔，后面的文件覆盖前面的文件
+func parseConfigPaths() []string {
+	defaultPath := "config.yaml"
+	if envPath := os.Getenv("DATATRANS_CONFIG"); envPath != "" {
+		defaultPath = envPath
+	}
+
+	configPath := flag.String("config", defaultPath, "配置文件或配置目录路径，多个路径用逗号分隔，后面的覆盖前面的（也可通过环境变量 DATATRANS_CONFIG 指定）")
+	flag.Parse()
+
+	var configPaths []string
+	for _, path := range strings.Split(*configPath, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			configPaths = append(configPaths, path)
+		}
+	}
+	return configPaths
+}
+
 func main() {
 	// 配置文件路径
-	configPath := "config.yaml"
+	configPaths := parseConfigPaths()
 
 	// 初始化配置
-	cfg, err := initConfig(configPath)
+	cfg, err := initConfig(configPaths)
 	if err != nil {
 		os.Exit(1)
 	}
 
+	// 校验模式：试运行转换脚本后退出
+	if *validateMode {
+		if !runValidate(cfg, *samplesDir) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 重放模式：重新处理保存的原始数据后退出
+	if *replayDir != "" {
+		initLogger(cfg)
+		ok := replayFromFlags(cfg)
+		logger.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// 初始化日志系统
 	initLogger(cfg)
 	logger.Info("数据转换服务正在启动...")
 	defer logger.Close()
 
+	// 启动调试服务
+	debugServer, err := startDebugServer(cfg)
+	if err != nil {
+		logger.Error("启动调试服务失败: %v", err)
+		os.Exit(1)
+	}
+
+	// 启动指标服务，按主题统计的消息数限制主题数量，修改需要重启
+	metrics.SetMaxTopics(cfg.Metrics.MaxTopics)
+	metricsServer, err := startMetricsServer(cfg)
+	if err != nil {
+		logger.Error("启动指标服务失败: %v", err)
+		os.Exit(1)
+	}
+
 	// 初始化转换器管理器
-	transformerManager, err := transformer.NewManager(cfg.Transformers)
+	transformerManager, err := transformer.NewManager(cfg.Transformers, cfg.TransformersDir, cfg.Lookups)
 	if err != nil {
 		logger.Error("初始化转换器管理器失败: %v", err)
 		os.Exit(1)
 	}
+	transformerManager.SetMinQuality(cfg.MinQuality)
+	if err := transformerManager.SetUnitNormalization(cfg.UnitNormalization); err != nil {
+		logger.Error("初始化单位换算规则失败: %v", err)
+		os.Exit(1)
+	}
+	if err := loadRegistry(cfg.Registry.Path, transformerManager); err != nil {
+		logger.Error("加载设备注册表失败: %v", err)
+		os.Exit(1)
+	}
+	if *selfTestMode {
+		if err := prepareSelfTest(transformerManager); err != nil {
+			logger.Error("加载自检转换器失败: %v", err)
+			os.Exit(1)
+		}
+	}
 
 	// 初始化存储系统
 	storageManager, err := initStorage(cfg)
@@ -164,7 +622,15 @@ func main() {
 		logger.Error("初始化存储系统失败: %v", err)
 		os.Exit(1)
 	}
-	defer storageManager.Close()
+
+	// 发布数据库连接池统计
+	registerDatabaseGauges(storageManager)
+
+	// 启用预写日志，并在接收新数据前重新存储上次运行未确认的数据
+	if err := initWAL(storageManager, cfg.Storage.WAL); err != nil {
+		logger.Error("初始化存储预写日志失败: %v", err)
+		os.Exit(1)
+	}
 
 	// 初始化MQTT管理器
 	mqttManager, err := mqtt.NewManager(cfg, transformerManager, storageManager)
@@ -179,15 +645,84 @@ func main() {
 		os.Exit(1)
 	}
 
+	// 自检：确认消息能够经过代理、转换和存储
+	if *selfTestMode {
+		if err := runSelfTest(mqttManager, storageManager, *selfTestTopic, *selfTestTimeout); err != nil {
+			logger.Error("自检失败: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// 启动HTTP数据查询接口
+	apiServer, err := startAPIServer(cfg, storageManager, transformerManager, mqttManager)
+	if err != nil {
+		logger.Error("启动HTTP接口失败: %v", err)
+		os.Exit(1)
+	}
+
 	// 监听配置文件变化
-	watchConfigChanges(configPath, transformerManager, storageManager)
+	watchConfigChanges(configPaths, transformerManager, storageManager, mqttManager)
+
+	// 监听脚本目录变化
+	watchTransformersDir(cfg.TransformersDir, transformerManager)
+
+	// 监听设备注册表变化
+	watchRegistry(cfg.Registry.Path, transformerManager)
+
+	// 通过信号临时切换日志级别
+	watchLevelSignals()
+
+	// 通过信号暂停和恢复接收消息
+	watchPauseSignals(mqttManager)
+
+	// 定期输出转换耗时统计
+	stopTimingSummary := logTimingSummary(cfg.TimingLogInterval)
 
 	logger.Info("数据转换服务已启动，等待设备数据...")
 
 	// 等待退出信号
 	_ = waitForExitSignal()
 
-	// 停止MQTT服务
-	mqttManager.Stop()
+	// 停止输出转换耗时统计
+	stopTimingSummary()
+
+	// 停止HTTP接口
+	if apiServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := apiServer.Stop(ctx); err != nil {
+			logger.Warn("停止HTTP接口失败: %v", err)
+		}
+		cancel()
+	}
+
+	// 停止MQTT服务，等待处理中的消息完成
+	drainTimeout := cfg.MQTT.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = 10 * time.Second
+	}
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	mqttManager.Stop(drainCtx)
+	cancelDrain()
+
+	// 刷新存储缓冲区并关闭存储连接
+	storageManager.Close()
+
+	// 停止调试服务
+	if debugServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := debugServer.Stop(ctx); err != nil {
+			logger.Warn("停止调试服务失败: %v", err)
+		}
+		cancel()
+	}
+
+	// 停止指标服务
+	if metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := metricsServer.Stop(ctx); err != nil {
+			logger.Warn("停止指标服务失败: %v", err)
+		}
+		cancel()
+	}
 	logger.Info("服务已安全停止")
 }
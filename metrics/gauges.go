@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+)
+
+// Gauge is a sampled value, e.g. the open connections of a storage backend
+type Gauge struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// GaugeFunc returns the current values of a gauge source, it is called on every read
+type GaugeFunc func() []Gauge
+
+var (
+	// gaugeSources holds the registered gauge sources by name
+	gaugeSources = make(map[string]GaugeFunc)
+	gaugesMutex  sync.RWMutex
+)
+
+func init() {
+	// gauges are sampled when read, published through expvar as "gauges"
+	expvar.Publish("gauges", expvar.Func(func() interface{} { return Gauges() }))
+}
+
+// RegisterGauges registers the gauge source name, replacing an existing one.
+// The source is sampled on every read, so it reports the state at that time
+func RegisterGauges(name string, f GaugeFunc) {
+	gaugesMutex.Lock()
+	defer gaugesMutex.Unlock()
+
+	gaugeSources[name] = f
+}
+
+// Gauges samples all gauge sources, sorted by gauge name
+func Gauges() []Gauge {
+	gaugesMutex.RLock()
+	sources := make([]GaugeFunc, 0, len(gaugeSources))
+	for _, f := range gaugeSources {
+		sources = append(sources, f)
+	}
+	gaugesMutex.RUnlock()
+
+	var gauges []Gauge
+	for _, f := range sources {
+		gauges = append(gauges, f()...)
+	}
+	sort.SliceStable(gauges, func(i, j int) bool { return gauges[i].Name < gauges[j].Name })
+	return gauges
+}
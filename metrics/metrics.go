@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"expvar"
+)
+
+// counters holds all service counters, published through expvar as "counters"
+var counters = expvar.NewMap("counters")
+
+// Names of the counters maintained by the service
+const (
+	// MessagesReceived counts messages received from the broker
+	MessagesReceived = "messages_received"
+	// MessagesProcessed counts messages that went through the processing pipeline
+	MessagesProcessed = "messages_processed"
+	// MessagesDroppedQueueFull counts messages dropped because the worker queue was full
+	MessagesDroppedQueueFull = "messages_dropped_queue_full"
+	// MessagesDroppedPaused counts QoS 0 messages dropped while ingestion was paused because too many were held
+	MessagesDroppedPaused = "messages_dropped_paused"
+	// SubscribeFailures counts failed attempts to subscribe to a topic, failed subscriptions are retried
+	SubscribeFailures = "subscribe_failures"
+	// StoreFailures counts messages whose all-or-nothing store failed
+	StoreFailures = "store_failures"
+	// OversizeDropped counts messages dropped because their payload exceeded the maximum payload size
+	OversizeDropped = "oversize_dropped"
+	// TopicFiltered counts messages dropped because their topic is denied or not allowed
+	TopicFiltered = "topic_filtered"
+	// DuplicatesDropped counts messages skipped by deduplication
+	DuplicatesDropped = "duplicates_dropped"
+	// SchemaRejected counts payloads rejected by the input schema of their device type
+	SchemaRejected = "schema_rejected"
+	// InvalidPayloads counts payloads of json codec device types that are not complete JSON
+	InvalidPayloads = "invalid_payloads"
+	// RateLimited counts messages dropped by the per-device rate limiter
+	RateLimited = "rate_limited"
+	// LowQualityDropped counts records skipped because all their attributes were below min_quality
+	LowQualityDropped = "low_quality_dropped"
+	// RulesMatched counts records that matched a routing rule, once per matching rule
+	RulesMatched = "rules_matched"
+	// CircuitOpenSkips counts backend stores skipped because the circuit of the backend was open
+	CircuitOpenSkips = "circuit_open_skips"
+	// WALEntriesDropped counts WAL entries that failed on some backends and were dropped because the kept segments exceeded their maximum size
+	WALEntriesDropped = "wal_entries_dropped"
+)
+
+// Inc increments the counter with the given name by one
+func Inc(name string) {
+	counters.Add(name, 1)
+}
+
+// Add adds delta to the counter with the given name
+func Add(name string, delta int64) {
+	counters.Add(name, delta)
+}
+
+// Get returns the current value of the counter with the given name
+func Get(name string) int64 {
+	if v, ok := counters.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// PrometheusContentType is the content type of the Prometheus text exposition format
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// labelEscaper escapes label values as required by the text exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes the counters in the Prometheus text exposition format, each counter
+// as {name}_total, the messages received per topic as messages_total{topic="..."} and the gauges
+func WritePrometheus(w io.Writer) error {
+	out := bufio.NewWriter(w)
+
+	var names []string
+	values := make(map[string]int64)
+	counters.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			names = append(names, kv.Key)
+			values[kv.Key] = v.Value()
+		}
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "# TYPE %s_total counter\n%s_total %d\n", name, name, values[name])
+	}
+
+	topics := TopicCounts()
+	keys := make([]string, 0, len(topics))
+	for topic := range topics {
+		keys = append(keys, topic)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(out, "# HELP messages_total Messages received per topic, topics beyond the limit are counted as %q\n", OtherTopic)
+	fmt.Fprintf(out, "# TYPE messages_total counter\n")
+	for _, topic := range keys {
+		fmt.Fprintf(out, "messages_total{topic=\"%s\"} %d\n", labelEscaper.Replace(topic), topics[topic])
+	}
+
+	previous := ""
+	for _, gauge := range Gauges() {
+		if gauge.Name != previous {
+			fmt.Fprintf(out, "# TYPE %s gauge\n", gauge.Name)
+			previous = gauge.Name
+		}
+		fmt.Fprintf(out, "%s%s %g\n", gauge.Name, formatLabels(gauge.Labels), gauge.Value)
+	}
+
+	return out.Flush()
+}
+
+// formatLabels formats labels as {name="value",...} sorted by name, empty without labels
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
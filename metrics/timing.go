@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+)
+
+// timings holds duration statistics by timing name and key, published through expvar as "timings"
+var timings = expvar.NewMap("timings")
+
+var (
+	// timingsMutex serializes creating the statistics of a new name or key
+	timingsMutex sync.Mutex
+	// timingKeys is the number of keys timed separately per timing name
+	timingKeys = make(map[string]int)
+)
+
+// MaxTimingKeys is the number of keys timed separately per timing name, durations of further keys
+// are observed under OtherTimingKey, so device types taken from arbitrary topics cannot grow the map without bound
+const MaxTimingKeys = 1000
+
+// OtherTimingKey is the key durations of keys beyond MaxTimingKeys are observed under
+const OtherTimingKey = "other"
+
+// Names of the timings maintained by the service
+const (
+	// TransformDuration is the duration of the transform engine per device type
+	TransformDuration = "transform_duration"
+)
+
+// timingWindow is the number of most recent durations the percentile is computed from
+const timingWindow = 1024
+
+// TimingStats summarizes the durations observed for a key, Min, Avg and Max cover all
+// observations and P95 the most recent ones
+type TimingStats struct {
+	Count int64
+	Min   time.Duration
+	Avg   time.Duration
+	Max   time.Duration
+	P95   time.Duration
+}
+
+// timing collects the durations of one key, it implements expvar.Var
+type timing struct {
+	mutex sync.Mutex
+	count int64
+	sum   time.Duration
+	min   time.Duration
+	max   time.Duration
+	// recent is a ring buffer of the last timingWindow durations, next is the slot written next
+	recent []time.Duration
+	next   int
+}
+
+// Observe records duration d of the timing name for key, e.g. a device type
+func Observe(name string, key string, d time.Duration) {
+	timingFor(name, key).observe(d)
+}
+
+// Timings returns the statistics of the timing name by key
+func Timings(name string) map[string]TimingStats {
+	stats := make(map[string]TimingStats)
+	group, ok := timings.Get(name).(*expvar.Map)
+	if !ok {
+		return stats
+	}
+	group.Do(func(kv expvar.KeyValue) {
+		if t, ok := kv.Value.(*timing); ok {
+			stats[kv.Key] = t.stats()
+		}
+	})
+	return stats
+}
+
+// timingFor returns the statistics of name and key, creating them on first use. Once MaxTimingKeys
+// keys are timed, the statistics of OtherTimingKey are returned for new keys
+func timingFor(name string, key string) *timing {
+	if group, ok := timings.Get(name).(*expvar.Map); ok {
+		if t, ok := group.Get(key).(*timing); ok {
+			return t
+		}
+	}
+
+	timingsMutex.Lock()
+	defer timingsMutex.Unlock()
+
+	group, ok := timings.Get(name).(*expvar.Map)
+	if !ok {
+		group = new(expvar.Map)
+		timings.Set(name, group)
+	}
+	t, ok := group.Get(key).(*timing)
+	if ok {
+		return t
+	}
+	if timingKeys[name] >= MaxTimingKeys {
+		key = OtherTimingKey
+		if t, ok := group.Get(key).(*timing); ok {
+			return t
+		}
+	} else {
+		timingKeys[name]++
+	}
+	t = &timing{recent: make([]time.Duration, 0, timingWindow)}
+	group.Set(key, t)
+	return t
+}
+
+// observe records one duration
+func (t *timing) observe(d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.count == 0 || d < t.min {
+		t.min = d
+	}
+	if d > t.max {
+		t.max = d
+	}
+	t.count++
+	t.sum += d
+
+	if len(t.recent) < timingWindow {
+		t.recent = append(t.recent, d)
+	} else {
+		t.recent[t.next] = d
+	}
+	t.next = (t.next + 1) % timingWindow
+}
+
+// stats summarizes the recorded durations
+func (t *timing) stats() TimingStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.count == 0 {
+		return TimingStats{}
+	}
+
+	recent := append([]time.Duration(nil), t.recent...)
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	return TimingStats{
+		Count: t.count,
+		Min:   t.min,
+		Avg:   t.sum / time.Duration(t.count),
+		Max:   t.max,
+		P95:   recent[(len(recent)*95+99)/100-1],
+	}
+}
+
+// String implements expvar.Var, durations are in milliseconds
+func (t *timing) String() string {
+	stats := t.stats()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	out, _ := json.Marshal(map[string]interface{}{
+		"count":  stats.Count,
+		"min_ms": ms(stats.Min),
+		"avg_ms": ms(stats.Avg),
+		"max_ms": ms(stats.Max),
+		"p95_ms": ms(stats.P95),
+	})
+	return string(out)
+}
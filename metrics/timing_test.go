@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestObserveCapsKeys(t *testing.T) {
+	const name = "test_capped_duration"
+	for i := 0; i < MaxTimingKeys+10; i++ {
+		Observe(name, fmt.Sprintf("type%d", i), time.Millisecond)
+	}
+	// Keys timed before the limit was reached keep their statistics
+	Observe(name, "type0", time.Millisecond)
+
+	stats := Timings(name)
+	if len(stats) != MaxTimingKeys+1 {
+		t.Fatalf("%d keys timed, want %d and %q", len(stats), MaxTimingKeys, OtherTimingKey)
+	}
+	if got := stats[OtherTimingKey].Count; got != 10 {
+		t.Errorf("%s count = %d, want 10", OtherTimingKey, got)
+	}
+	if got := stats["type0"].Count; got != 2 {
+		t.Errorf("type0 count = %d, want 2", got)
+	}
+}
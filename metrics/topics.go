@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"expvar"
+	"sync"
+)
+
+// topicMessages holds the number of messages received per topic, published through expvar as "topic_messages"
+var topicMessages = expvar.NewMap("topic_messages")
+
+// DefaultMaxTopics is the number of topics counted separately when no limit is configured
+const DefaultMaxTopics = 1000
+
+// OtherTopic is the topic label messages of topics beyond the limit are counted under. It contains
+// a wildcard, which MQTT does not allow in the topic of a message, so it never clashes with a real topic
+const OtherTopic = "#other"
+
+var (
+	// maxTopics is the number of topics counted separately, topicCount the number counted so far
+	maxTopics  = DefaultMaxTopics
+	topicCount int
+	topicMutex sync.Mutex
+)
+
+// SetMaxTopics limits the number of topics counted separately, messages of further topics are
+// counted under OtherTopic. Zero selects DefaultMaxTopics. Topics already counted keep their counter
+func SetMaxTopics(max int) {
+	if max <= 0 {
+		max = DefaultMaxTopics
+	}
+
+	topicMutex.Lock()
+	defer topicMutex.Unlock()
+
+	maxTopics = max
+}
+
+// IncTopic increments the message counter of topic by one
+func IncTopic(topic string) {
+	if topicMessages.Get(topic) != nil {
+		topicMessages.Add(topic, 1)
+		return
+	}
+
+	topicMutex.Lock()
+	defer topicMutex.Unlock()
+
+	// Another message of the topic may have added it meanwhile
+	if topicMessages.Get(topic) == nil {
+		if topicCount >= maxTopics {
+			topicMessages.Add(OtherTopic, 1)
+			return
+		}
+		topicCount++
+	}
+	topicMessages.Add(topic, 1)
+}
+
+// TopicCounts returns the number of messages received per topic, including OtherTopic
+func TopicCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	topicMessages.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			counts[kv.Key] = v.Value()
+		}
+	})
+	return counts
+}
@@ -0,0 +1,22 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIncTopicLimitsTopics(t *testing.T) {
+	SetMaxTopics(2)
+	defer SetMaxTopics(0)
+
+	// A real topic named like the overflow label of older versions keeps its own series
+	for _, topic := range []string{"other", "devices/temperature/sensor1", "devices/temperature/sensor2", "devices/temperature/sensor3", "other"} {
+		IncTopic(topic)
+	}
+
+	counts := TopicCounts()
+	want := map[string]int64{"other": 2, "devices/temperature/sensor1": 1, OtherTopic: 2}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("topic counts = %v, want %v", counts, want)
+	}
+}
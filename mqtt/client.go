@@ -1,18 +1,25 @@
 package mqtt
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"regexp"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/deadletter"
 	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/metrics"
 	"github.com/eddielth/data-trans/storage"
 	"github.com/eddielth/data-trans/transformer"
 )
 
+// DefaultMaxPayloadSize is the largest payload in bytes processed when no maximum is configured
+const DefaultMaxPayloadSize = 1 << 20
+
 // Client represents an MQTT client
 type Client struct {
 	client  mqtt.Client
@@ -20,83 +27,583 @@ type Client struct {
 	handler MessageHandler
 }
 
-// MessageHandler is the callback function type for handling MQTT messages
-type MessageHandler func(topic string, payload []byte)
+// MessageHandler is the callback function type for handling MQTT messages,
+// properties holds the MQTT 5 user properties of the message and is nil for MQTT 3.1.1, qos is the QoS it was delivered with.
+// ack acknowledges a QoS 1 or 2 message to the broker, the clients do not acknowledge on their own
+type MessageHandler func(topic string, payload []byte, properties map[string]string, qos byte, ack func())
+
+// brokerClient is the connection to the MQTT broker, implemented for MQTT 3.1.1 and MQTT 5
+type brokerClient interface {
+	Connect() error
+	Subscribe(topic string) error
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+	Unsubscribe(topic string) error
+	Disconnect()
+}
 
 // Manager MQTT Manager
 type Manager struct {
-	client             *Client
+	config             config.MQTTConfig
+	client             brokerClient
 	transformerManager *transformer.Manager
 	storageManager     *storage.Manager
+	pool               *workerPool
+	heartbeat          *heartbeat
+	// subscriptions tracks the subscribed topics and retries failed subscriptions
+	subscriptions *subscriber
+	// publisher is the connected client used by message processing to publish, nil while disconnected.
+	// It has its own mutex so publishing never waits for a Reconnect or Stop holding clientMutex
+	publisher    brokerClient
+	publishMutex sync.RWMutex
+	// selfTests are the self-tests waiting for their message to be processed
+	selfTests *selfTests
+	// latest is the configuration applied by the next Reconnect
+	latest config.MQTTConfig
+	// clientMutex guards config, client, heartbeat, subscriptions and latest against a concurrent Reconnect
+	clientMutex sync.Mutex
+	// ctx is passed to message processing and cancelled when the drain on shutdown times out
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// inFlight tracks queued and processing messages so Stop can drain them
+	inFlight      sync.WaitGroup
+	inFlightCount atomic.Int64
+	stopping      bool
+	stopMutex     sync.Mutex
+	// gate holds dispatched messages while ingestion is paused
+	gate gate
 }
 
 // NewManager creates a new MQTT manager
 func NewManager(cfg *config.Config, transformerManager *transformer.Manager, storageManager *storage.Manager) (*Manager, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		config:             cfg.MQTT,
+		latest:             cfg.MQTT,
+		transformerManager: transformerManager,
+		storageManager:     storageManager,
+		selfTests:          newSelfTests(),
+		ctx:                ctx,
+		cancel:             cancel,
+	}
+
 	// Create message handler function
-	messageHandler := createMessageHandler(transformerManager, storageManager)
+	messageHandler, err := createMessageHandler(cfg, transformerManager, storageManager, m.Publish, m.selfTests)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// Process messages with a bounded number of workers
+	pool, err := newWorkerPool(cfg.MQTT.Workers, cfg.MQTT.QueueSize, cfg.MQTT.QueueFullPolicy, func(msg message) {
+		defer m.finishMessage()
+		messageHandler(m.ctx, msg.topic, msg.payload, msg.properties)
+		// Acknowledge only once processed, so the records are in the WAL or stored before the broker forgets the message
+		msg.ack()
+		metrics.Inc(metrics.MessagesProcessed)
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to initialize worker pool: %v", err)
+	}
+	m.pool = pool
+	// Held QoS 0 messages are bounded like the queue they are passed to on Resume
+	m.gate.limit = cfg.MQTT.QueueSize
+	if m.gate.limit <= 0 {
+		m.gate.limit = DefaultQueueSize
+	}
 
 	// Initialize MQTT client
-	mqttClient, err := newClient(cfg.MQTT, messageHandler)
+	mqttClient, err := m.newBrokerClient(cfg.MQTT)
 	if err != nil {
+		pool.stop()
+		cancel()
 		return nil, fmt.Errorf("failed to initialize MQTT client: %v", err)
 	}
+	m.client = mqttClient
 
-	return &Manager{
-		client:             mqttClient,
-		transformerManager: transformerManager,
-		storageManager:     storageManager,
-	}, nil
+	return m, nil
+}
+
+// newBrokerClient creates the client of the configured protocol version, messages are passed to dispatch
+func (m *Manager) newBrokerClient(cfg config.MQTTConfig) (brokerClient, error) {
+	if cfg.ProtocolVersion == ProtocolVersion5 {
+		return newV5Client(cfg, m.dispatch)
+	}
+	return newClient(cfg, m.dispatch)
+}
+
+// dispatch queues a received message for the worker pool, which acknowledges it once processed.
+// New messages are dropped unacknowledged once stopping, so the broker delivers them again to the session.
+// While paused the message is held until resumed, it counts as in flight so Stop drains it
+func (m *Manager) dispatch(topic string, payload []byte, properties map[string]string, qos byte, ack func()) {
+	m.stopMutex.Lock()
+	if m.stopping {
+		m.stopMutex.Unlock()
+		logger.Warn("service is stopping, dropped message from topic %s without acknowledging it", topic)
+		return
+	}
+	m.inFlight.Add(1)
+	m.stopMutex.Unlock()
+	m.inFlightCount.Add(1)
+	metrics.Inc(metrics.MessagesReceived)
+	metrics.IncTopic(topic)
+
+	msg := message{topic: topic, payload: payload, properties: properties, qos: qos, ack: ack}
+	held, full := m.gate.hold(msg)
+	if held {
+		return
+	}
+	if full {
+		ack()
+		m.finishMessage()
+		metrics.Inc(metrics.MessagesDroppedPaused)
+		logger.Warn("ingestion is paused and %d messages are held, dropped QoS 0 message from topic %s", m.gate.limit, topic)
+		return
+	}
+	m.submit(msg)
+}
+
+// submit queues a message for the worker pool, a message dropped because the queue is full is acknowledged
+func (m *Manager) submit(msg message) {
+	if !m.pool.submit(msg) {
+		msg.ack()
+		m.finishMessage()
+		metrics.Inc(metrics.MessagesDroppedQueueFull)
+		logger.Debug("worker queue is full, dropped message from topic %s", msg.topic)
+	}
+}
+
+// finishMessage marks an in-flight message as done
+func (m *Manager) finishMessage() {
+	m.inFlightCount.Add(-1)
+	m.inFlight.Done()
 }
 
 // Start starts the MQTT service
 func (m *Manager) Start() error {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	return m.start()
+}
+
+// start connects to the broker, subscribes to the configured topics and starts the heartbeat
+func (m *Manager) start() error {
 	// Connect to MQTT broker
 	if err := m.client.Connect(); err != nil {
 		return fmt.Errorf("failed to connect to MQTT broker: %v", err)
 	}
 
-	// Subscribe to configured topics
-	for _, topic := range m.client.config.Topics {
-		if err := m.client.Subscribe(topic); err != nil {
-			logger.Warn("failed to subscribe to topic %s: %v", topic, err)
+	m.setPublisher(m.client)
+
+	// Subscribe to configured topics once each, failed subscriptions are retried in the background
+	m.subscriptions = startSubscriber(m.client, uniqueTopics(m.config.Topics))
+
+	// Publish heartbeats
+	if m.config.Heartbeat.Enabled {
+		m.heartbeat = startHeartbeat(m.client, m.config.Heartbeat, m.storageManager)
+	}
+
+	return nil
+}
+
+// setPublisher replaces the client used by message processing to publish
+func (m *Manager) setPublisher(client brokerClient) {
+	m.publishMutex.Lock()
+	defer m.publishMutex.Unlock()
+
+	m.publisher = client
+}
+
+// Publish publishes payload with the connected client, e.g. records matching a routing rule
+// or self-test messages
+func (m *Manager) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	m.publishMutex.RLock()
+	defer m.publishMutex.RUnlock()
+
+	if m.publisher == nil {
+		return fmt.Errorf("not connected to the MQTT broker")
+	}
+	return m.publisher.Publish(topic, qos, retained, payload)
+}
+
+// SubscribedTopics returns the configured topics whose subscription succeeded
+func (m *Manager) SubscribedTopics() []string {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	if m.subscriptions == nil {
+		return nil
+	}
+	return m.subscriptions.topics()
+}
+
+// SetConfig stores a reloaded configuration, its connection settings and topics are applied by the next Reconnect.
+// Settings of the message processing such as workers and topic_regex still require a restart
+func (m *Manager) SetConfig(cfg config.MQTTConfig) {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	m.latest = cfg
+}
+
+// Reconnect disconnects from the broker and connects again with the latest configuration, e.g. after
+// rotating credentials, then subscribes to its topics. Messages keep being processed meanwhile and
+// paused ingestion is resumed, so held messages are processed while their connection is still up.
+// When the new connection fails, the previous client is connected again and the error is returned
+func (m *Manager) Reconnect() error {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	m.stopMutex.Lock()
+	stopping := m.stopping
+	m.stopMutex.Unlock()
+	if stopping {
+		return fmt.Errorf("service is stopping")
+	}
+
+	// Create the new client first, invalid settings keep the current connection
+	newClient, err := m.newBrokerClient(m.latest)
+	if err != nil {
+		return fmt.Errorf("failed to initialize MQTT client: %v", err)
+	}
+
+	logger.Info("reconnecting to MQTT broker %s", m.latest.Broker)
+	if m.Resume() {
+		logger.Info("ingestion resumed for the reconnect")
+	}
+	m.disconnect()
+
+	previousClient, previousConfig := m.client, m.config
+	m.client, m.config = newClient, m.latest
+	if err := m.start(); err != nil {
+		// The new client may still be retrying in the background
+		newClient.Disconnect()
+		m.client, m.config = previousClient, previousConfig
+		if restoreErr := m.start(); restoreErr != nil {
+			logger.Error("failed to restore the previous MQTT connection: %v", restoreErr)
 		}
+		return err
 	}
 
+	logger.Info("reconnected to MQTT broker %s", m.config.Broker)
 	return nil
 }
 
-// Stop stops the MQTT service
-func (m *Manager) Stop() {
+// disconnect stops the heartbeat, unsubscribes from the subscribed topics and disconnects from the broker
+func (m *Manager) disconnect() {
+	if m.heartbeat != nil {
+		m.heartbeat.stop()
+		m.heartbeat = nil
+	}
+
+	m.stopSubscriptions()
+
+	m.setPublisher(nil)
 	m.client.Disconnect()
 }
 
-// createMessageHandler creates an MQTT message handler function
-func createMessageHandler(transformerManager *transformer.Manager, storageManager *storage.Manager) MessageHandler {
-	return func(topic string, payload []byte) {
+// stopSubscriptions stops retrying failed subscriptions and unsubscribes from the subscribed topics
+func (m *Manager) stopSubscriptions() {
+	if m.subscriptions != nil {
+		m.subscriptions.stop()
+		m.subscriptions = nil
+	}
+}
+
+// Stop stops the MQTT service gracefully: it unsubscribes from all topics, waits until
+// in-flight messages are processed or ctx is done, then disconnects from the broker
+func (m *Manager) Stop(ctx context.Context) {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	if m.heartbeat != nil {
+		m.heartbeat.stop()
+		m.heartbeat = nil
+	}
+
+	// Release held messages so they are drained with the others
+	m.Resume()
+
+	// Stop accepting new messages
+	m.stopSubscriptions()
+
+	m.stopMutex.Lock()
+	m.stopping = true
+	m.stopMutex.Unlock()
+
+	// Wait for in-flight messages
+	pending := m.inFlightCount.Load()
+	done := make(chan struct{})
+	go func() {
+		m.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info("drained %d in-flight messages", pending)
+	case <-ctx.Done():
+		remaining := m.inFlightCount.Load()
+		logger.Warn("drain timed out, drained %d of %d in-flight messages", pending-remaining, pending)
+		// Abort stores still in progress
+		m.cancel()
+	}
+
+	// Announce the clean shutdown, the broker only sends the will on unexpected disconnects
+	if cfg := m.config; cfg.PublishWillOnStop && cfg.WillTopic != "" {
+		if err := m.client.Publish(cfg.WillTopic, cfg.WillQoS, cfg.WillRetained, []byte(cfg.WillPayload)); err != nil {
+			logger.Warn("failed to publish offline status to %s: %v", cfg.WillTopic, err)
+		}
+	}
+
+	m.setPublisher(nil)
+	m.client.Disconnect()
+
+	// Workers finish in the background if the drain timed out
+	go func() {
+		m.pool.stop()
+		m.cancel()
+	}()
+}
+
+// createMessageHandler creates the function processing a received message, ctx is passed to the storage backends.
+// publish is used to publish records matching a routing rule, selfTests receive the outcome of self-test messages
+func createMessageHandler(cfg *config.Config, transformerManager *transformer.Manager, storageManager *storage.Manager, publish publishFunc, selfTests *selfTests) (func(ctx context.Context, topic string, payload []byte, properties map[string]string), error) {
+	topics, err := configuredTopicParser(cfg.MQTT)
+	if err != nil {
+		return nil, err
+	}
+
+	var dedup *deduplicator
+	if cfg.Dedup.Enabled {
+		dedup = newDeduplicator(cfg.Dedup)
+	}
+
+	var limiter *rateLimiter
+	if cfg.RateLimit.Enabled {
+		limiter = newRateLimiter(cfg.RateLimit)
+	}
+
+	filter, err := newTopicFilter(cfg.MQTT.AllowTopics, cfg.MQTT.DenyTopics)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs, err := newInputValidator(cfg.Transformers)
+	if err != nil {
+		return nil, err
+	}
+	payloads := newPayloadChecker(cfg.Transformers)
+
+	routes, err := newRouter(cfg.Rules, publish, storageManager)
+	if err != nil {
+		return nil, err
+	}
+
+	republish := newRepublisher(cfg.Transformers, cfg.MQTT.Topics, transformerManager.HasTransformer, publish)
+
+	maxPayloadSize := cfg.MQTT.MaxPayloadSize
+	if maxPayloadSize <= 0 {
+		maxPayloadSize = DefaultMaxPayloadSize
+	}
+
+	var deadLetters *deadletter.Writer
+	if cfg.DeadLetter.Enabled {
+		deadLetters, err = deadletter.NewWriter(cfg.DeadLetter.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// writeDeadLetter writes a failed message to the dead-letter files when dead-lettering is enabled,
+	// the payload hash links the record to the rows of the error log
+	writeDeadLetter := func(e storage.ProcessingError, payload []byte) {
+		if deadLetters == nil {
+			return
+		}
+		err := deadLetters.Write(deadletter.Record{
+			Timestamp:   e.Timestamp,
+			Topic:       e.Topic,
+			DeviceType:  e.DeviceType,
+			Reason:      e.Reason,
+			Error:       e.Error,
+			PayloadHash: e.PayloadHash,
+			Payload:     payload,
+		})
+		if err != nil {
+			logger.ErrorKV("failed to dead-letter message", logger.Fields{"topic": e.Topic, "device_type": e.DeviceType, "error": err})
+		}
+	}
+	// deadLetter records a failed message in the error log of the storage backends that have it enabled,
+	// and when dead-lettering is enabled in the dead-letter files
+	deadLetter := func(reason string, topic string, deviceType string, payload []byte, cause error) {
+		e := storage.NewProcessingError(topic, deviceType, reason, cause, payload)
+		storageManager.RecordError(context.Background(), e)
+		writeDeadLetter(e, payload)
+	}
+
+	return func(ctx context.Context, topic string, payload []byte, properties map[string]string) {
+		// Drop oversize payloads before anything copies or parses them. They are not dead-lettered,
+		// which would write the same payload to disk
+		if len(payload) > maxPayloadSize {
+			metrics.Inc(metrics.OversizeDropped)
+			logger.WarnKV("dropped message: payload exceeds the maximum size", logger.Fields{"topic": topic, "size": len(payload), "max_size": maxPayloadSize})
+			selfTests.report(topic, fmt.Errorf("dropped: payload of %d bytes exceeds the maximum size of %d", len(payload), maxPayloadSize))
+			return
+		}
+
+		// Skip topics received through a broad subscription that should not be processed
+		if filter != nil && !filter.allowed(topic) {
+			metrics.Inc(metrics.TopicFiltered)
+			logger.DebugKV("dropped message from filtered topic", logger.Fields{"topic": topic})
+			selfTests.report(topic, errors.New("dropped: the topic is denied or not allowed"))
+			return
+		}
+
 		// Determine device type based on topic
-		deviceType := GetDeviceTypeFromTopic(topic)
+		deviceType := topics.deviceType(topic)
 		if deviceType == "" {
-			logger.Warn("unable to determine device type from topic %s", topic)
+			logger.WarnKV("unable to determine device type from topic", logger.Fields{"topic": topic})
+			selfTests.report(topic, errors.New("dropped: unable to determine the device type from the topic"))
+			return
+		}
+
+		// Skip redelivered messages
+		if dedup != nil && dedup.isDuplicate(topic, payload) {
+			metrics.Inc(metrics.DuplicatesDropped)
+			logger.DebugKV("dropped duplicate message", logger.Fields{"topic": topic, "device_type": deviceType})
+			selfTests.report(topic, errors.New("dropped as a duplicate"))
+			return
+		}
+
+		// Drop messages of topics sending faster than allowed, before spending time on the transform
+		if limiter != nil && limiter.key == RateLimitKeyTopic && !limiter.allow(topic) {
+			metrics.Inc(metrics.RateLimited)
+			logger.DebugKV("rate limited message", logger.Fields{"topic": topic, "device_type": deviceType})
+			selfTests.report(topic, errors.New("dropped by the rate limiter of the topic"))
 			return
 		}
 
-		logger.Debug("received data from device type %s: %s", deviceType, string(payload))
+		logger.DebugKV("received data", logger.Fields{"topic": topic, "device_type": deviceType, "payload": payload})
 
-		// Process data using corresponding transformer
-		result, err := transformerManager.Transform(deviceType, payload)
+		// Unwrap hex or base64 payloads for the checks below, the transformer unwraps them again itself.
+		// A payload not matching its encoding is rejected like invalid JSON
+		content, err := transformerManager.DecodePayload(deviceType, payload)
 		if err != nil {
-			logger.Error("failed to transform data [%s]: %v", deviceType, err)
+			metrics.Inc(metrics.InvalidPayloads)
+			logger.WarnKV("payload rejected", logger.Fields{"topic": topic, "device_type": deviceType, "error": err})
+			deadLetter(deadletter.ReasonInvalidPayload, topic, deviceType, payload, err)
+			selfTests.report(topic, fmt.Errorf("payload rejected: %w", err))
 			return
 		}
 
-		// Process transformed data
-		logger.Info("device type: %s, transformed data: %v", deviceType, result)
+		// Reject incomplete JSON before it reaches the transformer, it points to a transport or publisher problem
+		if payloads != nil {
+			if err := payloads.check(deviceType, content); err != nil {
+				metrics.Inc(metrics.InvalidPayloads)
+				logger.WarnKV("payload rejected", logger.Fields{"topic": topic, "device_type": deviceType, "error": err})
+				deadLetter(deadletter.ReasonInvalidPayload, topic, deviceType, payload, err)
+				selfTests.report(topic, fmt.Errorf("payload rejected: %w", err))
+				return
+			}
+		}
 
-		// Store data
-		if err := storageManager.Store(deviceType, result); err != nil {
-			logger.Error("failed to store data: %v", err)
+		// Reject payloads not matching the input schema before they reach the transformer
+		if inputs != nil {
+			if err := inputs.validate(deviceType, content); err != nil {
+				metrics.Inc(metrics.SchemaRejected)
+				logger.WarnKV("payload rejected by input schema", logger.Fields{"topic": topic, "device_type": deviceType, "error": err})
+				deadLetter(deadletter.ReasonSchema, topic, deviceType, payload, err)
+				selfTests.report(topic, fmt.Errorf("payload rejected by input schema: %w", err))
+				return
+			}
 		}
-	}
+
+		// Process data using corresponding transformer, one message may hold the records of several devices
+		results, err := transformerManager.Transform(deviceType, payload, transformer.MessageContext{
+			Topic:          topic,
+			ReceivedAt:     time.Now(),
+			UserProperties: properties,
+			// Topic-addressed devices may omit their name from the payload
+			DeviceName: topics.deviceName(topic),
+		})
+		if errors.Is(err, transformer.ErrBelowMinQuality) {
+			metrics.Inc(metrics.LowQualityDropped)
+			logger.DebugKV("skipped message", logger.Fields{"topic": topic, "device_type": deviceType, "reason": err})
+			selfTests.report(topic, fmt.Errorf("skipped: %w", err))
+			return
+		}
+		if errors.Is(err, transformer.ErrNoTransformer) {
+			// Not a failure of the payload, dead-lettered so it can be replayed once a transformer is added
+			logger.WarnKV("no transformer for device type, message not processed", logger.Fields{"topic": topic, "device_type": deviceType})
+			deadLetter(deadletter.ReasonTransform, topic, deviceType, payload, err)
+			selfTests.report(topic, err)
+			return
+		}
+		if err != nil {
+			logger.ErrorKV("failed to transform data", logger.Fields{"topic": topic, "device_type": deviceType, "error": err})
+			deadLetter(deadletter.ReasonTransform, topic, deviceType, payload, err)
+			selfTests.report(topic, err)
+			return
+		}
+
+		// Captures of the topic pattern, e.g. the site, are added to every record unless the transformer set them
+		topicMetadata := topics.metadata(topic)
+
+		var storeErrs []error
+		// outcomes are passed to a waiting self-test, they include the backend failures the store mode ignores
+		var outcomes []error
+		if len(results) == 0 {
+			outcomes = append(outcomes, errors.New("the transform returned no records"))
+		}
+		for _, result := range results {
+			// The device name is only known after the transform
+			if limiter != nil && limiter.key == RateLimitKeyDeviceName && !limiter.allow(deviceType+"/"+result.DeviceName) {
+				metrics.Inc(metrics.RateLimited)
+				logger.DebugKV("rate limited message", logger.Fields{"topic": topic, "device_type": deviceType, "device_name": result.DeviceName})
+				outcomes = append(outcomes, fmt.Errorf("record of device %s dropped by the rate limiter", result.DeviceName))
+				continue
+			}
+
+			MergeTopicMetadata(&result, topicMetadata)
+
+			// Process transformed data
+			logger.InfoKV("transformed data", logger.Fields{"topic": topic, "device_type": deviceType, "device_name": result.DeviceName, "data": result})
+			logger.DebugKV("transformed attributes", logger.Fields{"device_type": deviceType, "device_name": result.DeviceName, "attributes": result.Attributes, "metadata": result.Metadata})
+
+			// Store data
+			failures, err := storageManager.StoreFailuresCtx(ctx, deviceType, result)
+			if err != nil {
+				metrics.Inc(metrics.StoreFailures)
+				logger.ErrorKV("failed to store data", logger.Fields{"topic": topic, "device_type": deviceType, "device_name": result.DeviceName, "error": err})
+				storeErrs = append(storeErrs, err)
+			}
+			// Every failing backend is recorded in the error log, also when the store mode ignores it
+			for _, failure := range failures {
+				failureErr := fmt.Errorf("record of device %s not stored to %s", result.DeviceName, failure)
+				storageManager.RecordError(context.Background(), storage.NewProcessingError(topic, deviceType, deadletter.ReasonStore, failureErr, payload))
+				outcomes = append(outcomes, failureErr)
+			}
+
+			// Forward the transformed record to its output topic, whether or not it was stored
+			if republish != nil {
+				republish.republish(deviceType, result, topicMetadata)
+			}
+
+			// Publish and store records matching a routing rule, e.g. alarms, additionally
+			if routes != nil {
+				routes.route(ctx, deviceType, result)
+			}
+		}
+
+		// The message is dead-lettered once, replaying it stores all of its records again. Its backend
+		// failures are in the error log already
+		if len(storeErrs) > 0 {
+			writeDeadLetter(storage.NewProcessingError(topic, deviceType, deadletter.ReasonStore, errors.Join(storeErrs...), payload), payload)
+		}
+		selfTests.report(topic, errors.Join(outcomes...))
+	}, nil
 }
 
 // newClient creates a new MQTT client
@@ -117,6 +624,35 @@ func newClient(config config.MQTTConfig, handler MessageHandler) (*Client, error
 		opts.SetUsername(config.Username)
 		opts.SetPassword(config.Password)
 	}
+	// Fetch a fresh password on every (re)connect
+	if creds := newCredentials(config); creds != nil {
+		opts.SetCredentialsProvider(creds.get)
+	}
+
+	tlsConfig, err := newTLSConfig(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	if config.WillTopic != "" {
+		opts.SetWill(config.WillTopic, config.WillPayload, config.WillQoS, config.WillRetained)
+	}
+
+	// Messages are acknowledged by the worker pool once processed, a persistent session gets
+	// the unacknowledged ones delivered again after a crash
+	opts.SetAutoAckDisabled(true)
+	opts.SetCleanSession(config.SessionExpiry <= 0)
+
+	// Delivery tuning, see the README on how it interacts with the worker pool
+	if config.OrderMatters != nil {
+		opts.SetOrderMatters(*config.OrderMatters)
+	}
+	if config.MaxResumePubInFlight > 0 {
+		opts.SetMaxResumePubInFlight(config.MaxResumePubInFlight)
+	}
 
 	opts.SetAutoReconnect(true)
 	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
@@ -153,9 +689,9 @@ func (c *Client) Connect() error {
 
 // Subscribe subscribes to the specified topic
 func (c *Client) Subscribe(topic string) error {
-	token := c.client.Subscribe(topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
+	token := c.client.Subscribe(topic, c.config.QoS, func(_ mqtt.Client, msg mqtt.Message) {
 		logger.Debug("received message from topic %s", msg.Topic())
-		c.handler(msg.Topic(), msg.Payload())
+		c.handler(msg.Topic(), msg.Payload(), nil, msg.Qos(), func() { acknowledge(msg) })
 	})
 
 	if !token.WaitTimeout(5 * time.Second) {
@@ -170,6 +706,37 @@ func (c *Client) Subscribe(topic string) error {
 	return nil
 }
 
+// acknowledge acknowledges msg. paho panics when the connection msg was received on has closed meanwhile,
+// that acknowledgement is dropped and the broker delivers the message again
+func acknowledge(msg mqtt.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Debug("connection closed, acknowledgement of message from topic %s dropped", msg.Topic())
+		}
+	}()
+	msg.Ack()
+}
+
+// Publish publishes payload to the specified topic
+func (c *Client) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	token := c.client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("publishing to topic %s timed out", topic)
+	}
+
+	return token.Error()
+}
+
+// Unsubscribe unsubscribes from the specified topic
+func (c *Client) Unsubscribe(topic string) error {
+	token := c.client.Unsubscribe(topic)
+	if !token.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("unsubscription from topic %s timed out", topic)
+	}
+
+	return token.Error()
+}
+
 // Disconnect disconnects from the MQTT broker
 func (c *Client) Disconnect() {
 	c.client.Disconnect(250)
@@ -177,21 +744,13 @@ func (c *Client) Disconnect() {
 }
 
 // GetDeviceTypeFromTopic extracts the device type from the topic
-// The topic format is assumed to be: devices/{device_type}/{device_name}
+// The topic format is assumed to be: devices/{device_type}/{device_name}, extra levels are ignored
 func GetDeviceTypeFromTopic(topic string) string {
-	// Use regex to match topic format
-	re := regexp.MustCompile(`devices/([^/]+)/.*`)
-	matches := re.FindStringSubmatch(topic)
-
-	if len(matches) > 1 {
-		return matches[1]
-	}
-
-	// Try simple split method
-	parts := strings.Split(topic, "/")
-	if len(parts) >= 2 && parts[0] == "devices" {
-		return parts[1]
-	}
+	return defaultTopicParser.deviceType(topic)
+}
 
-	return ""
+// GetDeviceNameFromTopic extracts the device name from the topic
+// The topic format is assumed to be: devices/{device_type}/{device_name}, an empty string is returned without a name level
+func GetDeviceNameFromTopic(topic string) string {
+	return defaultTopicParser.deviceName(topic)
 }
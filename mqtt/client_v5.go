@@ -0,0 +1,268 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/logger"
+)
+
+// MQTT protocol versions
+const (
+	// ProtocolVersion311 is MQTT 3.1.1, used when no protocol version is configured
+	ProtocolVersion311 = 4
+	// ProtocolVersion5 is MQTT 5.0
+	ProtocolVersion5 = 5
+)
+
+// v5Client represents an MQTT 5 client, it passes the user properties of received messages to the handler
+type v5Client struct {
+	config  config.MQTTConfig
+	handler MessageHandler
+	options autopaho.ClientConfig
+	conn    *autopaho.ConnectionManager
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	// topics are subscribed again after reconnecting, the session ends with the connection
+	topics []string
+	mutex  sync.Mutex
+}
+
+// newV5Client creates a new MQTT 5 client
+func newV5Client(config config.MQTTConfig, handler MessageHandler) (*v5Client, error) {
+	if config.Broker == "" {
+		return nil, fmt.Errorf("MQTT broker address cannot be empty")
+	}
+
+	brokerURL, err := url.Parse(config.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT broker address %s: %v", config.Broker, err)
+	}
+
+	if config.ClientID == "" {
+		config.ClientID = fmt.Sprintf("data-trans-%d", time.Now().Unix())
+	}
+
+	tlsConfig, err := newTLSConfig(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &v5Client{
+		config:  config,
+		handler: handler,
+	}
+
+	c.options = autopaho.ClientConfig{
+		ServerUrls:        []*url.URL{brokerURL},
+		TlsCfg:            tlsConfig,
+		KeepAlive:         30,
+		ConnectRetryDelay: 10 * time.Second,
+		ConnectTimeout:    10 * time.Second,
+		OnConnectionUp:    c.onConnectionUp,
+		OnConnectError: func(err error) {
+			logger.Error("failed to connect to MQTT broker, retrying: %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: config.ClientID,
+			// Messages are acknowledged by the worker pool once processed, paho sends the acknowledgements in order
+			EnableManualAcknowledgment: true,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					logger.Debug("received message from topic %s", pr.Packet.Topic)
+					c.handler(pr.Packet.Topic, pr.Packet.Payload, userProperties(pr.Packet.Properties), pr.Packet.QoS, func() {
+						// Fails when the connection the message was received on has closed, the broker delivers it again
+						if err := pr.Client.Ack(pr.Packet); err != nil {
+							logger.Debug("failed to acknowledge message from topic %s: %v", pr.Packet.Topic, err)
+						}
+					})
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				logger.Error("MQTT connection lost: %v", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				logger.Error("MQTT broker closed the connection, reason code %d", d.ReasonCode)
+			},
+		},
+	}
+
+	// A persistent session gets the unacknowledged messages delivered again after a crash
+	if config.SessionExpiry > 0 {
+		c.options.SessionExpiryInterval = uint32(config.SessionExpiry / time.Second)
+	}
+
+	if config.Username != "" {
+		c.options.ConnectUsername = config.Username
+		c.options.ConnectPassword = []byte(config.Password)
+	}
+
+	// Fetch a fresh password on every (re)connect and limit the unacknowledged messages the broker sends,
+	// see the README on how it interacts with the worker pool
+	creds := newCredentials(config)
+	if creds != nil || config.ReceiveMaximum > 0 {
+		receiveMaximum := uint16(config.ReceiveMaximum)
+		c.options.ConnectPacketBuilder = func(cp *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+			if creds != nil {
+				username, password := creds.get()
+				cp.Username, cp.UsernameFlag = username, username != ""
+				cp.Password, cp.PasswordFlag = []byte(password), password != ""
+			}
+			if receiveMaximum > 0 {
+				if cp.Properties == nil {
+					cp.Properties = &paho.ConnectProperties{}
+				}
+				cp.Properties.ReceiveMaximum = &receiveMaximum
+			}
+			return cp, nil
+		}
+	}
+
+	if config.WillTopic != "" {
+		c.options.WillMessage = &paho.WillMessage{
+			Topic:   config.WillTopic,
+			Payload: []byte(config.WillPayload),
+			QoS:     config.WillQoS,
+			Retain:  config.WillRetained,
+		}
+	}
+
+	return c, nil
+}
+
+// userProperties converts the user properties of a message into a map, the last value wins for repeated keys
+func userProperties(properties *paho.PublishProperties) map[string]string {
+	if properties == nil || len(properties.User) == 0 {
+		return nil
+	}
+
+	result := make(map[string]string, len(properties.User))
+	for _, property := range properties.User {
+		result[property.Key] = property.Value
+	}
+	return result
+}
+
+// onConnectionUp subscribes to the topics again after reconnecting
+func (c *v5Client) onConnectionUp(conn *autopaho.ConnectionManager, _ *paho.Connack) {
+	c.mutex.Lock()
+	topics := append([]string(nil), c.topics...)
+	c.mutex.Unlock()
+
+	for _, topic := range topics {
+		if err := c.subscribe(conn, topic); err != nil {
+			logger.Warn("failed to subscribe to topic %s: %v", topic, err)
+		}
+	}
+}
+
+// Connect connects to the MQTT broker, the connection is re-established automatically when lost
+func (c *v5Client) Connect() error {
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	conn, err := autopaho.NewConnection(c.ctx, c.options)
+	if err != nil {
+		c.cancel()
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	defer cancel()
+	if err := conn.AwaitConnection(ctx); err != nil {
+		c.cancel()
+		return fmt.Errorf("connection to MQTT broker timed out")
+	}
+	c.conn = conn
+
+	logger.Info("successfully connected to MQTT broker: %s (MQTT 5)", c.config.Broker)
+	return nil
+}
+
+// Subscribe subscribes to the specified topic
+func (c *v5Client) Subscribe(topic string) error {
+	if err := c.subscribe(c.conn, topic); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.topics = append(c.topics, topic)
+	c.mutex.Unlock()
+
+	logger.Info("successfully subscribed to topic: %s", topic)
+	return nil
+}
+
+// subscribe sends the subscription for topic on conn
+func (c *v5Client) subscribe(conn *autopaho.ConnectionManager, topic string) error {
+	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := conn.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: c.config.QoS}},
+	})
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("subscription to topic %s timed out", topic)
+	}
+	return err
+}
+
+// Publish publishes payload to the specified topic
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := c.conn.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: payload,
+	})
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("publishing to topic %s timed out", topic)
+	}
+	return err
+}
+
+// Unsubscribe unsubscribes from the specified topic
+func (c *v5Client) Unsubscribe(topic string) error {
+	c.mutex.Lock()
+	for i, subscribed := range c.topics {
+		if subscribed == topic {
+			c.topics = append(c.topics[:i], c.topics[i+1:]...)
+			break
+		}
+	}
+	c.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := c.conn.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}})
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("unsubscription from topic %s timed out", topic)
+	}
+	return err
+}
+
+// Disconnect disconnects from the MQTT broker
+func (c *v5Client) Disconnect() {
+	if c.conn == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if err := c.conn.Disconnect(ctx); err != nil {
+		logger.Warn("failed to disconnect from MQTT broker: %v", err)
+	}
+	c.cancel()
+	logger.Info("disconnected from MQTT broker")
+}
@@ -0,0 +1,89 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/logger"
+)
+
+// DefaultTokenTimeout limits the token command when no token timeout is configured
+const DefaultTokenTimeout = 10 * time.Second
+
+// credentials fetches the password again on every (re)connect, for brokers using short-lived tokens
+type credentials struct {
+	username     string
+	passwordFile string
+	command      string
+	timeout      time.Duration
+
+	mutex sync.Mutex
+	// password is the last password fetched, kept when fetching a new one fails
+	password string
+}
+
+// newCredentials creates the credentials of the connection, nil when the configured password is static
+func newCredentials(cfg config.MQTTConfig) *credentials {
+	if cfg.TokenCommand == "" && !cfg.RefreshPasswordFile {
+		return nil
+	}
+
+	c := &credentials{
+		username: cfg.Username,
+		command:  cfg.TokenCommand,
+		timeout:  cfg.TokenTimeout,
+		password: cfg.Password,
+	}
+	if cfg.RefreshPasswordFile {
+		c.passwordFile = cfg.PasswordFile
+	}
+	if c.timeout <= 0 {
+		c.timeout = DefaultTokenTimeout
+	}
+	return c
+}
+
+// get returns the username and password for the next connection attempt.
+// When fetching the password fails the last one is used, the broker rejects it if it has expired
+func (c *credentials) get() (string, string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	password, err := c.fetch()
+	if err != nil {
+		logger.Error("failed to refresh MQTT password, using the previous one: %v", err)
+	} else {
+		c.password = password
+		logger.Debug("refreshed MQTT password")
+	}
+	return c.username, c.password
+}
+
+// fetch runs the token command or reads the password file
+func (c *credentials) fetch() (string, error) {
+	if c.command == "" {
+		return config.ReadSecretFile(c.passwordFile)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.command)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("token command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	token := strings.TrimSpace(string(output))
+	if token == "" {
+		return "", fmt.Errorf("token command returned no token")
+	}
+	return token, nil
+}
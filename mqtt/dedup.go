@@ -0,0 +1,111 @@
+package mqtt
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/config"
+)
+
+// Default deduplication settings
+const (
+	DefaultDedupCacheSize = 10000
+	DefaultDedupTTL       = 5 * time.Minute
+)
+
+// dedupEntry is a key remembered by the deduplicator
+type dedupEntry struct {
+	key      string
+	expireAt time.Time
+}
+
+// deduplicator detects redelivered messages with an LRU cache of recently seen keys
+type deduplicator struct {
+	keyFields []string
+	cacheSize int
+	ttl       time.Duration
+
+	entries map[string]*list.Element
+	order   *list.List // front is the most recently seen
+	mutex   sync.Mutex
+}
+
+// newDeduplicator creates a deduplicator from configuration
+func newDeduplicator(cfg config.DedupConfig) *deduplicator {
+	cacheSize := cfg.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = DefaultDedupCacheSize
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = DefaultDedupTTL
+	}
+
+	return &deduplicator{
+		keyFields: cfg.KeyFields,
+		cacheSize: cacheSize,
+		ttl:       ttl,
+		entries:   make(map[string]*list.Element),
+		order:     list.New(),
+	}
+}
+
+// isDuplicate reports whether the message was already seen within the TTL, and remembers it otherwise
+func (d *deduplicator) isDuplicate(topic string, payload []byte) bool {
+	key := d.key(topic, payload)
+	now := time.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if element, ok := d.entries[key]; ok {
+		entry := element.Value.(*dedupEntry)
+		if now.Before(entry.expireAt) {
+			d.order.MoveToFront(element)
+			return true
+		}
+		// Expired, treat as a new message
+		entry.expireAt = now.Add(d.ttl)
+		d.order.MoveToFront(element)
+		return false
+	}
+
+	d.entries[key] = d.order.PushFront(&dedupEntry{key: key, expireAt: now.Add(d.ttl)})
+	for d.order.Len() > d.cacheSize {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupEntry).key)
+	}
+	return false
+}
+
+// key builds the dedup key from the configured payload fields, falling back to a payload hash
+// when no fields are configured, the payload is not a JSON object or a field is missing
+func (d *deduplicator) key(topic string, payload []byte) string {
+	if len(d.keyFields) > 0 {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(payload, &fields); err == nil {
+			key := topic
+			complete := true
+			for _, name := range d.keyFields {
+				value, ok := fields[name]
+				if !ok {
+					complete = false
+					break
+				}
+				key += fmt.Sprintf("|%v", value)
+			}
+			if complete {
+				return key
+			}
+		}
+	}
+
+	sum := sha256.Sum256(payload)
+	return topic + "|" + hex.EncodeToString(sum[:])
+}
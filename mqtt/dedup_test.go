@@ -0,0 +1,80 @@
+package mqtt
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eddielth/data-trans/config"
+)
+
+func TestDeduplicatorEvictsLeastRecentlySeen(t *testing.T) {
+	d := newDeduplicator(config.DedupConfig{CacheSize: 2, TTL: time.Hour})
+
+	for _, payload := range []string{"a", "b"} {
+		if d.isDuplicate("devices/temperature/sensor1", []byte(payload)) {
+			t.Fatalf("first %q reported as duplicate", payload)
+		}
+	}
+	// Seeing a again makes b the least recently seen key
+	if !d.isDuplicate("devices/temperature/sensor1", []byte("a")) {
+		t.Fatal("redelivered a not reported as duplicate")
+	}
+	if d.isDuplicate("devices/temperature/sensor1", []byte("c")) {
+		t.Fatal("first c reported as duplicate")
+	}
+
+	if d.isDuplicate("devices/temperature/sensor1", []byte("b")) {
+		t.Error("evicted b reported as duplicate")
+	}
+	if !d.isDuplicate("devices/temperature/sensor1", []byte("c")) {
+		t.Error("c evicted instead of the least recently seen key")
+	}
+	if len(d.entries) != 2 || d.order.Len() != 2 {
+		t.Errorf("cache holds %d keys and %d list entries, want 2", len(d.entries), d.order.Len())
+	}
+}
+
+func TestDeduplicatorExpiresKeys(t *testing.T) {
+	d := newDeduplicator(config.DedupConfig{TTL: 20 * time.Millisecond})
+
+	payload := []byte(`{"seq": 1}`)
+	if d.isDuplicate("devices/temperature/sensor1", payload) {
+		t.Fatal("first message reported as duplicate")
+	}
+	if !d.isDuplicate("devices/temperature/sensor1", payload) {
+		t.Fatal("redelivery within the TTL not reported as duplicate")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if d.isDuplicate("devices/temperature/sensor1", payload) {
+		t.Error("message after the TTL reported as duplicate")
+	}
+	if !d.isDuplicate("devices/temperature/sensor1", payload) {
+		t.Error("the TTL was not renewed for the message seen after it expired")
+	}
+}
+
+func TestDeduplicatorKey(t *testing.T) {
+	d := newDeduplicator(config.DedupConfig{KeyFields: []string{"id", "seq"}})
+
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"id": "a", "seq": 1, "value": 2}`, "devices/x|a|1"},
+		// Payloads without every key field and non-objects fall back to the payload hash
+		{`{"id": "a"}`, ""},
+		{`[1, 2]`, ""},
+	}
+	for _, tt := range tests {
+		got := d.key("devices/x", []byte(tt.payload))
+		if tt.want == "" {
+			tt.want = fmt.Sprintf("devices/x|%x", sha256.Sum256([]byte(tt.payload)))
+		}
+		if got != tt.want {
+			t.Errorf("key(%s) = %q, want %q", tt.payload, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// topicFilter decides which delivered topics are processed, so broad wildcard subscriptions
+// can skip topics such as internal or test devices
+type topicFilter struct {
+	allow []string
+	deny  []string
+}
+
+// newTopicFilter checks the patterns and creates a topic filter, nil is returned when there are no patterns.
+// Patterns use the MQTT wildcards, + for one level and # for all remaining levels, and each
+// other level is a glob as in path.Match, e.g. devices/+/test-*
+func newTopicFilter(allow []string, deny []string) (*topicFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range append(append([]string(nil), allow...), deny...) {
+		if err := checkTopicPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return &topicFilter{allow: allow, deny: deny}, nil
+}
+
+// checkTopicPattern reports whether pattern is a valid topic pattern
+func checkTopicPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("topic pattern cannot be empty")
+	}
+	levels := strings.Split(pattern, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("topic pattern %q: # must be the last level", pattern)
+		}
+		if _, err := path.Match(level, ""); err != nil {
+			return fmt.Errorf("topic pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// allowed reports whether topic is processed: it must match an allow pattern when there are any,
+// and no deny pattern. Deny patterns take precedence
+func (f *topicFilter) allowed(topic string) bool {
+	for _, pattern := range f.deny {
+		if matchTopic(pattern, topic) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, pattern := range f.allow {
+		if matchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTopic reports whether topic matches pattern level by level
+func matchTopic(pattern string, topic string) bool {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range patternLevels {
+		if level == "#" {
+			// # also matches the parent level, devices/# matches devices
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level == "+" {
+			continue
+		}
+		if matched, _ := path.Match(level, topicLevels[i]); !matched {
+			return false
+		}
+	}
+	return len(patternLevels) == len(topicLevels)
+}
@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/metrics"
+	"github.com/eddielth/data-trans/storage"
+)
+
+// DefaultHeartbeatInterval is the heartbeat interval used when none is configured
+const DefaultHeartbeatInterval = 30 * time.Second
+
+// startTime is when the service started, used to report uptime
+var startTime = time.Now()
+
+// heartbeatStatus is the payload of a heartbeat message
+type heartbeatStatus struct {
+	Timestamp         int64    `json:"timestamp"`
+	UptimeSeconds     int64    `json:"uptime_seconds"`
+	MessagesReceived  int64    `json:"messages_received"`
+	MessagesProcessed int64    `json:"messages_processed"`
+	StorageBackends   []string `json:"storage_backends"`
+}
+
+// heartbeat periodically publishes the service status
+type heartbeat struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// startHeartbeat starts publishing heartbeats in the background
+func startHeartbeat(client brokerClient, cfg config.HeartbeatConfig, storageManager *storage.Manager) *heartbeat {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+
+	h := &heartbeat{done: make(chan struct{})}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				publishHeartbeat(client, cfg, storageManager)
+			case <-h.done:
+				return
+			}
+		}
+	}()
+
+	logger.Info("publishing heartbeat to %s every %v", cfg.Topic, interval)
+	return h
+}
+
+// publishHeartbeat publishes one heartbeat message
+func publishHeartbeat(client brokerClient, cfg config.HeartbeatConfig, storageManager *storage.Manager) {
+	now := time.Now()
+	payload, err := json.Marshal(heartbeatStatus{
+		Timestamp:         now.UnixMilli(),
+		UptimeSeconds:     int64(now.Sub(startTime).Seconds()),
+		MessagesReceived:  metrics.Get(metrics.MessagesReceived),
+		MessagesProcessed: metrics.Get(metrics.MessagesProcessed),
+		StorageBackends:   storageManager.BackendTypes(),
+	})
+	if err != nil {
+		logger.Error("failed to serialize heartbeat: %v", err)
+		return
+	}
+
+	if err := client.Publish(cfg.Topic, cfg.QoS, false, payload); err != nil {
+		logger.Warn("failed to publish heartbeat to %s: %v", cfg.Topic, err)
+	}
+}
+
+// stop stops publishing heartbeats
+func (h *heartbeat) stop() {
+	close(h.done)
+	h.wg.Wait()
+}
@@ -0,0 +1,87 @@
+package mqtt
+
+import "sync"
+
+// gate parks dispatched messages while ingestion is paused, so the MQTT client keeps reading
+// and answering keep-alives instead of blocking in the message callback
+type gate struct {
+	mu sync.Mutex
+	// closed is set while ingestion is paused
+	closed bool
+	// held are the messages received while paused in the order received, unacknowledged until processed
+	held []message
+	// limit is the number of messages held at most before QoS 0 messages are dropped
+	limit int
+}
+
+// close pauses the gate, it returns false when the gate was already paused
+func (g *gate) close() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return false
+	}
+	g.closed = true
+	return true
+}
+
+// hold parks msg while the gate is paused and reports whether it did. full reports a QoS 0 message
+// that was not parked because limit messages are held already. QoS 1 and 2 messages are always parked:
+// dropping them would acknowledge messages the broker keeps otherwise, and leaving them unacknowledged
+// would hold back the acknowledgements of every later message. The broker's inflight window bounds them
+func (g *gate) hold(msg message) (held bool, full bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.closed {
+		return false, false
+	}
+	if msg.qos == 0 && len(g.held) >= g.limit {
+		return false, true
+	}
+	g.held = append(g.held, msg)
+	return true, false
+}
+
+// open resumes the gate and passes the held messages to submit in the order received, it returns
+// false when the gate was not paused. Messages dispatched meanwhile wait, so they follow the held ones
+func (g *gate) open(submit func(msg message)) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.closed {
+		return false
+	}
+	g.closed = false
+	held := g.held
+	g.held = nil
+	for _, msg := range held {
+		submit(msg)
+	}
+	return true
+}
+
+// paused reports whether the gate is paused
+func (g *gate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closed
+}
+
+// Pause holds received messages until Resume is called, it returns false when already paused.
+// Held messages are parked unacknowledged, so the broker stops sending QoS 1 and 2 messages once its
+// in-flight window is full; the connection, keep-alives and subscriptions stay up
+func (m *Manager) Pause() bool {
+	return m.gate.close()
+}
+
+// Resume passes the held messages to the workers and resumes ingestion, it returns false when not paused
+func (m *Manager) Resume() bool {
+	return m.gate.open(m.submit)
+}
+
+// Paused reports whether ingestion is paused
+func (m *Manager) Paused() bool {
+	return m.gate.paused()
+}
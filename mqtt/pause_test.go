@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// newPauseTestManager returns a manager with a single worker recording the topics it processes in order
+func newPauseTestManager(t *testing.T, limit int) (*Manager, func() []string) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var processed []string
+	m := &Manager{}
+	pool, err := newWorkerPool(1, 10, QueuePolicyBlock, func(msg message) {
+		defer m.finishMessage()
+		mu.Lock()
+		processed = append(processed, msg.topic)
+		mu.Unlock()
+		msg.ack()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.pool = pool
+	m.gate.limit = limit
+
+	return m, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), processed...)
+	}
+}
+
+func TestPauseHoldsMessagesWithoutBlocking(t *testing.T) {
+	m, processed := newPauseTestManager(t, 2)
+
+	acked := make(map[string]bool)
+	var ackMu sync.Mutex
+	dispatch := func(topic string, qos byte) {
+		m.dispatch(topic, nil, nil, qos, func() {
+			ackMu.Lock()
+			acked[topic] = true
+			ackMu.Unlock()
+		})
+	}
+
+	if !m.Pause() {
+		t.Fatal("Pause() = false, want true")
+	}
+	if m.Pause() {
+		t.Error("second Pause() = true, want false")
+	}
+
+	// dispatch returns right away, a blocked callback would hang the test here
+	dispatch("devices/a/1", 0)
+	dispatch("devices/a/2", 0)
+	dispatch("devices/a/3", 0)
+	// QoS 1 messages beyond the limit are held, unacknowledged, instead of dropped
+	dispatch("devices/b/1", 1)
+
+	if got := processed(); len(got) != 0 {
+		t.Fatalf("processed %v while paused", got)
+	}
+	ackMu.Lock()
+	if acked["devices/a/1"] || acked["devices/a/2"] || acked["devices/b/1"] {
+		t.Error("held messages were acknowledged before they were processed")
+	}
+	if !acked["devices/a/3"] {
+		t.Error("QoS 0 message dropped beyond the limit was not acknowledged")
+	}
+	ackMu.Unlock()
+
+	if !m.Resume() {
+		t.Fatal("Resume() = false, want true")
+	}
+	dispatch("devices/a/4", 0)
+	m.inFlight.Wait()
+
+	want := []string{"devices/a/1", "devices/a/2", "devices/b/1", "devices/a/4"}
+	if got := processed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("processed %v, want %v", got, want)
+	}
+	ackMu.Lock()
+	for _, topic := range want {
+		if !acked[topic] {
+			t.Errorf("%s was not acknowledged after processing", topic)
+		}
+	}
+	ackMu.Unlock()
+
+	if m.Resume() {
+		t.Error("Resume() while not paused = true, want false")
+	}
+	m.pool.stop()
+}
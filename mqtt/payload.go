@@ -0,0 +1,48 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// payloadChecker rejects malformed payloads of device types using the json codec before they are transformed,
+// so a payload truncated in transport is reported as such instead of failing inside the transformer
+type payloadChecker struct {
+	// codecs are the codecs of the configured transformers, device types without one use the default transformer
+	codecs map[string]string
+}
+
+// newPayloadChecker creates a payload checker, it returns nil when no transformer uses the json codec
+func newPayloadChecker(transformers map[string]config.Transformer) *payloadChecker {
+	codecs := make(map[string]string, len(transformers))
+	usesJSON := false
+	for deviceType, transformerCfg := range transformers {
+		codecs[deviceType] = transformerCfg.Codec
+		if transformerCfg.Codec == transformer.CodecJSON {
+			usesJSON = true
+		}
+	}
+	if !usesJSON {
+		return nil
+	}
+	return &payloadChecker{codecs: codecs}
+}
+
+// check returns an error when deviceType uses the json codec and payload is not complete JSON
+func (c *payloadChecker) check(deviceType string, payload []byte) error {
+	codec, ok := c.codecs[deviceType]
+	if !ok {
+		codec = c.codecs[transformer.DefaultTransformer]
+	}
+	if codec != transformer.CodecJSON || json.Valid(payload) {
+		return nil
+	}
+
+	// Decode again only for the error, a truncated payload reports "unexpected end of JSON input"
+	var value interface{}
+	err := json.Unmarshal(payload, &value)
+	return fmt.Errorf("invalid JSON payload of %d bytes: %v", len(payload), err)
+}
@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/config"
+)
+
+// Rate limit keys
+const (
+	RateLimitKeyTopic      = "topic"
+	RateLimitKeyDeviceName = "device_name"
+)
+
+// DefaultRateLimitBurst is the bucket size used when no burst is configured
+const DefaultRateLimitBurst = 10
+
+// rateLimitSweepInterval is how often idle buckets are removed
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds the tokens of one key
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter is a token-bucket rate limiter with one bucket per key
+type rateLimiter struct {
+	key   string
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+// newRateLimiter creates a rate limiter from configuration
+func newRateLimiter(cfg config.RateLimitConfig) *rateLimiter {
+	key := cfg.Key
+	if key == "" {
+		key = RateLimitKeyTopic
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = DefaultRateLimitBurst
+	}
+
+	return &rateLimiter{
+		key:       key,
+		rate:      cfg.Rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of key and reports whether one was available
+func (l *rateLimiter) allow(key string) bool {
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens += now.Sub(bucket.updated).Seconds() * l.rate
+		if bucket.tokens > l.burst {
+			bucket.tokens = l.burst
+		}
+		bucket.updated = now
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// sweep removes buckets that have refilled completely, they behave like new buckets.
+// The caller must hold the mutex
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
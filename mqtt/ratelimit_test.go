@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eddielth/data-trans/config"
+)
+
+func TestRateLimiterRefillsTokens(t *testing.T) {
+	l := newRateLimiter(config.RateLimitConfig{Rate: 10, Burst: 2})
+
+	for i := 0; i < 2; i++ {
+		if !l.allow("devices/temperature/sensor1") {
+			t.Fatalf("message %d within the burst was limited", i+1)
+		}
+	}
+	if l.allow("devices/temperature/sensor1") {
+		t.Fatal("message beyond the burst was allowed")
+	}
+	// Buckets are per key
+	if !l.allow("devices/temperature/sensor2") {
+		t.Fatal("message of another key was limited")
+	}
+
+	// One token is added every 100ms
+	time.Sleep(150 * time.Millisecond)
+	if !l.allow("devices/temperature/sensor1") {
+		t.Error("message after a refill was limited")
+	}
+	if l.allow("devices/temperature/sensor1") {
+		t.Error("more tokens refilled than the elapsed time allows")
+	}
+}
+
+func TestRateLimiterSweepsIdleBuckets(t *testing.T) {
+	l := newRateLimiter(config.RateLimitConfig{Rate: 1, Burst: 5})
+
+	l.allow("idle")
+	l.allow("active")
+
+	// The idle bucket has refilled completely, the active one was just used
+	now := time.Now()
+	l.buckets["idle"].updated = now.Add(-10 * time.Second)
+	l.lastSweep = now.Add(-2 * rateLimitSweepInterval)
+	l.allow("active")
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("idle bucket was not swept")
+	}
+	if _, ok := l.buckets["active"]; !ok {
+		t.Error("active bucket was swept")
+	}
+}
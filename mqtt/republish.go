@@ -0,0 +1,124 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// placeholderPattern matches the {name} placeholders of a republish topic template
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// republisher publishes the transformed records of a device type to a topic rendered from its template
+type republisher struct {
+	// targets are the republish settings by device type, device types handled by the default transformer use its settings
+	targets map[string]config.RepublishConfig
+	// hasTransformer reports whether a device type has a transformer of its own, so the default transformer's settings do not apply
+	hasTransformer func(deviceType string) bool
+	publish        publishFunc
+}
+
+// newRepublisher creates a republisher, nil is returned when no transformer republishes.
+// Templates that may render a subscribed topic are logged, the service would consume its own output
+func newRepublisher(transformers map[string]config.Transformer, topics []string, hasTransformer func(deviceType string) bool, publish publishFunc) *republisher {
+	targets := make(map[string]config.RepublishConfig)
+	for deviceType, transformerCfg := range transformers {
+		if transformerCfg.Republish.Topic == "" {
+			continue
+		}
+		targets[deviceType] = transformerCfg.Republish
+
+		filter := templateFilter(transformerCfg.Republish.Topic)
+		for _, topic := range topics {
+			if topicsOverlap(filter, topic) {
+				logger.Warn("republish topic %s of device type %s overlaps subscribed topic %s, republished records may be received again", transformerCfg.Republish.Topic, deviceType, topic)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	return &republisher{targets: targets, hasTransformer: hasTransformer, publish: publish}
+}
+
+// templateFilter returns the topic filter matching every topic a template renders, levels with a placeholder become +
+func templateFilter(template string) string {
+	levels := strings.Split(template, "/")
+	for i, level := range levels {
+		if placeholderPattern.MatchString(level) {
+			levels[i] = "+"
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+// republish publishes data as JSON when deviceType republishes. captures are the named captures of the
+// topic pattern. Failures are logged, they do not fail the message
+func (r *republisher) republish(deviceType string, data transformer.DeviceData, captures map[string]string) {
+	target, ok := r.targets[deviceType]
+	if !ok {
+		// A device type with a transformer of its own and no republish setting is not republished
+		if r.hasTransformer(deviceType) {
+			return
+		}
+		if target, ok = r.targets[transformer.DefaultTransformer]; !ok {
+			return
+		}
+	}
+
+	topic, err := renderTopic(target.Topic, deviceType, data, captures)
+	if err != nil {
+		logger.WarnKV("failed to republish record", logger.Fields{"device_type": deviceType, "device_name": data.DeviceName, "error": err})
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logger.ErrorKV("failed to serialize republished record", logger.Fields{"device_type": deviceType, "device_name": data.DeviceName, "error": err})
+		return
+	}
+	if err := r.publish(topic, target.QoS, target.Retained, payload); err != nil {
+		logger.WarnKV("failed to republish record", logger.Fields{"topic": topic, "device_type": deviceType, "device_name": data.DeviceName, "error": err})
+	}
+}
+
+// renderTopic replaces the placeholders of template. {device_type} and {device_name} are taken from the
+// record, other names from the topic captures first and then the record metadata. A placeholder without
+// a value, or with a value containing /, + or #, is an error since it would change the topic levels
+func renderTopic(template string, deviceType string, data transformer.DeviceData, captures map[string]string) (string, error) {
+	var err error
+	topic := placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+
+		var value string
+		switch name {
+		case "device_type":
+			value = deviceType
+		case "device_name":
+			value = data.DeviceName
+		default:
+			if capture, ok := captures[name]; ok {
+				value = capture
+			} else if metadata, ok := data.Metadata[name]; ok && metadata != nil {
+				value = fmt.Sprint(metadata)
+			}
+		}
+
+		if err == nil {
+			if value == "" {
+				err = fmt.Errorf("republish topic %s has no value for %s", template, placeholder)
+			} else if strings.ContainsAny(value, "/+#") {
+				err = fmt.Errorf("value %q of %s in republish topic %s contains /, + or #", value, placeholder, template)
+			}
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return topic, nil
+}
@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/metrics"
+	"github.com/eddielth/data-trans/rules"
+	"github.com/eddielth/data-trans/storage"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// publishFunc publishes a message with the current broker connection
+type publishFunc func(topic string, qos byte, retained bool, payload []byte) error
+
+// router publishes and stores the records matching a routing rule in addition to the normal storage
+type router struct {
+	engine         *rules.Engine
+	publish        publishFunc
+	storageManager *storage.Manager
+}
+
+// newRouter compiles the routing rules, nil is returned when there are no rules
+func newRouter(cfgs []config.Rule, publish publishFunc, storageManager *storage.Manager) (*router, error) {
+	engine, err := rules.NewEngine(cfgs)
+	if err != nil || engine == nil {
+		return nil, err
+	}
+	return &router{engine: engine, publish: publish, storageManager: storageManager}, nil
+}
+
+// route evaluates the rules on data and runs the actions of every matching rule.
+// Failures are logged, they do not fail the message
+func (r *router) route(ctx context.Context, deviceType string, data transformer.DeviceData) {
+	for _, rule := range r.engine.Match(deviceType, data) {
+		metrics.Inc(metrics.RulesMatched)
+		logger.Debug("record of device %s/%s matched rule %s", deviceType, data.DeviceName, rule.Name)
+		alert := rules.Alert(rule, deviceType, data)
+
+		if rule.PublishTopic != "" {
+			topic := rules.Topic(rule, deviceType, data)
+			payload, err := json.Marshal(alert)
+			if err != nil {
+				logger.Error("failed to serialize record matching rule %s: %v", rule.Name, err)
+			} else if err := r.publish(topic, rule.QoS, rule.Retained, payload); err != nil {
+				logger.Warn("failed to publish record matching rule %s to %s: %v", rule.Name, topic, err)
+			}
+		}
+
+		if rule.StoreAs != "" {
+			if err := r.storageManager.StoreToCtx(ctx, rule.Backends, rule.StoreAs, alert); err != nil {
+				logger.Warn("failed to store record matching rule %s: %v", rule.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// inputValidator validates inbound payloads against the JSON Schema of their device type
+type inputValidator struct {
+	schemas map[string]*jsonschema.Schema
+}
+
+// newInputValidator compiles the input_schema files of all transformers,
+// it returns nil when no device type has a schema
+func newInputValidator(transformers map[string]config.Transformer) (*inputValidator, error) {
+	deviceTypes := make([]string, 0, len(transformers))
+	for deviceType, transformerCfg := range transformers {
+		if transformerCfg.InputSchema != "" {
+			deviceTypes = append(deviceTypes, deviceType)
+		}
+	}
+	if len(deviceTypes) == 0 {
+		return nil, nil
+	}
+	sort.Strings(deviceTypes)
+
+	compiler := jsonschema.NewCompiler()
+	v := &inputValidator{schemas: make(map[string]*jsonschema.Schema)}
+	for _, deviceType := range deviceTypes {
+		path := transformers[deviceType].InputSchema
+		schema, err := compiler.Compile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile input schema %s of device type %s: %v", path, deviceType, err)
+		}
+		v.schemas[deviceType] = schema
+	}
+	return v, nil
+}
+
+// validate checks payload against the schema of deviceType, device types without a schema always pass
+func (v *inputValidator) validate(deviceType string, payload []byte) error {
+	schema, ok := v.schemas[deviceType]
+	if !ok {
+		return nil
+	}
+
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("payload is not valid JSON: %v", err)
+	}
+	return schema.Validate(instance)
+}
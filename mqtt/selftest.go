@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SelfTestDeviceType is the device type of self-test messages, it is transformed with the passthrough engine
+const SelfTestDeviceType = "selftest"
+
+// selfTests holds the self-tests waiting for their message to be processed, by topic
+type selfTests struct {
+	waiting map[string]chan error
+	mutex   sync.Mutex
+}
+
+// newSelfTests creates an empty set of waiting self-tests
+func newSelfTests() *selfTests {
+	return &selfTests{waiting: make(map[string]chan error)}
+}
+
+// wait registers a self-test of topic, the returned channel receives the outcome of its message
+func (s *selfTests) wait(topic string) (<-chan error, func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	outcome := make(chan error, 1)
+	s.waiting[topic] = outcome
+	return outcome, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.waiting[topic] == outcome {
+			delete(s.waiting, topic)
+		}
+	}
+}
+
+// report passes the outcome of processing a message of topic to its waiting self-test, if any.
+// A nil error means the message was transformed and stored
+func (s *selfTests) report(topic string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	outcome, ok := s.waiting[topic]
+	if !ok {
+		return
+	}
+	delete(s.waiting, topic)
+	outcome <- err
+}
+
+// SelfTest publishes a synthetic message to topic and waits until the service has received,
+// transformed and stored it, or ctx is done. topic must be covered by the subscribed topics and
+// resolve to SelfTestDeviceType, so the check covers the broker ACLs, the subscriptions and the storage
+func (m *Manager) SelfTest(ctx context.Context, topic string) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"selftest":  true,
+		"timestamp": time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+
+	outcome, cancel := m.selfTests.wait(topic)
+	defer cancel()
+
+	if err := m.Publish(topic, 1, false, payload); err != nil {
+		return fmt.Errorf("failed to publish self-test message to %s: %v", topic, err)
+	}
+
+	select {
+	case err := <-outcome:
+		if err != nil {
+			return fmt.Errorf("self-test message on %s failed: %v", topic, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("self-test message on %s was not processed: %v, check that it is subscribed and allowed", topic, ctx.Err())
+	}
+}
@@ -0,0 +1,182 @@
+package mqtt
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/metrics"
+)
+
+// Backoff between attempts to subscribe to topics whose subscription failed
+const (
+	subscribeRetryMin = time.Second
+	subscribeRetryMax = time.Minute
+)
+
+// subscriber subscribes to the configured topics and retries failed subscriptions
+// with exponential backoff in the background until they succeed or it is stopped
+type subscriber struct {
+	client brokerClient
+	// subscribed holds the topics whose subscription succeeded
+	subscribed map[string]bool
+	mutex      sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// startSubscriber subscribes to topics, failed subscriptions are retried in the background
+func startSubscriber(client brokerClient, topics []string) *subscriber {
+	s := &subscriber{
+		client:     client,
+		subscribed: make(map[string]bool, len(topics)),
+		done:       make(chan struct{}),
+	}
+
+	pending := s.subscribe(topics)
+	if len(pending) > 0 {
+		s.wg.Add(1)
+		go s.retry(pending)
+	}
+	return s
+}
+
+// uniqueTopics returns topics without duplicates in their configured order, logging a warning for
+// every duplicate and for every pair of overlapping topic filters
+func uniqueTopics(topics []string) []string {
+	seen := make(map[string]bool, len(topics))
+	unique := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if seen[topic] {
+			logger.Warn("topic %s is configured more than once, subscribing to it once", topic)
+			continue
+		}
+		seen[topic] = true
+		unique = append(unique, topic)
+	}
+
+	for i, a := range unique {
+		for _, b := range unique[i+1:] {
+			if topicsOverlap(a, b) {
+				logger.Warn("topics %s and %s overlap, depending on the broker a message matching both is delivered once per subscription", a, b)
+			}
+		}
+	}
+	return unique
+}
+
+// topicsOverlap reports whether some topic matches both MQTT topic filters, e.g. devices/# and devices/temperature/+.
+// Shared subscriptions are compared by the filter after $share/{group}/
+func topicsOverlap(a string, b string) bool {
+	aLevels := strings.Split(sharedFilter(a), "/")
+	bLevels := strings.Split(sharedFilter(b), "/")
+
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		if aLevels[i] == "#" || bLevels[i] == "#" {
+			return true
+		}
+		if aLevels[i] != "+" && bLevels[i] != "+" && aLevels[i] != bLevels[i] {
+			return false
+		}
+	}
+	if len(aLevels) == len(bLevels) {
+		return true
+	}
+
+	// # also matches the parent level, devices/# overlaps devices
+	longer := aLevels
+	if len(bLevels) > len(aLevels) {
+		longer = bLevels
+	}
+	shorter := min(len(aLevels), len(bLevels))
+	return len(longer) == shorter+1 && longer[shorter] == "#"
+}
+
+// sharedFilter returns the topic filter of a shared subscription, other topics are returned unchanged
+func sharedFilter(topic string) string {
+	if rest, ok := strings.CutPrefix(topic, "$share/"); ok {
+		if _, filter, ok := strings.Cut(rest, "/"); ok {
+			return filter
+		}
+	}
+	return topic
+}
+
+// subscribe subscribes to topics and returns the topics whose subscription failed
+func (s *subscriber) subscribe(topics []string) []string {
+	var failed []string
+	for _, topic := range topics {
+		if err := s.client.Subscribe(topic); err != nil {
+			metrics.Inc(metrics.SubscribeFailures)
+			logger.Warn("failed to subscribe to topic %s: %v", topic, err)
+			failed = append(failed, topic)
+			continue
+		}
+
+		s.mutex.Lock()
+		s.subscribed[topic] = true
+		s.mutex.Unlock()
+	}
+	return failed
+}
+
+// retry subscribes to pending topics again, doubling the delay after each failed attempt
+func (s *subscriber) retry(pending []string) {
+	defer s.wg.Done()
+
+	delay := subscribeRetryMin
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		logger.Info("retrying subscription to %d topics in %v", len(pending), delay)
+		select {
+		case <-timer.C:
+		case <-s.done:
+			return
+		}
+
+		pending = s.subscribe(pending)
+		if len(pending) == 0 {
+			return
+		}
+
+		delay *= 2
+		if delay > subscribeRetryMax {
+			delay = subscribeRetryMax
+		}
+		timer.Reset(delay)
+	}
+}
+
+// topics returns the topics whose subscription succeeded, sorted
+func (s *subscriber) topics() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	topics := make([]string, 0, len(s.subscribed))
+	for topic := range s.subscribed {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// stop stops retrying and unsubscribes from the subscribed topics
+func (s *subscriber) stop() {
+	close(s.done)
+	s.wg.Wait()
+
+	for _, topic := range s.topics() {
+		if err := s.client.Unsubscribe(topic); err != nil {
+			logger.Warn("failed to unsubscribe from topic %s: %v", topic, err)
+		}
+	}
+
+	s.mutex.Lock()
+	s.subscribed = make(map[string]bool)
+	s.mutex.Unlock()
+}
@@ -0,0 +1,168 @@
+package mqtt
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+const (
+	// DefaultTopicRegex matches topics of the form devices/{device_type}/{device_name}/...
+	DefaultTopicRegex = config.DefaultTopicRegex
+	// DefaultDeviceTypeGroup is the capture group of DefaultTopicRegex holding the device type
+	DefaultDeviceTypeGroup = config.DefaultDeviceTypeGroup
+	// DefaultDeviceNameGroup is the capture group of DefaultTopicRegex holding the device name
+	DefaultDeviceNameGroup = config.DefaultDeviceNameGroup
+)
+
+// defaultTopicParser parses topics using the default format
+var defaultTopicParser = mustTopicParser(DefaultTopicRegex, DefaultDeviceTypeGroup, DefaultDeviceNameGroup)
+
+// topicParser extracts the device type and name from the concrete topic a message was delivered on.
+// Messages received through wildcard subscriptions (devices/+/+, devices/#) always carry
+// the concrete topic, so the pattern never has to deal with wildcards itself
+type topicParser struct {
+	re        *regexp.Regexp
+	typeGroup int
+	// nameGroup is the capture group holding the device name, zero when the topic has none
+	nameGroup int
+	// captures are the capture groups of a topic pattern merged into the record metadata by name
+	captures map[int]string
+}
+
+// newTopicParser creates a topic parser, see config.CompileTopicRegex for the defaults
+func newTopicParser(pattern string, typeGroup int, nameGroup int) (*topicParser, error) {
+	re, typeGroup, nameGroup, err := config.CompileTopicRegex(pattern, typeGroup, nameGroup)
+	if err != nil {
+		return nil, err
+	}
+	return &topicParser{re: re, typeGroup: typeGroup, nameGroup: nameGroup}, nil
+}
+
+// Captures of a topic pattern with a special meaning, the others are merged into the record metadata
+const (
+	// TopicCaptureDeviceType is the capture holding the device type, every topic pattern needs it
+	TopicCaptureDeviceType = config.TopicCaptureDeviceType
+	// TopicCaptureDeviceName is the capture holding the device name, used when the transformer sets none
+	TopicCaptureDeviceName = config.TopicCaptureDeviceName
+)
+
+// newTopicPatternParser creates a topic parser from a topic pattern such as sites/{site}/{device_type}/{device_name},
+// see config.CompileTopicPattern
+func newTopicPatternParser(pattern string) (*topicParser, error) {
+	re, err := config.CompileTopicPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &topicParser{re: re, captures: make(map[int]string)}
+	for i, name := range re.SubexpNames() {
+		switch name {
+		case "":
+		case TopicCaptureDeviceType:
+			p.typeGroup = i
+		case TopicCaptureDeviceName:
+			p.nameGroup = i
+		default:
+			p.captures[i] = name
+		}
+	}
+	if p.typeGroup == 0 {
+		return nil, fmt.Errorf("topic pattern %q has no {%s} capture", pattern, TopicCaptureDeviceType)
+	}
+	return p, nil
+}
+
+// configuredTopicParser creates the topic parser of the MQTT configuration, topic_pattern takes precedence over topic_regex
+func configuredTopicParser(cfg config.MQTTConfig) (*topicParser, error) {
+	if cfg.TopicPattern != "" {
+		return newTopicPatternParser(cfg.TopicPattern)
+	}
+	return newTopicParser(cfg.TopicRegex, cfg.DeviceTypeGroup, cfg.DeviceNameGroup)
+}
+
+// TopicParser resolves topics the same way the message handler does, for messages processed outside the client such as replays
+type TopicParser struct {
+	p *topicParser
+}
+
+// NewTopicParser creates the topic parser of the MQTT configuration
+func NewTopicParser(cfg config.MQTTConfig) (*TopicParser, error) {
+	p, err := configuredTopicParser(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &TopicParser{p: p}, nil
+}
+
+// DeviceName returns the device name of topic, or an empty string if the topic does not match or has no name
+func (t *TopicParser) DeviceName(topic string) string {
+	return t.p.deviceName(topic)
+}
+
+// Metadata returns the values of the metadata captures of a topic pattern by name, nil when there are none
+func (t *TopicParser) Metadata(topic string) map[string]string {
+	return t.p.metadata(topic)
+}
+
+// MergeTopicMetadata adds the captures of a topic pattern to the record metadata unless the transformer set them
+func MergeTopicMetadata(data *transformer.DeviceData, metadata map[string]string) {
+	for key, value := range metadata {
+		if data.Metadata == nil {
+			data.Metadata = make(map[string]interface{}, len(metadata))
+		}
+		if _, ok := data.Metadata[key]; !ok {
+			data.Metadata[key] = value
+		}
+	}
+}
+
+// mustTopicParser creates a topic parser and panics on error
+func mustTopicParser(pattern string, typeGroup int, nameGroup int) *topicParser {
+	p, err := newTopicParser(pattern, typeGroup, nameGroup)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// deviceType returns the device type of topic, or an empty string if the topic does not match
+func (p *topicParser) deviceType(topic string) string {
+	matches := p.re.FindStringSubmatch(topic)
+	if matches == nil {
+		return ""
+	}
+	return matches[p.typeGroup]
+}
+
+// metadata returns the values of the metadata captures of a topic pattern by name,
+// nil when the topic does not match or the parser has no such captures
+func (p *topicParser) metadata(topic string) map[string]string {
+	if len(p.captures) == 0 {
+		return nil
+	}
+	matches := p.re.FindStringSubmatch(topic)
+	if matches == nil {
+		return nil
+	}
+
+	values := make(map[string]string, len(p.captures))
+	for i, name := range p.captures {
+		values[name] = matches[i]
+	}
+	return values
+}
+
+// deviceName returns the device name of topic, or an empty string if the topic does not match or has no name
+func (p *topicParser) deviceName(topic string) string {
+	if p.nameGroup == 0 {
+		return ""
+	}
+	matches := p.re.FindStringSubmatch(topic)
+	if matches == nil {
+		return ""
+	}
+	return matches[p.nameGroup]
+}
@@ -0,0 +1,115 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultTopicParser(t *testing.T) {
+	tests := []struct {
+		topic      string
+		deviceType string
+		deviceName string
+	}{
+		{"devices/temperature/a", "temperature", "a"},
+		{"devices/temperature", "temperature", ""},
+		// deeper levels are ignored, the regex is only anchored at the start
+		{"devices/a/b/c", "a", "b"},
+		{"foo/bar", "", ""},
+		{"foo/devices/temperature/a", "", ""},
+	}
+
+	for _, tt := range tests {
+		if got := defaultTopicParser.deviceType(tt.topic); got != tt.deviceType {
+			t.Errorf("deviceType(%q) = %q, want %q", tt.topic, got, tt.deviceType)
+		}
+		if got := defaultTopicParser.deviceName(tt.topic); got != tt.deviceName {
+			t.Errorf("deviceName(%q) = %q, want %q", tt.topic, got, tt.deviceName)
+		}
+		if got := defaultTopicParser.metadata(tt.topic); got != nil {
+			t.Errorf("metadata(%q) = %v, want nil", tt.topic, got)
+		}
+	}
+}
+
+func TestNewTopicParserGroups(t *testing.T) {
+	tests := []struct {
+		name       string
+		pattern    string
+		typeGroup  int
+		nameGroup  int
+		topic      string
+		deviceType string
+		deviceName string
+		wantErr    bool
+	}{
+		{name: "defaults", topic: "devices/temperature/a", deviceType: "temperature", deviceName: "a"},
+		{name: "default regex with swapped groups", typeGroup: 2, nameGroup: 1, topic: "devices/temperature/a", deviceType: "a", deviceName: "temperature"},
+		{name: "default regex without group 3", nameGroup: 3, wantErr: true},
+		{name: "custom regex keeps no name", pattern: `^sites/([^/]+)/([^/]+)/([^/]+)`, typeGroup: 2, topic: "sites/berlin/temperature/t1", deviceType: "temperature"},
+		{name: "custom regex with name group", pattern: `^sites/([^/]+)/([^/]+)/([^/]+)`, typeGroup: 2, nameGroup: 3, topic: "sites/berlin/temperature/t1", deviceType: "temperature", deviceName: "t1"},
+		{name: "zero type group without capture groups", pattern: `^devices/.*`, wantErr: true},
+		{name: "type group out of range", pattern: `^devices/([^/]+)`, typeGroup: 2, wantErr: true},
+		{name: "negative type group", typeGroup: -1, wantErr: true},
+		{name: "negative name group", nameGroup: -1, wantErr: true},
+		{name: "invalid regex", pattern: `^devices/(`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newTopicParser(tt.pattern, tt.typeGroup, tt.nameGroup)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.deviceType(tt.topic); got != tt.deviceType {
+				t.Errorf("deviceType(%q) = %q, want %q", tt.topic, got, tt.deviceType)
+			}
+			if got := p.deviceName(tt.topic); got != tt.deviceName {
+				t.Errorf("deviceName(%q) = %q, want %q", tt.topic, got, tt.deviceName)
+			}
+		})
+	}
+}
+
+func TestTopicPatternParser(t *testing.T) {
+	p, err := newTopicPatternParser("sites/{site}/{device_type}/{device_name}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		topic      string
+		deviceType string
+		deviceName string
+		metadata   map[string]string
+	}{
+		{"sites/berlin/temperature/t1", "temperature", "t1", map[string]string{"site": "berlin"}},
+		{"sites/berlin/temperature", "", "", nil},
+		{"sites/berlin/temperature/t1/extra", "", "", nil},
+		{"devices/temperature/a", "", "", nil},
+	}
+
+	for _, tt := range tests {
+		if got := p.deviceType(tt.topic); got != tt.deviceType {
+			t.Errorf("deviceType(%q) = %q, want %q", tt.topic, got, tt.deviceType)
+		}
+		if got := p.deviceName(tt.topic); got != tt.deviceName {
+			t.Errorf("deviceName(%q) = %q, want %q", tt.topic, got, tt.deviceName)
+		}
+		if got := p.metadata(tt.topic); !reflect.DeepEqual(got, tt.metadata) {
+			t.Errorf("metadata(%q) = %v, want %v", tt.topic, got, tt.metadata)
+		}
+	}
+
+	for _, pattern := range []string{"sites/{site}/{device_name}", "sites/#/{device_type}", "sites/{device_type", "sites/{1x}/{device_type}"} {
+		if _, err := newTopicPatternParser(pattern); err == nil {
+			t.Errorf("pattern %q: expected an error", pattern)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Queue full policies of the worker pool
+const (
+	// QueuePolicyBlock blocks the MQTT callback until the queue has room, applying backpressure to the broker
+	QueuePolicyBlock = "block"
+	// QueuePolicyDrop drops the message when the queue is full
+	QueuePolicyDrop = "drop"
+)
+
+// Default worker pool settings
+const (
+	DefaultWorkers   = 4
+	DefaultQueueSize = 1000
+)
+
+// message represents a received MQTT message waiting to be processed
+type message struct {
+	topic      string
+	payload    []byte
+	properties map[string]string
+	// qos is the QoS the message was delivered with
+	qos byte
+	// ack acknowledges the message to the broker
+	ack func()
+}
+
+// workerPool processes queued messages with a fixed number of workers
+type workerPool struct {
+	queue   chan message
+	handler func(msg message)
+	drop    bool
+	wg      sync.WaitGroup
+}
+
+// newWorkerPool creates and starts a worker pool
+func newWorkerPool(workers, queueSize int, policy string, handler func(msg message)) (*workerPool, error) {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	var drop bool
+	switch policy {
+	case "", QueuePolicyBlock:
+	case QueuePolicyDrop:
+		drop = true
+	default:
+		return nil, fmt.Errorf("unsupported queue full policy: %s", policy)
+	}
+
+	p := &workerPool{
+		queue:   make(chan message, queueSize),
+		handler: handler,
+		drop:    drop,
+	}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer p.wg.Done()
+			for msg := range p.queue {
+				p.handler(msg)
+			}
+		}()
+	}
+
+	return p, nil
+}
+
+// submit enqueues a message, it returns false if the message was dropped because the queue is full
+func (p *workerPool) submit(msg message) bool {
+	if !p.drop {
+		p.queue <- msg
+		return true
+	}
+
+	select {
+	case p.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops accepting messages and waits for the workers to finish the queued ones
+func (p *workerPool) stop() {
+	close(p.queue)
+	p.wg.Wait()
+}
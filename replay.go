@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/deadletter"
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/mqtt"
+	"github.com/eddielth/data-trans/storage"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// replayFilter 选择要重放的消息，零值表示不限制
+type replayFilter struct {
+	deviceType string
+	from       time.Time
+	to         time.Time
+}
+
+// match 判断消息是否在重放范围内
+func (f replayFilter) match(deviceType string, receivedAt time.Time) bool {
+	if f.deviceType != "" && f.deviceType != deviceType {
+		return false
+	}
+	if !f.from.IsZero() && receivedAt.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && receivedAt.After(f.to) {
+		return false
+	}
+	return true
+}
+
+// parseReplayTime 解析重放时间范围，支持RFC3339和 YYYY-MM-DD（本地时间当天0点）
+func parseReplayTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("无效的时间 %q，应为RFC3339或YYYY-MM-DD格式", value)
+	}
+	return t, nil
+}
+
+// replayMessage 是从文件中读取的一条原始消息
+type replayMessage struct {
+	topic      string
+	deviceType string
+	receivedAt time.Time
+	payload    []byte
+}
+
+// replayBatchSize 是一次批量转换的最大消息数，转换一批时实时消息需要等待同一设备类型的JavaScript运行时
+const replayBatchSize = 1000
+
+// 重放模式：读取死信文件和保存了原始数据的文件存储记录，用当前的转换器重新转换并存储
+// 死信文件为 *.jsonl，文件存储记录为 *.json、*.ndjson 或压缩的 *.json.gz（不支持 Avro 记录），
+// 压缩合并后的每日归档为 *.ndjson.gz，记录的元数据中需要有 raw_payload 或 raw_payload_base64
+func runReplay(cfg *config.Config, dir string, filter replayFilter) bool {
+	// 先列出所有文件，重放中写入的新死信记录不会被再次读取
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && (strings.HasSuffix(path, ".jsonl") || storage.IsArchive(path) || strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".ndjson") || strings.HasSuffix(path, ".json.gz")) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("读取重放目录失败: %v", err)
+		return false
+	}
+	sort.Strings(files)
+
+	transformerManager, err := transformer.NewManager(cfg.Transformers, cfg.TransformersDir, cfg.Lookups)
+	if err != nil {
+		logger.Error("初始化转换器管理器失败: %v", err)
+		return false
+	}
+	transformerManager.SetMinQuality(cfg.MinQuality)
+	if err := transformerManager.SetUnitNormalization(cfg.UnitNormalization); err != nil {
+		logger.Error("初始化单位换算规则失败: %v", err)
+		return false
+	}
+	if err := loadRegistry(cfg.Registry.Path, transformerManager); err != nil {
+		logger.Error("加载设备注册表失败: %v", err)
+		return false
+	}
+
+	// 与MQTT消息处理使用相同的主题解析规则
+	topics, err := mqtt.NewTopicParser(cfg.MQTT)
+	if err != nil {
+		logger.Error("解析主题规则失败: %v", err)
+		return false
+	}
+
+	storageManager, err := initStorage(cfg)
+	if err != nil {
+		logger.Error("初始化存储系统失败: %v", err)
+		return false
+	}
+	defer storageManager.Close()
+
+	batcher := &replayBatcher{
+		transformers: transformerManager,
+		storage:      storageManager,
+		topics:       topics,
+		pending:      make(map[string][]replayMessage),
+	}
+	var skipped int
+	for _, file := range files {
+		messages, err := readReplayFile(file)
+		if err != nil {
+			logger.Error("读取重放文件 %s 失败: %v", file, err)
+			batcher.failed++
+			continue
+		}
+		for _, msg := range messages {
+			if !filter.match(msg.deviceType, msg.receivedAt) {
+				skipped++
+				continue
+			}
+			batcher.add(msg)
+		}
+	}
+	batcher.flushAll()
+
+	logger.Info("重放完成: 成功 %d 条，跳过 %d 条，失败 %d 条", batcher.replayed, skipped, batcher.failed)
+	return batcher.failed == 0
+}
+
+// replayBatcher 按设备类型收集消息，每种设备类型攒满一批后用 TransformBatch 一次转换
+type replayBatcher struct {
+	transformers *transformer.Manager
+	storage      *storage.Manager
+	topics       *mqtt.TopicParser
+	// pending 是每种设备类型等待转换的消息
+	pending  map[string][]replayMessage
+	replayed int
+	failed   int
+}
+
+// add 加入一条消息，该设备类型攒满一批时立即转换并存储
+func (b *replayBatcher) add(msg replayMessage) {
+	b.pending[msg.deviceType] = append(b.pending[msg.deviceType], msg)
+	if len(b.pending[msg.deviceType]) >= replayBatchSize {
+		b.flush(msg.deviceType)
+	}
+}
+
+// flushAll 转换并存储所有设备类型剩余的消息
+func (b *replayBatcher) flushAll() {
+	deviceTypes := make([]string, 0, len(b.pending))
+	for deviceType := range b.pending {
+		deviceTypes = append(deviceTypes, deviceType)
+	}
+	sort.Strings(deviceTypes)
+	for _, deviceType := range deviceTypes {
+		b.flush(deviceType)
+	}
+}
+
+// flush 批量转换一种设备类型等待的消息并逐条存储结果
+func (b *replayBatcher) flush(deviceType string) {
+	messages := b.pending[deviceType]
+	delete(b.pending, deviceType)
+	if len(messages) == 0 {
+		return
+	}
+
+	payloads := make([][]byte, len(messages))
+	msgCtxs := make([]transformer.MessageContext, len(messages))
+	for i, msg := range messages {
+		payloads[i] = msg.payload
+		msgCtxs[i] = transformer.MessageContext{
+			Topic:      msg.topic,
+			ReceivedAt: msg.receivedAt,
+			DeviceName: b.topics.DeviceName(msg.topic),
+		}
+	}
+	results, errs := b.transformers.TransformBatch(deviceType, payloads, msgCtxs)
+
+	for i, msg := range messages {
+		if err := b.store(msg, results[i], errs[i]); err != nil {
+			logger.Error("重放主题 %s 的消息失败: %v", msg.topic, err)
+			b.failed++
+			continue
+		}
+		b.replayed++
+	}
+}
+
+// replayFromFlags 根据命令行参数执行重放
+func replayFromFlags(cfg *config.Config) bool {
+	from, err := parseReplayTime(*replayFrom)
+	if err != nil {
+		logger.Error("解析 -replay-from 失败: %v", err)
+		return false
+	}
+	to, err := parseReplayTime(*replayTo)
+	if err != nil {
+		logger.Error("解析 -replay-to 失败: %v", err)
+		return false
+	}
+	return runReplay(cfg, *replayDir, replayFilter{deviceType: *replayType, from: from, to: to})
+}
+
+// store 存储一条消息的转换结果，err 是该消息的转换错误
+func (b *replayBatcher) store(msg replayMessage, results []transformer.DeviceData, err error) error {
+	if errors.Is(err, transformer.ErrBelowMinQuality) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// 主题模式的捕获组与MQTT消息一样加入元数据
+	topicMetadata := b.topics.Metadata(msg.topic)
+	var storeErrs []error
+	for _, result := range results {
+		mqtt.MergeTopicMetadata(&result, topicMetadata)
+		if err := b.storage.Store(msg.deviceType, result); err != nil {
+			storeErrs = append(storeErrs, err)
+		}
+	}
+	return errors.Join(storeErrs...)
+}
+
+// readReplayFile 读取文件中的原始消息，没有原始数据的存储记录被忽略
+func readReplayFile(path string) ([]replayMessage, error) {
+	// 压缩合并的每日归档，逐行读取，不把整个归档读入内存
+	if storage.IsArchive(path) {
+		var messages []replayMessage
+		var firstErr error
+		err := storage.ReadArchive(path, func(data transformer.DeviceData) {
+			msg, ok, err := storedMessage(data)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if ok {
+				messages = append(messages, msg)
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("读取归档失败: %v", err)
+		}
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return messages, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// 单个存储记录文件，压缩的记录文件先解压
+	if strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".ndjson") || strings.HasSuffix(path, ".json.gz") {
+		var reader io.Reader = file
+		if strings.HasSuffix(path, ".gz") {
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				return nil, fmt.Errorf("解压存储记录失败: %v", err)
+			}
+			defer gz.Close()
+			reader = gz
+		}
+
+		var data transformer.DeviceData
+		if err := json.NewDecoder(reader).Decode(&data); err != nil {
+			return nil, fmt.Errorf("解析存储记录失败: %v", err)
+		}
+		msg, ok, err := storedMessage(data)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return []replayMessage{msg}, nil
+	}
+
+	// 死信文件，每行一条记录
+	var messages []replayMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record deadletter.Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("解析第 %d 行死信记录失败: %v", line, err)
+		}
+		messages = append(messages, replayMessage{
+			topic:      record.Topic,
+			deviceType: record.DeviceType,
+			receivedAt: time.UnixMilli(record.Timestamp),
+			payload:    record.Payload,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// storedMessage 从存储记录的元数据中取出原始数据和主题
+func storedMessage(data transformer.DeviceData) (replayMessage, bool, error) {
+	msg := replayMessage{
+		deviceType: data.DeviceType,
+		receivedAt: time.UnixMilli(data.Timestamp),
+	}
+	msg.topic, _ = data.Metadata["topic"].(string)
+
+	if raw, ok := data.Metadata["raw_payload"].(string); ok {
+		msg.payload = []byte(raw)
+		return msg, true, nil
+	}
+	if encoded, ok := data.Metadata["raw_payload_base64"].(string); ok {
+		payload, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return msg, false, fmt.Errorf("解码原始数据失败: %v", err)
+		}
+		msg.payload = payload
+		return msg, true, nil
+	}
+	return msg, false, nil
+}
@@ -0,0 +1,142 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/transformer"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+)
+
+// Engine evaluates routing rules on transformed records, it is safe for concurrent use
+type Engine struct {
+	rules []rule
+}
+
+// rule is a compiled routing rule
+type rule struct {
+	config.Rule
+	program cel.Program
+}
+
+// NewEngine compiles the conditions of the rules, nil is returned when there are no rules.
+// A condition can use the variables record (the record as JSON object), attributes
+// (attribute values by name) and device_type, and must evaluate to a bool
+func NewEngine(cfgs []config.Rule) (*Engine, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+
+	env, err := cel.NewEnv(
+		cel.Variable("record", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("attributes", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("device_type", cel.StringType),
+		ext.Strings(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rule environment: %v", err)
+	}
+
+	e := &Engine{rules: make([]rule, 0, len(cfgs))}
+	for _, cfg := range cfgs {
+		ast, issues := env.Compile(cfg.Condition)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("failed to compile condition of rule %s: %v", cfg.Name, issues.Err())
+		}
+		if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+			return nil, fmt.Errorf("condition of rule %s must evaluate to bool, got %v", cfg.Name, ast.OutputType())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create program of rule %s: %v", cfg.Name, err)
+		}
+		e.rules = append(e.rules, rule{Rule: cfg, program: program})
+	}
+
+	logger.Info("loaded %d routing rules", len(e.rules))
+	return e, nil
+}
+
+// Match returns the rules whose condition is true for data. A condition that fails to
+// evaluate, e.g. because it reads an attribute the record does not have, does not match
+func (e *Engine) Match(deviceType string, data transformer.DeviceData) []config.Rule {
+	activation, err := activation(deviceType, data)
+	if err != nil {
+		logger.Warn("failed to evaluate rules for device %s/%s: %v", deviceType, data.DeviceName, err)
+		return nil
+	}
+
+	var matched []config.Rule
+	for _, r := range e.rules {
+		result, _, err := r.program.Eval(activation)
+		if err != nil {
+			logger.Debug("rule %s not evaluated for device %s/%s: %v", r.Name, deviceType, data.DeviceName, err)
+			continue
+		}
+		if ok, isBool := result.Value().(bool); isBool && ok {
+			matched = append(matched, r.Rule)
+		}
+	}
+	return matched
+}
+
+// activation returns the variables conditions are evaluated with
+func activation(deviceType string, data transformer.DeviceData) (map[string]interface{}, error) {
+	// Through JSON so the record has the same field names and value types as stored data
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return nil, err
+	}
+
+	attributes := make(map[string]interface{}, len(data.Attributes))
+	if list, ok := record["attributes"].([]interface{}); ok {
+		for _, item := range list {
+			if attr, ok := item.(map[string]interface{}); ok {
+				if name, ok := attr["name"].(string); ok {
+					attributes[name] = attr["value"]
+				}
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"record":      record,
+		"attributes":  attributes,
+		"device_type": deviceType,
+	}, nil
+}
+
+// Topic returns the publish topic of rule for data, with {device_type}, {device_name} and {rule} replaced
+func Topic(rule config.Rule, deviceType string, data transformer.DeviceData) string {
+	return strings.NewReplacer(
+		"{device_type}", deviceType,
+		"{device_name}", data.DeviceName,
+		"{rule}", rule.Name,
+	).Replace(rule.PublishTopic)
+}
+
+// Alert returns the copy of data published and stored for a matched rule, the name of the
+// rule and the device type of the record are added to its metadata
+func Alert(rule config.Rule, deviceType string, data transformer.DeviceData) transformer.DeviceData {
+	metadata := make(map[string]interface{}, len(data.Metadata)+2)
+	for key, value := range data.Metadata {
+		metadata[key] = value
+	}
+	metadata["rule"] = rule.Name
+	metadata["source_device_type"] = deviceType
+
+	alert := data
+	alert.Metadata = metadata
+	if rule.StoreAs != "" {
+		alert.DeviceType = rule.StoreAs
+	}
+	return alert
+}
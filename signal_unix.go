@@ -0,0 +1,52 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/mqtt"
+)
+
+// 监听日志级别信号：SIGUSR1 把日志级别切换为DEBUG，SIGUSR2 恢复配置文件中的日志级别
+func watchLevelSignals() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range sigChan {
+			switch sig {
+			case syscall.SIGUSR1:
+				logger.SetLevel(logger.DEBUG)
+				logger.Warn("收到 SIGUSR1，日志级别已切换为 DEBUG，发送 SIGUSR2 恢复")
+			case syscall.SIGUSR2:
+				level := logger.ResetLevel()
+				logger.Warn("收到 SIGUSR2，日志级别已恢复为 %s", level)
+			}
+		}
+	}()
+}
+
+// 监听暂停信号：SIGTSTP 暂停接收消息，SIGCONT 恢复。捕获 SIGTSTP 后进程不会被挂起，连接保持
+func watchPauseSignals(mqttManager *mqtt.Manager) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTSTP, syscall.SIGCONT)
+
+	go func() {
+		for sig := range sigChan {
+			switch sig {
+			case syscall.SIGTSTP:
+				if mqttManager.Pause() {
+					logger.Warn("收到 SIGTSTP，已暂停接收消息，发送 SIGCONT 恢复")
+				}
+			case syscall.SIGCONT:
+				if mqttManager.Resume() {
+					logger.Warn("收到 SIGCONT，已恢复接收消息")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,9 @@
+package main
+
+import "github.com/eddielth/data-trans/mqtt"
+
+// Windows 没有 SIGUSR1 和 SIGUSR2，日志级别只能通过配置文件修改
+func watchLevelSignals() {}
+
+// Windows 没有 SIGTSTP 和 SIGCONT，只能通过HTTP接口暂停接收消息
+func watchPauseSignals(mqttManager *mqtt.Manager) {}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// AvroSchema is the Avro schema of stored device data. Attribute values are a union of the
+// scalar types, objects and arrays are JSON encoded strings like in the SQL backends.
+// Attribute metadata is JSON encoded and record metadata values are strings
+const AvroSchema = `{
+  "type": "record",
+  "name": "DeviceData",
+  "namespace": "data_trans",
+  "fields": [
+    {"name": "device_name", "type": "string"},
+    {"name": "device_type", "type": "string"},
+    {"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "attributes", "type": {"type": "array", "items": {
+      "type": "record",
+      "name": "DeviceAttribute",
+      "fields": [
+        {"name": "name", "type": "string"},
+        {"name": "type", "type": "string"},
+        {"name": "value", "type": ["null", "boolean", "long", "double", "string"]},
+        {"name": "unit", "type": "string"},
+        {"name": "quality", "type": "int"},
+        {"name": "metadata", "type": ["null", "string"]}
+      ]
+    }}},
+    {"name": "metadata", "type": {"type": "map", "values": "string"}}
+  ]
+}`
+
+// Branches of the attribute value union in AvroSchema
+const (
+	avroNull = iota
+	avroBoolean
+	avroLong
+	avroDouble
+	avroString
+)
+
+// avroMagic starts every Avro object container file
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+// avroSerializer encodes data as an Avro object container file holding one record
+type avroSerializer struct {
+	// header is the encoded file header, the schema is compacted once
+	header []byte
+	sync   [16]byte
+}
+
+// newAvroSerializer creates an Avro serializer with a random sync marker
+func newAvroSerializer() (*avroSerializer, error) {
+	var schema bytes.Buffer
+	if err := json.Compact(&schema, []byte(AvroSchema)); err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %v", err)
+	}
+
+	s := &avroSerializer{}
+	if _, err := rand.Read(s.sync[:]); err != nil {
+		return nil, fmt.Errorf("generate avro sync marker failed: %v", err)
+	}
+
+	var header avroEncoder
+	header.buf.Write(avroMagic)
+	// File metadata is a map of bytes
+	header.writeLong(2)
+	header.writeString("avro.codec")
+	header.writeString("null")
+	header.writeString("avro.schema")
+	header.writeString(schema.String())
+	header.writeLong(0)
+	header.buf.Write(s.sync[:])
+	s.header = header.buf.Bytes()
+	return s, nil
+}
+
+// MarshalDeviceData implements Serializer
+func (s *avroSerializer) MarshalDeviceData(data transformer.DeviceData) ([]byte, error) {
+	var record avroEncoder
+	if err := record.writeDeviceData(data); err != nil {
+		return nil, err
+	}
+
+	var file avroEncoder
+	file.buf.Write(s.header)
+	// One block holding one record
+	file.writeLong(1)
+	file.writeLong(int64(record.buf.Len()))
+	file.buf.Write(record.buf.Bytes())
+	file.buf.Write(s.sync[:])
+	return file.buf.Bytes(), nil
+}
+
+// Extension implements Serializer
+func (*avroSerializer) Extension() string {
+	return ".avro"
+}
+
+// avroEncoder writes values in the Avro binary encoding
+type avroEncoder struct {
+	buf bytes.Buffer
+}
+
+// writeDeviceData writes data as a DeviceData record of AvroSchema
+func (e *avroEncoder) writeDeviceData(data transformer.DeviceData) error {
+	e.writeString(data.DeviceName)
+	e.writeString(data.DeviceType)
+	e.writeLong(data.Timestamp)
+
+	if len(data.Attributes) > 0 {
+		e.writeLong(int64(len(data.Attributes)))
+		for _, attr := range data.Attributes {
+			e.writeString(attr.Name)
+			e.writeString(attr.Type)
+			e.writeValue(attr.Value)
+			e.writeString(attr.Unit)
+			e.writeLong(int64(attr.Quality))
+			if attr.Metadata == nil {
+				e.writeLong(avroNull)
+			} else {
+				metadata, err := json.Marshal(attr.Metadata)
+				if err != nil {
+					return fmt.Errorf("%w: serialize attribute metadata failed: %v", ErrInvalidData, err)
+				}
+				e.writeLong(1)
+				e.writeString(string(metadata))
+			}
+		}
+	}
+	e.writeLong(0)
+
+	if len(data.Metadata) > 0 {
+		// Sorted so equal data is encoded to equal bytes
+		keys := make([]string, 0, len(data.Metadata))
+		for key := range data.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		e.writeLong(int64(len(keys)))
+		for _, key := range keys {
+			e.writeString(key)
+			e.writeString(valueString(data.Metadata[key]))
+		}
+	}
+	e.writeLong(0)
+	return nil
+}
+
+// writeValue writes an attribute value as the matching branch of the value union
+func (e *avroEncoder) writeValue(value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		e.writeLong(avroNull)
+	case bool:
+		e.writeLong(avroBoolean)
+		if v {
+			e.buf.WriteByte(1)
+		} else {
+			e.buf.WriteByte(0)
+		}
+	case int:
+		e.writeLong(avroLong)
+		e.writeLong(int64(v))
+	case int32:
+		e.writeLong(avroLong)
+		e.writeLong(int64(v))
+	case int64:
+		e.writeLong(avroLong)
+		e.writeLong(v)
+	case float32:
+		e.writeLong(avroDouble)
+		e.writeDouble(float64(v))
+	case float64:
+		e.writeLong(avroDouble)
+		e.writeDouble(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			e.writeLong(avroLong)
+			e.writeLong(i)
+		} else if f, err := v.Float64(); err == nil {
+			e.writeLong(avroDouble)
+			e.writeDouble(f)
+		} else {
+			e.writeLong(avroString)
+			e.writeString(v.String())
+		}
+	default:
+		e.writeLong(avroString)
+		e.writeString(valueString(v))
+	}
+}
+
+// writeLong writes n as a zig-zag encoded variable-length integer, also used for int
+func (e *avroEncoder) writeLong(n int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.buf.Write(buf[:binary.PutVarint(buf[:], n)])
+}
+
+// writeString writes s as its length followed by its UTF-8 bytes, also used for bytes
+func (e *avroEncoder) writeString(s string) {
+	e.writeLong(int64(len(s)))
+	e.buf.WriteString(s)
+}
+
+// writeDouble writes f as 8 bytes in little-endian order
+func (e *avroEncoder) writeDouble(f float64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+	e.buf.Write(buf[:])
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/metrics"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// Default circuit breaker settings
+const (
+	// DefaultCircuitFailureThreshold is the number of consecutive failures opening a circuit when none is configured
+	DefaultCircuitFailureThreshold = 5
+	// DefaultCircuitCooldown is how long an open circuit skips its backend when no cooldown is configured
+	DefaultCircuitCooldown = 30 * time.Second
+)
+
+// ErrInvalidData marks store errors caused by the data itself, such as metadata that cannot be serialized.
+// They would fail on every backend and retry, so they do not count towards opening the circuit
+var ErrInvalidData = errors.New("invalid data")
+
+// ErrCircuitOpen is returned for backends skipped because their circuit is open
+var ErrCircuitOpen = errors.New("circuit open")
+
+// errorClass classifies the outcome of a backend store
+type errorClass int
+
+// Error classes of a failed store
+const (
+	// errorClassNone is a successful store
+	errorClassNone errorClass = iota
+	// errorClassBackend is a failure of the backend, e.g. a lost connection or a timeout
+	errorClassBackend
+	// errorClassData is a failure caused by the stored data
+	errorClassData
+	// errorClassCanceled is a store aborted because the service is shutting down
+	errorClassCanceled
+)
+
+// classifyError returns the error class of a store error, ctx is the context the store ran with
+func classifyError(ctx context.Context, err error) errorClass {
+	switch {
+	case err == nil:
+		return errorClassNone
+	case errors.Is(err, ErrInvalidData):
+		return errorClassData
+	case errors.Is(ctx.Err(), context.Canceled):
+		return errorClassCanceled
+	default:
+		return errorClassBackend
+	}
+}
+
+// Circuit breaker states
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker skips a backend after consecutive failures. Once the cooldown has passed
+// a single store is let through (half-open): success closes the circuit, failure opens it again
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mutex     sync.Mutex
+	state     int
+	failures  int
+	openUntil time.Time
+}
+
+// newCircuitBreaker creates a closed circuit breaker for the named backend
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	if cooldown <= 0 {
+		cooldown = DefaultCircuitCooldown
+	}
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a store may be attempted
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		// Let one store through to test whether the backend recovered
+		b.state = circuitHalfOpen
+		logger.Info("Circuit of %s storage backend half-open, testing recovery", b.name)
+		return true
+	case circuitHalfOpen:
+		// The test store is still running
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the circuit with the error class of a store that was allowed
+func (b *circuitBreaker) record(class errorClass) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch class {
+	case errorClassBackend:
+		b.failures++
+		if b.state == circuitHalfOpen || b.failures >= b.threshold {
+			if b.state != circuitOpen {
+				logger.Error("Circuit of %s storage backend opened after %d consecutive failures, skipping it for %v", b.name, b.failures, b.cooldown)
+			}
+			b.state = circuitOpen
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+	case errorClassCanceled:
+		// Says nothing about the backend, a test store is retried with the next message
+		if b.state == circuitHalfOpen {
+			b.state = circuitOpen
+		}
+	default:
+		// The backend accepted the store or rejected only the data, so it is reachable
+		if b.state != circuitClosed {
+			logger.Info("Circuit of %s storage backend closed, backend recovered", b.name)
+		}
+		b.state = circuitClosed
+		b.failures = 0
+	}
+}
+
+// SetCircuitBreaker enables a circuit breaker per backend: after threshold consecutive failures
+// the backend is skipped for cooldown, then one store tests whether it recovered. 0 disables it
+func (m *Manager) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	m.breakerMutex.Lock()
+	defer m.breakerMutex.Unlock()
+
+	m.breakerThreshold = threshold
+	m.breakerCooldown = cooldown
+	// Start over with closed circuits using the new settings
+	m.breakers = nil
+}
+
+// breaker returns the circuit breaker of backend, nil when circuit breaking is disabled
+func (m *Manager) breaker(backend StorageBackend) *circuitBreaker {
+	m.breakerMutex.Lock()
+	defer m.breakerMutex.Unlock()
+
+	if m.breakerThreshold <= 0 {
+		return nil
+	}
+	if b, ok := m.breakers[backend]; ok {
+		return b
+	}
+	if m.breakers == nil {
+		m.breakers = make(map[StorageBackend]*circuitBreaker)
+	}
+	b := newCircuitBreaker(backendType(backend), m.breakerThreshold, m.breakerCooldown)
+	m.breakers[backend] = b
+	return b
+}
+
+// forgetBreaker drops the circuit breaker of a removed backend
+func (m *Manager) forgetBreaker(backend StorageBackend) {
+	m.breakerMutex.Lock()
+	defer m.breakerMutex.Unlock()
+
+	delete(m.breakers, backend)
+}
+
+// storeBackend stores data to one backend unless its circuit is open, which returns ErrCircuitOpen
+func (m *Manager) storeBackend(ctx context.Context, backend StorageBackend, deviceType string, data transformer.DeviceData) error {
+	b := m.breaker(backend)
+	if b == nil {
+		return backend.StoreCtx(ctx, deviceType, data)
+	}
+
+	if !b.allow() {
+		metrics.Inc(metrics.CircuitOpenSkips)
+		return ErrCircuitOpen
+	}
+	err := backend.StoreCtx(ctx, deviceType, data)
+	b.record(classifyError(ctx, err))
+	return err
+}
+
+// logStoreFailure logs a failed backend store, skips of open circuits are only logged at debug level
+func logStoreFailure(backend StorageBackend, err error) {
+	if errors.Is(err, ErrCircuitOpen) {
+		logger.DebugKV("Skipped storage backend", logger.Fields{"backend": backendType(backend), "reason": err})
+		return
+	}
+	logger.ErrorKV("Failed to store data to backend", logger.Fields{"backend": backendType(backend), "error": err})
+}
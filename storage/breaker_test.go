@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// fakeBackend records the device names it stored and fails with err while it is set
+type fakeBackend struct {
+	mu     sync.Mutex
+	err    error
+	calls  int
+	stored []string
+}
+
+func (f *fakeBackend) Store(deviceType string, data transformer.DeviceData) error {
+	return f.StoreCtx(context.Background(), deviceType, data)
+}
+
+func (f *fakeBackend) StoreCtx(ctx context.Context, deviceType string, data transformer.DeviceData) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	f.stored = append(f.stored, data.DeviceName)
+	return nil
+}
+
+func (f *fakeBackend) Close() error {
+	return nil
+}
+
+func (f *fakeBackend) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *fakeBackend) storedNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.stored...)
+}
+
+func (f *fakeBackend) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func TestCircuitBreakerCycle(t *testing.T) {
+	b := newCircuitBreaker("test", 2, 50*time.Millisecond)
+
+	b.record(errorClassBackend)
+	if !b.allow() {
+		t.Fatal("circuit opened before reaching the threshold")
+	}
+	b.record(errorClassBackend)
+	if b.allow() {
+		t.Fatal("circuit still closed after reaching the threshold")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("circuit did not half-open after the cooldown")
+	}
+	if b.allow() {
+		t.Error("half-open circuit let a second store through while testing")
+	}
+
+	// A failing test store opens the circuit for another cooldown
+	b.record(errorClassBackend)
+	if b.allow() {
+		t.Fatal("circuit not open again after a failed test store")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("circuit did not half-open after the second cooldown")
+	}
+	b.record(errorClassNone)
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatal("circuit not closed after a successful test store")
+		}
+	}
+}
+
+func TestCircuitBreakerIgnoresDataErrors(t *testing.T) {
+	b := newCircuitBreaker("test", 1, time.Minute)
+
+	b.record(classifyError(context.Background(), errors.Join(ErrInvalidData, errors.New("bad metadata"))))
+	if !b.allow() {
+		t.Error("a data error opened the circuit")
+	}
+}
+
+func TestManagerSkipsOpenCircuit(t *testing.T) {
+	backend := &fakeBackend{err: errors.New("connection refused")}
+	m := NewManager([]StorageBackend{backend})
+	m.SetCircuitBreaker(2, 50*time.Millisecond)
+
+	data := transformer.DeviceData{DeviceName: "sensor1"}
+	for i := 0; i < 4; i++ {
+		m.Store("temperature", data)
+	}
+	if got := backend.callCount(); got != 2 {
+		t.Fatalf("backend called %d times, want 2 before the circuit opened", got)
+	}
+
+	backend.setErr(nil)
+	time.Sleep(60 * time.Millisecond)
+	m.Store("temperature", data)
+	m.Store("temperature", data)
+	if got := backend.storedNames(); len(got) != 2 {
+		t.Errorf("stored %d records after the cooldown, want 2", len(got))
+	}
+}
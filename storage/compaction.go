@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// DefaultCompactionInterval is how often completed days are compacted when no interval is configured
+const DefaultCompactionInterval = time.Hour
+
+// archiveSuffix is the file name suffix of daily archives
+const archiveSuffix = ".ndjson.gz"
+
+// compactionGrace is how long after midnight a day is considered complete,
+// so a write that started just before midnight has finished before its day is compacted
+const compactionGrace = time.Minute
+
+// CompactionOptions controls rolling the files of completed days into daily archives
+type CompactionOptions struct {
+	Enabled bool
+	// Interval is how often completed days are compacted, zero falls back to DefaultCompactionInterval
+	Interval time.Duration
+	// KeepOriginals keeps the compacted files instead of removing them
+	KeepOriginals bool
+}
+
+// compactionLoop compacts completed days every interval until the storage is closed
+func (fs *FileStorage) compactionLoop(interval time.Duration) {
+	defer fs.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := fs.Compact(fs.clock.Now()); err != nil {
+			logger.Error("compact files failed: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-fs.done:
+			return
+		}
+	}
+}
+
+// Compact merges the files of every device type and completed day before now into
+// deviceType/YYYY-MM-DD.ndjson.gz, one JSON record per line. Files are grouped by the
+// write date in their names, so files of a day can no longer be created once it is over
+func (fs *FileStorage) Compact(now time.Time) error {
+	entries, err := os.ReadDir(fs.basePath)
+	if err != nil {
+		return fmt.Errorf("read dir %s failed: %v", fs.basePath, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if err := fs.compactDeviceType(filepath.Join(fs.basePath, entry.Name()), now); err != nil {
+			logger.Error("compact files of device type %s failed: %v", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// compactDeviceType compacts the completed days of one device type directory
+func (fs *FileStorage) compactDeviceType(deviceDir string, now time.Time) error {
+	days := make(map[time.Time][]string)
+	err := filepath.WalkDir(deviceDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isRecordFile(path) {
+			return nil
+		}
+		day, ok := fileDay(d.Name())
+		if !ok || now.Before(day.AddDate(0, 0, 1).Add(compactionGrace)) {
+			return nil
+		}
+		days[day] = append(days[day], path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for day, files := range days {
+		if err := fs.compactDay(deviceDir, day, files); err != nil {
+			logger.Error("compact files of %s in %s failed: %v", day.Format("2006-01-02"), deviceDir, err)
+		}
+	}
+	return nil
+}
+
+// fileDay returns the local day a file was written from its name, e.g. 20060102-150405.000.json
+func fileDay(name string) (time.Time, bool) {
+	if len(name) < 8 {
+		return time.Time{}, false
+	}
+	day, err := time.ParseInLocation("20060102", name[:8], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return day, true
+}
+
+// compactDay writes the files of one day into its archive and removes them unless originals are kept.
+// Files of a day that already has an archive, e.g. written late or left over from a run interrupted while
+// removing them, are appended to it unless their record is already archived. The archive is written to a
+// temporary file and renamed, so an interrupted run leaves no partial archive
+func (fs *FileStorage) compactDay(deviceDir string, day time.Time, files []string) error {
+	archive := filepath.Join(deviceDir, day.Format("2006-01-02")+archiveSuffix)
+	archived, err := archiveLines(archive)
+	if err != nil {
+		return fmt.Errorf("read archive %s failed: %v", archive, err)
+	}
+
+	sort.Strings(files)
+
+	var lines [][]byte
+	var compacted, pending []string
+	for _, path := range files {
+		content, err := readRecordFile(path)
+		if err != nil {
+			return fmt.Errorf("read file %s failed: %v", path, err)
+		}
+
+		var line bytes.Buffer
+		if err := json.Compact(&line, content); err != nil {
+			logger.Warn("skip unparseable file %s: %v", path, err)
+			continue
+		}
+		compacted = append(compacted, path)
+		if archived[line.String()] {
+			continue
+		}
+		line.WriteByte('\n')
+		lines = append(lines, line.Bytes())
+		pending = append(pending, path)
+	}
+	if len(compacted) == 0 {
+		return nil
+	}
+
+	if len(pending) > 0 {
+		if err := fs.writeArchive(deviceDir, archive, archived != nil, lines); err != nil {
+			return err
+		}
+		logger.Info("compacted %d files into %s", len(pending), archive)
+	}
+
+	if !fs.compaction.KeepOriginals {
+		fs.removeCompacted(deviceDir, compacted)
+	}
+	return nil
+}
+
+// archiveLines returns the records of an archive as compact JSON lines, nil when it does not exist
+func archiveLines(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	lines := make(map[string]bool)
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		lines[scanner.Text()] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// writeArchive writes lines to archive through a temporary file, after the records of the existing archive when appending
+func (fs *FileStorage) writeArchive(deviceDir string, archive string, appending bool, lines [][]byte) error {
+	tmp := archive + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create file %s failed: %v", tmp, err)
+	}
+	defer os.Remove(tmp)
+
+	gz := gzip.NewWriter(file)
+	if appending {
+		if err := copyArchive(gz, archive); err != nil {
+			file.Close()
+			return fmt.Errorf("read archive %s failed: %v", archive, err)
+		}
+	}
+	for _, line := range lines {
+		if _, err := gz.Write(line); err != nil {
+			file.Close()
+			return fmt.Errorf("write file %s failed: %v", tmp, err)
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		file.Close()
+		return fmt.Errorf("write file %s failed: %v", tmp, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync file %s failed: %v", tmp, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close file %s failed: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, archive); err != nil {
+		return fmt.Errorf("rename file %s failed: %v", tmp, err)
+	}
+	// Make the archive name durable before the originals are removed
+	if fs.fsync == FsyncFull {
+		if err := syncDir(deviceDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyArchive writes the decompressed records of archive to w
+func copyArchive(w io.Writer, archive string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	_, err = io.Copy(w, gz)
+	return err
+}
+
+// removeCompacted removes compacted files and the partition directories left empty
+func (fs *FileStorage) removeCompacted(deviceDir string, files []string) {
+	for _, path := range files {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Warn("remove compacted file %s failed: %v", path, err)
+			continue
+		}
+		// Removing a non-empty directory fails, which stops at the first one still in use
+		for dir := filepath.Dir(path); dir != deviceDir && strings.HasPrefix(dir, deviceDir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+}
+
+// readArchive reads the records of a daily archive
+func readArchive(path string) ([]transformer.DeviceData, error) {
+	var results []transformer.DeviceData
+	err := ReadArchive(path, func(data transformer.DeviceData) {
+		results = append(results, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// IsArchive reports whether path is a daily archive written by compaction
+func IsArchive(path string) bool {
+	return strings.HasSuffix(path, archiveSuffix)
+}
+
+// ReadArchive calls fn for each record of a daily archive written by compaction, line by line
+// so the archive is never held in memory. Unparseable lines are logged and skipped
+func ReadArchive(path string, fn func(data transformer.DeviceData)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var data transformer.DeviceData
+		if err := json.Unmarshal(scanner.Bytes(), &data); err != nil {
+			logger.Warn("skip unparseable line in %s: %v", path, err)
+			continue
+		}
+		fn(data)
+	}
+	return scanner.Err()
+}
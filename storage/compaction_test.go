@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eddielth/data-trans/clock"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// newTestFileStorage creates a json file storage in a temporary directory running on c
+func newTestFileStorage(t *testing.T, c clock.Clock, compaction CompactionOptions) (*FileStorage, string) {
+	t.Helper()
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir, PartitionNone, CompressNone, "", FsyncNone, compaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetClock(c)
+	t.Cleanup(func() { fs.Close() })
+	return fs, dir
+}
+
+// storeAt stores a record of device a while c shows now
+func storeAt(t *testing.T, fs *FileStorage, c *clock.Fake, now time.Time) {
+	t.Helper()
+	c.Set(now)
+	data := transformer.DeviceData{DeviceName: "a", DeviceType: "temperature", Timestamp: now.UnixMilli()}
+	if err := fs.Store("temperature", data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileNamedByClock(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 3, 1, 12, 30, 45, 123e6, time.Local))
+	fs, dir := newTestFileStorage(t, c, CompactionOptions{})
+
+	storeAt(t, fs, c, c.Now())
+
+	if _, err := os.Stat(filepath.Join(dir, "temperature", "20240301-123045.123.json")); err != nil {
+		t.Fatalf("file not named after the clock: %v", err)
+	}
+}
+
+func TestCompactCompletedDays(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	c := clock.NewFake(day)
+	fs, dir := newTestFileStorage(t, c, CompactionOptions{})
+	deviceDir := filepath.Join(dir, "temperature")
+
+	storeAt(t, fs, c, day.Add(10*time.Hour))
+	storeAt(t, fs, c, day.Add(23*time.Hour))
+	storeAt(t, fs, c, day.AddDate(0, 0, 1).Add(time.Hour))
+	archive := filepath.Join(deviceDir, "2024-03-01"+archiveSuffix)
+
+	// Within the grace period after midnight the day is not complete yet
+	if err := fs.Compact(day.AddDate(0, 0, 1).Add(compactionGrace / 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(archive); !os.IsNotExist(err) {
+		t.Fatalf("day compacted within the grace period: %v", err)
+	}
+
+	if err := fs.Compact(day.AddDate(0, 0, 1).Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	records, err := readArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("archive holds %d records, want 2", len(records))
+	}
+
+	entries, err := os.ReadDir(deviceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := []string{"2024-03-01" + archiveSuffix, "20240302-010000.000.json"}
+	if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] {
+		t.Errorf("device directory holds %v, want %v", names, want)
+	}
+}
+
+func TestCompactKeepOriginals(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	c := clock.NewFake(day)
+	fs, dir := newTestFileStorage(t, c, CompactionOptions{KeepOriginals: true})
+	compactAt := day.AddDate(0, 0, 2)
+
+	storeAt(t, fs, c, day.Add(time.Hour))
+	// A second run must not archive the kept originals again
+	for i := 0; i < 2; i++ {
+		if err := fs.Compact(compactAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := readArchive(filepath.Join(dir, "temperature", "2024-03-01"+archiveSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("archive holds %d records, want 1", len(records))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "temperature", "20240301-010000.000.json")); err != nil {
+		t.Errorf("original removed although keep_originals is set: %v", err)
+	}
+}
+
+func TestCompactAppendsLateFiles(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	c := clock.NewFake(day)
+	fs, dir := newTestFileStorage(t, c, CompactionOptions{})
+	compactAt := day.AddDate(0, 0, 2)
+
+	storeAt(t, fs, c, day.Add(time.Hour))
+	if err := fs.Compact(compactAt); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file of the compacted day that is not in the archive yet, e.g. restored from a backup
+	storeAt(t, fs, c, day.Add(2*time.Hour))
+	if err := fs.Compact(compactAt); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := readArchive(filepath.Join(dir, "temperature", "2024-03-01"+archiveSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("archive holds %d records, want 2", len(records))
+	}
+	if records[0].Timestamp != day.Add(time.Hour).UnixMilli() || records[1].Timestamp != day.Add(2*time.Hour).UnixMilli() {
+		t.Errorf("archive holds timestamps %d and %d, want the first file followed by the late one", records[0].Timestamp, records[1].Timestamp)
+	}
+}
+
+func TestFileStorageCloseTwice(t *testing.T) {
+	// The compaction loop is running, so the clock is not replaced
+	fs, err := NewFileStorage(t.TempDir(), PartitionNone, CompressNone, "", FsyncNone, CompactionOptions{Enabled: true, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
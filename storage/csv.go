@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// csvFixedColumns are the columns every CSV file starts with, attribute columns follow
+var csvFixedColumns = []string{"device_name", "device_type", "timestamp", "metadata"}
+
+// csvAttributePrefix is prepended to the column of an attribute named like a fixed column or starting with the prefix
+const csvAttributePrefix = "attr_"
+
+// CSVStorage represents a storage backend that appends rows to per-device-type CSV files.
+//
+// Every attribute becomes a column named after the attribute, attributes named like a fixed
+// column or starting with attr_ get the attr_ prefix. Files are rotated by date,
+// one file per device type per day. When a record carries an attribute that is not yet in
+// the header, the file is rewritten with the new column appended so the header is always
+// a superset of all attribute names seen in that file; older rows get an empty cell.
+type CSVStorage struct {
+	basePath string
+	// headers caches the header of each file that has been written, keyed by file path
+	headers map[string][]string
+	mu      sync.Mutex
+}
+
+// NewCSVStorage creates a new CSV storage backend
+func NewCSVStorage(basePath string) (*CSVStorage, error) {
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, fmt.Errorf("create dir %s failed: %v", basePath, err)
+	}
+
+	logger.Info("init csv storage: %s", basePath)
+	return &CSVStorage{
+		basePath: basePath,
+		headers:  make(map[string][]string),
+	}, nil
+}
+
+// Store appends data as a row to the device type's CSV file of the day
+func (cs *CSVStorage) Store(deviceType string, data transformer.DeviceData) error {
+	return cs.StoreCtx(context.Background(), deviceType, data)
+}
+
+// StoreCtx appends data as a row to the device type's CSV file of the day, nothing is written once ctx is done
+func (cs *CSVStorage) StoreCtx(ctx context.Context, deviceType string, data transformer.DeviceData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	deviceDir := filepath.Join(cs.basePath, deviceType)
+	if err := os.MkdirAll(deviceDir, 0755); err != nil {
+		return fmt.Errorf("create dir %s failed: %v", deviceDir, err)
+	}
+
+	filename := filepath.Join(deviceDir, time.Now().Format("2006-01-02")+".csv")
+
+	header, err := cs.loadHeader(filename)
+	if err != nil {
+		return err
+	}
+
+	// Collect attribute columns missing from the header
+	known := make(map[string]bool, len(header))
+	for _, column := range header {
+		known[column] = true
+	}
+	var newColumns []string
+	for _, attr := range data.Attributes {
+		column := csvColumn(attr.Name)
+		if !known[column] {
+			known[column] = true
+			newColumns = append(newColumns, column)
+		}
+	}
+
+	if header == nil {
+		header = append(append([]string{}, csvFixedColumns...), sortedColumns(newColumns)...)
+		if err := cs.rewrite(filename, header); err != nil {
+			return err
+		}
+	} else if len(newColumns) > 0 {
+		header = append(header, sortedColumns(newColumns)...)
+		if err := cs.rewrite(filename, header); err != nil {
+			return err
+		}
+		logger.Info("csv header of %s extended with %v", filename, newColumns)
+	}
+	cs.headers[filename] = header
+
+	row, err := csvRow(header, data)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open file %s failed: %v", filename, err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	if err := writer.Write(row); err != nil {
+		return fmt.Errorf("write file %s failed: %v", filename, err)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("write file %s failed: %v", filename, err)
+	}
+
+	logger.Debug("has stored data to csv file: %s", filename)
+	return nil
+}
+
+// loadHeader returns the header of the given file, nil if the file does not exist yet
+func (cs *CSVStorage) loadHeader(filename string) ([]string, error) {
+	if header, ok := cs.headers[filename]; ok {
+		return header, nil
+	}
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open file %s failed: %v", filename, err)
+	}
+	defer file.Close()
+
+	header, err := csv.NewReader(file).Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read csv header of %s failed: %v", filename, err)
+	}
+	return header, nil
+}
+
+// rewrite rewrites the file with the given header, padding existing rows to the new width
+func (cs *CSVStorage) rewrite(filename string, header []string) error {
+	var rows [][]string
+	if file, err := os.Open(filename); err == nil {
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		rows, err = reader.ReadAll()
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("read file %s failed: %v", filename, err)
+		}
+		// Drop the old header
+		if len(rows) > 0 {
+			rows = rows[1:]
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("open file %s failed: %v", filename, err)
+	}
+
+	tmpFile := filename + ".tmp"
+	file, err := os.Create(tmpFile)
+	if err != nil {
+		return fmt.Errorf("create file %s failed: %v", tmpFile, err)
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write(header)
+	for _, row := range rows {
+		for len(row) < len(header) {
+			row = append(row, "")
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		os.Remove(tmpFile)
+		return fmt.Errorf("write file %s failed: %v", tmpFile, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("close file %s failed: %v", tmpFile, err)
+	}
+
+	if err := os.Rename(tmpFile, filename); err != nil {
+		return fmt.Errorf("rename file %s failed: %v", tmpFile, err)
+	}
+	return nil
+}
+
+// csvRow flattens data into a row matching the header
+func csvRow(header []string, data transformer.DeviceData) ([]string, error) {
+	metadataJSON, err := json.Marshal(data.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("%w: serialize metadata failed: %v", ErrInvalidData, err)
+	}
+
+	values := make(map[string]string, len(data.Attributes))
+	for _, attr := range data.Attributes {
+		values[csvColumn(attr.Name)] = valueString(attr.Value)
+	}
+
+	row := make([]string, len(header))
+	row[0] = data.DeviceName
+	row[1] = data.DeviceType
+	row[2] = strconv.FormatInt(data.Timestamp, 10)
+	row[3] = string(metadataJSON)
+	for i := len(csvFixedColumns); i < len(header); i++ {
+		row[i] = values[header[i]]
+	}
+	return row, nil
+}
+
+// csvColumn returns the column of the attribute name, names of fixed columns are prefixed
+// so the attribute neither overwrites nor is hidden by the fixed column. Names already starting
+// with the prefix are prefixed again, so device_name and attr_device_name never share a column
+func csvColumn(name string) string {
+	if strings.HasPrefix(name, csvAttributePrefix) {
+		return csvAttributePrefix + name
+	}
+	for _, column := range csvFixedColumns {
+		if name == column {
+			return csvAttributePrefix + name
+		}
+	}
+	return name
+}
+
+// sortedColumns sorts newly discovered columns so the header order is stable
+func sortedColumns(columns []string) []string {
+	sort.Strings(columns)
+	return columns
+}
+
+// Close implement StorageBackend
+func (cs *CSVStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eddielth/data-trans/transformer"
+)
+
+func TestCSVStorageAttributesNamedLikeFixedColumns(t *testing.T) {
+	dir := t.TempDir()
+	cs, err := NewCSVStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := transformer.DeviceData{
+		DeviceName: "sensor1",
+		DeviceType: "temperature",
+		Timestamp:  1700000000000,
+		Attributes: []transformer.DeviceAttribute{
+			{Name: "timestamp", Value: 42},
+			{Name: "device_name", Value: "probe"},
+			{Name: "attr_device_name", Value: "spare"},
+			{Name: "value", Value: 21.5},
+		},
+	}
+	if err := cs.Store("temperature", data); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "temperature", time.Now().Format("2006-01-02")+".csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"device_name", "device_type", "timestamp", "metadata", "attr_attr_device_name", "attr_device_name", "attr_timestamp", "value"},
+		{"sensor1", "temperature", "1700000000000", "null", "spare", "probe", "42", "21.5"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+}
+
+func TestCSVColumnIsUnique(t *testing.T) {
+	names := []string{"device_name", "attr_device_name", "attr_attr_device_name", "timestamp", "attr_timestamp", "value", "attr_value"}
+	columns := make(map[string]string)
+	for _, name := range names {
+		column := csvColumn(name)
+		if other, ok := columns[column]; ok {
+			t.Errorf("attributes %s and %s share the column %s", other, name, column)
+		}
+		for _, fixed := range csvFixedColumns {
+			if column == fixed {
+				t.Errorf("attribute %s is written to the fixed column %s", name, column)
+			}
+		}
+		columns[column] = name
+	}
+}
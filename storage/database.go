@@ -1,7 +1,18 @@
 package storage
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/transformer"
 )
 
 // DatabaseType
@@ -12,6 +23,8 @@ const (
 	MySQL DatabaseType = "mysql"
 	// PostgreSQL
 	PostgreSQL DatabaseType = "postgresql"
+	// ClickHouse
+	ClickHouse DatabaseType = "clickhouse"
 )
 
 // DatabaseStorage
@@ -21,14 +34,277 @@ type DatabaseStorage interface {
 	InitDatabase() error
 }
 
-// NewDatabaseStorage
-func NewDatabaseStorage(dbType string, dsn string) (DatabaseStorage, error) {
-	switch DatabaseType(dbType) {
-	case MySQL:
-		return NewMySQLStorage(dsn)
-	case PostgreSQL:
-		return NewPostgreSQLStorage(dsn)
+// Default connection pool settings
+const (
+	DefaultMaxOpenConns    = 10
+	DefaultMaxIdleConns    = 5
+	DefaultConnMaxLifetime = 5 * time.Minute
+)
+
+// DatabaseOptions holds the tunable settings of SQL backends, zero values fall back to defaults
+type DatabaseOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// BatchSize and FlushInterval control batched inserts of backends that buffer writes (ClickHouse)
+	BatchSize     int
+	FlushInterval time.Duration
+	// TablePrefix is prepended to the table names, e.g. site_a_ for site_a_device_data,
+	// so several instances can share one database
+	TablePrefix string
+	// UpsertDeviceTypes are the device types stored with InsertModeUpsert, all others are appended
+	UpsertDeviceTypes map[string]bool
+	// WideDeviceTypes are the device types stored with TableLayoutWide (MySQL and PostgreSQL), mapped to the
+	// kinds of their declared attributes whose columns are created upfront
+	WideDeviceTypes map[string]map[string]string
+	// RetentionDays deletes records older than this many days by their timestamp, zero keeps all records.
+	// RetentionInterval is how often they are deleted, zero falls back to DefaultRetentionInterval (MySQL and PostgreSQL)
+	RetentionDays     int
+	RetentionInterval time.Duration
+	// ErrorLog creates the processing_errors table and records processing errors into it (MySQL and PostgreSQL)
+	ErrorLog bool
+}
+
+// Insert modes of SQL backends, selected per device type
+const (
+	// InsertModeInsert appends every record, keeping the full history. It is the default
+	InsertModeInsert = "insert"
+	// InsertModeUpsert keeps one record per device type and device name and updates it in place
+	InsertModeUpsert = "upsert"
+)
+
+// applyPool applies the connection pool settings to db
+func (o DatabaseOptions) applyPool(db *sql.DB) {
+	maxOpenConns := o.MaxOpenConns
+	if maxOpenConns <= 0 {
+		maxOpenConns = DefaultMaxOpenConns
+	}
+	maxIdleConns := o.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = DefaultMaxIdleConns
+	}
+	connMaxLifetime := o.ConnMaxLifetime
+	if connMaxLifetime <= 0 {
+		connMaxLifetime = DefaultConnMaxLifetime
+	}
+
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(connMaxLifetime)
+}
+
+// MaxTablePrefixLength keeps prefixed table and index names within the identifier limits of all databases
+const MaxTablePrefixLength = 32
+
+// tablePrefixPattern is the set of table prefixes accepted, prefixed names are used unquoted
+var tablePrefixPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateTablePrefix checks that prefix is safe to be prepended to table names, an empty prefix is valid
+func ValidateTablePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if len(prefix) > MaxTablePrefixLength {
+		return fmt.Errorf("table prefix %q exceeds %d characters", prefix, MaxTablePrefixLength)
+	}
+	if !tablePrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("invalid table prefix %q, only letters, digits and '_' are allowed and it must not start with a digit", prefix)
+	}
+	return nil
+}
+
+// sqlTables holds the table names of a SQL backend
+type sqlTables struct {
+	// prefix is also prepended to index names, PostgreSQL requires them to be unique per schema
+	prefix     string
+	data       string
+	attributes string
+	errors     string
+}
+
+// tables returns the table names with the configured prefix
+func (o DatabaseOptions) tables() (sqlTables, error) {
+	if err := ValidateTablePrefix(o.TablePrefix); err != nil {
+		return sqlTables{}, err
+	}
+	return sqlTables{
+		prefix:     o.TablePrefix,
+		data:       o.TablePrefix + "device_data",
+		attributes: o.TablePrefix + "device_attributes",
+		errors:     o.TablePrefix + "processing_errors",
+	}, nil
+}
+
+// databaseNamePattern is the set of database names accepted when creating databases
+var databaseNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// validateDatabaseName checks that name is safe to be used as a database identifier
+func validateDatabaseName(name string, maxLength int) error {
+	if name == "" {
+		return fmt.Errorf("database name cannot be empty")
+	}
+	if len(name) > maxLength {
+		return fmt.Errorf("database name %q exceeds %d characters", name, maxLength)
+	}
+	if !databaseNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid database name %q, only letters, digits, '_' and '-' are allowed and it must not start with a digit or '-'", name)
+	}
+	return nil
+}
+
+// quoteMySQLIdentifier quotes an identifier with backticks for MySQL
+func quoteMySQLIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// quotePostgreSQLIdentifier quotes an identifier with double quotes for PostgreSQL
+func quotePostgreSQLIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// numericAttributeTypes are the attribute types whose values are stored in the numeric value column
+var numericAttributeTypes = map[string]bool{
+	"float":   true,
+	"double":  true,
+	"number":  true,
+	"int":     true,
+	"integer": true,
+	"long":    true,
+}
+
+// numericValue returns the attribute value as a number for the numeric value column.
+// Attributes with a numeric type are converted when possible; attributes without a type
+// are stored as numbers only when the value already is one. Everything else is NULL.
+func numericValue(attr transformer.DeviceAttribute) sql.NullFloat64 {
+	attrType := strings.ToLower(attr.Type)
+	if attrType != "" && !numericAttributeTypes[attrType] {
+		return sql.NullFloat64{}
+	}
+
+	switch v := attr.Value.(type) {
+	case float64:
+		return sql.NullFloat64{Float64: v, Valid: true}
+	case float32:
+		return sql.NullFloat64{Float64: float64(v), Valid: true}
+	case int:
+		return sql.NullFloat64{Float64: float64(v), Valid: true}
+	case int64:
+		return sql.NullFloat64{Float64: float64(v), Valid: true}
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return sql.NullFloat64{Float64: f, Valid: true}
+		}
+	case string:
+		if attrType == "" {
+			return sql.NullFloat64{}
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return sql.NullFloat64{Float64: f, Valid: true}
+		}
+	}
+	return sql.NullFloat64{}
+}
+
+// valueString returns the attribute value for the text value column. Scalars are stored
+// as they read, objects and arrays are JSON encoded so nested payloads keep their structure
+func valueString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		if data, err := json.Marshal(v); err == nil {
+			return string(data)
+		}
+	case nil, bool, json.Number, float64, float32, int, int64, int32, uint, uint64, uint32:
+		return fmt.Sprintf("%v", v)
 	default:
-		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+		// Typed maps, slices and structs, e.g. from Go transformers
+		switch reflect.ValueOf(v).Kind() {
+		case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+			if data, err := json.Marshal(v); err == nil {
+				return string(data)
+			}
+		}
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// DatabaseDriver creates the database backend of a database type from its DSN
+type DatabaseDriver func(dsn string, opts DatabaseOptions) (DatabaseStorage, error)
+
+var (
+	databaseDrivers = map[DatabaseType]DatabaseDriver{
+		MySQL: func(dsn string, opts DatabaseOptions) (DatabaseStorage, error) {
+			return NewMySQLStorage(dsn, opts)
+		},
+		PostgreSQL: func(dsn string, opts DatabaseOptions) (DatabaseStorage, error) {
+			return NewPostgreSQLStorage(dsn, opts)
+		},
+		ClickHouse: func(dsn string, opts DatabaseOptions) (DatabaseStorage, error) {
+			return NewClickHouseStorage(dsn, opts)
+		},
 	}
+	databaseDriversMutex sync.RWMutex
+
+	// databaseNames holds the database type backends created by NewDatabaseStorage were registered under
+	databaseNames      = make(map[StorageBackend]string)
+	databaseNamesMutex sync.RWMutex
+)
+
+// RegisterDatabaseDriver registers the driver of a database type, replacing an existing one.
+// Register drivers before the storage is created, e.g. from an init function
+func RegisterDatabaseDriver(dbType DatabaseType, driver DatabaseDriver) {
+	databaseDriversMutex.Lock()
+	defer databaseDriversMutex.Unlock()
+
+	databaseDrivers[dbType] = driver
+}
+
+// DatabaseTypes returns the registered database types, sorted
+func DatabaseTypes() []string {
+	databaseDriversMutex.RLock()
+	defer databaseDriversMutex.RUnlock()
+
+	types := make([]string, 0, len(databaseDrivers))
+	for dbType := range databaseDrivers {
+		types = append(types, string(dbType))
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewDatabaseStorage creates the database backend of a database type with its registered driver
+func NewDatabaseStorage(dbType string, dsn string, opts DatabaseOptions) (DatabaseStorage, error) {
+	databaseDriversMutex.RLock()
+	driver, ok := databaseDrivers[DatabaseType(dbType)]
+	databaseDriversMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported database type: %s, registered types are %s", dbType, strings.Join(DatabaseTypes(), ", "))
+	}
+	backend, err := driver(dsn, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	databaseNamesMutex.Lock()
+	databaseNames[backend] = dbType
+	databaseNamesMutex.Unlock()
+	return backend, nil
+}
+
+// databaseName returns the database type a backend was created for by NewDatabaseStorage
+func databaseName(backend StorageBackend) (string, bool) {
+	databaseNamesMutex.RLock()
+	defer databaseNamesMutex.RUnlock()
+
+	name, ok := databaseNames[backend]
+	return name, ok
+}
+
+// forgetDatabaseName drops the database type of a removed backend
+func forgetDatabaseName(backend StorageBackend) {
+	databaseNamesMutex.Lock()
+	defer databaseNamesMutex.Unlock()
+
+	delete(databaseNames, backend)
 }
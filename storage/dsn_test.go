@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// specialPasswords contain the characters that separate the parts of a DSN
+var specialPasswords = []string{
+	"p@ss",
+	"p:ss",
+	"p/ss",
+	"a@b:c/d?e#f%g",
+	"@:/",
+}
+
+func TestBuildMySQLDSNEscapesPassword(t *testing.T) {
+	for _, password := range specialPasswords {
+		dsn, err := BuildDSN("mysql", DSNOptions{Host: "db.local", User: "root", Password: password, DBName: "data-trans"})
+		if err != nil {
+			t.Fatalf("password %q: %v", password, err)
+		}
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			t.Fatalf("password %q: driver cannot parse %s: %v", password, dsn, err)
+		}
+		if cfg.Passwd != password || cfg.User != "root" || cfg.Addr != "db.local:3306" || cfg.DBName != "data-trans" {
+			t.Errorf("password %q: DSN %s parses to user %q password %q addr %q dbname %q", password, dsn, cfg.User, cfg.Passwd, cfg.Addr, cfg.DBName)
+		}
+	}
+}
+
+func TestBuildURLDSNEscapesPassword(t *testing.T) {
+	for _, dbType := range []string{"postgresql", "clickhouse"} {
+		for _, password := range specialPasswords {
+			dsn, err := BuildDSN(dbType, DSNOptions{Host: "db.local", Port: 1234, User: "u:ser@x", Password: password, DBName: "data-trans"})
+			if err != nil {
+				t.Fatalf("%s password %q: %v", dbType, password, err)
+			}
+			u, err := url.Parse(dsn)
+			if err != nil {
+				t.Fatalf("%s password %q: cannot parse %s: %v", dbType, password, dsn, err)
+			}
+			got, _ := u.User.Password()
+			if got != password || u.User.Username() != "u:ser@x" || u.Host != "db.local:1234" || u.Path != "/data-trans" {
+				t.Errorf("%s password %q: DSN %s parses to user %q password %q host %q path %q", dbType, password, dsn, u.User.Username(), got, u.Host, u.Path)
+			}
+
+			database, _, err := parsePostgreSQLDSN(dsn)
+			if dbType == "postgresql" && (err != nil || database != "data-trans") {
+				t.Errorf("password %q: database of %s is %q (%v), want data-trans", password, dsn, database, err)
+			}
+		}
+	}
+}
+
+func TestBuildDSNSSLMode(t *testing.T) {
+	tests := []struct {
+		dbType  string
+		sslMode string
+		want    string // expected query parameter, key=value
+		wantErr bool
+	}{
+		{dbType: "mysql", sslMode: "disable", want: "tls=false"},
+		{dbType: "mysql", sslMode: "prefer", want: "tls=preferred"},
+		{dbType: "mysql", sslMode: "require", want: "tls=skip-verify"},
+		{dbType: "mysql", sslMode: "verify-full", want: "tls=true"},
+		{dbType: "postgresql", sslMode: "disable", want: "sslmode=disable"},
+		{dbType: "postgresql", sslMode: "verify-ca", want: "sslmode=verify-ca"},
+		// lib/pq does not support prefer
+		{dbType: "postgresql", sslMode: "prefer", wantErr: true},
+		{dbType: "clickhouse", sslMode: "require", want: "skip_verify=true"},
+		{dbType: "clickhouse", sslMode: "prefer", wantErr: true},
+		{dbType: "mysql", sslMode: "allow", wantErr: true},
+	}
+	for _, tt := range tests {
+		dsn, err := BuildDSN(tt.dbType, DSNOptions{Host: "db.local", User: "root", DBName: "data", SSLMode: tt.sslMode})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s sslmode %s: built %s, want an error", tt.dbType, tt.sslMode, dsn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s sslmode %s: %v", tt.dbType, tt.sslMode, err)
+			continue
+		}
+		_, rawQuery, _ := strings.Cut(dsn, "?")
+		query, err := url.ParseQuery(rawQuery)
+		key, value, _ := strings.Cut(tt.want, "=")
+		if err != nil || query.Get(key) != value {
+			t.Errorf("%s sslmode %s: DSN %s lacks %s", tt.dbType, tt.sslMode, dsn, tt.want)
+		}
+	}
+}
+
+func TestTLSFilesRejectPrefer(t *testing.T) {
+	for _, dbType := range []string{"mysql", "postgresql"} {
+		for _, sslMode := range []string{"prefer", "disable"} {
+			opts := DSNOptions{Host: "db.local", DBName: "data", SSLMode: sslMode, CAFile: "ca.pem"}
+			if dsn, err := BuildDSN(dbType, opts); err == nil {
+				t.Errorf("%s sslmode %s with a CA file built %s, want an error", dbType, sslMode, dsn)
+			}
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eddielth/data-trans/clock"
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// Default Elasticsearch settings
+const (
+	DefaultElasticIndex         = "data-trans-{device_type}-{date}"
+	DefaultElasticBatchSize     = 1000
+	DefaultElasticFlushInterval = 5 * time.Second
+)
+
+// elasticTimeout bounds each request sent to Elasticsearch
+const elasticTimeout = 30 * time.Second
+
+// elasticTemplateName is the name of the index template installed for the configured index pattern
+const elasticTemplateName = "data-trans"
+
+// ElasticOptions configures the Elasticsearch storage backend
+type ElasticOptions struct {
+	// URL is the address of the cluster, e.g. http://localhost:9200
+	URL string
+	// Username and Password are used for basic authentication, APIKey (base64 encoded id:key) takes precedence
+	Username string
+	Password string
+	APIKey   string
+	// Index is the index name template, {device_type}, {date} (YYYY.MM.DD) and {month} (YYYY.MM) are replaced
+	Index string
+	// BatchSize and FlushInterval control bulk requests
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// elasticDocument is the document indexed for one DeviceData
+type elasticDocument struct {
+	Timestamp  int64                  `json:"timestamp"`
+	DeviceType string                 `json:"device_type"`
+	DeviceName string                 `json:"device_name"`
+	Attributes []elasticAttribute     `json:"attributes"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// elasticAttribute is an attribute of an elasticDocument, value is always a string
+// so attributes of different types can share the mapping, value_num holds numeric values
+type elasticAttribute struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type,omitempty"`
+	Value    string      `json:"value"`
+	ValueNum *float64    `json:"value_num,omitempty"`
+	Unit     string      `json:"unit,omitempty"`
+	Quality  int         `json:"quality"`
+	Metadata interface{} `json:"metadata,omitempty"`
+}
+
+// elasticAction is one buffered bulk index action
+type elasticAction struct {
+	index    string
+	document []byte
+}
+
+// ElasticStorage represents an Elasticsearch storage backend.
+// Documents are buffered and indexed with the bulk API
+type ElasticStorage struct {
+	client        *http.Client
+	url           string
+	username      string
+	password      string
+	apiKey        string
+	index         string
+	batchSize     int
+	flushInterval time.Duration
+
+	mu     sync.Mutex
+	buffer []elasticAction
+	// dropped counts the batches dropped because flushing them failed
+	dropped atomic.Int64
+	// flushMu serializes bulk requests
+	flushMu sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewElasticStorage creates a new Elasticsearch storage backend and installs
+// an index template mapping timestamp as a date for the configured index pattern
+func NewElasticStorage(opts ElasticOptions) (*ElasticStorage, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("Elasticsearch URL is required")
+	}
+
+	index := opts.Index
+	if index == "" {
+		index = DefaultElasticIndex
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultElasticBatchSize
+	}
+	flushInterval := opts.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = DefaultElasticFlushInterval
+	}
+
+	storage := &ElasticStorage{
+		client:        &http.Client{Timeout: elasticTimeout},
+		url:           strings.TrimRight(opts.URL, "/"),
+		username:      opts.Username,
+		password:      opts.Password,
+		apiKey:        opts.APIKey,
+		index:         index,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+
+	// Test connection
+	if _, err := storage.request(context.Background(), http.MethodGet, "/", "", nil); err != nil {
+		return nil, fmt.Errorf("Elasticsearch connection test failed: %v", err)
+	}
+
+	if err := storage.InitIndexTemplate(); err != nil {
+		return nil, fmt.Errorf("failed to initialize Elasticsearch index template: %v", err)
+	}
+
+	// Flush partial batches periodically
+	storage.wg.Add(1)
+	go storage.flushLoop()
+
+	logger.Info("Elasticsearch storage initialized successfully")
+	return storage, nil
+}
+
+// InitIndexTemplate installs an index template for all indices the index name template can produce,
+// timestamp is mapped as an epoch_millis date, metadata as flattened fields
+func (es *ElasticStorage) InitIndexTemplate() error {
+	pattern := strings.ToLower(es.index)
+	for _, placeholder := range []string{"{device_type}", "{date}", "{month}"} {
+		pattern = strings.ReplaceAll(pattern, placeholder, "*")
+	}
+
+	template := map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"timestamp":   map[string]interface{}{"type": "date", "format": "epoch_millis"},
+					"device_type": map[string]interface{}{"type": "keyword"},
+					"device_name": map[string]interface{}{"type": "keyword"},
+					"metadata":    map[string]interface{}{"type": "flattened"},
+					"attributes": map[string]interface{}{
+						"properties": map[string]interface{}{
+							"name":      map[string]interface{}{"type": "keyword"},
+							"type":      map[string]interface{}{"type": "keyword"},
+							"value":     map[string]interface{}{"type": "keyword"},
+							"value_num": map[string]interface{}{"type": "double"},
+							"unit":      map[string]interface{}{"type": "keyword"},
+							"quality":   map[string]interface{}{"type": "integer"},
+							"metadata":  map[string]interface{}{"type": "flattened"},
+						},
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+
+	if _, err := es.request(context.Background(), http.MethodPut, "/_index_template/"+elasticTemplateName, "application/json", body); err != nil {
+		return err
+	}
+
+	logger.Info("Ensured Elasticsearch index template %s for %s exists", elasticTemplateName, pattern)
+	return nil
+}
+
+// indexName returns the index data of the device type is written to
+func (es *ElasticStorage) indexName(deviceType string, data transformer.DeviceData) string {
+	t := dataTime(data, clock.Real{}).UTC()
+	name := strings.ReplaceAll(es.index, "{device_type}", deviceType)
+	name = strings.ReplaceAll(name, "{date}", t.Format("2006.01.02"))
+	name = strings.ReplaceAll(name, "{month}", t.Format("2006.01"))
+	// Index names must be lowercase
+	return strings.ToLower(name)
+}
+
+// Store buffers data as a document, a full batch is indexed immediately
+func (es *ElasticStorage) Store(deviceType string, data transformer.DeviceData) error {
+	return es.StoreCtx(context.Background(), deviceType, data)
+}
+
+// StoreCtx buffers data as a document, a full batch is indexed immediately within ctx
+func (es *ElasticStorage) StoreCtx(ctx context.Context, deviceType string, data transformer.DeviceData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	doc := elasticDocument{
+		Timestamp:  data.Timestamp,
+		DeviceType: data.DeviceType,
+		DeviceName: data.DeviceName,
+		Attributes: make([]elasticAttribute, 0, len(data.Attributes)),
+		Metadata:   data.Metadata,
+	}
+	for _, attr := range data.Attributes {
+		attribute := elasticAttribute{
+			Name:     attr.Name,
+			Type:     attr.Type,
+			Value:    valueString(attr.Value),
+			Unit:     attr.Unit,
+			Quality:  attr.Quality,
+			Metadata: attr.Metadata,
+		}
+		if num := numericValue(attr); num.Valid {
+			attribute.ValueNum = &num.Float64
+		}
+		doc.Attributes = append(doc.Attributes, attribute)
+	}
+
+	document, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("%w: failed to serialize document: %v", ErrInvalidData, err)
+	}
+
+	es.mu.Lock()
+	es.buffer = append(es.buffer, elasticAction{index: es.indexName(deviceType, data), document: document})
+	full := len(es.buffer) >= es.batchSize
+	es.mu.Unlock()
+
+	if full {
+		return es.flush(ctx)
+	}
+
+	logger.Debug("Buffered %s type data for Elasticsearch", deviceType)
+	return nil
+}
+
+// flushLoop flushes the buffer every flush interval until the storage is closed
+func (es *ElasticStorage) flushLoop() {
+	defer es.wg.Done()
+
+	ticker := time.NewTicker(es.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := es.Flush(); err != nil {
+				logger.Error("Failed to flush Elasticsearch batch: %v", err)
+			}
+		case <-es.done:
+			return
+		}
+	}
+}
+
+// elasticBulkResponse is the part of a bulk response needed to find failed items
+type elasticBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// Flush indexes all buffered documents with one bulk request, a failed batch is dropped
+func (es *ElasticStorage) Flush() error {
+	return es.flush(context.Background())
+}
+
+// flush indexes all buffered documents with one bulk request within ctx, a failed batch is dropped
+func (es *ElasticStorage) flush(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			es.dropped.Add(1)
+		}
+	}()
+
+	es.flushMu.Lock()
+	defer es.flushMu.Unlock()
+
+	es.mu.Lock()
+	actions := es.buffer
+	es.buffer = nil
+	es.mu.Unlock()
+
+	if len(actions) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	for _, action := range actions {
+		meta, err := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": action.index}})
+		if err != nil {
+			return fmt.Errorf("failed to serialize bulk action, %d documents dropped: %v", len(actions), err)
+		}
+		body.Write(meta)
+		body.WriteByte('\n')
+		body.Write(action.document)
+		body.WriteByte('\n')
+	}
+
+	respBody, err := es.request(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to send bulk request, %d documents dropped: %v", len(actions), err)
+	}
+
+	var resp elasticBulkResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return fmt.Errorf("failed to parse bulk response: %v", err)
+	}
+	if resp.Errors {
+		failed := 0
+		var firstError string
+		for _, item := range resp.Items {
+			for _, result := range item {
+				if result.Error == nil {
+					continue
+				}
+				failed++
+				if firstError == "" {
+					firstError = fmt.Sprintf("%s: %s", result.Error.Type, result.Error.Reason)
+				}
+			}
+		}
+		return fmt.Errorf("failed to index %d of %d documents: %s", failed, len(actions), firstError)
+	}
+
+	logger.Debug("Indexed %d documents into Elasticsearch", len(actions))
+	return nil
+}
+
+// request sends a request to Elasticsearch and returns the response body, non-2xx responses are errors
+func (es *ElasticStorage) request(ctx context.Context, method string, path string, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, es.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if es.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+es.apiKey)
+	} else if es.username != "" {
+		req.SetBasicAuth(es.username, es.password)
+	}
+
+	resp, err := es.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, bytes.TrimSpace(respBody))
+	}
+	return respBody, nil
+}
+
+// droppedBatches returns the number of batches dropped so far
+func (es *ElasticStorage) droppedBatches() int64 {
+	return es.dropped.Load()
+}
+
+// Close flushes buffered documents
+func (es *ElasticStorage) Close() error {
+	close(es.done)
+	es.wg.Wait()
+
+	if err := es.Flush(); err != nil {
+		return fmt.Errorf("failed to flush Elasticsearch batch: %v", err)
+	}
+	es.client.CloseIdleConnections()
+	logger.Info("Elasticsearch storage closed")
+	return nil
+}
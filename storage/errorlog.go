@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+)
+
+// ProcessingError is a message that failed to be processed. Unlike dead-letter records, which keep the
+// payload for reprocessing, it is recorded for analytics and alerting and only references the payload
+type ProcessingError struct {
+	// Timestamp is the time the message failed, in milliseconds
+	Timestamp  int64
+	Topic      string
+	DeviceType string
+	// Reason is the processing step that failed, e.g. transform or store
+	Reason string
+	Error  string
+	// PayloadHash is the hex encoded SHA-256 of the raw payload, it identifies the payload in dead-letter files
+	PayloadHash string
+	PayloadSize int
+}
+
+// NewProcessingError creates the processing error of a message that failed now
+func NewProcessingError(topic, deviceType, reason string, cause error, payload []byte) ProcessingError {
+	hash := sha256.Sum256(payload)
+	return ProcessingError{
+		Timestamp:   time.Now().UnixMilli(),
+		Topic:       topic,
+		DeviceType:  deviceType,
+		Reason:      reason,
+		Error:       cause.Error(),
+		PayloadHash: hex.EncodeToString(hash[:]),
+		PayloadSize: len(payload),
+	}
+}
+
+// ErrorRecorder is implemented by storage backends that can record processing errors
+type ErrorRecorder interface {
+	// ErrorLogEnabled reports whether the backend was created with the error log enabled
+	ErrorLogEnabled() bool
+	// RecordError records a processing error
+	RecordError(ctx context.Context, e ProcessingError) error
+}
+
+// RecordError records a processing error in all backends with the error log enabled, it does nothing
+// when there are none. Failures are logged and returned, they do not affect the processed message
+func (m *Manager) RecordError(ctx context.Context, e ProcessingError) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.storeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.storeTimeout)
+		defer cancel()
+	}
+
+	var errs []error
+	for _, backend := range m.backends {
+		recorder, ok := backend.(ErrorRecorder)
+		if !ok || !recorder.ErrorLogEnabled() {
+			continue
+		}
+		if err := recorder.RecordError(ctx, e); err != nil {
+			logger.Error("Failed to record processing error in %s backend: %v", backendType(backend), err)
+			errs = append(errs, fmt.Errorf("%s: %v", backendType(backend), err))
+		}
+	}
+	return errors.Join(errs...)
+}
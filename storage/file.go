@@ -1,60 +1,389 @@
 package storage
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/eddielth/data-trans/clock"
 	"github.com/eddielth/data-trans/logger"
 	"github.com/eddielth/data-trans/transformer"
 )
 
+// Partition modes of file storage
+const (
+	// PartitionNone stores all files of a device type in one directory
+	PartitionNone = "none"
+	// PartitionDay stores files under deviceType/YYYY/MM/DD
+	PartitionDay = "day"
+	// PartitionHour stores files under deviceType/YYYY/MM/DD/HH
+	PartitionHour = "hour"
+)
+
+// Compression modes of file storage
+const (
+	// CompressNone writes files as encoded by the serializer
+	CompressNone = "none"
+	// CompressGzip writes compact JSON gzipped into .json.gz files
+	CompressGzip = "gzip"
+)
+
+// Fsync modes of file storage
+const (
+	// FsyncNone leaves flushing written files to disk to the operating system
+	FsyncNone = "none"
+	// FsyncFile syncs every written file to disk before the store returns
+	FsyncFile = "file"
+	// FsyncFull also syncs the directory of every written file, so the new file name survives a power loss too
+	FsyncFull = "full"
+)
+
+// gzipSuffix is the file name suffix of gzipped record files
+const gzipSuffix = ".json.gz"
+
 // FileStorage
 type FileStorage struct {
-	basePath string
+	basePath   string
+	partition  string
+	compress   string
+	serializer Serializer
+	fsync      string
+	compaction CompactionOptions
+	// clock provides the time in file names and of compaction runs
+	clock clock.Clock
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 // NewFileStorage
-func NewFileStorage(basePath string) (*FileStorage, error) {
+func NewFileStorage(basePath string, partition string, compress string, serializer string, fsync string, compaction CompactionOptions) (*FileStorage, error) {
+	switch partition {
+	case "":
+		partition = PartitionNone
+	case PartitionNone, PartitionDay, PartitionHour:
+	default:
+		return nil, fmt.Errorf("unsupported partition mode: %s", partition)
+	}
+	switch compress {
+	case "":
+		compress = CompressNone
+	case CompressNone, CompressGzip:
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compress)
+	}
+	switch fsync {
+	case "":
+		fsync = FsyncNone
+	case FsyncNone, FsyncFile, FsyncFull:
+	default:
+		return nil, fmt.Errorf("unsupported fsync mode: %s", fsync)
+	}
+	if serializer == "" {
+		serializer = SerializerJSON
+	}
+	if compress == CompressGzip && serializer != SerializerJSON {
+		return nil, fmt.Errorf("compression %s requires the %s serializer", compress, SerializerJSON)
+	}
+	if compaction.Enabled && serializer == SerializerAvro {
+		return nil, fmt.Errorf("compaction does not support the %s serializer", serializer)
+	}
+	var s Serializer
+	if compress == CompressGzip {
+		// Compressed files are compact since indentation gains nothing once gzipped
+		s = jsonSerializer{}
+	} else {
+		var err error
+		if s, err = NewSerializer(serializer); err != nil {
+			return nil, err
+		}
+	}
+
 	// make dir
 	if err := os.MkdirAll(basePath, 0755); err != nil {
 		return nil, fmt.Errorf("create dir %s failed: %v", basePath, err)
 	}
 
-	logger.Info("init file storage: %s", basePath)
-	return &FileStorage{
-		basePath: basePath,
-	}, nil
+	logger.Info("init file storage: %s, partition: %s, compress: %s, serializer: %s, fsync: %s", basePath, partition, compress, serializer, fsync)
+	fs := &FileStorage{
+		basePath:   basePath,
+		partition:  partition,
+		compress:   compress,
+		serializer: s,
+		fsync:      fsync,
+		compaction: compaction,
+		clock:      clock.Real{},
+		done:       make(chan struct{}),
+	}
+
+	// Roll completed days into daily archives in the background
+	if compaction.Enabled {
+		interval := compaction.Interval
+		if interval <= 0 {
+			interval = DefaultCompactionInterval
+		}
+		fs.wg.Add(1)
+		go fs.compactionLoop(interval)
+		logger.Info("file compaction enabled, interval: %s, keep originals: %t", interval, compaction.KeepOriginals)
+	}
+	return fs, nil
+}
+
+// SetClock replaces the clock used for file names and compaction, nil selects the system clock.
+// Call it before storing data
+func (fs *FileStorage) SetClock(c clock.Clock) {
+	fs.clock = clock.Or(c)
 }
 
 // Store save data to file
 func (fs *FileStorage) Store(deviceType string, data transformer.DeviceData) error {
-	deviceDir := filepath.Join(fs.basePath, deviceType)
-	if err := os.MkdirAll(deviceDir, 0755); err != nil {
-		return fmt.Errorf("create dir %s failed: %v", deviceDir, err)
+	return fs.StoreCtx(context.Background(), deviceType, data)
+}
+
+// StoreCtx save data to file, nothing is written once ctx is done
+func (fs *FileStorage) StoreCtx(ctx context.Context, deviceType string, data transformer.DeviceData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deviceDir := fs.partitionDir(deviceType, data)
+	if err := fs.makeDir(deviceDir); err != nil {
+		return err
 	}
 
-	timestamp := time.Now().Format("20060102-150405.000")
-	filename := filepath.Join(deviceDir, fmt.Sprintf("%s.json", timestamp))
+	timestamp := fs.clock.Now().Format("20060102-150405.000")
+	filename := filepath.Join(deviceDir, timestamp+fs.serializer.Extension())
 
-	// marshal data
-	jsonData, err := json.MarshalIndent(data, "", "  ")
+	content, err := fs.serializer.MarshalDeviceData(data)
 	if err != nil {
-		return fmt.Errorf("serialize data failed: %v", err)
+		return fmt.Errorf("%w: serialize data failed: %v", ErrInvalidData, err)
+	}
+
+	if fs.compress == CompressGzip {
+		filename += ".gz"
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(content); err != nil {
+			return fmt.Errorf("compress file %s failed: %v", filename, err)
+		}
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("compress file %s failed: %v", filename, err)
+		}
+		content = buf.Bytes()
 	}
 
 	// write file
-	if err := os.WriteFile(filename, jsonData, 0644); err != nil {
-		return fmt.Errorf("write file %s failed: %v", filename, err)
+	if err := fs.writeFile(filename, content); err != nil {
+		return err
 	}
 
 	logger.Debug("has stored data to file: %s", filename)
 	return nil
 }
 
-// Close implement StorageBackend
+// makeDir creates dir and its missing parents. With FsyncFull the directories holding the new
+// directories are synced, so a new partition directory survives a power loss like the files in it
+func (fs *FileStorage) makeDir(dir string) error {
+	var created bool
+	if fs.fsync == FsyncFull {
+		_, err := os.Stat(dir)
+		created = os.IsNotExist(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create dir %s failed: %v", dir, err)
+	}
+	if !created {
+		return nil
+	}
+
+	// Sync up to the base path, which existed since the storage was created
+	base := filepath.Clean(fs.basePath)
+	for dir = filepath.Clean(dir); dir != base; {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		if err := syncDir(parent); err != nil {
+			return err
+		}
+		dir = parent
+	}
+	return nil
+}
+
+// writeFile writes content to filename, syncing it according to the fsync mode
+func (fs *FileStorage) writeFile(filename string, content []byte) error {
+	if fs.fsync == FsyncNone {
+		if err := os.WriteFile(filename, content, 0644); err != nil {
+			return fmt.Errorf("write file %s failed: %v", filename, err)
+		}
+		return nil
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("write file %s failed: %v", filename, err)
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return fmt.Errorf("write file %s failed: %v", filename, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync file %s failed: %v", filename, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close file %s failed: %v", filename, err)
+	}
+
+	if fs.fsync == FsyncFull {
+		return syncDir(filepath.Dir(filename))
+	}
+	return nil
+}
+
+// syncDir syncs a directory, making the creation, rename and removal of its entries durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("sync dir %s failed: %v", dir, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir %s failed: %v", dir, err)
+	}
+	return nil
+}
+
+// partitionDir returns the directory the data should be written to
+func (fs *FileStorage) partitionDir(deviceType string, data transformer.DeviceData) string {
+	deviceDir := filepath.Join(fs.basePath, deviceType)
+
+	t := dataTime(data, fs.clock)
+	switch fs.partition {
+	case PartitionDay:
+		return filepath.Join(deviceDir, t.Format("2006"), t.Format("01"), t.Format("02"))
+	case PartitionHour:
+		return filepath.Join(deviceDir, t.Format("2006"), t.Format("01"), t.Format("02"), t.Format("15"))
+	default:
+		return deviceDir
+	}
+}
+
+// dataTime returns the time of the data from its timestamp, falling back to the current time of c.
+// Timestamps are normalized to milliseconds by the transformer manager.
+func dataTime(data transformer.DeviceData, c clock.Clock) time.Time {
+	if data.Timestamp <= 0 {
+		return c.Now()
+	}
+	return time.UnixMilli(data.Timestamp)
+}
+
+// Query read stored data back from files
+func (fs *FileStorage) Query(filter QueryFilter) ([]transformer.DeviceData, error) {
+	root := fs.basePath
+	if filter.DeviceType != "" {
+		root = filepath.Join(fs.basePath, filter.DeviceType)
+	}
+
+	var results []transformer.DeviceData
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		// Archives are copies of the kept originals
+		if strings.HasSuffix(path, archiveSuffix) {
+			if fs.compaction.KeepOriginals {
+				return nil
+			}
+			archived, err := readArchive(path)
+			if err != nil {
+				return fmt.Errorf("read archive %s failed: %v", path, err)
+			}
+			for _, data := range archived {
+				if filter.Match(data) {
+					results = append(results, data)
+				}
+			}
+			return nil
+		}
+		if !isRecordFile(path) {
+			return nil
+		}
+
+		content, err := readRecordFile(path)
+		if err != nil {
+			return fmt.Errorf("read file %s failed: %v", path, err)
+		}
+
+		var data transformer.DeviceData
+		if err := json.Unmarshal(content, &data); err != nil {
+			logger.Warn("skip unparseable file %s: %v", path, err)
+			return nil
+		}
+
+		if filter.Match(data) {
+			results = append(results, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query files failed: %v", err)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Timestamp < results[j].Timestamp
+	})
+	return filter.paginate(results), nil
+}
+
+// isRecordFile reports whether path is a JSON file holding one record, .json, .ndjson or gzipped .json.gz.
+// Avro files are not read back
+func isRecordFile(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".json" || ext == ".ndjson" || strings.HasSuffix(path, gzipSuffix)
+}
+
+// readRecordFile reads the content of a record file, gzipped files are decompressed
+func readRecordFile(path string) ([]byte, error) {
+	if !strings.HasSuffix(path, gzipSuffix) {
+		return os.ReadFile(path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return io.ReadAll(gz)
+}
+
+// Close implement StorageBackend, it waits for a running compaction and may be called more than once
 func (fs *FileStorage) Close() error {
+	fs.closeOnce.Do(func() { close(fs.done) })
+	fs.wg.Wait()
 	return nil
 }
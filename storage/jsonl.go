@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/clock"
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// DefaultJSONLMaxSize is the size in MB a JSON Lines file is rotated at when none is configured
+const DefaultJSONLMaxSize = 100
+
+// jsonlExt is the extension of JSON Lines files
+const jsonlExt = ".jsonl"
+
+// JSONLStorage represents a storage backend that appends one JSON object per line to
+// a file per device type, {basePath}/{device_type}.jsonl.
+//
+// Files are opened once and kept open. When a file exceeds the maximum size it is renamed
+// to {device_type}.YYYYMMDD-HHMMSS.000.jsonl and a new file is started, like log files.
+type JSONLStorage struct {
+	basePath   string
+	maxSize    int64 // Unit: bytes
+	maxBackups int
+	// clock provides the time in the names of rotated files
+	clock clock.Clock
+	// files holds the open file of each device type
+	files map[string]*jsonlFile
+	mu    sync.Mutex
+}
+
+// jsonlFile is the open file of a device type
+type jsonlFile struct {
+	path string
+	file *os.File
+	size int64
+}
+
+// NewJSONLStorage creates a new JSON Lines storage backend, maxSize is in MB and 0 selects
+// DefaultJSONLMaxSize. maxBackups is the number of rotated files kept per device type, 0 keeps all
+func NewJSONLStorage(basePath string, maxSize int, maxBackups int) (*JSONLStorage, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultJSONLMaxSize
+	}
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, fmt.Errorf("create dir %s failed: %v", basePath, err)
+	}
+
+	logger.Info("init jsonl storage: %s, max size: %d MB", basePath, maxSize)
+	return &JSONLStorage{
+		basePath:   basePath,
+		maxSize:    int64(maxSize) * 1024 * 1024,
+		maxBackups: maxBackups,
+		clock:      clock.Real{},
+		files:      make(map[string]*jsonlFile),
+	}, nil
+}
+
+// SetClock replaces the clock used for the names of rotated files, nil selects the system clock.
+// Call it before storing data
+func (js *JSONLStorage) SetClock(c clock.Clock) {
+	js.clock = clock.Or(c)
+}
+
+// Store appends data as a line to the device type's file
+func (js *JSONLStorage) Store(deviceType string, data transformer.DeviceData) error {
+	return js.StoreCtx(context.Background(), deviceType, data)
+}
+
+// StoreCtx appends data as a line to the device type's file, nothing is written once ctx is done
+func (js *JSONLStorage) StoreCtx(ctx context.Context, deviceType string, data transformer.DeviceData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("%w: serialize data failed: %v", ErrInvalidData, err)
+	}
+	line = append(line, '\n')
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	f, err := js.open(deviceType)
+	if err != nil {
+		return err
+	}
+
+	// The line is written with a single unbuffered write, so a crash never leaves half a record behind
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write file %s failed: %v", f.path, err)
+	}
+
+	if f.size >= js.maxSize {
+		js.rotate(deviceType, f)
+	}
+
+	logger.Debug("has stored data to jsonl file: %s", f.path)
+	return nil
+}
+
+// open returns the open file of the device type, opening or creating it on first use
+func (js *JSONLStorage) open(deviceType string) (*jsonlFile, error) {
+	if f, ok := js.files[deviceType]; ok {
+		return f, nil
+	}
+
+	path := filepath.Join(js.basePath, deviceType+jsonlExt)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open file %s failed: %v", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("stat file %s failed: %v", path, err)
+	}
+
+	f := &jsonlFile{path: path, file: file, size: info.Size()}
+	js.files[deviceType] = f
+	return f, nil
+}
+
+// rotate renames the file of the device type and removes the oldest rotated files beyond
+// maxBackups, the next store opens a new file
+func (js *JSONLStorage) rotate(deviceType string, f *jsonlFile) {
+	delete(js.files, deviceType)
+	if err := f.file.Close(); err != nil {
+		logger.Warn("close file %s failed: %v", f.path, err)
+	}
+
+	timestamp := js.clock.Now().Format("20060102-150405.000")
+	rotated := filepath.Join(js.basePath, fmt.Sprintf("%s.%s%s", deviceType, timestamp, jsonlExt))
+	if err := os.Rename(f.path, rotated); err != nil {
+		logger.Warn("rotate file %s failed: %v", f.path, err)
+		return
+	}
+	logger.Info("rotated jsonl file %s to %s", f.path, rotated)
+
+	if js.maxBackups > 0 {
+		js.removeOldFiles(deviceType)
+	}
+}
+
+// removeOldFiles removes the oldest rotated files of the device type beyond maxBackups.
+// Rotated file names sort by the time they were rotated
+func (js *JSONLStorage) removeOldFiles(deviceType string) {
+	rotated, err := js.rotatedFiles(deviceType)
+	if err != nil {
+		logger.Warn("find rotated files of %s failed: %v", deviceType, err)
+		return
+	}
+
+	for i := 0; i < len(rotated)-js.maxBackups; i++ {
+		if err := os.Remove(rotated[i]); err != nil {
+			logger.Warn("remove file %s failed: %v", rotated[i], err)
+		}
+	}
+}
+
+// rotatedFiles returns the rotated files of the device type, oldest first
+func (js *JSONLStorage) rotatedFiles(deviceType string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(js.basePath, deviceType+".*"+jsonlExt))
+	if err != nil {
+		return nil, err
+	}
+
+	// Device types sharing the prefix, e.g. "temperature.indoor", are not rotated files of "temperature"
+	rotated := matches[:0]
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(match), deviceType+"."), jsonlExt)
+		if _, err := time.Parse("20060102-150405.000", stamp); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// Query reads stored data back from the current and rotated files
+func (js *JSONLStorage) Query(filter QueryFilter) ([]transformer.DeviceData, error) {
+	// Only the file list is taken under the lock, so stores are not blocked while the files are read
+	js.mu.Lock()
+	matches, err := js.queryFiles(filter.DeviceType)
+	// Open files are read up to their size at this point, so a line being appended is never read half written
+	sizes := make(map[string]int64, len(js.files))
+	for _, f := range js.files {
+		sizes[f.path] = f.size
+	}
+	js.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("query files failed: %v", err)
+	}
+
+	var results []transformer.DeviceData
+	for _, path := range matches {
+		size, ok := sizes[path]
+		if !ok {
+			size = -1
+		}
+		if err := readJSONL(path, size, filter, &results); err != nil {
+			return nil, fmt.Errorf("query files failed: %v", err)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Timestamp < results[j].Timestamp
+	})
+	return filter.paginate(results), nil
+}
+
+// queryFiles returns the files holding records of the device type, of all device types when it is empty
+func (js *JSONLStorage) queryFiles(deviceType string) ([]string, error) {
+	if deviceType == "" {
+		return filepath.Glob(filepath.Join(js.basePath, "*"+jsonlExt))
+	}
+	rotated, err := js.rotatedFiles(deviceType)
+	if err != nil {
+		return nil, err
+	}
+	return append(rotated, filepath.Join(js.basePath, deviceType+jsonlExt)), nil
+}
+
+// readJSONL appends the records of the file matching filter to results, unparseable lines are skipped.
+// Only the first size bytes are read unless size is negative. A file removed by a rotation meanwhile is skipped
+func readJSONL(path string, size int64, filter QueryFilter, results *[]transformer.DeviceData) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read file %s failed: %v", path, err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if size >= 0 {
+		reader = io.LimitReader(file, size)
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var data transformer.DeviceData
+		if err := json.Unmarshal(scanner.Bytes(), &data); err != nil {
+			logger.Warn("skip unparseable line %d of %s: %v", line, path, err)
+			continue
+		}
+		if filter.Match(data) {
+			*results = append(*results, data)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read file %s failed: %v", path, err)
+	}
+	return nil
+}
+
+// Close implement StorageBackend, it closes the open files
+func (js *JSONLStorage) Close() error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	var firstErr error
+	for deviceType, f := range js.files {
+		if err := f.file.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("close file %s failed: %v", f.path, err)
+		}
+		delete(js.files, deviceType)
+	}
+	return firstErr
+}
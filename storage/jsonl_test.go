@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eddielth/data-trans/transformer"
+)
+
+func TestJSONLQueryReadsUpToTheStoredSize(t *testing.T) {
+	dir := t.TempDir()
+	js, err := NewJSONLStorage(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.Close()
+
+	for i := 1; i <= 3; i++ {
+		data := transformer.DeviceData{DeviceName: fmt.Sprintf("sensor%d", i), DeviceType: "temperature", Timestamp: int64(i)}
+		if err := js.Store("temperature", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Open files are read up to the size stored through the backend, so a line appended after the
+	// file list was taken, possibly half written, is left out
+	file, err := os.OpenFile(filepath.Join(dir, "temperature"+jsonlExt), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"device_name":"sensor4","device_type":"temperature","timestamp":4}` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	results, err := js.Query(QueryFilter{DeviceType: "temperature"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d records, want 3", len(results))
+	}
+	for i, data := range results {
+		if want := fmt.Sprintf("sensor%d", i+1); data.DeviceName != want {
+			t.Errorf("record %d is %s, want %s", i, data.DeviceName, want)
+		}
+	}
+}
@@ -1,32 +1,80 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/eddielth/data-trans/logger"
 	"github.com/eddielth/data-trans/transformer"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
+// mysqlWideDialect is the SQL of MySQL wide tables
+var mysqlWideDialect = wideDialect{
+	name:        "MySQL",
+	placeholder: func(int) string { return "?" },
+	quote:       quoteMySQLIdentifier,
+	createTable: `
+	CREATE TABLE IF NOT EXISTS %[1]s (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		device_name VARCHAR(255) NOT NULL,
+		timestamp BIGINT NOT NULL,
+		metadata JSON,
+		attributes JSON,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_device_name_timestamp (device_name, timestamp),
+		INDEX idx_timestamp (timestamp)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+	`,
+	columnTypes: map[string]string{WideKindNumber: "DOUBLE", WideKindBool: "BOOLEAN", WideKindString: "TEXT"},
+	addColumn:   "ALTER TABLE %s ADD COLUMN %s %s NULL",
+	duplicateColumn: func(err error) bool {
+		// ER_DUP_FIELDNAME
+		var mysqlErr *mysql.MySQLError
+		return errors.As(err, &mysqlErr) && mysqlErr.Number == 1060
+	},
+	listColumns: `SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?`,
+	kinds:       map[string]string{"double": WideKindNumber, "tinyint": WideKindBool, "text": WideKindString},
+	purge:       "DELETE FROM %s WHERE timestamp < ? ORDER BY id LIMIT ?",
+}
+
 // MySQLStorage represents a MySQL database storage backend
 type MySQLStorage struct {
 	db       *sql.DB
 	dsn      string
 	database string
+	tables   sqlTables
+	// upserts are the device types whose records are updated in place
+	upserts map[string]bool
+	// wide stores the device types with a wide table, nil when there are none
+	wide *wideTables
+	// retention purges expired records, nil when no retention is configured
+	retention *retentionJob
+	// errorLog records processing errors into the processing_errors table
+	errorLog bool
 }
 
 // NewMySQLStorage creates a new MySQL storage backend
-func NewMySQLStorage(dsn string) (*MySQLStorage, error) {
+func NewMySQLStorage(dsn string, opts DatabaseOptions) (*MySQLStorage, error) {
 	// Parse DSN to get database name
 	database, serverDSN, err := parseMySQLDSN(dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse MySQL DSN: %v", err)
 	}
 
+	// MySQL identifiers are limited to 64 characters
+	if err := validateDatabaseName(database, 64); err != nil {
+		return nil, err
+	}
+	tables, err := opts.tables()
+	if err != nil {
+		return nil, err
+	}
+
 	// First connect to MySQL server (without specifying database)
 	serverDB, err := sql.Open("mysql", serverDSN)
 	if err != nil {
@@ -35,7 +83,7 @@ func NewMySQLStorage(dsn string) (*MySQLStorage, error) {
 	defer serverDB.Close()
 
 	// Create database if not exists
-	_, err = serverDB.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s` CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci", database))
+	_, err = serverDB.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci", quoteMySQLIdentifier(database)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create database: %v", err)
 	}
@@ -55,14 +103,22 @@ func NewMySQLStorage(dsn string) (*MySQLStorage, error) {
 	}
 
 	// Set connection pool parameters
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(time.Minute * 5)
+	opts.applyPool(db)
+
+	wide, err := newWideTables(db, mysqlWideDialect, opts.TablePrefix, opts.WideDeviceTypes)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	storage := &MySQLStorage{
 		db:       db,
 		dsn:      dsn,
 		database: database,
+		tables:   tables,
+		upserts:  opts.UpsertDeviceTypes,
+		wide:     wide,
+		errorLog: opts.ErrorLog,
 	}
 
 	// Initialize database and tables
@@ -71,6 +127,8 @@ func NewMySQLStorage(dsn string) (*MySQLStorage, error) {
 		return nil, fmt.Errorf("failed to initialize MySQL database: %v", err)
 	}
 
+	storage.retention = startRetention("MySQL", opts, storage.purgeExpired)
+
 	logger.Info("MySQL database storage initialized successfully")
 	return storage, nil
 }
@@ -99,8 +157,8 @@ func parseMySQLDSN(dsn string) (database string, serverDSN string, err error) {
 // InitDatabase initializes database and tables
 func (ms *MySQLStorage) InitDatabase() error {
 	// Create device data table
-	deviceTableSQL := `
-	CREATE TABLE IF NOT EXISTS device_data (
+	deviceTableSQL := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
 		id BIGINT AUTO_INCREMENT PRIMARY KEY,
 		device_name VARCHAR(255) NOT NULL,
 		device_type VARCHAR(255) NOT NULL,
@@ -111,24 +169,26 @@ func (ms *MySQLStorage) InitDatabase() error {
 		INDEX idx_device_name (device_name),
 		INDEX idx_timestamp (timestamp)
 	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
-	`
+	`, ms.tables.data)
 
 	// Create device attributes table
-	attributeTableSQL := `
-	CREATE TABLE IF NOT EXISTS device_attributes (
+	attributeTableSQL := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %[1]s (
 		id BIGINT AUTO_INCREMENT PRIMARY KEY,
 		device_data_id BIGINT NOT NULL,
 		name VARCHAR(255) NOT NULL,
 		type VARCHAR(50) NOT NULL,
 		value TEXT NOT NULL,
+		value_num DOUBLE,
 		unit VARCHAR(50),
 		quality INT,
 		metadata JSON,
-		FOREIGN KEY (device_data_id) REFERENCES device_data(id) ON DELETE CASCADE,
+		FOREIGN KEY (device_data_id) REFERENCES %[2]s(id) ON DELETE CASCADE,
 		INDEX idx_device_data_id (device_data_id),
-		INDEX idx_name (name)
+		INDEX idx_name (name),
+		INDEX idx_name_value_num (name, value_num)
 	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
-	`
+	`, ms.tables.attributes, ms.tables.data)
 
 	// Execute table creation SQL
 	_, err := ms.db.Exec(deviceTableSQL)
@@ -141,14 +201,91 @@ func (ms *MySQLStorage) InitDatabase() error {
 		return fmt.Errorf("failed to create device attributes table: %v", err)
 	}
 
+	// Add numeric value column to tables created by older versions
+	var columnCount int
+	err = ms.db.QueryRow(`SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ? AND column_name = 'value_num'`, ms.tables.attributes).Scan(&columnCount)
+	if err != nil {
+		return fmt.Errorf("failed to check device attributes table columns: %v", err)
+	}
+	if columnCount == 0 {
+		_, err = ms.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN value_num DOUBLE AFTER value, ADD INDEX idx_name_value_num (name, value_num)", ms.tables.attributes))
+		if err != nil {
+			return fmt.Errorf("failed to add numeric value column: %v", err)
+		}
+		logger.Info("Added value_num column to MySQL device attributes table")
+	}
+
+	if len(ms.upserts) > 0 {
+		if err := ms.ensureSnapshotIndex(); err != nil {
+			return err
+		}
+	}
+
+	if ms.errorLog {
+		_, err = ms.db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			timestamp BIGINT NOT NULL,
+			topic TEXT NOT NULL,
+			device_type VARCHAR(255) NOT NULL,
+			reason VARCHAR(50) NOT NULL,
+			error TEXT NOT NULL,
+			payload_hash CHAR(64) NOT NULL,
+			payload_size INT NOT NULL,
+			INDEX idx_timestamp (timestamp),
+			INDEX idx_device_type_timestamp (device_type, timestamp)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+		`, ms.tables.errors))
+		if err != nil {
+			return fmt.Errorf("failed to create processing errors table: %v", err)
+		}
+	}
+
+	if ms.wide != nil {
+		if err := ms.wide.init(); err != nil {
+			return err
+		}
+	}
+
 	logger.Info("MySQL database tables initialized successfully")
 	return nil
 }
 
+// ensureSnapshotIndex adds the snapshot column and the unique index upserted records are keyed on.
+// Appended records leave snapshot NULL, which the unique index never treats as a duplicate
+func (ms *MySQLStorage) ensureSnapshotIndex() error {
+	var columnCount int
+	err := ms.db.QueryRow(`SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ? AND column_name = 'snapshot'`, ms.tables.data).Scan(&columnCount)
+	if err != nil {
+		return fmt.Errorf("failed to check device data table columns: %v", err)
+	}
+	if columnCount > 0 {
+		return nil
+	}
+
+	_, err = ms.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN snapshot BOOLEAN NULL, ADD UNIQUE INDEX idx_snapshot (device_type, device_name, snapshot)", ms.tables.data))
+	if err != nil {
+		return fmt.Errorf("failed to add snapshot unique index: %v", err)
+	}
+	logger.Info("Added snapshot unique index to MySQL device data table")
+	return nil
+}
+
 // Store stores data into MySQL database
 func (ms *MySQLStorage) Store(deviceType string, data transformer.DeviceData) error {
+	return ms.StoreCtx(context.Background(), deviceType, data)
+}
+
+// StoreCtx stores data into MySQL database, cancelling ctx aborts the statements and rolls back
+func (ms *MySQLStorage) StoreCtx(ctx context.Context, deviceType string, data transformer.DeviceData) error {
+	if ms.wide.has(deviceType) {
+		return ms.wide.store(ctx, deviceType, data)
+	}
+
 	// Start transaction
-	tx, err := ms.db.Begin()
+	tx, err := ms.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -164,12 +301,18 @@ func (ms *MySQLStorage) Store(deviceType string, data transformer.DeviceData) er
 	// Convert metadata to JSON
 	metadataJSON, err := json.Marshal(data.Metadata)
 	if err != nil {
-		return fmt.Errorf("failed to serialize metadata: %v", err)
+		return fmt.Errorf("%w: failed to serialize metadata: %v", ErrInvalidData, err)
 	}
 
-	// Insert device data
-	deviceSQL := `INSERT INTO device_data (device_name, device_type, timestamp, metadata) VALUES (?, ?, ?, ?)`
-	result, err := tx.Exec(deviceSQL, data.DeviceName, data.DeviceType, data.Timestamp, metadataJSON)
+	// Insert device data, or update the snapshot of the device in upsert mode
+	upsert := ms.upserts[deviceType]
+	deviceSQL := fmt.Sprintf("INSERT INTO %s (device_name, device_type, timestamp, metadata) VALUES (?, ?, ?, ?)", ms.tables.data)
+	if upsert {
+		// LAST_INSERT_ID(id) makes the id of an updated row the insert ID
+		deviceSQL = fmt.Sprintf(`INSERT INTO %s (device_name, device_type, timestamp, metadata, snapshot) VALUES (?, ?, ?, ?, TRUE)
+			ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), timestamp = VALUES(timestamp), metadata = VALUES(metadata)`, ms.tables.data)
+	}
+	result, err := tx.ExecContext(ctx, deviceSQL, data.DeviceName, data.DeviceType, data.Timestamp, metadataJSON)
 	if err != nil {
 		return fmt.Errorf("failed to insert device data: %v", err)
 	}
@@ -180,30 +323,38 @@ func (ms *MySQLStorage) Store(deviceType string, data transformer.DeviceData) er
 		return fmt.Errorf("failed to get insert ID: %v", err)
 	}
 
+	// The attributes of the previous snapshot are replaced
+	if upsert {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE device_data_id = ?", ms.tables.attributes), deviceDataID)
+		if err != nil {
+			return fmt.Errorf("failed to delete previous device attributes: %v", err)
+		}
+	}
+
 	// Batch insert attributes
 	if len(data.Attributes) > 0 {
 		// Build batch insert SQL
 		valueStrings := make([]string, 0, len(data.Attributes))
-		valueArgs := make([]interface{}, 0, len(data.Attributes)*7)
+		valueArgs := make([]interface{}, 0, len(data.Attributes)*8)
 
 		for _, attr := range data.Attributes {
 			// Convert attribute value to string
-			valueStr := fmt.Sprintf("%v", attr.Value)
+			valueStr := valueString(attr.Value)
 
 			// Convert attribute metadata to JSON
 			attrMetadataJSON, err := json.Marshal(attr.Metadata)
 			if err != nil {
-				return fmt.Errorf("failed to serialize attribute metadata: %v", err)
+				return fmt.Errorf("%w: failed to serialize attribute metadata: %v", ErrInvalidData, err)
 			}
 
-			valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?)")
-			valueArgs = append(valueArgs, deviceDataID, attr.Name, attr.Type, valueStr, attr.Unit, attr.Quality, attrMetadataJSON)
+			valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?)")
+			valueArgs = append(valueArgs, deviceDataID, attr.Name, attr.Type, valueStr, numericValue(attr), attr.Unit, attr.Quality, attrMetadataJSON)
 		}
 
-		attrSQL := fmt.Sprintf("INSERT INTO device_attributes (device_data_id, name, type, value, unit, quality, metadata) VALUES %s",
-			strings.Join(valueStrings, ","))
+		attrSQL := fmt.Sprintf("INSERT INTO %s (device_data_id, name, type, value, value_num, unit, quality, metadata) VALUES %s",
+			ms.tables.attributes, strings.Join(valueStrings, ","))
 
-		_, err = tx.Exec(attrSQL, valueArgs...)
+		_, err = tx.ExecContext(ctx, attrSQL, valueArgs...)
 		if err != nil {
 			return fmt.Errorf("failed to insert device attributes: %v", err)
 		}
@@ -218,8 +369,65 @@ func (ms *MySQLStorage) Store(deviceType string, data transformer.DeviceData) er
 	return nil
 }
 
-// Close closes the database connection
+// Query queries stored data from MySQL database
+func (ms *MySQLStorage) Query(filter QueryFilter) ([]transformer.DeviceData, error) {
+	if ms.wide.has(filter.DeviceType) {
+		return ms.wide.query(filter)
+	}
+	return querySQL(ms.db, ms.tables, func(int) string { return "?" }, filter)
+}
+
+// purgeExpired deletes up to limit records older than cutoff, the attributes are deleted by the cascade.
+// The wide tables are purged once the device data table has no more expired records, then the processing errors
+func (ms *MySQLStorage) purgeExpired(cutoff int64, limit int) (int64, error) {
+	result, err := ms.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE timestamp < ? ORDER BY id LIMIT ?", ms.tables.data), cutoff, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired device data: %v", err)
+	}
+	purged, err := result.RowsAffected()
+	if err != nil || purged >= int64(limit) {
+		return purged, err
+	}
+	n, err := ms.wide.purge(cutoff, limit-int(purged))
+	purged += n
+	if err != nil || purged >= int64(limit) || !ms.errorLog {
+		return purged, err
+	}
+
+	result, err = ms.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE timestamp < ? ORDER BY id LIMIT ?", ms.tables.errors), cutoff, limit-int(purged))
+	if err != nil {
+		return purged, fmt.Errorf("failed to delete expired processing errors: %v", err)
+	}
+	n, err = result.RowsAffected()
+	return purged + n, err
+}
+
+// ErrorLogEnabled implements ErrorRecorder
+func (ms *MySQLStorage) ErrorLogEnabled() bool {
+	return ms.errorLog
+}
+
+// RecordError inserts a processing error into the processing_errors table
+func (ms *MySQLStorage) RecordError(ctx context.Context, e ProcessingError) error {
+	_, err := ms.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (timestamp, topic, device_type, reason, error, payload_hash, payload_size)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, ms.tables.errors),
+		e.Timestamp, e.Topic, e.DeviceType, e.Reason, e.Error, e.PayloadHash, e.PayloadSize)
+	if err != nil {
+		return fmt.Errorf("failed to insert processing error: %v", err)
+	}
+	return nil
+}
+
+// Stats returns the connection pool statistics of the MySQL database
+func (ms *MySQLStorage) Stats() sql.DBStats {
+	return ms.db.Stats()
+}
+
+// Close stops the retention job and closes the database connection
 func (ms *MySQLStorage) Close() error {
+	if ms.retention != nil {
+		ms.retention.stop()
+	}
 	if ms.db != nil {
 		err := ms.db.Close()
 		if err != nil {
@@ -1,32 +1,75 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/eddielth/data-trans/logger"
 	"github.com/eddielth/data-trans/transformer"
 	_ "github.com/lib/pq"
 )
 
+// postgresWideDialect is the SQL of PostgreSQL wide tables, index names carry the table name because they are unique per schema
+var postgresWideDialect = wideDialect{
+	name:        "PostgreSQL",
+	placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	quote:       quotePostgreSQLIdentifier,
+	createTable: `
+	CREATE TABLE IF NOT EXISTS %[1]s (
+		id BIGSERIAL PRIMARY KEY,
+		device_name VARCHAR(255) NOT NULL,
+		timestamp BIGINT NOT NULL,
+		metadata JSONB,
+		attributes JSONB,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS %[1]s_idx_name_ts ON %[1]s(device_name, timestamp);
+	CREATE INDEX IF NOT EXISTS %[1]s_idx_ts ON %[1]s(timestamp);
+	`,
+	columnTypes: map[string]string{WideKindNumber: "DOUBLE PRECISION", WideKindBool: "BOOLEAN", WideKindString: "TEXT"},
+	addColumn:   "ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s",
+	listColumns: `SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1`,
+	kinds:       map[string]string{"double precision": WideKindNumber, "boolean": WideKindBool, "text": WideKindString},
+	purge:       "DELETE FROM %[1]s WHERE id IN (SELECT id FROM %[1]s WHERE timestamp < $1 ORDER BY id LIMIT $2)",
+}
+
 // PostgreSQLStorage represents a PostgreSQL database storage backend
 type PostgreSQLStorage struct {
 	db       *sql.DB
 	dsn      string
 	database string
+	tables   sqlTables
+	// upserts are the device types whose records are updated in place
+	upserts map[string]bool
+	// wide stores the device types with a wide table, nil when there are none
+	wide *wideTables
+	// retention purges expired records, nil when no retention is configured
+	retention *retentionJob
+	// errorLog records processing errors into the processing_errors table
+	errorLog bool
 }
 
 // NewPostgreSQLStorage creates a new PostgreSQL storage backend
-func NewPostgreSQLStorage(dsn string) (*PostgreSQLStorage, error) {
+func NewPostgreSQLStorage(dsn string, opts DatabaseOptions) (*PostgreSQLStorage, error) {
 	// Parse DSN to get database name and server DSN
 	database, serverDSN, err := parsePostgreSQLDSN(dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse PostgreSQL DSN: %v", err)
 	}
 
+	// PostgreSQL identifiers are limited to 63 bytes
+	if err := validateDatabaseName(database, 63); err != nil {
+		return nil, err
+	}
+	tables, err := opts.tables()
+	if err != nil {
+		return nil, err
+	}
+
 	// First connect to PostgreSQL server (without specifying database)
 	serverDB, err := sql.Open("postgres", serverDSN)
 	if err != nil {
@@ -44,7 +87,7 @@ func NewPostgreSQLStorage(dsn string) (*PostgreSQLStorage, error) {
 	// Create database if not exists
 	if !exists {
 		// Creating database requires separate connection as it can't be in transaction
-		_, err = serverDB.Exec(fmt.Sprintf("CREATE DATABASE %s", database))
+		_, err = serverDB.Exec(fmt.Sprintf("CREATE DATABASE %s", quotePostgreSQLIdentifier(database)))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create database: %v", err)
 		}
@@ -66,14 +109,22 @@ func NewPostgreSQLStorage(dsn string) (*PostgreSQLStorage, error) {
 	}
 
 	// Set connection pool parameters
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(time.Minute * 5)
+	opts.applyPool(db)
+
+	wide, err := newWideTables(db, postgresWideDialect, opts.TablePrefix, opts.WideDeviceTypes)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	storage := &PostgreSQLStorage{
 		db:       db,
 		dsn:      dsn,
 		database: database,
+		tables:   tables,
+		upserts:  opts.UpsertDeviceTypes,
+		wide:     wide,
+		errorLog: opts.ErrorLog,
 	}
 
 	// Initialize database and tables
@@ -82,6 +133,8 @@ func NewPostgreSQLStorage(dsn string) (*PostgreSQLStorage, error) {
 		return nil, fmt.Errorf("failed to initialize PostgreSQL database: %v", err)
 	}
 
+	storage.retention = startRetention("PostgreSQL", opts, storage.purgeExpired)
+
 	logger.Info("PostgreSQL database storage initialized successfully")
 	return storage, nil
 }
@@ -134,9 +187,9 @@ func parsePostgreSQLDSN(dsn string) (database string, serverDSN string, err erro
 
 // InitDatabase initializes database and tables
 func (ps *PostgreSQLStorage) InitDatabase() error {
-	// Create device data table
-	deviceTableSQL := `
-	CREATE TABLE IF NOT EXISTS device_data (
+	// Create device data table, index names carry the table prefix because they are unique per schema
+	deviceTableSQL := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %[1]s (
 		id SERIAL PRIMARY KEY,
 		device_name VARCHAR(255) NOT NULL,
 		device_type VARCHAR(255) NOT NULL,
@@ -145,28 +198,35 @@ func (ps *PostgreSQLStorage) InitDatabase() error {
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 
-	CREATE INDEX IF NOT EXISTS idx_device_type ON device_data(device_type);
-	CREATE INDEX IF NOT EXISTS idx_device_name ON device_data(device_name);
-	CREATE INDEX IF NOT EXISTS idx_timestamp ON device_data(timestamp);
-	`
+	CREATE INDEX IF NOT EXISTS %[2]sidx_device_type ON %[1]s(device_type);
+	CREATE INDEX IF NOT EXISTS %[2]sidx_device_name ON %[1]s(device_name);
+	CREATE INDEX IF NOT EXISTS %[2]sidx_timestamp ON %[1]s(timestamp);
+	`, ps.tables.data, ps.tables.prefix)
 
 	// Create device attributes table
-	attributeTableSQL := `
-	CREATE TABLE IF NOT EXISTS device_attributes (
+	attributeTableSQL := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %[1]s (
 		id SERIAL PRIMARY KEY,
 		device_data_id INTEGER NOT NULL,
 		name VARCHAR(255) NOT NULL,
 		type VARCHAR(50) NOT NULL,
 		value TEXT NOT NULL,
+		value_num DOUBLE PRECISION,
 		unit VARCHAR(50),
 		quality INTEGER,
 		metadata JSONB,
-		FOREIGN KEY (device_data_id) REFERENCES device_data(id) ON DELETE CASCADE
+		FOREIGN KEY (device_data_id) REFERENCES %[2]s(id) ON DELETE CASCADE
 	);
 
-	CREATE INDEX IF NOT EXISTS idx_device_data_id ON device_attributes(device_data_id);
-	CREATE INDEX IF NOT EXISTS idx_name ON device_attributes(name);
-	`
+	CREATE INDEX IF NOT EXISTS %[3]sidx_device_data_id ON %[1]s(device_data_id);
+	CREATE INDEX IF NOT EXISTS %[3]sidx_name ON %[1]s(name);
+	`, ps.tables.attributes, ps.tables.data, ps.tables.prefix)
+
+	// Add numeric value column to tables created by older versions
+	valueNumSQL := fmt.Sprintf(`
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS value_num DOUBLE PRECISION;
+	CREATE INDEX IF NOT EXISTS %[2]sidx_name_value_num ON %[1]s(name, value_num);
+	`, ps.tables.attributes, ps.tables.prefix)
 
 	// Execute table creation SQL
 	_, err := ps.db.Exec(deviceTableSQL)
@@ -179,14 +239,69 @@ func (ps *PostgreSQLStorage) InitDatabase() error {
 		return fmt.Errorf("failed to create device attributes table: %v", err)
 	}
 
+	_, err = ps.db.Exec(valueNumSQL)
+	if err != nil {
+		return fmt.Errorf("failed to add numeric value column: %v", err)
+	}
+
+	// Upserted records are keyed on a unique index, appended records leave snapshot NULL
+	// which the index never treats as a duplicate
+	if len(ps.upserts) > 0 {
+		snapshotSQL := fmt.Sprintf(`
+		ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS snapshot BOOLEAN;
+		CREATE UNIQUE INDEX IF NOT EXISTS %[2]sidx_device_snapshot ON %[1]s(device_type, device_name, snapshot);
+		`, ps.tables.data, ps.tables.prefix)
+		_, err = ps.db.Exec(snapshotSQL)
+		if err != nil {
+			return fmt.Errorf("failed to add snapshot unique index: %v", err)
+		}
+	}
+
+	if ps.errorLog {
+		errorTableSQL := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			id BIGSERIAL PRIMARY KEY,
+			timestamp BIGINT NOT NULL,
+			topic TEXT NOT NULL,
+			device_type VARCHAR(255) NOT NULL,
+			reason VARCHAR(50) NOT NULL,
+			error TEXT NOT NULL,
+			payload_hash CHAR(64) NOT NULL,
+			payload_size INTEGER NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS %[2]sidx_errors_timestamp ON %[1]s(timestamp);
+		CREATE INDEX IF NOT EXISTS %[2]sidx_errors_device_type_timestamp ON %[1]s(device_type, timestamp);
+		`, ps.tables.errors, ps.tables.prefix)
+		_, err = ps.db.Exec(errorTableSQL)
+		if err != nil {
+			return fmt.Errorf("failed to create processing errors table: %v", err)
+		}
+	}
+
+	if ps.wide != nil {
+		if err := ps.wide.init(); err != nil {
+			return err
+		}
+	}
+
 	logger.Info("PostgreSQL database tables initialized successfully")
 	return nil
 }
 
 // Store stores data into PostgreSQL database
 func (ps *PostgreSQLStorage) Store(deviceType string, data transformer.DeviceData) error {
+	return ps.StoreCtx(context.Background(), deviceType, data)
+}
+
+// StoreCtx stores data into PostgreSQL database, cancelling ctx aborts the statements and rolls back
+func (ps *PostgreSQLStorage) StoreCtx(ctx context.Context, deviceType string, data transformer.DeviceData) error {
+	if ps.wide.has(deviceType) {
+		return ps.wide.store(ctx, deviceType, data)
+	}
+
 	// Start transaction
-	tx, err := ps.db.Begin()
+	tx, err := ps.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -202,45 +317,59 @@ func (ps *PostgreSQLStorage) Store(deviceType string, data transformer.DeviceDat
 	// Convert metadata to JSON
 	metadataJSON, err := json.Marshal(data.Metadata)
 	if err != nil {
-		return fmt.Errorf("failed to serialize metadata: %v", err)
+		return fmt.Errorf("%w: failed to serialize metadata: %v", ErrInvalidData, err)
 	}
 
-	// Insert device data
-	deviceSQL := `INSERT INTO device_data (device_name, device_type, timestamp, metadata) VALUES ($1, $2, $3, $4) RETURNING id`
+	// Insert device data, or update the snapshot of the device in upsert mode
+	upsert := ps.upserts[deviceType]
+	deviceSQL := fmt.Sprintf("INSERT INTO %s (device_name, device_type, timestamp, metadata) VALUES ($1, $2, $3, $4) RETURNING id", ps.tables.data)
+	if upsert {
+		deviceSQL = fmt.Sprintf(`INSERT INTO %s (device_name, device_type, timestamp, metadata, snapshot) VALUES ($1, $2, $3, $4, TRUE)
+			ON CONFLICT (device_type, device_name, snapshot) DO UPDATE SET timestamp = EXCLUDED.timestamp, metadata = EXCLUDED.metadata
+			RETURNING id`, ps.tables.data)
+	}
 	var deviceDataID int64
-	err = tx.QueryRow(deviceSQL, data.DeviceName, data.DeviceType, data.Timestamp, metadataJSON).Scan(&deviceDataID)
+	err = tx.QueryRowContext(ctx, deviceSQL, data.DeviceName, data.DeviceType, data.Timestamp, metadataJSON).Scan(&deviceDataID)
 	if err != nil {
 		return fmt.Errorf("failed to insert device data: %v", err)
 	}
 
+	// The attributes of the previous snapshot are replaced
+	if upsert {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE device_data_id = $1", ps.tables.attributes), deviceDataID)
+		if err != nil {
+			return fmt.Errorf("failed to delete previous device attributes: %v", err)
+		}
+	}
+
 	// Batch insert attributes
 	if len(data.Attributes) > 0 {
 		// Build batch insert SQL
 		valueStrings := make([]string, 0, len(data.Attributes))
-		valueArgs := make([]interface{}, 0, len(data.Attributes)*7)
+		valueArgs := make([]interface{}, 0, len(data.Attributes)*8)
 		paramCounter := 1
 
 		for _, attr := range data.Attributes {
 			// Convert attribute value to string
-			valueStr := fmt.Sprintf("%v", attr.Value)
+			valueStr := valueString(attr.Value)
 
 			// Convert attribute metadata to JSON
 			attrMetadataJSON, err := json.Marshal(attr.Metadata)
 			if err != nil {
-				return fmt.Errorf("failed to serialize attribute metadata: %v", err)
+				return fmt.Errorf("%w: failed to serialize attribute metadata: %v", ErrInvalidData, err)
 			}
 
-			placeholders := fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)",
-				paramCounter, paramCounter+1, paramCounter+2, paramCounter+3, paramCounter+4, paramCounter+5, paramCounter+6)
+			placeholders := fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+				paramCounter, paramCounter+1, paramCounter+2, paramCounter+3, paramCounter+4, paramCounter+5, paramCounter+6, paramCounter+7)
 			valueStrings = append(valueStrings, placeholders)
-			valueArgs = append(valueArgs, deviceDataID, attr.Name, attr.Type, valueStr, attr.Unit, attr.Quality, attrMetadataJSON)
-			paramCounter += 7
+			valueArgs = append(valueArgs, deviceDataID, attr.Name, attr.Type, valueStr, numericValue(attr), attr.Unit, attr.Quality, attrMetadataJSON)
+			paramCounter += 8
 		}
 
-		attrSQL := fmt.Sprintf("INSERT INTO device_attributes (device_data_id, name, type, value, unit, quality, metadata) VALUES %s",
-			strings.Join(valueStrings, ","))
+		attrSQL := fmt.Sprintf("INSERT INTO %s (device_data_id, name, type, value, value_num, unit, quality, metadata) VALUES %s",
+			ps.tables.attributes, strings.Join(valueStrings, ","))
 
-		_, err = tx.Exec(attrSQL, valueArgs...)
+		_, err = tx.ExecContext(ctx, attrSQL, valueArgs...)
 		if err != nil {
 			return fmt.Errorf("failed to insert device attributes: %v", err)
 		}
@@ -255,8 +384,65 @@ func (ps *PostgreSQLStorage) Store(deviceType string, data transformer.DeviceDat
 	return nil
 }
 
-// Close closes the database connection
+// Query queries stored data from PostgreSQL database
+func (ps *PostgreSQLStorage) Query(filter QueryFilter) ([]transformer.DeviceData, error) {
+	if ps.wide.has(filter.DeviceType) {
+		return ps.wide.query(filter)
+	}
+	return querySQL(ps.db, ps.tables, func(n int) string { return fmt.Sprintf("$%d", n) }, filter)
+}
+
+// purgeExpired deletes up to limit records older than cutoff, the attributes are deleted by the cascade.
+// The wide tables are purged once the device data table has no more expired records, then the processing errors
+func (ps *PostgreSQLStorage) purgeExpired(cutoff int64, limit int) (int64, error) {
+	result, err := ps.db.Exec(fmt.Sprintf("DELETE FROM %[1]s WHERE id IN (SELECT id FROM %[1]s WHERE timestamp < $1 ORDER BY id LIMIT $2)", ps.tables.data), cutoff, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired device data: %v", err)
+	}
+	purged, err := result.RowsAffected()
+	if err != nil || purged >= int64(limit) {
+		return purged, err
+	}
+	n, err := ps.wide.purge(cutoff, limit-int(purged))
+	purged += n
+	if err != nil || purged >= int64(limit) || !ps.errorLog {
+		return purged, err
+	}
+
+	result, err = ps.db.Exec(fmt.Sprintf("DELETE FROM %[1]s WHERE id IN (SELECT id FROM %[1]s WHERE timestamp < $1 ORDER BY id LIMIT $2)", ps.tables.errors), cutoff, limit-int(purged))
+	if err != nil {
+		return purged, fmt.Errorf("failed to delete expired processing errors: %v", err)
+	}
+	n, err = result.RowsAffected()
+	return purged + n, err
+}
+
+// ErrorLogEnabled implements ErrorRecorder
+func (ps *PostgreSQLStorage) ErrorLogEnabled() bool {
+	return ps.errorLog
+}
+
+// RecordError inserts a processing error into the processing_errors table
+func (ps *PostgreSQLStorage) RecordError(ctx context.Context, e ProcessingError) error {
+	_, err := ps.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (timestamp, topic, device_type, reason, error, payload_hash, payload_size)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, ps.tables.errors),
+		e.Timestamp, e.Topic, e.DeviceType, e.Reason, e.Error, e.PayloadHash, e.PayloadSize)
+	if err != nil {
+		return fmt.Errorf("failed to insert processing error: %v", err)
+	}
+	return nil
+}
+
+// Stats returns the connection pool statistics of the PostgreSQL database
+func (ps *PostgreSQLStorage) Stats() sql.DBStats {
+	return ps.db.Stats()
+}
+
+// Close stops the retention job and closes the database connection
 func (ps *PostgreSQLStorage) Close() error {
+	if ps.retention != nil {
+		ps.retention.stop()
+	}
 	if ps.db != nil {
 		err := ps.db.Close()
 		if err != nil {
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// ErrNoQueryableBackend is returned by Manager.Query when no backend supports queries
+var ErrNoQueryableBackend = errors.New("no queryable storage backend configured")
+
+// QueryFilter represents the conditions of a storage query, zero values are not filtered
+type QueryFilter struct {
+	// DeviceType matches the device type exactly
+	DeviceType string
+	// DeviceName matches the device name exactly
+	DeviceName string
+	// From is the inclusive lower bound of the data timestamp
+	From int64
+	// To is the inclusive upper bound of the data timestamp
+	To int64
+	// Descending orders results by timestamp from newest to oldest
+	Descending bool
+	// Limit is the maximum number of results
+	Limit int
+	// Offset is the number of results to skip
+	Offset int
+}
+
+// QueryableBackend represents a storage backend that can read back stored data
+type QueryableBackend interface {
+	StorageBackend
+	// Query returns the stored data matching filter, ordered and paginated as requested
+	Query(filter QueryFilter) ([]transformer.DeviceData, error)
+}
+
+// Match reports whether data satisfies the filter
+func (f QueryFilter) Match(data transformer.DeviceData) bool {
+	if f.DeviceType != "" && data.DeviceType != f.DeviceType {
+		return false
+	}
+	if f.DeviceName != "" && data.DeviceName != f.DeviceName {
+		return false
+	}
+	if f.From != 0 && data.Timestamp < f.From {
+		return false
+	}
+	if f.To != 0 && data.Timestamp > f.To {
+		return false
+	}
+	return true
+}
+
+// paginate applies ordering offset and limit of the filter to results sorted by timestamp ascending
+func (f QueryFilter) paginate(results []transformer.DeviceData) []transformer.DeviceData {
+	if f.Descending {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
+	if f.Offset > 0 {
+		if f.Offset >= len(results) {
+			return nil
+		}
+		results = results[f.Offset:]
+	}
+	if f.Limit > 0 && f.Limit < len(results) {
+		results = results[:f.Limit]
+	}
+	return results
+}
+
+// Query queries the first backend that supports queries
+func (m *Manager) Query(filter QueryFilter) ([]transformer.DeviceData, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, backend := range m.backends {
+		if queryable, ok := backend.(QueryableBackend); ok {
+			return queryable.Query(filter)
+		}
+	}
+
+	return nil, ErrNoQueryableBackend
+}
+
+// querySQL queries device data and attributes from a SQL database,
+// placeholder returns the bind parameter for the n-th (1-based) argument
+func querySQL(db *sql.DB, tables sqlTables, placeholder func(n int) string, filter QueryFilter) ([]transformer.DeviceData, error) {
+	clauses, args := sqlClauses(filter, placeholder, true)
+	deviceSQL := "SELECT id, device_name, device_type, timestamp, metadata FROM " + tables.data + clauses
+
+	rows, err := db.Query(deviceSQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device data: %v", err)
+	}
+	defer rows.Close()
+
+	var results []transformer.DeviceData
+	var ids []interface{}
+	indexByID := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var data transformer.DeviceData
+		var metadataJSON []byte
+		if err := rows.Scan(&id, &data.DeviceName, &data.DeviceType, &data.Timestamp, &metadataJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan device data: %v", err)
+		}
+		if len(metadataJSON) > 0 {
+			if err := json.Unmarshal(metadataJSON, &data.Metadata); err != nil {
+				return nil, fmt.Errorf("failed to parse metadata: %v", err)
+			}
+		}
+		indexByID[id] = len(results)
+		ids = append(ids, id)
+		results = append(results, data)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read device data: %v", err)
+	}
+
+	if len(ids) == 0 {
+		return results, nil
+	}
+
+	// Load attributes of all matched records
+	placeholders := make([]string, len(ids))
+	for i := range ids {
+		placeholders[i] = placeholder(i + 1)
+	}
+	attrSQL := fmt.Sprintf("SELECT device_data_id, name, type, value, value_num, unit, quality, metadata FROM %s WHERE device_data_id IN (%s) ORDER BY id",
+		tables.attributes, strings.Join(placeholders, ","))
+
+	attrRows, err := db.Query(attrSQL, ids...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device attributes: %v", err)
+	}
+	defer attrRows.Close()
+
+	for attrRows.Next() {
+		var deviceDataID int64
+		var attr transformer.DeviceAttribute
+		var value string
+		var valueNum sql.NullFloat64
+		var unit sql.NullString
+		var quality sql.NullInt64
+		var metadataJSON []byte
+		if err := attrRows.Scan(&deviceDataID, &attr.Name, &attr.Type, &value, &valueNum, &unit, &quality, &metadataJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan device attribute: %v", err)
+		}
+
+		if valueNum.Valid {
+			attr.Value = valueNum.Float64
+		} else {
+			attr.Value = value
+		}
+		attr.Unit = unit.String
+		attr.Quality = int(quality.Int64)
+		if len(metadataJSON) > 0 {
+			if err := json.Unmarshal(metadataJSON, &attr.Metadata); err != nil {
+				return nil, fmt.Errorf("failed to parse attribute metadata: %v", err)
+			}
+		}
+
+		if i, ok := indexByID[deviceDataID]; ok {
+			results[i].Attributes = append(results[i].Attributes, attr)
+		}
+	}
+	if err := attrRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read device attributes: %v", err)
+	}
+
+	return results, nil
+}
+
+// sqlClauses returns the WHERE, ORDER BY and LIMIT clauses of filter and the arguments of the WHERE clause.
+// The device type is only filtered with withDeviceType, wide tables hold the records of a single device type
+func sqlClauses(filter QueryFilter, placeholder func(n int) string, withDeviceType bool) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(column string, op string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf("%s %s %s", column, op, placeholder(len(args))))
+	}
+
+	if withDeviceType && filter.DeviceType != "" {
+		addCondition("device_type", "=", filter.DeviceType)
+	}
+	if filter.DeviceName != "" {
+		addCondition("device_name", "=", filter.DeviceName)
+	}
+	if filter.From != 0 {
+		addCondition("timestamp", ">=", filter.From)
+	}
+	if filter.To != 0 {
+		addCondition("timestamp", "<=", filter.To)
+	}
+
+	var clauses string
+	if len(conditions) > 0 {
+		clauses += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if filter.Descending {
+		clauses += " ORDER BY timestamp DESC, id DESC"
+	} else {
+		clauses += " ORDER BY timestamp, id"
+	}
+	if filter.Limit > 0 || filter.Offset > 0 {
+		limit := int64(filter.Limit)
+		if limit <= 0 {
+			// Both databases require a LIMIT when OFFSET is used
+			limit = math.MaxInt64
+		}
+		clauses += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, filter.Offset)
+	}
+	return clauses, args
+}
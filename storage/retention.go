@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+)
+
+// DefaultRetentionInterval is how often expired records are purged when no interval is configured
+const DefaultRetentionInterval = time.Hour
+
+// retentionBatchSize is the number of records deleted per statement, so a purge never holds
+// locks on the tables long enough to block the inserts of incoming data
+const retentionBatchSize = 1000
+
+// purgeBatch deletes up to limit records with a timestamp before cutoff (Unit: milliseconds)
+// and returns the number of records deleted, their attributes are deleted by the cascade
+type purgeBatch func(cutoff int64, limit int) (int64, error)
+
+// retentionJob deletes the records older than the retention period every interval
+// in the background until it is stopped
+type retentionJob struct {
+	name     string
+	days     int
+	interval time.Duration
+	purge    purgeBatch
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// startRetention starts purging the records of the backend name older than opts.RetentionDays,
+// nil is returned when no retention is configured
+func startRetention(name string, opts DatabaseOptions, purge purgeBatch) *retentionJob {
+	if opts.RetentionDays <= 0 {
+		return nil
+	}
+	interval := opts.RetentionInterval
+	if interval <= 0 {
+		interval = DefaultRetentionInterval
+	}
+
+	r := &retentionJob{
+		name:     name,
+		days:     opts.RetentionDays,
+		interval: interval,
+		purge:    purge,
+		done:     make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.loop()
+
+	logger.Info("%s retention enabled: records older than %d days are purged every %v", name, r.days, interval)
+	return r
+}
+
+// loop purges expired records every interval until the job is stopped
+func (r *retentionJob) loop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.run(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// run deletes the records older than the retention period before now in batches
+func (r *retentionJob) run(now time.Time) {
+	cutoff := now.AddDate(0, 0, -r.days).UnixMilli()
+
+	var purged int64
+	for {
+		n, err := r.purge(cutoff, retentionBatchSize)
+		purged += n
+		if err != nil {
+			logger.Error("Failed to purge expired %s records after deleting %d: %v", r.name, purged, err)
+			return
+		}
+		if n < retentionBatchSize {
+			break
+		}
+
+		select {
+		case <-r.done:
+			logger.Info("Purged %d expired %s records before stopping", purged, r.name)
+			return
+		default:
+		}
+	}
+
+	logger.Info("Purged %d %s records older than %d days", purged, r.name, r.days)
+}
+
+// stop stops the job and waits for a running purge to finish its batch
+func (r *retentionJob) stop() {
+	close(r.done)
+	r.wg.Wait()
+}
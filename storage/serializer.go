@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// Serializers of file storage
+const (
+	// SerializerJSON writes one indented JSON document per file, it is the default
+	SerializerJSON = "json"
+	// SerializerNDJSON writes one compact JSON line per file, ready to be concatenated
+	SerializerNDJSON = "ndjson"
+	// SerializerAvro writes one Avro object container file per record, see AvroSchema
+	SerializerAvro = "avro"
+)
+
+// Serializer encodes the device data written to a file
+type Serializer interface {
+	// MarshalDeviceData encodes data into the content of a file
+	MarshalDeviceData(data transformer.DeviceData) ([]byte, error)
+	// Extension is the file name extension of encoded files, e.g. ".json"
+	Extension() string
+}
+
+// NewSerializer returns the serializer with the given name, empty selects SerializerJSON
+func NewSerializer(name string) (Serializer, error) {
+	switch name {
+	case "", SerializerJSON:
+		return jsonSerializer{indent: true}, nil
+	case SerializerNDJSON:
+		return ndjsonSerializer{}, nil
+	case SerializerAvro:
+		return newAvroSerializer()
+	default:
+		return nil, fmt.Errorf("unsupported serializer: %s", name)
+	}
+}
+
+// jsonSerializer encodes data as a JSON document, indented unless the file is compressed
+type jsonSerializer struct {
+	indent bool
+}
+
+// MarshalDeviceData implements Serializer
+func (s jsonSerializer) MarshalDeviceData(data transformer.DeviceData) ([]byte, error) {
+	if s.indent {
+		return json.MarshalIndent(data, "", "  ")
+	}
+	return json.Marshal(data)
+}
+
+// Extension implements Serializer
+func (jsonSerializer) Extension() string {
+	return ".json"
+}
+
+// ndjsonSerializer encodes data as a single JSON line terminated by a newline
+type ndjsonSerializer struct{}
+
+// MarshalDeviceData implements Serializer
+func (ndjsonSerializer) MarshalDeviceData(data transformer.DeviceData) ([]byte, error) {
+	line, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// Extension implements Serializer
+func (ndjsonSerializer) Extension() string {
+	return ".ndjson"
+}
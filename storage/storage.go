@@ -1,7 +1,13 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/eddielth/data-trans/logger"
 	"github.com/eddielth/data-trans/transformer"
@@ -11,48 +17,358 @@ import (
 type StorageBackend interface {
 	// Store stores data
 	Store(deviceType string, data transformer.DeviceData) error
+	// StoreCtx stores data, in-flight work is aborted with an error once ctx is done
+	StoreCtx(ctx context.Context, deviceType string, data transformer.DeviceData) error
 	// Close closes the storage connection
 	Close() error
 }
 
+// Flusher is implemented by storage backends that buffer data before writing it
+type Flusher interface {
+	// Flush writes all buffered data
+	Flush() error
+}
+
+// StatsReporter is implemented by storage backends with a connection pool
+type StatsReporter interface {
+	// Stats returns the connection pool statistics
+	Stats() sql.DBStats
+}
+
+// StoreMode controls how Manager.Store treats backend failures
+type StoreMode string
+
+const (
+	// StoreModeBestEffort logs backend failures and continues, Store never fails
+	StoreModeBestEffort StoreMode = "best_effort"
+	// StoreModeAllOrNothing attempts all backends and fails if any of them failed.
+	// Backends are not transactional, data written to the backends that succeeded is not rolled back
+	StoreModeAllOrNothing StoreMode = "all_or_nothing"
+)
+
 // Manager manages multiple storage backends
 type Manager struct {
 	backends []StorageBackend
 	mutex    sync.RWMutex
+	// defaultMode applies to device types without an entry in deviceModes
+	defaultMode StoreMode
+	deviceModes map[string]StoreMode
+	// concurrent stores to all backends at once, storeTimeout bounds each store
+	concurrent   bool
+	storeTimeout time.Duration
+	// breakers holds the circuit breaker of each backend, created on first use
+	breakers         map[StorageBackend]*circuitBreaker
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	breakerMutex     sync.Mutex
+	// wal records data before it is stored, nil disables it. walFailures holds the types of the backends
+	// that failed each WAL entry since the last checkpoint by sequence number, walDropped the number of
+	// batches dropped by each buffering backend at the last checkpoint
+	wal         *WAL
+	walFailures map[int64][]string
+	walMutex    sync.Mutex
+	walDropped  map[string]int64
+	walDone     chan struct{}
+	walWG       sync.WaitGroup
+	// checkpointMutex serializes the WAL checkpoints, the replay and the last checkpoint of Close
+	checkpointMutex sync.Mutex
 }
 
 // NewManager creates a new storage manager
 func NewManager(backends []StorageBackend) *Manager {
 	return &Manager{
-		backends: backends,
+		backends:    backends,
+		defaultMode: StoreModeBestEffort,
+	}
+}
+
+// SetStoreModes sets the default store mode and per device type overrides,
+// an empty default mode selects best effort
+func (m *Manager) SetStoreModes(defaultMode StoreMode, deviceModes map[string]StoreMode) {
+	if defaultMode == "" {
+		defaultMode = StoreModeBestEffort
 	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.defaultMode = defaultMode
+	m.deviceModes = deviceModes
+}
+
+// SetConcurrentStore enables storing to all backends concurrently, one goroutine per backend.
+// timeout bounds each store in both modes, a backend that has not finished in time counts as failed, 0 waits for all backends
+func (m *Manager) SetConcurrentStore(enabled bool, timeout time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.concurrent = enabled
+	m.storeTimeout = timeout
 }
 
-// Store stores data to all backends
+// storeMode returns the store mode of a device type, the caller must hold the mutex
+func (m *Manager) storeMode(deviceType string) StoreMode {
+	if mode, ok := m.deviceModes[deviceType]; ok && mode != "" {
+		return mode
+	}
+	return m.defaultMode
+}
+
+// Store stores data to all backends without a deadline other than the configured store timeout
 func (m *Manager) Store(deviceType string, data transformer.DeviceData) error {
+	return m.StoreCtx(context.Background(), deviceType, data)
+}
+
+// StoreCtx stores data to all backends. In best effort mode failures are only logged,
+// in all-or-nothing mode every backend is still attempted and an error is returned if any failed.
+// Backends abort their in-flight work once ctx is done or the store timeout expires
+func (m *Manager) StoreCtx(ctx context.Context, deviceType string, data transformer.DeviceData) error {
+	_, err := m.StoreFailuresCtx(ctx, deviceType, data)
+	return err
+}
+
+// StoreFailuresCtx stores data like StoreCtx and also returns the failure of each backend that failed, and
+// of the WAL, as "type: error", including the failures a best effort store mode does not return an error for
+func (m *Manager) StoreFailuresCtx(ctx context.Context, deviceType string, data transformer.DeviceData) ([]string, error) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
+	var failures []string
+	// Record the data before it reaches the backends, so it is replayed if the process crashes
+	var seq int64
+	if m.wal != nil {
+		var err error
+		if seq, err = m.wal.Append(deviceType, data); err != nil {
+			logger.Error("Failed to append data to the WAL: %v", err)
+			failures = append(failures, fmt.Sprintf("wal: %v", err))
+		}
+	}
+
+	backendFailures := m.storeBackends(ctx, m.backends, deviceType, data)
+	// Entries of the WAL are kept for the backends that failed them
+	if seq > 0 {
+		m.recordWALFailures(seq, backendFailures)
+	}
+	for _, failure := range backendFailures {
+		failures = append(failures, failure.String())
+	}
+
+	if len(failures) > 0 && m.storeMode(deviceType) == StoreModeAllOrNothing {
+		return failures, fmt.Errorf("failed to store data to %d of %d backends: %s", len(failures), len(m.backends), strings.Join(failures, "; "))
+	}
+	return failures, nil
+}
+
+// StoreToCtx stores data to the backends of the given types only, e.g. "mysql" or "file", and to all
+// backends when types is empty. Failures are logged and returned; the WAL and the store modes do not apply
+func (m *Manager) StoreToCtx(ctx context.Context, types []string, deviceType string, data transformer.DeviceData) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.storeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.storeTimeout)
+		defer cancel()
+	}
+
+	var failures []string
 	for _, backend := range m.backends {
-		if err := backend.Store(deviceType, data); err != nil {
-			// Log error but continue to other backends
-			logger.Error("Failed to store data to backend: %v", err)
+		if len(types) > 0 && !slices.Contains(types, backendType(backend)) {
+			continue
+		}
+		if err := m.storeBackend(ctx, backend, deviceType, data); err != nil {
+			logStoreFailure(backend, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", backendType(backend), err))
 		}
 	}
 
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to store data to %d backends: %s", len(failures), strings.Join(failures, "; "))
+	}
 	return nil
 }
 
-// Close closes all storage backend connections
+// backendFailure is the failure of a backend to store data
+type backendFailure struct {
+	backend StorageBackend
+	err     error
+}
+
+// String returns the failure as "type: error"
+func (f backendFailure) String() string {
+	return fmt.Sprintf("%s: %v", backendType(f.backend), f.err)
+}
+
+// storeBackends stores data to backends within the store timeout and returns the failures,
+// the caller must hold the mutex
+func (m *Manager) storeBackends(ctx context.Context, backends []StorageBackend, deviceType string, data transformer.DeviceData) []backendFailure {
+	if m.storeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.storeTimeout)
+		defer cancel()
+	}
+
+	if m.concurrent {
+		return m.storeConcurrent(ctx, backends, deviceType, data)
+	}
+
+	var failures []backendFailure
+	for _, backend := range backends {
+		if err := m.storeBackend(ctx, backend, deviceType, data); err != nil {
+			// Log error but continue to other backends
+			logStoreFailure(backend, err)
+			failures = append(failures, backendFailure{backend: backend, err: err})
+		}
+	}
+	return failures
+}
+
+// storeResult is the outcome of storing to one backend
+type storeResult struct {
+	index int
+	err   error
+}
+
+// storeConcurrent stores data to backends at once and returns the failures,
+// the caller must hold the mutex. Backends still running when ctx is done are reported
+// as failed; they are cancelled through ctx and finish in the background.
+func (m *Manager) storeConcurrent(ctx context.Context, backends []StorageBackend, deviceType string, data transformer.DeviceData) []backendFailure {
+	// Buffered so backends finishing after ctx is done do not block
+	results := make(chan storeResult, len(backends))
+	for i, backend := range backends {
+		go func(i int, backend StorageBackend) {
+			results <- storeResult{index: i, err: m.storeBackend(ctx, backend, deviceType, data)}
+		}(i, backend)
+	}
+
+	var failures []backendFailure
+	done := make([]bool, len(backends))
+	for received := 0; received < len(backends); received++ {
+		select {
+		case result := <-results:
+			done[result.index] = true
+			if result.err != nil {
+				logStoreFailure(backends[result.index], result.err)
+				failures = append(failures, backendFailure{backend: backends[result.index], err: result.err})
+			}
+		case <-ctx.Done():
+			for i, backend := range backends {
+				if !done[i] {
+					logger.ErrorKV("Storing data to backend aborted", logger.Fields{"backend": backendType(backend), "error": ctx.Err()})
+					failures = append(failures, backendFailure{backend: backend, err: ctx.Err()})
+				}
+			}
+			return failures
+		}
+	}
+	return failures
+}
+
+// Flush flushes all buffering backends
+func (m *Manager) Flush() {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	m.flush()
+}
+
+// flush flushes all buffering backends and reports whether all succeeded, the caller must hold the mutex
+func (m *Manager) flush() bool {
+	flushed := true
+	for _, backend := range m.backends {
+		if flusher, ok := backend.(Flusher); ok {
+			if err := flusher.Flush(); err != nil {
+				logger.Error("Failed to flush storage backend: %v", err)
+				flushed = false
+			}
+		}
+	}
+	return flushed
+}
+
+// Close flushes buffered data and closes all storage backend connections. The WAL segments are
+// removed, except for the entries that failed on some backends, which are replayed for them on the next startup
 func (m *Manager) Close() {
+	if m.walDone != nil {
+		close(m.walDone)
+		m.walWG.Wait()
+	}
+
+	m.checkpointMutex.Lock()
+	defer m.checkpointMutex.Unlock()
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	var unconfirmed []string
+	if m.wal != nil {
+		unconfirmed = m.flushUnconfirmed()
+	} else {
+		m.flush()
+	}
 	for _, backend := range m.backends {
 		if err := backend.Close(); err != nil {
 			logger.Error("Failed to close storage backend connection: %v", err)
 		}
 	}
+
+	if m.wal != nil {
+		if err := m.wal.closeCurrent(); err != nil {
+			logger.Error("Failed to close the WAL: %v", err)
+		}
+		m.confirmWAL(m.takeWALFailures(), unconfirmed)
+	}
+}
+
+// BackendTypes returns the types of the configured backends
+func (m *Manager) BackendTypes() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	types := make([]string, 0, len(m.backends))
+	for _, backend := range m.backends {
+		types = append(types, backendType(backend))
+	}
+	return types
+}
+
+// DatabaseStats returns the connection pool statistics of the backends reporting them by backend type
+func (m *Manager) DatabaseStats() map[string]sql.DBStats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	stats := make(map[string]sql.DBStats)
+	for _, backend := range m.backends {
+		if reporter, ok := backend.(StatsReporter); ok {
+			stats[backendType(backend)] = reporter.Stats()
+		}
+	}
+	return stats
+}
+
+// backendType returns a short name describing the backend
+func backendType(backend StorageBackend) string {
+	// Backends of registered drivers are named after the database type they were registered under
+	if name, ok := databaseName(backend); ok {
+		return name
+	}
+	switch backend.(type) {
+	case *MySQLStorage:
+		return "mysql"
+	case *PostgreSQLStorage:
+		return "postgresql"
+	case *ClickHouseStorage:
+		return "clickhouse"
+	case *ElasticStorage:
+		return "elasticsearch"
+	case *FileStorage:
+		return "file"
+	case *CSVStorage:
+		return "csv"
+	case *JSONLStorage:
+		return "jsonl"
+	default:
+		return fmt.Sprintf("%T", backend)
+	}
 }
 
 // AddBackend adds a new storage backend
@@ -63,6 +379,32 @@ func (m *Manager) AddBackend(backend StorageBackend) {
 	m.backends = append(m.backends, backend)
 }
 
+// ReplaceDatabaseBackend swaps all database backends for backend in one step, so no message is
+// stored while the manager has no database. The previous database backends are closed afterwards
+func (m *Manager) ReplaceDatabaseBackend(backend DatabaseStorage) {
+	m.mutex.Lock()
+	var previous []StorageBackend
+	backends := make([]StorageBackend, 0, len(m.backends))
+	for _, existing := range m.backends {
+		if _, ok := existing.(DatabaseStorage); ok {
+			previous = append(previous, existing)
+			continue
+		}
+		backends = append(backends, existing)
+	}
+	m.backends = append(backends, backend)
+	m.mutex.Unlock()
+
+	for _, old := range previous {
+		m.forgetBreaker(old)
+		if err := old.Close(); err != nil {
+			logger.Error("Failed to close replaced %s storage backend: %v", backendType(old), err)
+		}
+		logger.Info("%s storage backend replaced by %s", backendType(old), backendType(backend))
+		forgetDatabaseName(old)
+	}
+}
+
 // RemoveBackendByType removes storage backend by type
 func (m *Manager) RemoveBackendByType(backendType string) {
 	m.mutex.Lock()
@@ -70,6 +412,19 @@ func (m *Manager) RemoveBackendByType(backendType string) {
 
 	var newBackends []StorageBackend
 	for _, backend := range m.backends {
+		// Backends of registered drivers are matched by the database type they were created for
+		if name, ok := databaseName(backend); ok {
+			if name != backendType {
+				newBackends = append(newBackends, backend)
+				continue
+			}
+			if err := backend.Close(); err != nil {
+				logger.Error("Failed to close %s storage backend: %v", name, err)
+			}
+			logger.Info("%s storage backend removed", name)
+			continue
+		}
+
 		// Check backend type
 		switch backend.(type) {
 		case *MySQLStorage:
@@ -92,17 +447,73 @@ func (m *Manager) RemoveBackendByType(backendType string) {
 				}
 				logger.Info("PostgreSQL storage backend removed")
 			}
+		case *ClickHouseStorage:
+			if backendType != "clickhouse" {
+				newBackends = append(newBackends, backend)
+			} else {
+				// Flush buffered readings and close connection of backend to be removed
+				if err := backend.Close(); err != nil {
+					logger.Error("Failed to close ClickHouse storage backend connection: %v", err)
+				}
+				logger.Info("ClickHouse storage backend removed")
+			}
+		case *ElasticStorage:
+			if backendType != "elasticsearch" {
+				newBackends = append(newBackends, backend)
+			} else {
+				// Flush buffered documents of backend to be removed
+				if err := backend.Close(); err != nil {
+					logger.Error("Failed to close Elasticsearch storage backend: %v", err)
+				}
+				logger.Info("Elasticsearch storage backend removed")
+			}
 		case *FileStorage:
 			if backendType != "file" {
 				newBackends = append(newBackends, backend)
 			} else {
+				// Stop the compaction of backend to be removed
+				if err := backend.Close(); err != nil {
+					logger.Error("Failed to close file storage backend: %v", err)
+				}
 				logger.Info("File storage backend removed")
 			}
+		case *CSVStorage:
+			if backendType != "file" {
+				newBackends = append(newBackends, backend)
+			} else {
+				logger.Info("CSV file storage backend removed")
+			}
+		case *JSONLStorage:
+			if backendType != "file" {
+				newBackends = append(newBackends, backend)
+			} else {
+				// Close the open files of backend to be removed
+				if err := backend.Close(); err != nil {
+					logger.Error("Failed to close JSON Lines file storage backend: %v", err)
+				}
+				logger.Info("JSON Lines file storage backend removed")
+			}
 		default:
 			// Keep backends of unknown types
 			newBackends = append(newBackends, backend)
 		}
 	}
 
+	for _, backend := range m.backends {
+		if !containsBackend(newBackends, backend) {
+			m.forgetBreaker(backend)
+			forgetDatabaseName(backend)
+		}
+	}
 	m.backends = newBackends
 }
+
+// containsBackend reports whether backends contains backend
+func containsBackend(backends []StorageBackend, backend StorageBackend) bool {
+	for _, existing := range backends {
+		if existing == backend {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlTLSConfigCount numbers the TLS configs registered with the MySQL driver.
+// Every build registers a new name, so a backend kept after a failed reload keeps its config
+var mysqlTLSConfigCount atomic.Int64
+
+// hasTLSFiles reports whether a CA, client certificate or key file is configured
+func (opts DSNOptions) hasTLSFiles() bool {
+	return opts.CAFile != "" || opts.CertFile != "" || opts.KeyFile != ""
+}
+
+// tlsSSLMode returns the sslmode to use with TLS files. Without an explicit mode
+// a CA file selects verify-full and a client certificate alone selects require
+func (opts DSNOptions) tlsSSLMode() (string, error) {
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return "", fmt.Errorf("client certificate and key file must be set together")
+	}
+
+	switch opts.SSLMode {
+	case "":
+		if opts.CAFile != "" {
+			return "verify-full", nil
+		}
+		return "require", nil
+	case "disable":
+		return "", fmt.Errorf("TLS files cannot be used with sslmode disable")
+	case "prefer":
+		// A custom TLS config cannot fall back to an unencrypted connection
+		return "", fmt.Errorf("TLS files cannot be used with sslmode prefer, use require, verify-ca or verify-full")
+	case "require", "verify-ca", "verify-full":
+		return opts.SSLMode, nil
+	default:
+		return "", fmt.Errorf("unsupported sslmode: %s", opts.SSLMode)
+	}
+}
+
+// loadTLSConfig builds the TLS config of the connection from the CA, client certificate and key files.
+// Without a CA file the system roots are used
+func (opts DSNOptions) loadTLSConfig(sslMode string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: opts.Host}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA file %s contains no PEM certificates", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	switch sslMode {
+	case "require":
+		tlsConfig.InsecureSkipVerify = true
+	case "verify-ca":
+		// Verify the chain against the CA but not the host name
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         tlsConfig.RootCAs,
+				Intermediates: intermediates,
+			})
+			return err
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// registerMySQLTLSConfig registers the TLS config with the MySQL driver and returns the value of its tls parameter
+func registerMySQLTLSConfig(opts DSNOptions) (string, error) {
+	sslMode, err := opts.tlsSSLMode()
+	if err != nil {
+		return "", err
+	}
+	tlsConfig, err := opts.loadTLSConfig(sslMode)
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("data-trans-%d", mysqlTLSConfigCount.Add(1))
+	if err := mysql.RegisterTLSConfig(name, tlsConfig); err != nil {
+		return "", fmt.Errorf("failed to register MySQL TLS config: %v", err)
+	}
+	return name, nil
+}
+
+// checkTLSFiles loads the TLS files so unreadable or invalid files fail when the DSN is built
+// instead of on the first connection, and returns the sslmode to use with them
+func checkTLSFiles(opts DSNOptions) (string, error) {
+	sslMode, err := opts.tlsSSLMode()
+	if err != nil {
+		return "", err
+	}
+	if _, err := opts.loadTLSConfig(sslMode); err != nil {
+		return "", err
+	}
+	return sslMode, nil
+}
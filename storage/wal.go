@@ -0,0 +1,637 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/metrics"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// DefaultWALCheckpointInterval is how often buffered backends are flushed and the WAL truncated when no interval is configured
+const DefaultWALCheckpointInterval = 10 * time.Second
+
+// DefaultWALMaxSize is the size in MB the kept WAL segments are limited to when no size is configured
+const DefaultWALMaxSize = 1024
+
+// walSuffix is the file name suffix of WAL segments
+const walSuffix = ".wal"
+
+// walEntry is one line of a WAL segment
+type walEntry struct {
+	// Seq numbers the entries appended by the running process, the backend failures of an entry are tracked by it
+	Seq        int64                  `json:"seq,omitempty"`
+	DeviceType string                 `json:"device_type"`
+	Data       transformer.DeviceData `json:"data"`
+	// Backends are the types of the backends the entry still has to be stored to, empty for all backends
+	Backends []string `json:"backends,omitempty"`
+}
+
+// keptSegment is a segment holding the entries that failed on some backends
+type keptSegment struct {
+	segment int64
+	size    int64
+	entries int
+}
+
+// WAL is an on-disk write-ahead log of the data passed to Manager.Store. Entries are appended to
+// the current segment before they reach the backends; a checkpoint starts a new segment and removes
+// the previous ones once the buffering backends have flushed them. Entries that failed on some
+// backends are kept in a separate segment for those backends only and retried by a later checkpoint.
+// Segments left by a crash are replayed on startup, so data is stored at least once
+type WAL struct {
+	dir string
+	// sync calls fsync after every append, which also survives power loss but limits throughput
+	sync bool
+	// maxSize limits the total size of the kept segments, the oldest are removed beyond it (Unit: bytes)
+	maxSize int64
+	// seq is the sequence number of the last appended entry
+	seq atomic.Int64
+
+	mutex   sync.Mutex
+	file    *os.File
+	segment int64
+	// last is the highest segment number in use
+	last int64
+	// closed are the segments written before the current one, waiting for the next checkpoint
+	closed []int64
+	// kept are the segments of entries that failed on some backends, oldest first
+	kept []keptSegment
+	// recovered are the segments left by a previous run, stored again by Manager.ReplayWAL
+	recovered []int64
+}
+
+// OpenWAL opens the WAL in dir and starts a new segment after the existing ones. maxSize is in MB
+// and 0 selects DefaultWALMaxSize
+func OpenWAL(dir string, sync bool, maxSize int) (*WAL, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultWALMaxSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create dir %s failed: %v", dir, err)
+	}
+
+	segments, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{dir: dir, sync: sync, maxSize: int64(maxSize) * 1024 * 1024, recovered: segments}
+	if len(segments) > 0 {
+		w.last = segments[len(segments)-1]
+	}
+	if err := w.openSegment(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// walSegments returns the numbers of the segments in dir in ascending order
+func walSegments(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir %s failed: %v", dir, err)
+	}
+
+	var segments []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		segment, err := strconv.ParseInt(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// segmentPath returns the path of a segment
+func (w *WAL) segmentPath(segment int64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", segment, walSuffix))
+}
+
+// openSegment starts a new current segment, the caller must hold the mutex unless w is not shared yet
+func (w *WAL) openSegment() error {
+	file, err := os.OpenFile(w.segmentPath(w.last+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open WAL segment failed: %v", err)
+	}
+	w.last++
+	w.file = file
+	w.segment = w.last
+	return nil
+}
+
+// Append writes an entry to the current segment and returns its sequence number
+func (w *WAL) Append(deviceType string, data transformer.DeviceData) (int64, error) {
+	seq := w.seq.Add(1)
+	line, err := json.Marshal(walEntry{Seq: seq, DeviceType: deviceType, Data: data})
+	if err != nil {
+		return 0, fmt.Errorf("%w: serialize WAL entry failed: %v", ErrInvalidData, err)
+	}
+	line = append(line, '\n')
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return 0, fmt.Errorf("WAL is closed")
+	}
+	if _, err := w.file.Write(line); err != nil {
+		return 0, fmt.Errorf("write WAL entry failed: %v", err)
+	}
+	if w.sync {
+		if err := w.file.Sync(); err != nil {
+			return 0, fmt.Errorf("sync WAL segment failed: %v", err)
+		}
+	}
+	return seq, nil
+}
+
+// rotate closes the current segment and starts a new one, entries appended so far are in the closed segments
+func (w *WAL) rotate() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return fmt.Errorf("WAL is closed")
+	}
+	if err := w.file.Close(); err != nil {
+		logger.Warn("close WAL segment failed: %v", err)
+	}
+	w.closed = append(w.closed, w.segment)
+	return w.openSegment()
+}
+
+// takeClosed returns the closed segments and forgets them
+func (w *WAL) takeClosed() []int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	closed := w.closed
+	w.closed = nil
+	return closed
+}
+
+// takeKept returns the kept segments and forgets them
+func (w *WAL) takeKept() []int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	segments := make([]int64, 0, len(w.kept))
+	for _, kept := range w.kept {
+		segments = append(segments, kept.segment)
+	}
+	w.kept = nil
+	return segments
+}
+
+// remove removes segments, their entries are stored or kept in another segment
+func (w *WAL) remove(segments []int64) {
+	for _, segment := range segments {
+		if err := os.Remove(w.segmentPath(segment)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("remove WAL segment failed: %v", err)
+		}
+	}
+}
+
+// keep writes entries to a new kept segment and removes the segments they were read from. Once the
+// kept segments exceed the maximum size, the oldest are removed and their entries are lost
+func (w *WAL) keep(entries []walEntry, replaced []int64) error {
+	if len(entries) > 0 {
+		var buf []byte
+		for _, entry := range entries {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return fmt.Errorf("serialize WAL entry failed: %v", err)
+			}
+			buf = append(append(buf, line...), '\n')
+		}
+
+		w.mutex.Lock()
+		w.last++
+		segment := w.last
+		w.mutex.Unlock()
+
+		if err := w.writeSegment(segment, buf); err != nil {
+			return err
+		}
+
+		w.mutex.Lock()
+		w.kept = append(w.kept, keptSegment{segment: segment, size: int64(len(buf)), entries: len(entries)})
+		w.mutex.Unlock()
+	}
+
+	w.remove(replaced)
+	w.limitKept()
+	return nil
+}
+
+// writeSegment writes a complete segment, it is synced so it survives the removal of the segments it replaces
+func (w *WAL) writeSegment(segment int64, buf []byte) error {
+	file, err := os.OpenFile(w.segmentPath(segment), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("open WAL segment failed: %v", err)
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		return fmt.Errorf("write WAL segment failed: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync WAL segment failed: %v", err)
+	}
+	return file.Close()
+}
+
+// limitKept removes the oldest kept segments while their total size exceeds the maximum size
+func (w *WAL) limitKept() {
+	w.mutex.Lock()
+	var size int64
+	for _, kept := range w.kept {
+		size += kept.size
+	}
+	var removed []keptSegment
+	for len(w.kept) > 0 && size > w.maxSize {
+		removed = append(removed, w.kept[0])
+		size -= w.kept[0].size
+		w.kept = w.kept[1:]
+	}
+	w.mutex.Unlock()
+
+	for _, kept := range removed {
+		w.remove([]int64{kept.segment})
+		metrics.Add(metrics.WALEntriesDropped, int64(kept.entries))
+		logger.Error("Kept WAL segments exceed %d MB, dropped %d entries that were not stored to every backend", w.maxSize/1024/1024, kept.entries)
+	}
+}
+
+// Close closes the current segment, its entries are replayed on the next startup unless they were removed
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// closeCurrent closes the current segment and adds it to the closed segments for a last checkpoint
+func (w *WAL) closeCurrent() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	w.closed = append(w.closed, w.segment)
+	return err
+}
+
+// readSegment calls fn for each entry of a segment. A torn last line left by a crash is skipped
+func readSegment(path string, fn func(entry walEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logger.Warn("skip unparseable WAL entry in %s: %v", path, err)
+			continue
+		}
+		fn(entry)
+	}
+	return scanner.Err()
+}
+
+// batchDropper is implemented by buffering backends that drop a batch when writing it fails
+type batchDropper interface {
+	// droppedBatches returns the number of batches dropped so far
+	droppedBatches() int64
+}
+
+// SetWAL makes the manager append stored data to w before it reaches the backends and
+// starts checkpoints every interval, zero falls back to DefaultWALCheckpointInterval.
+// Call ReplayWAL before storing new data to recover the entries of a previous run
+func (m *Manager) SetWAL(w *WAL, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultWALCheckpointInterval
+	}
+
+	m.mutex.Lock()
+	m.wal = w
+	m.walDropped = m.droppedBatches()
+	m.walDone = make(chan struct{})
+	m.mutex.Unlock()
+
+	m.walWG.Add(1)
+	go m.checkpointLoop(interval)
+	logger.Info("Storage WAL enabled in %s, checkpoint interval: %s, max kept size: %d MB", w.dir, interval, w.maxSize/1024/1024)
+}
+
+// checkpointLoop runs a checkpoint every interval until the manager is closed
+func (m *Manager) checkpointLoop(interval time.Duration) {
+	defer m.walWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.checkpoint()
+		case <-m.walDone:
+			return
+		}
+	}
+}
+
+// recordWALFailures remembers the backends that failed to store the WAL entry seq, so the next
+// checkpoint keeps the entry for them. Failures caused by the data are not retried, they would fail again
+func (m *Manager) recordWALFailures(seq int64, failures []backendFailure) {
+	var types []string
+	for _, failure := range failures {
+		if errors.Is(failure.err, ErrInvalidData) {
+			continue
+		}
+		types = append(types, backendType(failure.backend))
+	}
+	if len(types) == 0 {
+		return
+	}
+
+	m.walMutex.Lock()
+	defer m.walMutex.Unlock()
+
+	if m.walFailures == nil {
+		m.walFailures = make(map[int64][]string)
+	}
+	m.walFailures[seq] = types
+}
+
+// takeWALFailures returns the backend failures recorded since the last call by sequence number
+func (m *Manager) takeWALFailures() map[int64][]string {
+	m.walMutex.Lock()
+	defer m.walMutex.Unlock()
+
+	failures := m.walFailures
+	m.walFailures = nil
+	return failures
+}
+
+// checkpoint starts a new WAL segment, flushes the buffering backends and removes the previous
+// segments. Entries that failed on some backends are kept for them; when none failed, the entries
+// kept by earlier checkpoints are retried
+func (m *Manager) checkpoint() {
+	m.checkpointMutex.Lock()
+	defer m.checkpointMutex.Unlock()
+
+	// The write lock waits for in-flight stores, so every entry of the closed segments reached the backends
+	m.mutex.Lock()
+	err := m.wal.rotate()
+	var failures map[int64][]string
+	if err == nil {
+		failures = m.takeWALFailures()
+	}
+	m.mutex.Unlock()
+	if err != nil {
+		logger.Error("Failed to start a new WAL segment: %v", err)
+		return
+	}
+
+	m.mutex.RLock()
+	unconfirmed := m.flushUnconfirmed()
+	m.mutex.RUnlock()
+
+	if m.confirmWAL(failures, unconfirmed) {
+		m.retryKept()
+	}
+}
+
+// flushUnconfirmed flushes the buffering backends and returns the types of those that failed to flush
+// or dropped a batch since the last call. The caller must hold the mutex and the checkpoint mutex
+func (m *Manager) flushUnconfirmed() []string {
+	var unconfirmed []string
+	for _, backend := range m.backends {
+		if flusher, ok := backend.(Flusher); ok {
+			if err := flusher.Flush(); err != nil {
+				logger.Error("Failed to flush storage backend: %v", err)
+				unconfirmed = append(unconfirmed, backendType(backend))
+			}
+		}
+	}
+
+	dropped := m.droppedBatches()
+	for name, n := range dropped {
+		if n != m.walDropped[name] && !slices.Contains(unconfirmed, name) {
+			unconfirmed = append(unconfirmed, name)
+		}
+	}
+	m.walDropped = dropped
+	return unconfirmed
+}
+
+// droppedBatches returns the number of batches dropped by each buffering backend by backend type,
+// the caller must hold the mutex
+func (m *Manager) droppedBatches() map[string]int64 {
+	dropped := make(map[string]int64)
+	for _, backend := range m.backends {
+		if dropper, ok := backend.(batchDropper); ok {
+			dropped[backendType(backend)] = dropper.droppedBatches()
+		}
+	}
+	return dropped
+}
+
+// confirmWAL removes the closed WAL segments. Entries that failed on some backends, and every entry
+// for the buffering backends in unconfirmed, are kept for those backends. It reports whether every entry was stored
+func (m *Manager) confirmWAL(failures map[int64][]string, unconfirmed []string) bool {
+	closed := m.wal.takeClosed()
+	if len(failures) == 0 && len(unconfirmed) == 0 {
+		m.wal.remove(closed)
+		return true
+	}
+
+	var kept []walEntry
+	for _, segment := range closed {
+		err := readSegment(m.wal.segmentPath(segment), func(entry walEntry) {
+			if backends := mergeBackendTypes(failures[entry.Seq], unconfirmed); len(backends) > 0 {
+				entry.Backends = backends
+				kept = append(kept, entry)
+			}
+		})
+		if err != nil {
+			logger.Error("Failed to read WAL segment %d, its segments are replayed on the next startup: %v", segment, err)
+			return false
+		}
+	}
+	if err := m.wal.keep(kept, closed); err != nil {
+		logger.Error("Failed to keep WAL entries, their segments are replayed on the next startup: %v", err)
+		return false
+	}
+	logger.Warn("Storing %d entries failed on some backends since the last WAL checkpoint, they are kept and retried for those backends", len(kept))
+	return false
+}
+
+// retryKept stores the entries kept by earlier checkpoints again to the backends that failed them
+func (m *Manager) retryKept() {
+	segments := m.wal.takeKept()
+	if len(segments) == 0 {
+		return
+	}
+
+	retried, kept := m.retryEntries(segments)
+	if kept > 0 {
+		logger.Warn("Retried %d kept WAL entries, %d failed again and are kept", retried, kept)
+		return
+	}
+	logger.Info("Retried %d kept WAL entries", retried)
+}
+
+// retryEntries stores the entries of segments to the backends listed in each entry, or to all backends,
+// and removes the segments. Entries failing again are kept for the backends that failed them. It returns
+// the number of entries stored and kept. The caller must hold the checkpoint mutex
+func (m *Manager) retryEntries(segments []int64) (retried int, kept int) {
+	for _, segment := range segments {
+		var entries []walEntry
+		err := readSegment(m.wal.segmentPath(segment), func(entry walEntry) {
+			entries = append(entries, entry)
+		})
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Error("Failed to read WAL segment %d, it is replayed on the next startup: %v", segment, err)
+			}
+			continue
+		}
+
+		// targets are the backend types each entry was stored to
+		targets := make([][]string, len(entries))
+		failed := make([][]string, len(entries))
+		var missing []string
+		for i, entry := range entries {
+			m.mutex.RLock()
+			backends, unknown := m.backendsOf(entry.Backends)
+			failures := m.storeBackends(context.Background(), backends, entry.DeviceType, entry.Data)
+			m.mutex.RUnlock()
+
+			for _, backend := range backends {
+				targets[i] = append(targets[i], backendType(backend))
+			}
+			for _, failure := range failures {
+				if !errors.Is(failure.err, ErrInvalidData) {
+					failed[i] = append(failed[i], backendType(failure.backend))
+				}
+			}
+			missing = mergeBackendTypes(missing, unknown)
+		}
+		if len(missing) > 0 {
+			logger.Warn("WAL entries of segment %d were pending for backends that are no longer configured, skipped: %v", segment, missing)
+		}
+
+		m.mutex.RLock()
+		unconfirmed := m.flushUnconfirmed()
+		m.mutex.RUnlock()
+
+		var keep []walEntry
+		for i, entry := range entries {
+			backends := failed[i]
+			for _, name := range unconfirmed {
+				if slices.Contains(targets[i], name) {
+					backends = mergeBackendTypes(backends, []string{name})
+				}
+			}
+			if len(backends) > 0 {
+				entry.Backends = backends
+				keep = append(keep, entry)
+			}
+		}
+		if err := m.wal.keep(keep, []int64{segment}); err != nil {
+			logger.Error("Failed to keep WAL entries of segment %d, it is replayed on the next startup: %v", segment, err)
+			continue
+		}
+		retried += len(entries)
+		kept += len(keep)
+	}
+	return retried, kept
+}
+
+// backendsOf returns the backends of the given types and the types that are not configured,
+// all backends when types is empty. The caller must hold the mutex
+func (m *Manager) backendsOf(types []string) ([]StorageBackend, []string) {
+	if len(types) == 0 {
+		return m.backends, nil
+	}
+
+	var backends []StorageBackend
+	unknown := slices.Clone(types)
+	for _, backend := range m.backends {
+		name := backendType(backend)
+		if slices.Contains(types, name) {
+			backends = append(backends, backend)
+			unknown = slices.DeleteFunc(unknown, func(t string) bool { return t == name })
+		}
+	}
+	return backends, unknown
+}
+
+// mergeBackendTypes returns the types in a followed by those of b not in a
+func mergeBackendTypes(a, b []string) []string {
+	merged := slices.Clone(a)
+	for _, name := range b {
+		if !slices.Contains(merged, name) {
+			merged = append(merged, name)
+		}
+	}
+	return merged
+}
+
+// ReplayWAL stores the entries of the WAL segments left by a previous run, e.g. after a crash, through
+// the backends and removes the segments. Entries of a crashed run are stored to all backends, entries
+// kept for the backends that failed them only to those. Entries failing again are kept and retried
+func (m *Manager) ReplayWAL() error {
+	m.checkpointMutex.Lock()
+	defer m.checkpointMutex.Unlock()
+
+	m.mutex.RLock()
+	w := m.wal
+	m.mutex.RUnlock()
+	if w == nil || len(w.recovered) == 0 {
+		return nil
+	}
+
+	recovered := w.recovered
+	w.recovered = nil
+	replayed, kept := m.retryEntries(recovered)
+	if kept > 0 {
+		return fmt.Errorf("storing %d of %d replayed WAL entries failed, they are kept and retried for the failed backends", kept, replayed)
+	}
+	logger.Info("Replayed %d WAL entries of a previous run", replayed)
+	return nil
+}
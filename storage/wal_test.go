@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eddielth/data-trans/metrics"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// otherFakeBackend is a fakeBackend with a backend type of its own
+type otherFakeBackend struct {
+	*fakeBackend
+}
+
+// newWALTestManager opens the WAL in dir for a manager storing to backends, checkpoints only run when called
+func newWALTestManager(t *testing.T, dir string, backends ...StorageBackend) *Manager {
+	t.Helper()
+
+	w, err := OpenWAL(dir, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(backends)
+	m.SetWAL(w, time.Hour)
+	return m
+}
+
+// storeDevices stores one record per device name
+func storeDevices(m *Manager, names ...string) {
+	for _, name := range names {
+		m.Store("temperature", transformer.DeviceData{DeviceName: name, DeviceType: "temperature"})
+	}
+}
+
+// walEntries returns the entries of all segments in dir
+func walEntries(t *testing.T, dir string) []walEntry {
+	t.Helper()
+
+	segments, err := walSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []walEntry
+	for _, segment := range segments {
+		err := readSegment(filepath.Join(dir, fmt.Sprintf("%020d%s", segment, walSuffix)), func(entry walEntry) {
+			entries = append(entries, entry)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return entries
+}
+
+func TestWALAppendAndReplayAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sensor1", "sensor2"} {
+		if _, err := w.Append("temperature", transformer.DeviceData{DeviceName: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Crash: the process ends without a checkpoint
+	w.Close()
+
+	backend := &fakeBackend{}
+	m := newWALTestManager(t, dir, backend)
+	if err := m.ReplayWAL(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backend.storedNames(), []string{"sensor1", "sensor2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	m.Close()
+
+	if entries := walEntries(t, dir); len(entries) != 0 {
+		t.Errorf("%d entries left after the replay and a clean shutdown", len(entries))
+	}
+}
+
+func TestWALCheckpointTruncatesStoredEntries(t *testing.T) {
+	dir := t.TempDir()
+	backend := &fakeBackend{}
+	m := newWALTestManager(t, dir, backend)
+	defer m.Close()
+
+	storeDevices(m, "sensor1", "sensor2", "sensor3")
+	if entries := walEntries(t, dir); len(entries) != 3 {
+		t.Fatalf("%d entries in the WAL before the checkpoint, want 3", len(entries))
+	}
+
+	m.checkpoint()
+	if entries := walEntries(t, dir); len(entries) != 0 {
+		t.Errorf("%d entries left after a checkpoint without failures", len(entries))
+	}
+}
+
+func TestWALKeepsEntriesForFailedBackendsOnly(t *testing.T) {
+	dir := t.TempDir()
+	healthy := &fakeBackend{}
+	failing := &otherFakeBackend{&fakeBackend{err: errors.New("connection refused")}}
+	m := newWALTestManager(t, dir, healthy, failing)
+	defer m.Close()
+
+	storeDevices(m, "sensor1", "sensor2")
+	m.checkpoint()
+
+	entries := walEntries(t, dir)
+	if len(entries) != 2 {
+		t.Fatalf("%d entries kept, want 2", len(entries))
+	}
+	for _, entry := range entries {
+		if want := []string{backendType(failing)}; !reflect.DeepEqual(entry.Backends, want) {
+			t.Errorf("entry of %s kept for %v, want %v", entry.Data.DeviceName, entry.Backends, want)
+		}
+	}
+
+	// A checkpoint with failures does not retry the kept entries
+	storeDevices(m, "sensor3")
+	m.checkpoint()
+	if got := len(walEntries(t, dir)); got != 3 {
+		t.Fatalf("%d entries kept, want 3", got)
+	}
+
+	// The next checkpoint without failures retries the kept entries on the failed backend only
+	failing.setErr(nil)
+	storeDevices(m, "sensor4")
+	m.checkpoint()
+
+	if got := len(walEntries(t, dir)); got != 0 {
+		t.Errorf("%d entries kept after the retry, want 0", got)
+	}
+	if got, want := healthy.storedNames(), []string{"sensor1", "sensor2", "sensor3", "sensor4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("healthy backend stored %v, want %v without duplicates", got, want)
+	}
+	if got, want := failing.storedNames(), []string{"sensor4", "sensor1", "sensor2", "sensor3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("failed backend stored %v, want %v", got, want)
+	}
+}
+
+func TestWALDropsInvalidData(t *testing.T) {
+	dir := t.TempDir()
+	backend := &fakeBackend{err: fmt.Errorf("%w: serialize metadata failed", ErrInvalidData)}
+	m := newWALTestManager(t, dir, backend)
+	defer m.Close()
+
+	storeDevices(m, "sensor1")
+	m.checkpoint()
+	if entries := walEntries(t, dir); len(entries) != 0 {
+		t.Errorf("%d entries kept for data errors, want 0", len(entries))
+	}
+}
+
+func TestWALReplaysKeptEntriesToFailedBackendsOnly(t *testing.T) {
+	dir := t.TempDir()
+	healthy := &fakeBackend{}
+	failing := &otherFakeBackend{&fakeBackend{err: errors.New("connection refused")}}
+	m := newWALTestManager(t, dir, healthy, failing)
+	storeDevices(m, "sensor1", "sensor2")
+	// The failed entries are kept at shutdown
+	m.Close()
+
+	restartedHealthy := &fakeBackend{}
+	restartedFailing := &otherFakeBackend{&fakeBackend{err: errors.New("connection refused")}}
+	m = newWALTestManager(t, dir, restartedHealthy, restartedFailing)
+	if err := m.ReplayWAL(); err == nil {
+		t.Fatal("ReplayWAL() = nil while the backend still fails")
+	}
+	if got := len(walEntries(t, dir)); got != 2 {
+		t.Fatalf("%d entries kept after a failed replay, want 2", got)
+	}
+
+	restartedFailing.setErr(nil)
+	m.checkpoint()
+	m.Close()
+
+	if got := restartedHealthy.storedNames(); len(got) != 0 {
+		t.Errorf("healthy backend stored %v again", got)
+	}
+	if got, want := restartedFailing.storedNames(), []string{"sensor1", "sensor2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("failed backend stored %v, want %v", got, want)
+	}
+	if got := len(walEntries(t, dir)); got != 0 {
+		t.Errorf("%d entries left, want 0", got)
+	}
+}
+
+func TestWALLimitsKeptSize(t *testing.T) {
+	dir := t.TempDir()
+	failing := &fakeBackend{err: errors.New("connection refused")}
+	m := newWALTestManager(t, dir, failing)
+	defer m.Close()
+
+	dropped := metrics.Get(metrics.WALEntriesDropped)
+	storeDevices(m, "sensor1", "sensor2")
+	m.checkpoint()
+	// Room for the entries of one checkpoint only
+	m.wal.maxSize = m.wal.kept[0].size * 3 / 2
+	storeDevices(m, "sensor3", "sensor4")
+	m.checkpoint()
+
+	entries := walEntries(t, dir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Data.DeviceName)
+	}
+	if want := []string{"sensor3", "sensor4"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("kept %v, want the newest %v", names, want)
+	}
+	if got := metrics.Get(metrics.WALEntriesDropped) - dropped; got != 2 {
+		t.Errorf("wal_entries_dropped increased by %d, want 2", got)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("%d files in the WAL directory, want the kept and the current segment", len(files))
+	}
+}
@@ -0,0 +1,478 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// Table layouts of SQL backends, selected per device type
+const (
+	// TableLayoutNormalized stores a device_data row per record and a device_attributes row per attribute. It is the default
+	TableLayoutNormalized = "normalized"
+	// TableLayoutWide stores a row per record in a table of the device type, with a column per attribute
+	TableLayoutWide = "wide"
+)
+
+// MaxWideColumns is the number of attribute columns added to a wide table,
+// further attributes are kept in its attributes JSON column
+const MaxWideColumns = 256
+
+// Kinds of wide table columns, the same as the attribute types declared for a device type
+const (
+	WideKindNumber = "number"
+	WideKindBool   = "bool"
+	WideKindString = "string"
+)
+
+// maxWideTableName keeps the index names, the table name with a suffix, within the identifier limits of all databases
+const maxWideTableName = 51
+
+// wideTableNamePattern is the set of wide table names accepted, they are used unquoted
+var wideTableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// wideColumnPattern is the set of attribute names stored in a column of their own
+var wideColumnPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// wideReservedColumns are the columns of every wide table, attributes of these names are kept in the attributes column
+var wideReservedColumns = map[string]bool{
+	"id":          true,
+	"device_name": true,
+	"timestamp":   true,
+	"metadata":    true,
+	"attributes":  true,
+	"created_at":  true,
+}
+
+// WideTableName returns the name of the wide table of a device type
+func WideTableName(tablePrefix string, deviceType string) string {
+	return tablePrefix + "device_data_" + deviceType
+}
+
+// wideDialect holds the SQL of wide tables that differs between databases
+type wideDialect struct {
+	name        string
+	placeholder func(n int) string
+	quote       func(name string) string
+	// createTable creates the table %[1]s with its indexes
+	createTable string
+	// columnTypes are the SQL types of the column kinds
+	columnTypes map[string]string
+	// addColumn adds the column %[2]s of type %[3]s to the table %[1]s
+	addColumn string
+	// duplicateColumn reports whether an error of addColumn means the column exists already, nil when addColumn cannot fail for it
+	duplicateColumn func(err error) bool
+	// listColumns returns the names and data types of the columns of the table given as argument
+	listColumns string
+	// kinds are the column kinds of the data types returned by listColumns
+	kinds map[string]string
+	// purge deletes up to the second argument rows of the table %s with a timestamp before the first argument
+	purge string
+}
+
+// wideTables stores the records of the device types with TableLayoutWide. Attribute columns are added
+// when an attribute appears for the first time, columns are never removed or changed
+type wideTables struct {
+	db      *sql.DB
+	dialect wideDialect
+	// names are the table names by device type
+	names map[string]string
+	// declared are the attribute kinds declared per device type, their columns are created upfront
+	declared map[string]map[string]string
+
+	mutex sync.Mutex
+	// columns are the attribute columns and their kinds per device type, loaded at init and extended as attributes appear
+	columns map[string]map[string]string
+}
+
+// newWideTables creates the wide tables of deviceTypes, which maps the device types to their declared attribute kinds.
+// nil is returned when there are no wide device types
+func newWideTables(db *sql.DB, dialect wideDialect, tablePrefix string, deviceTypes map[string]map[string]string) (*wideTables, error) {
+	if len(deviceTypes) == 0 {
+		return nil, nil
+	}
+
+	w := &wideTables{
+		db:       db,
+		dialect:  dialect,
+		names:    make(map[string]string, len(deviceTypes)),
+		declared: deviceTypes,
+		columns:  make(map[string]map[string]string, len(deviceTypes)),
+	}
+	for deviceType := range deviceTypes {
+		name := WideTableName(tablePrefix, deviceType)
+		if !wideTableNamePattern.MatchString(name) || len(name) > maxWideTableName {
+			return nil, fmt.Errorf("invalid wide table name %q of device type %s, only letters, digits and '_' are allowed and it must not exceed %d characters", name, deviceType, maxWideTableName)
+		}
+		w.names[deviceType] = name
+	}
+	return w, nil
+}
+
+// has reports whether deviceType uses a wide table, w may be nil
+func (w *wideTables) has(deviceType string) bool {
+	if w == nil {
+		return false
+	}
+	_, ok := w.names[deviceType]
+	return ok
+}
+
+// init creates the tables, loads their columns and adds the columns of the declared attributes
+func (w *wideTables) init() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for deviceType, table := range w.names {
+		if _, err := w.db.Exec(fmt.Sprintf(w.dialect.createTable, table)); err != nil {
+			return fmt.Errorf("failed to create wide table %s: %v", table, err)
+		}
+
+		columns, err := w.loadColumns(table)
+		if err != nil {
+			return err
+		}
+		w.columns[deviceType] = columns
+
+		declared := make([]string, 0, len(w.declared[deviceType]))
+		for name := range w.declared[deviceType] {
+			declared = append(declared, name)
+		}
+		sort.Strings(declared)
+		for _, name := range declared {
+			column := strings.ToLower(name)
+			if _, ok := columns[column]; ok || !wideColumn(column) {
+				continue
+			}
+			if err := w.addColumn(deviceType, column, w.declared[deviceType][name]); err != nil {
+				return err
+			}
+		}
+	}
+
+	logger.Info("%s wide tables initialized successfully", w.dialect.name)
+	return nil
+}
+
+// loadColumns returns the attribute columns of table and their kinds, columns of unknown types are treated as strings
+func (w *wideTables) loadColumns(table string) (map[string]string, error) {
+	rows, err := w.db.Query(w.dialect.listColumns, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of wide table %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, fmt.Errorf("failed to read columns of wide table %s: %v", table, err)
+		}
+		if wideReservedColumns[name] {
+			continue
+		}
+		kind, ok := w.dialect.kinds[strings.ToLower(dataType)]
+		if !ok {
+			kind = WideKindString
+		}
+		columns[name] = kind
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read columns of wide table %s: %v", table, err)
+	}
+	return columns, nil
+}
+
+// addColumn adds an attribute column to the table of deviceType, the caller must hold mutex.
+// A column added meanwhile by another instance sharing the database keeps its type, the columns are reloaded then
+func (w *wideTables) addColumn(deviceType string, column string, kind string) error {
+	table := w.names[deviceType]
+	_, err := w.db.Exec(fmt.Sprintf(w.dialect.addColumn, table, w.dialect.quote(column), w.dialect.columnTypes[kind]))
+	if err != nil {
+		if w.dialect.duplicateColumn == nil || !w.dialect.duplicateColumn(err) {
+			return fmt.Errorf("failed to add column %s to wide table %s: %v", column, table, err)
+		}
+		columns, err := w.loadColumns(table)
+		if err != nil {
+			return err
+		}
+		w.columns[deviceType] = columns
+		return nil
+	}
+	w.columns[deviceType][column] = kind
+	logger.Info("Added %s column %s to %s wide table %s", kind, column, w.dialect.name, table)
+	return nil
+}
+
+// wideColumn reports whether an attribute, by its lower-cased name, gets a column of its own
+func wideColumn(column string) bool {
+	return wideColumnPattern.MatchString(column) && !wideReservedColumns[column]
+}
+
+// attributeKind returns the kind of the column created for an attribute seen for the first time
+func attributeKind(attr transformer.DeviceAttribute) string {
+	if _, ok := attr.Value.(bool); ok {
+		return WideKindBool
+	}
+	if numericValue(attr).Valid {
+		return WideKindNumber
+	}
+	return WideKindString
+}
+
+// wideValue converts an attribute value for a column of kind, false is returned when it does not fit the column
+func wideValue(kind string, attr transformer.DeviceAttribute) (interface{}, bool) {
+	if attr.Value == nil {
+		return nil, true
+	}
+
+	switch kind {
+	case WideKindNumber:
+		if value := numericValue(attr); value.Valid {
+			return value.Float64, true
+		}
+		return nil, false
+	case WideKindBool:
+		switch v := attr.Value.(type) {
+		case bool:
+			return v, true
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return b, true
+			}
+		}
+		return nil, false
+	default:
+		return valueString(attr.Value), true
+	}
+}
+
+// store inserts data as a row of the table of deviceType. Attributes without a column get one, unless their
+// name is not a valid column name or the table has MaxWideColumns attribute columns; those and values not
+// fitting the kind of their column are stored in the attributes JSON column
+func (w *wideTables) store(ctx context.Context, deviceType string, data transformer.DeviceData) error {
+	metadataJSON, err := json.Marshal(data.Metadata)
+	if err != nil {
+		return fmt.Errorf("%w: failed to serialize metadata: %v", ErrInvalidData, err)
+	}
+
+	values := make(map[string]interface{}, len(data.Attributes))
+	var overflow map[string]interface{}
+	keep := func(attr transformer.DeviceAttribute) {
+		if overflow == nil {
+			overflow = make(map[string]interface{})
+		}
+		overflow[attr.Name] = attr.Value
+	}
+
+	// Columns are only added here, so the kinds read under the mutex stay valid
+	w.mutex.Lock()
+	columns := w.columns[deviceType]
+	for _, attr := range data.Attributes {
+		column := strings.ToLower(attr.Name)
+		kind, ok := columns[column]
+		if !ok {
+			if !wideColumn(column) || len(columns) >= MaxWideColumns {
+				keep(attr)
+				continue
+			}
+			kind = attributeKind(attr)
+			if err := w.addColumn(deviceType, column, kind); err != nil {
+				w.mutex.Unlock()
+				return err
+			}
+			// The column may exist already with another kind, added by another instance
+			columns = w.columns[deviceType]
+			kind = columns[column]
+		}
+
+		value, fits := wideValue(kind, attr)
+		if !fits {
+			keep(attr)
+			continue
+		}
+		values[column] = value
+	}
+	w.mutex.Unlock()
+
+	// The attributes column is NULL when every attribute has a column
+	var overflowArg interface{}
+	if overflow != nil {
+		overflowJSON, err := json.Marshal(overflow)
+		if err != nil {
+			return fmt.Errorf("%w: failed to serialize attributes: %v", ErrInvalidData, err)
+		}
+		overflowArg = overflowJSON
+	}
+
+	names := make([]string, 0, len(values))
+	for column := range values {
+		names = append(names, column)
+	}
+	sort.Strings(names)
+
+	columnList := []string{"device_name", "timestamp", "metadata", "attributes"}
+	args := []interface{}{data.DeviceName, data.Timestamp, metadataJSON, overflowArg}
+	for _, column := range names {
+		columnList = append(columnList, w.dialect.quote(column))
+		args = append(args, values[column])
+	}
+	placeholders := make([]string, len(args))
+	for i := range args {
+		placeholders[i] = w.dialect.placeholder(i + 1)
+	}
+
+	insertSQL := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", w.names[deviceType], strings.Join(columnList, ", "), strings.Join(placeholders, ", "))
+	if _, err := w.db.ExecContext(ctx, insertSQL, args...); err != nil {
+		return fmt.Errorf("failed to insert into wide table %s: %v", w.names[deviceType], err)
+	}
+
+	logger.Debug("Stored %s type data in %s wide table", deviceType, w.dialect.name)
+	return nil
+}
+
+// attributeType returns the attribute type of a value read back from a wide table
+func attributeType(value interface{}) string {
+	switch value.(type) {
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	default:
+		return "string"
+	}
+}
+
+// query reads the records of the wide table of filter.DeviceType. Attributes are returned in
+// column order followed by those of the attributes column, with lower-cased names and without units
+func (w *wideTables) query(filter QueryFilter) ([]transformer.DeviceData, error) {
+	deviceType := filter.DeviceType
+
+	w.mutex.Lock()
+	names := make([]string, 0, len(w.columns[deviceType]))
+	kinds := make(map[string]string, len(w.columns[deviceType]))
+	for column, kind := range w.columns[deviceType] {
+		names = append(names, column)
+		kinds[column] = kind
+	}
+	w.mutex.Unlock()
+	sort.Strings(names)
+
+	columnList := []string{"device_name", "timestamp", "metadata", "attributes"}
+	for _, column := range names {
+		columnList = append(columnList, w.dialect.quote(column))
+	}
+	clauses, args := sqlClauses(filter, w.dialect.placeholder, false)
+	rows, err := w.db.Query(fmt.Sprintf("SELECT %s FROM %s%s", strings.Join(columnList, ", "), w.names[deviceType], clauses), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query wide table %s: %v", w.names[deviceType], err)
+	}
+	defer rows.Close()
+
+	var results []transformer.DeviceData
+	for rows.Next() {
+		data := transformer.DeviceData{DeviceType: deviceType}
+		var metadataJSON, overflowJSON []byte
+		dest := []interface{}{&data.DeviceName, &data.Timestamp, &metadataJSON, &overflowJSON}
+		values := make([]interface{}, len(names))
+		for i, column := range names {
+			switch kinds[column] {
+			case WideKindNumber:
+				values[i] = new(sql.NullFloat64)
+			case WideKindBool:
+				values[i] = new(sql.NullBool)
+			default:
+				values[i] = new(sql.NullString)
+			}
+			dest = append(dest, values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan wide table row: %v", err)
+		}
+
+		if len(metadataJSON) > 0 {
+			if err := json.Unmarshal(metadataJSON, &data.Metadata); err != nil {
+				return nil, fmt.Errorf("failed to parse metadata: %v", err)
+			}
+		}
+		for i, column := range names {
+			var value interface{}
+			switch v := values[i].(type) {
+			case *sql.NullFloat64:
+				if !v.Valid {
+					continue
+				}
+				value = v.Float64
+			case *sql.NullBool:
+				if !v.Valid {
+					continue
+				}
+				value = v.Bool
+			case *sql.NullString:
+				if !v.Valid {
+					continue
+				}
+				value = v.String
+			}
+			data.Attributes = append(data.Attributes, transformer.DeviceAttribute{Name: column, Type: attributeType(value), Value: value})
+		}
+		if len(overflowJSON) > 0 {
+			var overflow map[string]interface{}
+			if err := json.Unmarshal(overflowJSON, &overflow); err != nil {
+				return nil, fmt.Errorf("failed to parse attributes: %v", err)
+			}
+			overflowNames := make([]string, 0, len(overflow))
+			for name := range overflow {
+				overflowNames = append(overflowNames, name)
+			}
+			sort.Strings(overflowNames)
+			for _, name := range overflowNames {
+				data.Attributes = append(data.Attributes, transformer.DeviceAttribute{Name: name, Type: attributeType(overflow[name]), Value: overflow[name]})
+			}
+		}
+		results = append(results, data)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read wide table %s: %v", w.names[deviceType], err)
+	}
+	return results, nil
+}
+
+// purge deletes up to limit rows older than cutoff from the wide tables, w may be nil
+func (w *wideTables) purge(cutoff int64, limit int) (int64, error) {
+	if w == nil {
+		return 0, nil
+	}
+
+	tables := make([]string, 0, len(w.names))
+	for _, table := range w.names {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	var purged int64
+	for _, table := range tables {
+		if purged >= int64(limit) {
+			break
+		}
+		result, err := w.db.Exec(fmt.Sprintf(w.dialect.purge, table), cutoff, limit-int(purged))
+		if err != nil {
+			return purged, fmt.Errorf("failed to delete expired rows of wide table %s: %v", table, err)
+		}
+		n, err := result.RowsAffected()
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,94 @@
+package transformer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// celTransformer 使用CEL表达式将解析后的数据映射为DeviceData字段
+// CEL程序无副作用且可并发执行，适合不需要循环和辅助函数的简单映射
+type celTransformer struct {
+	program cel.Program
+	timeout time.Duration
+	// codec 不为空时用于解码 payload，否则按JSON解析
+	codec codec
+}
+
+// newCELTransformer 编译CEL表达式，表达式可以使用以下变量：
+// data（原始数据字符串）、payload（解码结果，未配置编码且不是JSON时为null）、topic 和 context
+func newCELTransformer(expression string, timeout time.Duration, payloadCodec codec) (*celTransformer, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	env, err := cel.NewEnv(
+		cel.Variable("data", cel.StringType),
+		cel.Variable("payload", cel.DynType),
+		cel.Variable("topic", cel.StringType),
+		cel.Variable("context", cel.MapType(cel.StringType, cel.DynType)),
+		// 字符串扩展函数，如 split、lowerAscii、replace
+		ext.Strings(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("创建CEL环境失败: %v", err)
+	}
+
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("编译CEL表达式失败: %v", issues.Err())
+	}
+
+	program, err := env.Program(ast, cel.InterruptCheckFrequency(100))
+	if err != nil {
+		return nil, fmt.Errorf("创建CEL程序失败: %v", err)
+	}
+
+	return &celTransformer{program: program, timeout: timeout, codec: payloadCodec}, nil
+}
+
+// run 在超时限制内计算表达式并导出为JSON兼容的Go值
+func (t *celTransformer) run(deviceType string, data []byte, msgCtx MessageContext) (interface{}, error) {
+	// 未配置编码时按JSON解析，非JSON数据时 payload 为 null，表达式可以继续使用 data
+	var payload interface{}
+	if t.codec != nil {
+		decoded, err := t.codec.decode(data)
+		if err != nil {
+			return nil, err
+		}
+		payload = decoded
+	} else if err := json.Unmarshal(data, &payload); err != nil {
+		payload = nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	result, _, err := t.program.ContextEval(ctx, map[string]interface{}{
+		"data":    string(data),
+		"payload": payload,
+		"topic":   msgCtx.Topic,
+		"context": map[string]interface{}{
+			"topic":           msgCtx.Topic,
+			"device_type":     deviceType,
+			"received_at":     msgCtx.ReceivedAt.UnixMilli(),
+			"user_properties": userPropertiesValue(msgCtx.UserProperties),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("执行转换失败: %v", err)
+	}
+
+	// 通过protobuf Value转换，得到与JSON一致的map、数组和基础类型
+	native, err := result.ConvertToNative(reflect.TypeOf(&structpb.Value{}))
+	if err != nil {
+		return nil, fmt.Errorf("转换CEL结果失败: %v", err)
+	}
+	return native.(*structpb.Value).AsInterface(), nil
+}
@@ -0,0 +1,123 @@
+package transformer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// 支持的数据编码
+const (
+	CodecJSON     = "json"
+	CodecMsgPack  = "msgpack"
+	CodecProtobuf = "protobuf"
+)
+
+// codec 将原始数据解码为通用的Go值（map、数组和基础类型）
+type codec interface {
+	decode(data []byte) (interface{}, error)
+}
+
+// newCodec 根据配置创建解码器，未配置编码时返回nil，脚本收到原始字符串
+func newCodec(cfg config.Transformer) (codec, error) {
+	switch cfg.Codec {
+	case "":
+		return nil, nil
+	case CodecJSON:
+		return jsonCodec{}, nil
+	case CodecMsgPack:
+		return msgpackCodec{}, nil
+	case CodecProtobuf:
+		return newProtobufCodec(cfg.ProtoDescriptor, cfg.ProtoMessage)
+	default:
+		return nil, fmt.Errorf("不支持的数据编码: %s", cfg.Codec)
+	}
+}
+
+// jsonCodec 解码JSON数据
+type jsonCodec struct{}
+
+func (jsonCodec) decode(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("解码JSON数据失败: %v", err)
+	}
+	return value, nil
+}
+
+// msgpackCodec 解码MessagePack数据
+type msgpackCodec struct{}
+
+func (msgpackCodec) decode(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := msgpack.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("解码MessagePack数据失败: %v", err)
+	}
+	return value, nil
+}
+
+// protobufCodec 根据描述符集合中的消息类型解码Protobuf数据
+type protobufCodec struct {
+	message protoreflect.MessageDescriptor
+}
+
+// newProtobufCodec 加载描述符集合文件（protoc --include_imports --descriptor_set_out 生成）并查找消息类型
+func newProtobufCodec(descriptorPath string, messageName string) (*protobufCodec, error) {
+	if descriptorPath == "" || messageName == "" {
+		return nil, fmt.Errorf("protobuf 编码需要配置 proto_descriptor 和 proto_message")
+	}
+
+	content, err := os.ReadFile(descriptorPath)
+	if err != nil {
+		return nil, fmt.Errorf("无法加载描述符文件 %s: %v", descriptorPath, err)
+	}
+
+	var descriptorSet descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(content, &descriptorSet); err != nil {
+		return nil, fmt.Errorf("解析描述符文件 %s 失败: %v", descriptorPath, err)
+	}
+
+	files, err := protodesc.NewFiles(&descriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("加载描述符文件 %s 失败: %v", descriptorPath, err)
+	}
+
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil, fmt.Errorf("描述符文件中没有消息类型 %s: %v", messageName, err)
+	}
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s 不是消息类型", messageName)
+	}
+
+	return &protobufCodec{message: message}, nil
+}
+
+// decode 解码后按protobuf的JSON映射转换，字段名使用 .proto 中的名称
+func (c *protobufCodec) decode(data []byte) (interface{}, error) {
+	message := dynamicpb.NewMessage(c.message)
+	if err := proto.Unmarshal(data, message); err != nil {
+		return nil, fmt.Errorf("解码Protobuf数据失败: %v", err)
+	}
+
+	jsonData, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("转换Protobuf数据失败: %v", err)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(jsonData, &value); err != nil {
+		return nil, fmt.Errorf("转换Protobuf数据失败: %v", err)
+	}
+	return value, nil
+}
@@ -1,5 +1,7 @@
 package transformer
 
+import "fmt"
+
 // DeviceData 表示统一的设备数据结构
 type DeviceData struct {
 	DeviceName string                 `json:"device_name"` // 设备名字
@@ -9,6 +11,11 @@ type DeviceData struct {
 	Metadata   map[string]interface{} `json:"metadata"`    // 额外元数据
 }
 
+// String 返回设备数据的简要描述，只包含属性数量，适合INFO日志；完整内容用 %+v 打印 Attributes
+func (d DeviceData) String() string {
+	return fmt.Sprintf("device=%s type=%s attributes=%d timestamp=%d", d.DeviceName, d.DeviceType, len(d.Attributes), d.Timestamp)
+}
+
 // DeviceAttribute 表示设备属性
 type DeviceAttribute struct {
 	Name     string      `json:"name"`     // 属性名称
@@ -0,0 +1,88 @@
+package transformer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/logger"
+)
+
+// DiscoverScripts 扫描目录中的 *.js 文件，文件名（不含扩展名）作为设备类型
+func DiscoverScripts(dir string) (map[string]config.Transformer, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取脚本目录 %s: %v", dir, err)
+	}
+
+	scripts := make(map[string]config.Transformer)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".js" {
+			continue
+		}
+		deviceType := strings.TrimSuffix(entry.Name(), ".js")
+		scripts[deviceType] = config.Transformer{ScriptPath: filepath.Join(dir, entry.Name())}
+	}
+	return scripts, nil
+}
+
+// Rescan 重新扫描脚本目录：加载新增和修改的脚本，移除已删除脚本对应的转换器
+// 单个脚本加载失败时保留原有转换器，继续处理其他脚本
+func (m *Manager) Rescan() error {
+	if m.dir == "" {
+		return nil
+	}
+
+	scripts, err := DiscoverScripts(m.dir)
+	if err != nil {
+		return err
+	}
+
+	// 加载新增和修改的脚本
+	for deviceType, cfg := range scripts {
+		m.mutex.RLock()
+		configured := m.configured[deviceType]
+		m.mutex.RUnlock()
+		if configured {
+			continue
+		}
+
+		transformer, err := m.newDeviceTransformer(cfg)
+		if err != nil {
+			logger.Warn("加载脚本 %s 失败: %v", cfg.ScriptPath, err)
+			m.mutex.Lock()
+			if _, exists := m.transformers[deviceType]; !exists {
+				m.failed[deviceType] = err
+			}
+			m.mutex.Unlock()
+			continue
+		}
+
+		m.mutex.Lock()
+		m.transformers[deviceType] = transformer
+		m.discovered[deviceType] = true
+		delete(m.failed, deviceType)
+		m.mutex.Unlock()
+	}
+
+	// 移除已删除脚本对应的转换器
+	m.mutex.Lock()
+	for deviceType := range m.discovered {
+		if _, ok := scripts[deviceType]; !ok {
+			delete(m.transformers, deviceType)
+			delete(m.discovered, deviceType)
+			logger.Info("脚本已删除，已移除设备类型 %s 的转换器", deviceType)
+		}
+	}
+	for deviceType := range m.failed {
+		if _, ok := scripts[deviceType]; !ok && !m.configured[deviceType] {
+			delete(m.failed, deviceType)
+		}
+	}
+	m.mutex.Unlock()
+
+	logger.Info("已重新扫描脚本目录 %s", m.dir)
+	return nil
+}
@@ -0,0 +1,66 @@
+package transformer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// 支持的原始数据传输编码，在解码器和转换引擎之前解开
+const (
+	// PayloadEncodingUTF8 要求原始数据是有效的UTF-8文本
+	PayloadEncodingUTF8 = "utf8"
+	// PayloadEncodingHex 把十六进制文本解码为字节，允许 0x 前缀和首尾空白
+	PayloadEncodingHex = "hex"
+	// PayloadEncodingBase64 把Base64文本解码为字节，允许省略填充和首尾空白
+	PayloadEncodingBase64 = "base64"
+)
+
+// ErrPayloadEncoding 表示原始数据不符合设备类型配置的 payload_encoding
+var ErrPayloadEncoding = errors.New("原始数据编码无效")
+
+// decodePayload 按传输编码解开原始数据，未配置编码时原样返回
+func decodePayload(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case PayloadEncodingUTF8:
+		if !utf8.Valid(data) {
+			return nil, fmt.Errorf("%w: 不是有效的UTF-8文本", ErrPayloadEncoding)
+		}
+		return data, nil
+	case PayloadEncodingHex:
+		text := bytes.TrimSpace(data)
+		if len(text) >= 2 && text[0] == '0' && (text[1] == 'x' || text[1] == 'X') {
+			text = text[2:]
+		}
+		decoded := make([]byte, hex.DecodedLen(len(text)))
+		if _, err := hex.Decode(decoded, text); err != nil {
+			return nil, fmt.Errorf("%w: 十六进制解码失败: %v", ErrPayloadEncoding, err)
+		}
+		return decoded, nil
+	case PayloadEncodingBase64:
+		text := bytes.TrimRight(bytes.TrimSpace(data), "=")
+		decoded := make([]byte, base64.RawStdEncoding.DecodedLen(len(text)))
+		n, err := base64.RawStdEncoding.Decode(decoded, text)
+		if err != nil {
+			return nil, fmt.Errorf("%w: Base64解码失败: %v", ErrPayloadEncoding, err)
+		}
+		return decoded[:n], nil
+	default:
+		return nil, fmt.Errorf("不支持的原始数据编码: %s", encoding)
+	}
+}
+
+// DecodePayload 按设备类型配置的 payload_encoding 解开原始数据，没有专用转换器时使用默认转换器的配置
+// Transform 会自行解码，该方法供转换前需要检查原始数据内容的调用方使用，例如JSON校验和输入模式校验
+func (m *Manager) DecodePayload(deviceType string, data []byte) ([]byte, error) {
+	state, exists := m.state(deviceType)
+	if !exists {
+		return data, nil
+	}
+	return decodePayload(state.transformer.cfg.PayloadEncoding, data)
+}
@@ -0,0 +1,41 @@
+package transformer
+
+import "errors"
+
+// ErrNoTransformer 表示设备类型没有转换器，也没有配置默认转换器
+var ErrNoTransformer = errors.New("没有找到转换器")
+
+// ErrBelowMinQuality 表示转换结果中每条记录的所有属性都因质量低于最低质量被丢弃，没有记录需要存储
+var ErrBelowMinQuality = errors.New("所有属性的质量都低于最低质量")
+
+// ErrAttributeType 表示属性的值无法转换为 attributes 中声明的类型
+var ErrAttributeType = errors.New("属性值无法转换为声明的类型")
+
+// TransformRuntimeError 表示转换引擎执行失败，例如脚本抛出异常、超时、Promise被拒绝或原始数据无法解码
+type TransformRuntimeError struct {
+	DeviceType string
+	Err        error
+}
+
+func (e *TransformRuntimeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransformRuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// OutputDecodeError 表示转换结果无法解析为DeviceData结构，例如字段类型不匹配，
+// 或属性值无法转换为声明的类型，此时错误链中包含 ErrAttributeType
+type OutputDecodeError struct {
+	DeviceType string
+	Err        error
+}
+
+func (e *OutputDecodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *OutputDecodeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,201 @@
+package transformer
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/eddielth/data-trans/logger"
+)
+
+// HelperContext 是创建辅助函数时可用的脚本运行时信息
+type HelperContext struct {
+	// VM 是辅助函数所属的脚本运行时
+	VM *goja.Runtime
+	// Payload 返回当前正在转换的原始数据，只在转换过程中有效
+	Payload func() []byte
+	// Lookup 查询配置的查找表，表名和键不区分大小写，键 "*" 返回表的默认值
+	Lookup func(table string, key string) (string, bool)
+}
+
+// HelperFactory 为一个脚本运行时创建辅助函数，返回值通过 VM.Set 注入脚本
+type HelperFactory func(ctx HelperContext) interface{}
+
+// HelperRegistry 按名称登记注入脚本的辅助函数
+type HelperRegistry struct {
+	mutex     sync.RWMutex
+	factories map[string]HelperFactory
+}
+
+// NewHelperRegistry 创建一个空的辅助函数注册表
+func NewHelperRegistry() *HelperRegistry {
+	return &HelperRegistry{factories: make(map[string]HelperFactory)}
+}
+
+// DefaultHelpers 是所有JavaScript转换器使用的注册表，包含内置辅助函数
+var DefaultHelpers = NewHelperRegistry()
+
+// Register 登记辅助函数，同名的辅助函数被替换，只对之后创建的转换器生效
+func (r *HelperRegistry) Register(name string, factory HelperFactory) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.factories[name] = factory
+}
+
+// Names 返回已登记的辅助函数名称，按名称排序
+func (r *HelperRegistry) Names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// inject 将辅助函数注入脚本运行时，names 为空时注入全部辅助函数
+func (r *HelperRegistry) inject(ctx HelperContext, names []string) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(names) == 0 {
+		for name, factory := range r.factories {
+			if err := ctx.VM.Set(name, factory(ctx)); err != nil {
+				return fmt.Errorf("注入辅助函数 %s 失败: %v", name, err)
+			}
+		}
+		return nil
+	}
+
+	for _, name := range names {
+		factory, ok := r.factories[name]
+		if !ok {
+			return fmt.Errorf("未知的辅助函数: %s", name)
+		}
+		if err := ctx.VM.Set(name, factory(ctx)); err != nil {
+			return fmt.Errorf("注入辅助函数 %s 失败: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// 内置辅助函数
+func init() {
+	// 以Uint8Array形式返回当前原始数据，用于解析二进制协议
+	DefaultHelpers.Register("payloadBytes", func(ctx HelperContext) interface{} {
+		return func() goja.Value {
+			return newUint8Array(ctx.VM, append([]byte(nil), ctx.Payload()...))
+		}
+	})
+
+	DefaultHelpers.Register("log", func(ctx HelperContext) interface{} {
+		return func(msg string) {
+			logger.Info("[JS] %s", msg)
+		}
+	})
+
+	DefaultHelpers.Register("parseJSON", func(ctx HelperContext) interface{} {
+		return func(jsonStr string) interface{} {
+			var data interface{}
+			err := json.Unmarshal([]byte(jsonStr), &data)
+			if err != nil {
+				logger.Warn("解析JSON失败: %v", err)
+				return nil
+			}
+			return data
+		}
+	})
+
+	// 格式化日期时间
+	DefaultHelpers.Register("formatDate", func(ctx HelperContext) interface{} {
+		return func(timestamp int64, format string) string {
+			if format == "" {
+				format = "2006-01-02 15:04:05"
+			}
+			return time.Unix(timestamp, 0).Format(format)
+		}
+	})
+
+	// 单位转换
+	DefaultHelpers.Register("convertTemperature", func(ctx HelperContext) interface{} {
+		return convertTemperature
+	})
+	DefaultHelpers.Register("convertPressure", func(ctx HelperContext) interface{} {
+		return convertPressure
+	})
+	DefaultHelpers.Register("convertLength", func(ctx HelperContext) interface{} {
+		return convertLength
+	})
+
+	// 数据验证
+	DefaultHelpers.Register("validateRange", func(ctx HelperContext) interface{} {
+		return func(value float64, min float64, max float64) bool {
+			return value >= min && value <= max
+		}
+	})
+
+	// 查找表，lookup(table, key[, default])，键不存在时依次返回 default、表中 "*" 的值或 null
+	DefaultHelpers.Register("lookup", func(ctx HelperContext) interface{} {
+		vm := ctx.VM
+		return func(call goja.FunctionCall) goja.Value {
+			table := call.Argument(0).String()
+			if value, ok := ctx.Lookup(table, call.Argument(1).String()); ok {
+				return vm.ToValue(value)
+			}
+			if len(call.Arguments) > 2 {
+				return call.Argument(2)
+			}
+			if value, ok := ctx.Lookup(table, lookupDefaultKey); ok {
+				return vm.ToValue(value)
+			}
+			return goja.Null()
+		}
+	})
+
+	// 校验与编码
+	DefaultHelpers.Register("crc16", func(ctx HelperContext) interface{} {
+		return func(call goja.FunctionCall) goja.Value {
+			return ctx.VM.ToValue(crc16Modbus(exportBytes(ctx.VM, call.Argument(0))))
+		}
+	})
+
+	DefaultHelpers.Register("md5hex", func(ctx HelperContext) interface{} {
+		return func(call goja.FunctionCall) goja.Value {
+			sum := md5.Sum(exportBytes(ctx.VM, call.Argument(0)))
+			return ctx.VM.ToValue(hex.EncodeToString(sum[:]))
+		}
+	})
+
+	DefaultHelpers.Register("sha256hex", func(ctx HelperContext) interface{} {
+		return func(call goja.FunctionCall) goja.Value {
+			sum := sha256.Sum256(exportBytes(ctx.VM, call.Argument(0)))
+			return ctx.VM.ToValue(hex.EncodeToString(sum[:]))
+		}
+	})
+
+	DefaultHelpers.Register("base64encode", func(ctx HelperContext) interface{} {
+		return func(call goja.FunctionCall) goja.Value {
+			return ctx.VM.ToValue(base64.StdEncoding.EncodeToString(exportBytes(ctx.VM, call.Argument(0))))
+		}
+	})
+
+	DefaultHelpers.Register("base64decode", func(ctx HelperContext) interface{} {
+		return func(encoded string) goja.Value {
+			data, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				panic(ctx.VM.NewTypeError("base64解码失败: %v", err))
+			}
+			return newUint8Array(ctx.VM, data)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package transformer
+
+import (
+	"strings"
+	"sync"
+)
+
+// lookupDefaultKey 是查找表中表示默认值的键
+const lookupDefaultKey = "*"
+
+// lookupTables 保存脚本通过 lookup() 查询的命名查找表，所有转换器共享
+// 配置经viper加载后键名均为小写，因此表名和键都不区分大小写
+type lookupTables struct {
+	tables map[string]map[string]string
+	mutex  sync.RWMutex
+}
+
+// newLookupTables 创建查找表
+func newLookupTables(tables map[string]map[string]string) *lookupTables {
+	l := &lookupTables{}
+	l.set(tables)
+	return l
+}
+
+// set 替换全部查找表
+func (l *lookupTables) set(tables map[string]map[string]string) {
+	normalized := make(map[string]map[string]string, len(tables))
+	for name, table := range tables {
+		entries := make(map[string]string, len(table))
+		for key, value := range table {
+			entries[strings.ToLower(key)] = value
+		}
+		normalized[strings.ToLower(name)] = entries
+	}
+
+	l.mutex.Lock()
+	l.tables = normalized
+	l.mutex.Unlock()
+}
+
+// lookup 查询表中键对应的值
+func (l *lookupTables) lookup(name string, key string) (string, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	table, ok := l.tables[strings.ToLower(name)]
+	if !ok {
+		return "", false
+	}
+	value, ok := table[strings.ToLower(key)]
+	return value, ok
+}
@@ -1,9 +1,12 @@
 package transformer
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -11,218 +14,768 @@ import (
 	"github.com/dop251/goja"
 	"github.com/eddielth/data-trans/config"
 	"github.com/eddielth/data-trans/logger"
+	"github.com/eddielth/data-trans/metrics"
 )
 
 // Manager 管理多个数据转换器
 type Manager struct {
-	transformers map[string]*Transformer
+	transformers map[string]*deviceTransformer
 	mutex        sync.RWMutex
+	// dir 是自动发现脚本的目录，为空时不扫描
+	dir string
+	// configured 记录配置文件中显式配置的设备类型，优先于目录中的同名脚本
+	configured map[string]bool
+	// discovered 记录从目录中加载的设备类型
+	discovered map[string]bool
+	// failed 记录转换器加载失败且没有可用转换器的设备类型及失败原因
+	failed map[string]error
+	// lookups 是脚本共享的查找表
+	lookups *lookupTables
+	// minQuality 是属性的最低质量，设备类型的 min_quality 优先
+	minQuality int
+	// units 把属性统一换算为配置的目标单位，为nil时不换算
+	units *unitNormalizer
+	// registry 是设备名称到静态元数据的映射，转换后合并到记录的元数据中
+	registry map[string]map[string]interface{}
 }
 
+// deviceTransformer 是一个设备类型的转换引擎及其配置
+type deviceTransformer struct {
+	engine
+	cfg config.Transformer
+	// schema 是属性的声明类型，为nil时不转换属性值
+	schema attributeSchema
+}
+
+// engine 表示一种转换引擎，run 返回可序列化为DeviceData的Go值
+type engine interface {
+	run(deviceType string, data []byte, msgCtx MessageContext) (interface{}, error)
+}
+
+// 支持的转换引擎
+const (
+	EngineJavaScript  = "js"
+	EngineCEL         = "cel"
+	EngineTemplate    = "template"
+	EnginePassthrough = "passthrough"
+)
+
+// DefaultTransformer 是处理没有专用转换器的设备类型的转换器名称，未配置时这些消息转换失败
+const DefaultTransformer = "default"
+
 // Transformer 表示一个数据转换器
 type Transformer struct {
 	vm         *goja.Runtime
 	transform  goja.Callable
 	scriptPath string
+	// payload 是当前正在转换的原始数据，供 payloadBytes() 读取
+	payload []byte
+	// timeout 是单次转换（包括等待Promise）的最长执行时间
+	timeout time.Duration
+	// codec 不为空时，原始数据解码后以对象形式传给脚本
+	codec codec
+	// mutex 保证同一时间只有一个调用使用JavaScript运行时
+	mutex sync.Mutex
 }
 
+// DefaultTimeout 是未配置超时时单次转换的最长执行时间
+const DefaultTimeout = 5 * time.Second
+
 // NewManager 创建一个新的转换器管理器
-func NewManager(configs map[string]config.Transformer) (*Manager, error) {
+// dir 不为空时，目录中的每个 *.js 文件也作为一个转换器加载，配置中显式配置的设备类型优先
+// lookups 是脚本通过 lookup(table, key) 查询的查找表
+// 各设备类型的转换器独立加载，加载失败的设备类型记录在 FailedDeviceTypes 中，其消息按未知设备类型处理
+func NewManager(configs map[string]config.Transformer, dir string, lookups map[string]map[string]string) (*Manager, error) {
 	manager := &Manager{
-		transformers: make(map[string]*Transformer),
+		transformers: make(map[string]*deviceTransformer),
+		dir:          dir,
+		configured:   make(map[string]bool),
+		discovered:   make(map[string]bool),
+		failed:       make(map[string]error),
+		lookups:      newLookupTables(lookups),
 	}
 
-	// 为每种设备类型创建转换器
+	all := make(map[string]config.Transformer)
+	if dir != "" {
+		scripts, err := DiscoverScripts(dir)
+		if err != nil {
+			return nil, err
+		}
+		for deviceType, cfg := range scripts {
+			if _, ok := configs[deviceType]; !ok {
+				all[deviceType] = cfg
+				manager.discovered[deviceType] = true
+			}
+		}
+	}
 	for deviceType, cfg := range configs {
-		var scriptCode string
-		var err error
+		all[deviceType] = cfg
+		manager.configured[deviceType] = true
+	}
+
+	// 为每种设备类型创建转换器，一个脚本出错不影响其他设备类型
+	for deviceType, cfg := range all {
+		transformer, err := manager.newDeviceTransformer(cfg)
+		if err != nil {
+			manager.failed[deviceType] = err
+			delete(manager.discovered, deviceType)
+			logger.Error("为设备类型 %s 创建转换器失败，该设备类型的消息按未知设备类型处理: %v", deviceType, err)
+			continue
+		}
+
+		manager.transformers[deviceType] = transformer
+		logger.Info("已为设备类型 %s 加载转换器", deviceType)
+	}
+
+	return manager, nil
+}
+
+// newDeviceTransformer 根据配置创建设备类型的转换器
+func (m *Manager) newDeviceTransformer(cfg config.Transformer) (*deviceTransformer, error) {
+	switch cfg.PayloadEncoding {
+	case "", PayloadEncodingUTF8, PayloadEncodingHex, PayloadEncodingBase64:
+	default:
+		return nil, fmt.Errorf("不支持的原始数据编码: %s", cfg.PayloadEncoding)
+	}
+	e, err := m.newEngine(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &deviceTransformer{engine: e, cfg: cfg, schema: newAttributeSchema(cfg.Attributes)}, nil
+}
+
+// newEngine 根据配置中的引擎类型创建转换器，默认使用JavaScript
+func (m *Manager) newEngine(cfg config.Transformer) (engine, error) {
+	payloadCodec, err := newCodec(cfg)
+	if err != nil {
+		return nil, err
+	}
 
+	switch cfg.Engine {
+	case "", EngineJavaScript:
+		var scriptCode string
 		// 优先使用配置中的脚本代码
 		if cfg.ScriptCode != "" {
 			scriptCode = cfg.ScriptCode
 		} else if cfg.ScriptPath != "" {
-			var scriptBytes []byte
 			// 从文件加载脚本
-			scriptBytes, err = os.ReadFile(cfg.ScriptPath)
+			scriptBytes, err := os.ReadFile(cfg.ScriptPath)
 			if err != nil {
 				return nil, fmt.Errorf("无法加载脚本文件 %s: %v", cfg.ScriptPath, err)
 			}
 			scriptCode = string(scriptBytes)
 		} else {
-			return nil, fmt.Errorf("设备类型 %s 没有提供脚本代码或脚本路径", deviceType)
+			return nil, fmt.Errorf("没有提供脚本代码或脚本路径")
 		}
-
-		// 创建转换器
-		transformer, err := newTransformer(scriptCode, cfg.ScriptPath)
-		if err != nil {
-			return nil, fmt.Errorf("为设备类型 %s 创建转换器失败: %v", deviceType, err)
+		return newTransformer(scriptCode, cfg.ScriptPath, cfg.Timeout, m.lookups, cfg.Helpers, payloadCodec)
+	case EngineCEL:
+		if cfg.Expression == "" {
+			return nil, fmt.Errorf("没有提供CEL表达式")
 		}
-
-		manager.transformers[deviceType] = transformer
-		logger.Info("已为设备类型 %s 加载转换器", deviceType)
+		return newCELTransformer(cfg.Expression, cfg.Timeout, payloadCodec)
+	case EngineTemplate:
+		if cfg.Template == "" {
+			return nil, fmt.Errorf("没有提供模板")
+		}
+		return newTemplateTransformer(cfg.Template, payloadCodec)
+	case EnginePassthrough:
+		return passthroughTransformer{}, nil
+	default:
+		return nil, fmt.Errorf("不支持的转换引擎: %s", cfg.Engine)
 	}
-
-	return manager, nil
 }
 
 // newTransformer 创建一个新的转换器
-func newTransformer(scriptCode, scriptPath string) (*Transformer, error) {
+func newTransformer(scriptCode, scriptPath string, timeout time.Duration, lookups *lookupTables, helpers []string, payloadCodec codec) (*Transformer, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
 	// 创建JavaScript运行时
 	vm := goja.New()
+	t := &Transformer{
+		vm:         vm,
+		scriptPath: scriptPath,
+		timeout:    timeout,
+		codec:      payloadCodec,
+	}
 
-	// 注入辅助函数
-	_ = vm.Set("log", func(msg string) {
-		logger.Info("[JS] %s", msg)
-	})
+	// 注入辅助函数，helpers 为空时注入全部已登记的辅助函数
+	err := DefaultHelpers.inject(HelperContext{
+		VM:      vm,
+		Payload: func() []byte { return t.payload },
+		Lookup:  lookups.lookup,
+	}, helpers)
+	if err != nil {
+		return nil, err
+	}
 
-	_ = vm.Set("parseJSON", func(jsonStr string) interface{} {
-		var data interface{}
-		err := json.Unmarshal([]byte(jsonStr), &data)
-		if err != nil {
-			logger.Warn("解析JSON失败: %v", err)
-			return nil
+	// 执行脚本
+	_, err = vm.RunString(scriptCode)
+	if err != nil {
+		return nil, fmt.Errorf("执行脚本失败: %v", err)
+	}
+
+	// 获取转换函数
+	transformValue := vm.Get("transform")
+	if transformValue == nil {
+		return nil, fmt.Errorf("脚本中没有定义 'transform' 函数")
+	}
+
+	transform, ok := goja.AssertFunction(transformValue)
+	if !ok {
+		return nil, fmt.Errorf("'transform' 不是一个函数")
+	}
+
+	t.transform = transform
+	return t, nil
+}
+
+// convertTemperature 在摄氏度（C）、华氏度（F）和开尔文（K）之间转换温度
+func convertTemperature(value float64, fromUnit string, toUnit string) float64 {
+	// 标准化单位
+	fromUnit = strings.ToUpper(fromUnit)
+	toUnit = strings.ToUpper(toUnit)
+
+	// 转换为摄氏度
+	var celsius float64
+	switch fromUnit {
+	case "C":
+		celsius = value
+	case "F":
+		celsius = (value - 32) * 5 / 9
+	case "K":
+		celsius = value - 273.15
+	default:
+		return value // 未知单位，返回原值
+	}
+
+	// 从摄氏度转换为目标单位
+	switch toUnit {
+	case "C":
+		return celsius
+	case "F":
+		return celsius*9/5 + 32
+	case "K":
+		return celsius + 273.15
+	default:
+		return celsius // 未知单位，返回摄氏度
+	}
+}
+
+// pressureUnits 是各压力单位换算为帕斯卡的系数，单位名不区分大小写
+var pressureUnits = map[string]float64{
+	"pa":   1,
+	"hpa":  100,
+	"kpa":  1000,
+	"mpa":  1000000,
+	"mbar": 100,
+	"bar":  100000,
+	"psi":  6894.757293168,
+	"atm":  101325,
+}
+
+// lengthUnits 是各长度单位换算为米的系数，单位名不区分大小写
+var lengthUnits = map[string]float64{
+	"mm": 0.001,
+	"cm": 0.01,
+	"m":  1,
+	"km": 1000,
+	"in": 0.0254,
+	"ft": 0.3048,
+}
+
+// convertPressure 在压力单位之间转换，单位未知时返回原值
+func convertPressure(value float64, fromUnit string, toUnit string) float64 {
+	return convertByFactor(pressureUnits, value, fromUnit, toUnit)
+}
+
+// convertLength 在长度单位之间转换，单位未知时返回原值
+func convertLength(value float64, fromUnit string, toUnit string) float64 {
+	return convertByFactor(lengthUnits, value, fromUnit, toUnit)
+}
+
+// convertByFactor 通过基准单位换算线性单位
+func convertByFactor(units map[string]float64, value float64, fromUnit string, toUnit string) float64 {
+	fromFactor, ok := units[strings.ToLower(fromUnit)]
+	if !ok {
+		return value // 未知单位，返回原值
+	}
+	toFactor, ok := units[strings.ToLower(toUnit)]
+	if !ok {
+		return value // 未知单位，返回原值
+	}
+	return value * fromFactor / toFactor
+}
+
+// exportBytes 将脚本传入的字符串、Uint8Array、ArrayBuffer或数字数组转换为字节切片
+func exportBytes(vm *goja.Runtime, value goja.Value) []byte {
+	switch v := value.Export().(type) {
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	case goja.ArrayBuffer:
+		return v.Bytes()
+	case []interface{}:
+		data := make([]byte, len(v))
+		for i, item := range v {
+			switch n := item.(type) {
+			case int64:
+				data[i] = byte(n)
+			case float64:
+				data[i] = byte(n)
+			default:
+				panic(vm.NewTypeError("数组第%d个元素不是数字", i))
+			}
 		}
 		return data
-	})
+	default:
+		panic(vm.NewTypeError("参数必须是字符串、Uint8Array、ArrayBuffer或数字数组"))
+	}
+}
 
-	// 格式化日期时间
-	_ = vm.Set("formatDate", func(timestamp int64, format string) string {
-		if format == "" {
-			format = "2006-01-02 15:04:05"
+// newUint8Array 使用字节切片创建一个脚本中的Uint8Array
+func newUint8Array(vm *goja.Runtime, data []byte) goja.Value {
+	array, err := vm.New(vm.Get("Uint8Array"), vm.ToValue(vm.NewArrayBuffer(data)))
+	if err != nil {
+		panic(err)
+	}
+	return array
+}
+
+// crc16Modbus 计算CRC-16/MODBUS校验值（多项式0xA001，初始值0xFFFF）
+func crc16Modbus(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
 		}
-		return time.Unix(timestamp, 0).Format(format)
+	}
+	return crc
+}
+
+// run 在超时限制内调用脚本的 transform 函数并导出结果，返回Promise时等待其完成
+func (t *Transformer) run(deviceType string, data []byte, msgCtx MessageContext) (interface{}, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.runLocked(deviceType, data, msgCtx)
+}
+
+// runLocked 与 run 相同，调用方需持有 t.mutex，批量转换时整批只加锁一次
+func (t *Transformer) runLocked(deviceType string, data []byte, msgCtx MessageContext) (interface{}, error) {
+	vm := t.vm
+	t.payload = data
+	defer func() { t.payload = nil }()
+
+	// 配置了编码时传入解码后的对象，否则传入原始字符串
+	input := vm.ToValue(string(data))
+	if t.codec != nil {
+		decoded, err := t.codec.decode(data)
+		if err != nil {
+			return nil, err
+		}
+		input = vm.ToValue(decoded)
+	}
+
+	// 超时后中断脚本执行
+	timer := time.AfterFunc(t.timeout, func() {
+		vm.Interrupt(fmt.Sprintf("转换超时（%v）", t.timeout))
 	})
+	result, err := t.transform(goja.Undefined(), input, vm.ToValue(msgCtx.Topic), newContextObject(vm, deviceType, msgCtx))
+	if !timer.Stop() {
+		// 定时器已触发：无论调用是否出错都清除残留的中断标记，避免下一条消息被立即中断
+		vm.ClearInterrupt()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("执行转换失败: %s", scriptError(err))
+	}
 
-	// 单位转换
-	_ = vm.Set("convertTemperature", func(value float64, fromUnit string, toUnit string) float64 {
-		// 标准化单位
-		fromUnit = strings.ToUpper(fromUnit)
-		toUnit = strings.ToUpper(toUnit)
-
-		// 转换为摄氏度
-		var celsius float64
-		switch fromUnit {
-		case "C":
-			celsius = value
-		case "F":
-			celsius = (value - 32) * 5 / 9
-		case "K":
-			celsius = value - 273.15
+	// 异步函数返回Promise，调用返回时任务队列已执行完毕
+	if promise, ok := result.Export().(*goja.Promise); ok {
+		switch promise.State() {
+		case goja.PromiseStateFulfilled:
+			result = promise.Result()
+		case goja.PromiseStateRejected:
+			return nil, fmt.Errorf("执行转换失败: Promise被拒绝: %s", rejectionReason(promise.Result()))
 		default:
-			return value // 未知单位，返回原值
+			// 运行时没有定时器等事件源，此时仍未完成的Promise不会再被完成
+			return nil, fmt.Errorf("执行转换失败: Promise未完成")
 		}
+	}
 
-		// 从摄氏度转换为目标单位
-		switch toUnit {
-		case "C":
-			return celsius
-		case "F":
-			return celsius*9/5 + 32
-		case "K":
-			return celsius + 273.15
-		default:
-			return celsius // 未知单位，返回摄氏度
+	// 将JavaScript值导出为Go值
+	return result.Export(), nil
+}
+
+// scriptError 返回脚本错误的描述，脚本抛出异常时包含完整的JavaScript调用栈
+// 结果保证是有效的UTF-8，可以直接写入日志和存储
+func scriptError(err error) string {
+	message := err.Error()
+	var exception *goja.Exception
+	if errors.As(err, &exception) {
+		// String() 包含 "at ..." 形式的全部调用栈帧，Error() 只包含第一帧
+		message = exception.String()
+	}
+	return strings.ToValidUTF8(message, "\uFFFD")
+}
+
+// rejectionReason 返回Promise被拒绝的原因，原因是Error对象时包含其调用栈
+func rejectionReason(reason goja.Value) string {
+	message := reason.String()
+	if obj, ok := reason.(*goja.Object); ok {
+		if stack := obj.Get("stack"); stack != nil && !goja.IsUndefined(stack) && !goja.IsNull(stack) {
+			message = stack.String()
 		}
-	})
+	}
+	return strings.ToValidUTF8(message, "\uFFFD")
+}
 
-	// 数据验证
-	_ = vm.Set("validateRange", func(value float64, min float64, max float64) bool {
-		return value >= min && value <= max
-	})
+// MessageContext 表示随原始数据一起传给转换脚本的消息上下文
+type MessageContext struct {
+	Topic          string            // 消息的MQTT主题
+	ReceivedAt     time.Time         // 消息的接收时间
+	UserProperties map[string]string // MQTT 5消息的用户属性，MQTT 3.1.1时为空
+	DeviceName     string            // 从主题提取的设备名称，转换结果没有设备名称时使用
+}
 
-	// 执行脚本
-	_, err := vm.RunString(scriptCode)
-	if err != nil {
-		return nil, fmt.Errorf("执行脚本失败: %v", err)
+// newContextObject 创建传给脚本的上下文对象
+func newContextObject(vm *goja.Runtime, deviceType string, msgCtx MessageContext) goja.Value {
+	obj := vm.NewObject()
+	_ = obj.Set("topic", msgCtx.Topic)
+	_ = obj.Set("device_type", deviceType)
+	_ = obj.Set("received_at", msgCtx.ReceivedAt.UnixMilli())
+	_ = obj.Set("user_properties", userPropertiesValue(msgCtx.UserProperties))
+	return obj
+}
+
+// userPropertiesValue 返回上下文中的用户属性，没有用户属性时为空对象，脚本可以直接按键读取
+func userPropertiesValue(properties map[string]string) map[string]interface{} {
+	result := make(map[string]interface{}, len(properties))
+	for key, value := range properties {
+		result[key] = value
 	}
+	return result
+}
 
-	// 获取转换函数
-	transformValue := vm.Get("transform")
-	if transformValue == nil {
-		return nil, fmt.Errorf("脚本中没有定义 'transform' 函数")
+// Transform 使用指定设备类型的转换器转换数据
+// 脚本以 transform(data, topic, context) 的形式调用，只声明 data 参数的旧脚本不受影响
+// 转换结果可以是单个对象，也可以是对象数组，例如网关把多个子设备的读数打包在一条消息中，每个元素是一条记录
+func (m *Manager) Transform(deviceType string, data []byte, msgCtx MessageContext) ([]DeviceData, error) {
+	state, exists := m.state(deviceType)
+	if !exists {
+		return nil, fmt.Errorf("设备类型 %s: %w", deviceType, ErrNoTransformer)
 	}
+	return state.transform(deviceType, data, msgCtx, state.transformer.run)
+}
 
-	transform, ok := goja.AssertFunction(transformValue)
-	if !ok {
-		return nil, fmt.Errorf("'transform' 不是一个函数")
+// TransformBatch 使用同一个转换器转换一批数据，用于重放等批量处理
+// 结果和错误按 payloads 的下标一一对应，一条数据失败不影响其他数据
+// msgCtxs 为nil时使用空的消息上下文，否则长度必须与 payloads 相同
+// JavaScript转换器整批只获取一次运行时，批量期间该设备类型的实时消息等待批量完成
+func (m *Manager) TransformBatch(deviceType string, payloads [][]byte, msgCtxs []MessageContext) ([][]DeviceData, []error) {
+	results := make([][]DeviceData, len(payloads))
+	errs := make([]error, len(payloads))
+
+	fail := func(err error) ([][]DeviceData, []error) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return results, errs
+	}
+	if msgCtxs != nil && len(msgCtxs) != len(payloads) {
+		return fail(fmt.Errorf("消息上下文数量 %d 与数据数量 %d 不一致", len(msgCtxs), len(payloads)))
+	}
+	state, exists := m.state(deviceType)
+	if !exists {
+		return fail(fmt.Errorf("设备类型 %s: %w", deviceType, ErrNoTransformer))
 	}
 
-	return &Transformer{
-		vm:         vm,
-		transform:  transform,
-		scriptPath: scriptPath,
-	}, nil
+	run := state.transformer.run
+	if t, ok := state.transformer.engine.(*Transformer); ok {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		run = t.runLocked
+	}
+
+	for i, data := range payloads {
+		var msgCtx MessageContext
+		if msgCtxs != nil {
+			msgCtx = msgCtxs[i]
+		}
+		results[i], errs[i] = state.transform(deviceType, data, msgCtx, run)
+	}
+	return results, errs
 }
 
-// Transform 使用指定设备类型的转换器转换数据
-func (m *Manager) Transform(deviceType string, data []byte) (DeviceData, error) {
+// transformState 是一次转换使用的转换器和全局设置的快照
+type transformState struct {
+	transformer *deviceTransformer
+	minQuality  int
+	units       *unitNormalizer
+	registry    map[string]map[string]interface{}
+}
+
+// state 返回设备类型当前的转换器和设置，没有专用转换器时使用默认转换器
+func (m *Manager) state(deviceType string) (transformState, bool) {
 	m.mutex.RLock()
-	transformer, exists := m.transformers[deviceType]
-	m.mutex.RUnlock()
+	defer m.mutex.RUnlock()
 
+	transformer, exists := m.transformers[deviceType]
 	if !exists {
-		return DeviceData{}, fmt.Errorf("没有找到设备类型 %s 的转换器", deviceType)
+		// 使用默认转换器处理未知设备类型
+		transformer, exists = m.transformers[DefaultTransformer]
 	}
+	return transformState{
+		transformer: transformer,
+		minQuality:  m.minQuality,
+		units:       m.units,
+		registry:    m.registry,
+	}, exists
+}
 
-	// 调用JavaScript转换函数
-	result, err := transformer.transform(goja.Undefined(), transformer.vm.ToValue(string(data)))
+// transform 用 run 调用转换引擎，再把结果解析为记录并补充、过滤
+func (s transformState) transform(deviceType string, data []byte, msgCtx MessageContext, run func(string, []byte, MessageContext) (interface{}, error)) ([]DeviceData, error) {
+	transformer, minQuality, units, registry := s.transformer, s.minQuality, s.units, s.registry
+
+	// 先解开传输编码，脚本和解码器收到解码后的内容，保存的原始数据仍是收到的内容
+	input, err := decodePayload(transformer.cfg.PayloadEncoding, data)
 	if err != nil {
-		return DeviceData{}, fmt.Errorf("执行转换失败: %v", err)
+		return nil, &TransformRuntimeError{DeviceType: deviceType, Err: err}
 	}
 
-	// 将JavaScript值导出为Go值
-	jsResult := result.Export()
+	// 调用转换引擎，按设备类型记录耗时
+	start := time.Now()
+	jsResult, err := run(deviceType, input, msgCtx)
+	metrics.Observe(metrics.TransformDuration, deviceType, time.Since(start))
+	if err != nil {
+		logger.Debug("设备类型 %s 转换失败的原始数据: %q", deviceType, data)
+		return nil, &TransformRuntimeError{DeviceType: deviceType, Err: err}
+	}
 
 	// 将结果转换为JSON
 	jsonData, err := json.Marshal(jsResult)
 	if err != nil {
-		return DeviceData{}, fmt.Errorf("序列化JavaScript结果失败: %v", err)
+		return nil, &OutputDecodeError{DeviceType: deviceType, Err: fmt.Errorf("序列化转换结果失败: %w", err)}
 	}
 
 	// 解析为DeviceData结构
-	var deviceData DeviceData
-	if err := json.Unmarshal(jsonData, &deviceData); err != nil {
-		return DeviceData{}, fmt.Errorf("解析为DeviceData结构失败: %v", err)
+	records, err := decodeRecords(jsonData)
+	if err != nil {
+		return nil, &OutputDecodeError{DeviceType: deviceType, Err: fmt.Errorf("解析为DeviceData结构失败: %w", err)}
+	}
+	if len(records) == 0 {
+		logger.Debug("设备类型 %s 的转换结果是空数组，没有需要存储的记录", deviceType)
+		return nil, nil
 	}
 
-	// 确保设备类型字段正确设置
-	if deviceData.DeviceType == "" {
-		deviceData.DeviceType = deviceType
+	if transformer.cfg.MinQuality != nil {
+		minQuality = *transformer.cfg.MinQuality
+	}
+
+	// 转换结果没有时间戳时从原始数据中读取，同一消息只解析一次
+	var fromPayload func() (int64, bool)
+	if path := transformer.cfg.TimestampPath; path != "" {
+		var timestamp int64
+		var found, parsed bool
+		fromPayload = func() (int64, bool) {
+			if !parsed {
+				timestamp, found = payloadTimestamp(input, path, transformer.cfg.TimestampFormat, transformer.cfg.TimestampUnit)
+				parsed = true
+				if !found {
+					logger.Debug("设备类型 %s 的原始数据中没有可用的时间戳 %s，使用接收时间", deviceType, path)
+				}
+			}
+			return timestamp, found
+		}
 	}
 
-	return deviceData, nil
+	results := records[:0]
+	for i := range records {
+		deviceData := &records[i]
+
+		// 确保设备类型字段正确设置
+		if deviceData.DeviceType == "" {
+			deviceData.DeviceType = deviceType
+		}
+
+		// 负载中没有设备名称时使用主题中的设备名称
+		if deviceData.DeviceName == "" {
+			deviceData.DeviceName = msgCtx.DeviceName
+		}
+
+		// 补充设备注册表中的静态元数据
+		if registry != nil {
+			enrich(registry, deviceData)
+		}
+
+		// 统一为毫秒时间戳
+		applyTimestamp(deviceData, transformer.cfg.TimestampUnit, transformer.cfg.TimestampSource, msgCtx.ReceivedAt, fromPayload)
+
+		// 把属性值转换为声明的类型，单位换算需要数值
+		if transformer.schema != nil {
+			if err := transformer.schema.coerce(deviceData); err != nil {
+				return nil, &OutputDecodeError{DeviceType: deviceType, Err: fmt.Errorf("设备类型 %s 设备 %s: %w", deviceType, deviceData.DeviceName, err)}
+			}
+		}
+
+		// 统一属性单位
+		if units != nil {
+			units.normalize(deviceType, deviceData)
+		}
+
+		// 丢弃质量过低的属性，属性全部被丢弃的记录被跳过
+		if !filterQuality(deviceType, deviceData, minQuality) {
+			continue
+		}
+
+		// 保存原始数据，用于审计和重放
+		if transformer.cfg.StoreRaw {
+			if deviceData.Metadata == nil {
+				deviceData.Metadata = make(map[string]interface{})
+			}
+			setRawPayload(deviceData.Metadata, data, msgCtx.Topic)
+		}
+
+		results = append(results, *deviceData)
+	}
+
+	if len(results) == 0 {
+		return nil, ErrBelowMinQuality
+	}
+	return results, nil
 }
 
-// ReloadTransformer 重新加载指定设备类型的转换器
-func (m *Manager) ReloadTransformer(deviceType string, cfg config.Transformer) error {
-	var scriptCode string
-	var err error
-
-	// 优先使用配置中的脚本代码
-	if cfg.ScriptCode != "" {
-		scriptCode = cfg.ScriptCode
-	} else if cfg.ScriptPath != "" {
-		// 从文件加载脚本
-		scriptBytes, err := os.ReadFile(cfg.ScriptPath)
-		if err != nil {
-			return fmt.Errorf("无法加载脚本文件 %s: %v", cfg.ScriptPath, err)
+// decodeRecords 把转换结果解析为记录，结果是数组时每个元素是一条记录
+func decodeRecords(jsonData []byte) ([]DeviceData, error) {
+	if trimmed := bytes.TrimSpace(jsonData); len(trimmed) > 0 && trimmed[0] == '[' {
+		var records []DeviceData
+		if err := json.Unmarshal(trimmed, &records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+
+	var deviceData DeviceData
+	if err := json.Unmarshal(jsonData, &deviceData); err != nil {
+		return nil, err
+	}
+	return []DeviceData{deviceData}, nil
+}
+
+// filterQuality 丢弃质量低于 minQuality 的属性，属性全部被丢弃时返回false，没有属性的记录保持不变
+func filterQuality(deviceType string, deviceData *DeviceData, minQuality int) bool {
+	if minQuality <= 0 || len(deviceData.Attributes) == 0 {
+		return true
+	}
+
+	kept := deviceData.Attributes[:0]
+	for _, attr := range deviceData.Attributes {
+		if attr.Quality >= minQuality {
+			kept = append(kept, attr)
 		}
-		scriptCode = string(scriptBytes)
-	} else {
-		return fmt.Errorf("没有提供脚本代码或脚本路径")
 	}
+	if dropped := len(deviceData.Attributes) - len(kept); dropped > 0 {
+		logger.Debug("设备 %s/%s 丢弃了 %d 个质量低于 %d 的属性", deviceType, deviceData.DeviceName, dropped, minQuality)
+	}
+	if len(kept) == 0 {
+		return false
+	}
+	deviceData.Attributes = kept
+	return true
+}
 
+// SetMinQuality 设置属性的最低质量，低于该质量的属性在存储前被丢弃，0 表示不过滤
+func (m *Manager) SetMinQuality(minQuality int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.minQuality = minQuality
+}
+
+// SetLookups 替换脚本共享的查找表，对已加载的转换器立即生效
+func (m *Manager) SetLookups(lookups map[string]map[string]string) {
+	m.lookups.set(lookups)
+}
+
+// HasTransformer 判断指定设备类型是否已加载转换器，不考虑默认转换器
+func (m *Manager) HasTransformer(deviceType string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	_, exists := m.transformers[deviceType]
+	return exists
+}
+
+// ReloadTransformer 重新加载指定设备类型的转换器，失败时保留原有转换器
+func (m *Manager) ReloadTransformer(deviceType string, cfg config.Transformer) error {
 	// 创建新的转换器
-	transformer, err := newTransformer(scriptCode, cfg.ScriptPath)
+	transformer, err := m.newDeviceTransformer(cfg)
 	if err != nil {
+		m.mutex.Lock()
+		if _, exists := m.transformers[deviceType]; !exists {
+			m.configured[deviceType] = true
+			m.failed[deviceType] = err
+		}
+		m.mutex.Unlock()
 		return fmt.Errorf("创建转换器失败: %v", err)
 	}
 
-	// 更新转换器
+	// 更新转换器，配置文件中的设备类型优先于目录中的同名脚本
 	m.mutex.Lock()
 	m.transformers[deviceType] = transformer
+	m.configured[deviceType] = true
+	delete(m.discovered, deviceType)
+	delete(m.failed, deviceType)
 	m.mutex.Unlock()
 
 	logger.Info("已重新加载设备类型 %s 的转换器", deviceType)
 	return nil
 }
+
+// FailedDeviceTypes 返回转换器加载失败且没有可用转换器的设备类型及失败原因
+// 重新加载或重新扫描成功后设备类型从中移除
+func (m *Manager) FailedDeviceTypes() map[string]error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	failed := make(map[string]error, len(m.failed))
+	for deviceType, err := range m.failed {
+		failed[deviceType] = err
+	}
+	return failed
+}
+
+// ListDeviceTypes 返回已加载转换器的设备类型，按名称排序，包含默认转换器
+func (m *Manager) ListDeviceTypes() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	deviceTypes := make([]string, 0, len(m.transformers))
+	for deviceType := range m.transformers {
+		deviceTypes = append(deviceTypes, deviceType)
+	}
+	sort.Strings(deviceTypes)
+	return deviceTypes
+}
+
+// RemoveTransformer 移除指定设备类型的转换器，之后该设备类型的消息按未知设备类型处理
+// 从脚本目录加载的转换器在下次重新扫描时会重新加载
+func (m *Manager) RemoveTransformer(deviceType string) {
+	m.mutex.Lock()
+	_, exists := m.transformers[deviceType]
+	delete(m.transformers, deviceType)
+	delete(m.configured, deviceType)
+	delete(m.discovered, deviceType)
+	delete(m.failed, deviceType)
+	m.mutex.Unlock()
+
+	if exists {
+		logger.Info("已移除设备类型 %s 的转换器", deviceType)
+	}
+}
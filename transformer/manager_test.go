@@ -0,0 +1,137 @@
+package transformer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eddielth/data-trans/config"
+)
+
+// batchScript returns one record named after the payload and throws for the payload "bad"
+const batchScript = `
+function transform(data) {
+  if (data === "bad") {
+    throw new Error("bad payload");
+  }
+  return {device_name: data, attributes: [{name: "value", type: "int", value: 1, quality: 100}]};
+}
+`
+
+func newBatchTestManager(t *testing.T) *Manager {
+	t.Helper()
+
+	m, err := NewManager(map[string]config.Transformer{
+		"temperature": {ScriptCode: batchScript},
+	}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTransformBatch(t *testing.T) {
+	m := newBatchTestManager(t)
+
+	payloads := [][]byte{[]byte("sensor1"), []byte("bad"), []byte("sensor3")}
+	msgCtxs := []MessageContext{{Topic: "devices/temperature/sensor1"}, {Topic: "devices/temperature/bad"}, {Topic: "devices/temperature/sensor3"}}
+	results, errs := m.TransformBatch("temperature", payloads, msgCtxs)
+	if len(results) != len(payloads) || len(errs) != len(payloads) {
+		t.Fatalf("got %d results and %d errors for %d payloads", len(results), len(errs), len(payloads))
+	}
+
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "sensor1"},
+		{wantErr: true},
+		{name: "sensor3"},
+	}
+	for i, tt := range tests {
+		if tt.wantErr {
+			if errs[i] == nil {
+				t.Errorf("payload %d: no error for a failing payload", i)
+			}
+			if len(results[i]) != 0 {
+				t.Errorf("payload %d: %d records for a failing payload", i, len(results[i]))
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("payload %d: %v", i, errs[i])
+			continue
+		}
+		if len(results[i]) != 1 || results[i][0].DeviceName != tt.name {
+			t.Errorf("payload %d: results %+v, want one record of %s", i, results[i], tt.name)
+		}
+	}
+}
+
+func TestTransformBatchWithoutContexts(t *testing.T) {
+	m := newBatchTestManager(t)
+
+	results, errs := m.TransformBatch("temperature", [][]byte{[]byte("sensor1")}, nil)
+	if errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	if len(results[0]) != 1 || results[0][0].DeviceName != "sensor1" {
+		t.Errorf("results %+v, want one record of sensor1", results[0])
+	}
+}
+
+func TestTransformBatchFailsEveryPayload(t *testing.T) {
+	m := newBatchTestManager(t)
+	payloads := [][]byte{[]byte("sensor1"), []byte("sensor2")}
+
+	tests := []struct {
+		name       string
+		deviceType string
+		msgCtxs    []MessageContext
+		want       error
+	}{
+		{name: "mismatched contexts", deviceType: "temperature", msgCtxs: []MessageContext{{}}},
+		{name: "no transformer", deviceType: "humidity", want: ErrNoTransformer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, errs := m.TransformBatch(tt.deviceType, payloads, tt.msgCtxs)
+			if len(results) != len(payloads) || len(errs) != len(payloads) {
+				t.Fatalf("got %d results and %d errors for %d payloads", len(results), len(errs), len(payloads))
+			}
+			for i := range payloads {
+				if errs[i] == nil {
+					t.Errorf("payload %d: no error", i)
+				} else if tt.want != nil && !errors.Is(errs[i], tt.want) {
+					t.Errorf("payload %d: error %v, want %v", i, errs[i], tt.want)
+				}
+				if results[i] != nil {
+					t.Errorf("payload %d: results %+v, want none", i, results[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTransformWrapsAttributeTypeErrors(t *testing.T) {
+	m, err := NewManager(map[string]config.Transformer{
+		"temperature": {
+			ScriptCode: `function transform(data) { return {device_name: "sensor1", attributes: [{name: "value", value: "warm"}]}; }`,
+			Attributes: []config.AttributeSchema{{Name: "value", Type: AttributeTypeNumber}},
+		},
+	}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Transform("temperature", []byte("{}"), MessageContext{})
+	var decodeErr *OutputDecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("Transform() error = %v, want an *OutputDecodeError", err)
+	}
+	if decodeErr.DeviceType != "temperature" {
+		t.Errorf("DeviceType = %q, want temperature", decodeErr.DeviceType)
+	}
+	if !errors.Is(err, ErrAttributeType) {
+		t.Errorf("Transform() error = %v, want ErrAttributeType in the chain", err)
+	}
+}
@@ -0,0 +1,40 @@
+package transformer
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode/utf8"
+)
+
+// passthroughTransformer 不解析数据，生成只包含原始数据的最小DeviceData，
+// 通常作为 default 转换器处理没有专用转换器的设备类型
+type passthroughTransformer struct{}
+
+// run 以主题的最后一级为设备名，原始数据保存在元数据中
+func (passthroughTransformer) run(deviceType string, data []byte, msgCtx MessageContext) (interface{}, error) {
+	metadata := make(map[string]interface{})
+	setRawPayload(metadata, data, msgCtx.Topic)
+
+	deviceName := msgCtx.Topic
+	if i := strings.LastIndex(deviceName, "/"); i >= 0 {
+		deviceName = deviceName[i+1:]
+	}
+
+	return DeviceData{
+		DeviceName: deviceName,
+		DeviceType: deviceType,
+		Attributes: []DeviceAttribute{},
+		Metadata:   metadata,
+	}, nil
+}
+
+// setRawPayload 在元数据中保存原始数据和主题，原始数据保存在 raw_payload 中，
+// 不是有效UTF-8的数据以Base64编码保存在 raw_payload_base64 中
+func setRawPayload(metadata map[string]interface{}, data []byte, topic string) {
+	metadata["topic"] = topic
+	if utf8.Valid(data) {
+		metadata["raw_payload"] = string(data)
+	} else {
+		metadata["raw_payload_base64"] = base64.StdEncoding.EncodeToString(data)
+	}
+}
@@ -0,0 +1,110 @@
+package transformer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// registryNameColumn 是CSV注册表中保存设备名称的列
+const registryNameColumn = "device_name"
+
+// LoadRegistry 读取设备注册表，返回设备名称到静态元数据（如位置、固件版本、负责人）的映射
+// .csv 文件的表头必须包含 device_name 列，其他列是元数据字段，空单元格被忽略
+// .yaml/.yml 文件是以设备名称为键、以元数据对象为值的映射
+func LoadRegistry(path string) (map[string]map[string]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开设备注册表失败: %v", err)
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return readCSVRegistry(file)
+	case ".yaml", ".yml":
+		return readYAMLRegistry(file)
+	default:
+		return nil, fmt.Errorf("不支持的设备注册表格式: %s，应为 .csv、.yaml 或 .yml", path)
+	}
+}
+
+// readCSVRegistry 解析CSV格式的设备注册表
+func readCSVRegistry(r io.Reader) (map[string]map[string]interface{}, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("解析设备注册表失败: %v", err)
+	}
+	if len(rows) == 0 {
+		return map[string]map[string]interface{}{}, nil
+	}
+
+	header := rows[0]
+	nameIndex := -1
+	for i, column := range header {
+		header[i] = strings.TrimSpace(column)
+		if header[i] == registryNameColumn {
+			nameIndex = i
+		}
+	}
+	if nameIndex < 0 {
+		return nil, fmt.Errorf("设备注册表缺少 %s 列", registryNameColumn)
+	}
+
+	entries := make(map[string]map[string]interface{}, len(rows)-1)
+	for _, row := range rows[1:] {
+		if nameIndex >= len(row) || strings.TrimSpace(row[nameIndex]) == "" {
+			continue
+		}
+		fields := make(map[string]interface{})
+		for i, value := range row {
+			if i == nameIndex || i >= len(header) || header[i] == "" || value == "" {
+				continue
+			}
+			fields[header[i]] = value
+		}
+		entries[strings.TrimSpace(row[nameIndex])] = fields
+	}
+	return entries, nil
+}
+
+// readYAMLRegistry 解析YAML格式的设备注册表
+func readYAMLRegistry(r io.Reader) (map[string]map[string]interface{}, error) {
+	entries := make(map[string]map[string]interface{})
+	if err := yaml.NewDecoder(r).Decode(&entries); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("解析设备注册表失败: %v", err)
+	}
+	return entries, nil
+}
+
+// enrich 把注册表中设备的元数据合并到记录中，记录中已有的字段优先，未登记的设备保持不变
+func enrich(registry map[string]map[string]interface{}, data *DeviceData) {
+	fields, ok := registry[data.DeviceName]
+	if !ok || len(fields) == 0 {
+		return
+	}
+
+	if data.Metadata == nil {
+		data.Metadata = make(map[string]interface{}, len(fields))
+	}
+	for key, value := range fields {
+		if _, exists := data.Metadata[key]; !exists {
+			data.Metadata[key] = value
+		}
+	}
+}
+
+// SetRegistry 替换设备注册表，对之后的转换结果生效，注册表为空时不补充元数据
+func (m *Manager) SetRegistry(entries map[string]map[string]interface{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.registry = entries
+}
@@ -0,0 +1,95 @@
+package transformer
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/eddielth/data-trans/config"
+)
+
+// 属性可声明的类型
+const (
+	AttributeTypeNumber = "number"
+	AttributeTypeBool   = "bool"
+	AttributeTypeString = "string"
+)
+
+// attributeSchema 是属性名称（小写）到声明类型的映射
+type attributeSchema map[string]string
+
+// newAttributeSchema 根据配置创建属性类型声明，没有声明时返回nil
+func newAttributeSchema(attributes []config.AttributeSchema) attributeSchema {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	schema := make(attributeSchema, len(attributes))
+	for _, attr := range attributes {
+		schema[strings.ToLower(attr.Name)] = attr.Type
+	}
+	return schema
+}
+
+// coerce 把声明了类型的属性值转换为声明的类型，并把属性类型设为声明的类型
+// 没有声明的属性保持不变，任一属性无法转换时返回 ErrAttributeType
+func (s attributeSchema) coerce(deviceData *DeviceData) error {
+	for i := range deviceData.Attributes {
+		attr := &deviceData.Attributes[i]
+		declared, ok := s[strings.ToLower(attr.Name)]
+		if !ok {
+			continue
+		}
+
+		value, ok := coerceValue(attr.Value, declared)
+		if !ok {
+			return fmt.Errorf("%w: 属性 %s 的值 %v (%T) 不能转换为 %s", ErrAttributeType, attr.Name, attr.Value, attr.Value, declared)
+		}
+		attr.Value = value
+		attr.Type = declared
+	}
+	return nil
+}
+
+// coerceValue 把JSON解码得到的值转换为声明的类型，null、对象和数组不能转换
+func coerceValue(value interface{}, declared string) (interface{}, bool) {
+	switch declared {
+	case AttributeTypeNumber:
+		switch v := value.(type) {
+		case float64:
+			return v, true
+		case bool:
+			if v {
+				return float64(1), true
+			}
+			return float64(0), true
+		case string:
+			// ParseFloat 接受 "NaN" 和 "Inf"，非有限值无法序列化为JSON，按转换失败处理
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+		}
+	case AttributeTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return v, true
+		case float64:
+			if v == 0 || v == 1 {
+				return v == 1, true
+			}
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			return b, err == nil
+		}
+	case AttributeTypeString:
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+	}
+	return nil, false
+}
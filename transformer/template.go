@@ -0,0 +1,98 @@
+package transformer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// templateTransformer 使用Go text/template生成DeviceData的JSON，适合只需重命名字段的简单映射
+type templateTransformer struct {
+	tmpl *template.Template
+	// codec 用于解码非JSON数据，JSON数据始终保留数字原文解析
+	codec codec
+}
+
+// templateFuncs 是模板中可用的辅助函数，另外可以使用 index 等内置函数
+var templateFuncs = template.FuncMap{
+	// convertTemp 转换温度单位，如 {{convertTemp .temp "F" "C"}}
+	"convertTemp": func(value interface{}, fromUnit string, toUnit string) (float64, error) {
+		number, err := toFloat(value)
+		if err != nil {
+			return 0, err
+		}
+		return convertTemperature(number, fromUnit, toUnit), nil
+	},
+	// toJSON 将值编码为JSON，用于输出字符串和对象，如 {{toJSON .name}}
+	"toJSON": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+	// now 返回当前时间的毫秒时间戳
+	"now": func() int64 {
+		return time.Now().UnixMilli()
+	},
+}
+
+// newTemplateTransformer 解析模板
+func newTemplateTransformer(text string, payloadCodec codec) (*templateTransformer, error) {
+	tmpl, err := template.New("transform").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("解析模板失败: %v", err)
+	}
+	if _, ok := payloadCodec.(jsonCodec); ok {
+		payloadCodec = nil
+	}
+	return &templateTransformer{tmpl: tmpl, codec: payloadCodec}, nil
+}
+
+// run 以解析后的JSON数据为 . 执行模板，并解析生成的JSON
+func (t *templateTransformer) run(deviceType string, data []byte, msgCtx MessageContext) (interface{}, error) {
+	var payload interface{}
+	if t.codec != nil {
+		decoded, err := t.codec.decode(data)
+		if err != nil {
+			return nil, err
+		}
+		payload = decoded
+	} else {
+		// 保留数字原文，避免大整数时间戳被输出为科学计数法
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&payload); err != nil {
+			return nil, fmt.Errorf("解析JSON数据失败: %v", err)
+		}
+	}
+
+	var output bytes.Buffer
+	if err := t.tmpl.Execute(&output, payload); err != nil {
+		return nil, fmt.Errorf("执行模板失败: %v", err)
+	}
+
+	var result interface{}
+	if err := json.Unmarshal(output.Bytes(), &result); err != nil {
+		return nil, fmt.Errorf("模板输出不是有效的JSON: %v", err)
+	}
+	return result, nil
+}
+
+// toFloat 将JSON数字或数字字符串转换为float64
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("无法将 %v 转换为数字", value)
+	}
+}
@@ -0,0 +1,125 @@
+package transformer
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 设备时间戳的单位，存储前统一转换为毫秒
+const (
+	TimestampUnitSeconds      = "s"
+	TimestampUnitMilliseconds = "ms"
+	TimestampUnitMicroseconds = "us"
+)
+
+// 存储的时间戳来源
+const (
+	// TimestampSourceMessage 使用转换结果中的时间戳，缺失时使用接收时间
+	TimestampSourceMessage = "message"
+	// TimestampSourceReceived 始终使用服务接收消息的时间
+	TimestampSourceReceived = "received"
+)
+
+// normalizeTimestamp 将设备时间戳转换为毫秒，unit 为空时按数值大小推断单位：
+// 小于1e11为秒，小于1e14为毫秒，小于1e17为微秒，否则为纳秒
+func normalizeTimestamp(timestamp int64, unit string) int64 {
+	switch unit {
+	case TimestampUnitSeconds:
+		return timestamp * 1000
+	case TimestampUnitMilliseconds:
+		return timestamp
+	case TimestampUnitMicroseconds:
+		return timestamp / 1000
+	}
+
+	switch {
+	case timestamp < 1e11:
+		return timestamp * 1000
+	case timestamp < 1e14:
+		return timestamp
+	case timestamp < 1e17:
+		return timestamp / 1000
+	default:
+		return timestamp / int64(time.Millisecond)
+	}
+}
+
+// applyTimestamp 按配置设置数据的毫秒时间戳
+// fromPayload 不为nil时，转换结果没有时间戳则先使用其返回的毫秒时间戳，再使用接收时间
+func applyTimestamp(data *DeviceData, unit string, source string, receivedAt time.Time, fromPayload func() (int64, bool)) {
+	if source != TimestampSourceReceived && data.Timestamp <= 0 && fromPayload != nil {
+		if timestamp, ok := fromPayload(); ok {
+			data.Timestamp = timestamp
+			return
+		}
+	}
+	if source == TimestampSourceReceived || data.Timestamp <= 0 {
+		if receivedAt.IsZero() {
+			receivedAt = time.Now()
+		}
+		data.Timestamp = receivedAt.UnixMilli()
+		return
+	}
+	data.Timestamp = normalizeTimestamp(data.Timestamp, unit)
+}
+
+// payloadTimestamp 从JSON原始数据的 path 读取毫秒时间戳，path 以点分隔，如 ts 或 metadata.time，
+// 数组元素用下标表示，如 readings.0.ts。数值按 unit 换算；字符串按 format（Go时间布局）解析，
+// format 为空时依次尝试RFC3339和数值字符串。字段不存在或无法解析时返回false
+func payloadTimestamp(payload []byte, path string, format string, unit string) (int64, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return 0, false
+	}
+
+	for _, key := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(v) {
+				return 0, false
+			}
+			value = v[index]
+		default:
+			return 0, false
+		}
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		return numberTimestamp(string(v), unit)
+	case string:
+		if format != "" {
+			t, err := time.Parse(format, v)
+			if err != nil {
+				return 0, false
+			}
+			return t.UnixMilli(), true
+		}
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t.UnixMilli(), true
+		}
+		return numberTimestamp(v, unit)
+	}
+	return 0, false
+}
+
+// numberTimestamp 把数值时间戳按 unit 换算为毫秒，非正数视为缺失
+func numberTimestamp(s string, unit string) (int64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || f <= 0 {
+		return 0, false
+	}
+	// 带小数的秒时间戳保留毫秒部分
+	if unit == TimestampUnitSeconds || (unit == "" && f < 1e11) {
+		return int64(f * 1000), true
+	}
+	return normalizeTimestamp(int64(f), unit), true
+}
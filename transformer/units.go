@@ -0,0 +1,108 @@
+package transformer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/logger"
+)
+
+// 单位换算的种类
+const (
+	UnitKindTemperature = "temperature"
+	UnitKindPressure    = "pressure"
+	UnitKindLength      = "length"
+)
+
+// temperatureUnits 是 convertTemperature 支持的温度单位
+var temperatureUnits = map[string]bool{"c": true, "f": true, "k": true}
+
+// unitNormalizer 把指定属性统一换算为目标单位，属性名不区分大小写
+type unitNormalizer struct {
+	rules map[string]config.UnitRule
+	// unmatched 记录已经警告过的无法换算的属性和单位，每个组合只警告一次
+	unmatched sync.Map
+}
+
+// knownUnit 判断单位是否属于换算种类
+func knownUnit(kind string, unit string) bool {
+	switch kind {
+	case UnitKindTemperature:
+		return temperatureUnits[strings.ToLower(unit)]
+	case UnitKindPressure:
+		_, ok := pressureUnits[strings.ToLower(unit)]
+		return ok
+	case UnitKindLength:
+		_, ok := lengthUnits[strings.ToLower(unit)]
+		return ok
+	default:
+		return false
+	}
+}
+
+// convertUnit 使用对应种类的换算函数换算数值
+func convertUnit(kind string, value float64, fromUnit string, toUnit string) float64 {
+	switch kind {
+	case UnitKindTemperature:
+		return convertTemperature(value, fromUnit, toUnit)
+	case UnitKindPressure:
+		return convertPressure(value, fromUnit, toUnit)
+	default:
+		return convertLength(value, fromUnit, toUnit)
+	}
+}
+
+// newUnitNormalizer 检查换算规则并创建单位换算器，没有规则时返回nil
+func newUnitNormalizer(rules map[string]config.UnitRule) (*unitNormalizer, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	normalized := make(map[string]config.UnitRule, len(rules))
+	for name, rule := range rules {
+		if !knownUnit(rule.Kind, rule.Unit) {
+			return nil, fmt.Errorf("属性 %s 的目标单位 %s 不是已知的 %s 单位", name, rule.Unit, rule.Kind)
+		}
+		normalized[strings.ToLower(name)] = rule
+	}
+	return &unitNormalizer{rules: normalized}, nil
+}
+
+// normalize 把属性换算为目标单位，已是目标单位、没有规则或值不是数字的属性保持不变
+func (n *unitNormalizer) normalize(deviceType string, data *DeviceData) {
+	for i := range data.Attributes {
+		attr := &data.Attributes[i]
+		rule, ok := n.rules[strings.ToLower(attr.Name)]
+		if !ok || strings.EqualFold(attr.Unit, rule.Unit) {
+			continue
+		}
+
+		value, isNumber := attr.Value.(float64)
+		if !isNumber || !knownUnit(rule.Kind, attr.Unit) {
+			key := deviceType + "/" + attr.Name + "/" + attr.Unit
+			if _, warned := n.unmatched.LoadOrStore(key, true); !warned {
+				logger.Warn("设备类型 %s 的属性 %s 无法从单位 %q 换算为 %s，保持原值", deviceType, attr.Name, attr.Unit, rule.Unit)
+			}
+			continue
+		}
+
+		attr.Value = convertUnit(rule.Kind, value, attr.Unit, rule.Unit)
+		attr.Unit = rule.Unit
+	}
+}
+
+// SetUnitNormalization 替换属性的单位换算规则，对之后的转换结果生效，规则为空时不换算
+func (m *Manager) SetUnitNormalization(rules map[string]config.UnitRule) error {
+	normalizer, err := newUnitNormalizer(rules)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.units = normalizer
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/eddielth/data-trans/config"
+	"github.com/eddielth/data-trans/transformer"
+)
+
+// 校验模式：编译每个转换器，并用示例数据试运行，不连接MQTT和数据库
+// 示例数据文件为 {samplesDir}/{device_type}.json，缺少示例文件时只检查脚本能否编译
+func runValidate(cfg *config.Config, samplesDir string) bool {
+	// 合并脚本目录中发现的脚本，配置文件中显式配置的设备类型优先
+	transformers := make(map[string]config.Transformer)
+	if cfg.TransformersDir != "" {
+		scripts, err := transformer.DiscoverScripts(cfg.TransformersDir)
+		if err != nil {
+			fmt.Printf("[FAIL] %v\n", err)
+			return false
+		}
+		for deviceType, transformerCfg := range scripts {
+			transformers[deviceType] = transformerCfg
+		}
+	}
+	for deviceType, transformerCfg := range cfg.Transformers {
+		transformers[deviceType] = transformerCfg
+	}
+
+	deviceTypes := make([]string, 0, len(transformers))
+	for deviceType := range transformers {
+		deviceTypes = append(deviceTypes, deviceType)
+	}
+	sort.Strings(deviceTypes)
+
+	ok := true
+	for _, deviceType := range deviceTypes {
+		if err := validateTransformer(deviceType, transformers[deviceType], cfg.Lookups, samplesDir); err != nil {
+			fmt.Printf("[FAIL] %s: %v\n", deviceType, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// 编译单个转换器并转换示例数据
+func validateTransformer(deviceType string, transformerCfg config.Transformer, lookups map[string]map[string]string, samplesDir string) error {
+	// 单独创建管理器，一个脚本出错不影响其他脚本的检查
+	manager, err := transformer.NewManager(map[string]config.Transformer{deviceType: transformerCfg}, "", lookups)
+	if err != nil {
+		return err
+	}
+	if err, failed := manager.FailedDeviceTypes()[deviceType]; failed {
+		return err
+	}
+
+	samplePath := filepath.Join(samplesDir, deviceType+".json")
+	payload, err := os.ReadFile(samplePath)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("[OK]   %s: 脚本编译通过（未找到示例数据 %s）\n", deviceType, samplePath)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取示例数据失败: %v", err)
+	}
+
+	results, err := manager.Transform(deviceType, payload, transformer.MessageContext{
+		Topic:      fmt.Sprintf("devices/%s/sample", deviceType),
+		ReceivedAt: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("转换示例数据 %s 失败: %v", samplePath, err)
+	}
+
+	// 只有一条记录时输出对象，与脚本返回单个对象的写法保持一致
+	var output []byte
+	if len(results) == 1 {
+		output, err = json.MarshalIndent(results[0], "", "  ")
+	} else {
+		output, err = json.MarshalIndent(results, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("序列化转换结果失败: %v", err)
+	}
+	fmt.Printf("[OK]   %s: %s\n%s\n", deviceType, samplePath, output)
+	return nil
+}